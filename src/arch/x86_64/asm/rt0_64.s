@@ -8,7 +8,10 @@ align 8
 
 ; Allocate space for the interrupt descriptor table (IDT).
 ; This arch supports up to 256 interrupt handlers
-%define IDT_ENTRIES 0xff
+%define IDT_ENTRIES 0x100
+
+; Vectors below this number are reserved for CPU exceptions
+%define FIRST_IRQ_VECTOR 32
 _rt0_idt_start:
 	resq 2 * IDT_ENTRIES ; each 64-bit IDT entry is 16 bytes
 _rt0_idt_end:
@@ -45,12 +48,18 @@ _rt0_64_entry:
 	call _rt0_64_setup_go_runtime_structs
 
 	; Call the kernel entry point passing a pointer to the multiboot data
-	; copied by the 32-bit entry code
+	; copied by the 32-bit entry code and the bounds of the boot stack
 	extern multiboot_data
 	extern _kernel_start
 	extern _kernel_end
 	extern kernel.Kmain
+	extern stack_bottom
+	extern stack_top
 	
+	mov rax, stack_top
+	push rax
+	mov rax, stack_bottom
+	push rax
 	mov rax, PAGE_OFFSET
 	push rax
 	mov rax, _kernel_end - PAGE_OFFSET
@@ -159,11 +168,17 @@ ret
 ; code must be popped off the stack before calling iretq. The generated handlers 
 ; are aware whether they need to deal with the code or not and jump to the 
 ; appropriate get dispatcher.
+;
+; Gate entries for hardware interrupts push the vector number in place of an
+; error code so that a single handler can service multiple vectors.
 ;------------------------------------------------------------------------------
 %assign gate_num 0 
 %rep    IDT_ENTRIES
 extern _rt0_interrupt_handlers
 _rt0_64_gate_entry_%+ gate_num:
+	%if gate_num >= FIRST_IRQ_VECTOR
+		push gate_num
+	%endif
 	push rax
 	mov rax, _rt0_interrupt_handlers
 	add rax, 8*gate_num
@@ -172,7 +187,9 @@ _rt0_64_gate_entry_%+ gate_num:
 
 	; For a list of gate numbers that push an error code see:
 	; http://wiki.osdev.org/Exceptions
-	%if (gate_num == 8) || (gate_num >= 10 && gate_num <= 14) || (gate_num == 17) || (gate_num == 30)
+	%if gate_num == 8
+		jmp _rt0_64_gate_dispatcher_double_fault
+	%elif (gate_num >= 10 && gate_num <= 14) || (gate_num == 17) || (gate_num == 21) || (gate_num == 29) || (gate_num == 30) || (gate_num >= FIRST_IRQ_VECTOR)
 		jmp _rt0_64_gate_dispatcher_with_code
 	%else
 		jmp _rt0_64_gate_dispatcher_without_code
@@ -267,6 +284,57 @@ _rt0_64_gate_dispatcher_with_code:
 	add rsp, 16	  ; pop handler address and exception code off the stack before returning
 	iretq
 
+;------------------------------------------------------------------------------
+; This dispatcher is invoked by the double-fault gate entry. The double-fault
+; handler runs on a dedicated interrupt stack but the TLS g pointer still 
+; refers to the g that was running when the fault occurred. As the prologue
+; of Go functions compares rsp against the stack guard of the TLS g, the
+; handler would end up calling morestack. To avoid this, the dispatcher 
+; performs the same steps as _rt0_64_gate_dispatcher_with_code but also:
+; - links the double-fault g (whose stack bounds are set via 
+;   irq.SetDoubleFaultStack) to the m of the interrupted g
+; - installs the double-fault g as the TLS g while the handler runs
+; - restores the original TLS g before returning
+;------------------------------------------------------------------------------
+extern _rt0_double_fault_g
+_rt0_64_gate_dispatcher_double_fault:
+	; The stack layout when entering this function is the same as the one 
+	; for _rt0_64_gate_dispatcher_with_code
+	cld
+
+	save_regs
+	mov rax, rsp   ; rax points to saved rax
+
+	; save the g pointer of the interrupted code and install the double-fault g
+	mov rcx, r0_g_ptr
+	mov rbx, [rcx]
+	push rbx
+	mov rdx, _rt0_double_fault_g
+	mov rsi, [rbx+GO_G_M]
+	mov qword [rdx+GO_G_M], rsi   ; g.m = interrupted g.m
+	mov qword [rcx], rdx
+
+	push rax       ; push pointer to saved regs
+
+	; push pointer to exception stack frame and exception code
+	add rax, 17*8
+	push rax
+	sub rax, 8
+	push qword [rax]
+
+	call [rsp + 19*8] ; call registered irq handler (one extra qword for the saved g)
+
+	add rsp, 3 * 8    ; unshift the pushed arguments so rsp points to the saved g
+
+	; restore the g pointer of the interrupted code
+	pop rbx
+	mov rcx, r0_g_ptr
+	mov qword [rcx], rbx
+	restore_regs
+
+	add rsp, 16	  ; pop handler address and exception code off the stack before returning
+	iretq
+
 ;------------------------------------------------------------------------------
 ; This dispatcher is invoked by gate entries that do not use exception codes.
 ; It performs the following functions:
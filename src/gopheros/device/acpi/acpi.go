@@ -4,6 +4,7 @@ import (
 	"gopheros/device"
 	"gopheros/device/acpi/table"
 	"gopheros/kernel"
+	"gopheros/kernel/clock"
 	"gopheros/kernel/kfmt"
 	"gopheros/kernel/mem"
 	"gopheros/kernel/mem/pmm"
@@ -24,6 +25,7 @@ var (
 	mapFn         = vmm.Map
 	identityMapFn = vmm.IdentityMapRegion
 	unmapFn       = vmm.Unmap
+	useHPETFn     = clock.UseHPET
 
 	// RDSP must be located in the physical memory region 0xe0000 to 0xfffff
 	rsdpLocationLow uintptr = 0xe0000
@@ -32,6 +34,11 @@ var (
 
 	rsdpSignature = [8]byte{'R', 'S', 'D', ' ', 'P', 'T', 'R', ' '}
 	fadtSignature = "FACP"
+	hpetSignature = "HPET"
+
+	// activeDriver points to the ACPI driver instance whose tables are
+	// used by LookupTable.
+	activeDriver *acpiDriver
 )
 
 type acpiDriver struct {
@@ -54,10 +61,34 @@ func (drv *acpiDriver) DriverInit(w io.Writer) *kernel.Error {
 	}
 
 	drv.printTableInfo(w)
+	drv.initHPET(w)
+	activeDriver = drv
 
 	return nil
 }
 
+// LookupTable returns a pointer to the header of the ACPI table with the
+// supplied signature or nil if the table is not present. It implements
+// table.Resolver.
+func (drv *acpiDriver) LookupTable(name string) *table.SDTHeader {
+	return drv.tableMap[name]
+}
+
+// LookupTable returns a pointer to the header of the ACPI table with the
+// supplied signature or nil if the table is not present or if no ACPI driver
+// has been initialized. The entire table contents are mapped into memory.
+//
+// Drivers for devices that are described by ACPI tables should use
+// device.DetectOrderACPI to ensure that LookupTable is invoked after the ACPI
+// driver has been initialized.
+func LookupTable(name string) *table.SDTHeader {
+	if activeDriver == nil {
+		return nil
+	}
+
+	return activeDriver.LookupTable(name)
+}
+
 // DriverName returns the name of this driver.
 func (*acpiDriver) DriverName() string {
 	return "ACPI"
@@ -80,6 +111,27 @@ func (drv *acpiDriver) printTableInfo(w io.Writer) {
 	}
 }
 
+// initHPET passes the address of the HPET described by the HPET table (if
+// present) to the clock package so it can be used for improving the accuracy
+// of the kernel clock. Failing to initialize the HPET is not fatal as the
+// kernel clock can still operate without it.
+func (drv *acpiDriver) initHPET(w io.Writer) {
+	header := drv.tableMap[hpetSignature]
+	if header == nil {
+		return
+	}
+
+	hpet := (*table.HPET)(unsafe.Pointer(header))
+	if hpet.AddressSpace != table.AddressSpaceSysMemory {
+		kfmt.Fprintf(w, "HPET registers are not memory-mapped; skipping\n")
+		return
+	}
+
+	if err := useHPETFn(uintptr(hpet.Address())); err != nil {
+		kfmt.Fprintf(w, "HPET init failed: %s\n", err.Message)
+	}
+}
+
 // enumerateTables detects and maps all ACPI tables that are present. Besides
 // the table list defined by the RSDP, this method will also peek into the
 // FADT (if found) looking for the address of DSDT.
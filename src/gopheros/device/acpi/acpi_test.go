@@ -1,8 +1,10 @@
 package acpi
 
 import (
+	"bytes"
 	"gopheros/device/acpi/table"
 	"gopheros/kernel"
+	"gopheros/kernel/clock"
 	"gopheros/kernel/mem"
 	"gopheros/kernel/mem/pmm"
 	"gopheros/kernel/mem/vmm"
@@ -189,6 +191,10 @@ func TestDriverInit(t *testing.T) {
 		if err := drv.DriverInit(os.Stderr); err != nil {
 			t.Fatal(err)
 		}
+
+		if activeDriver != drv {
+			t.Fatal("expected the initialized driver to be used by LookupTable")
+		}
 	})
 
 	t.Run("map errors in enumerateTables", func(t *testing.T) {
@@ -239,6 +245,92 @@ func TestDriverInit(t *testing.T) {
 
 }
 
+func TestLookupTable(t *testing.T) {
+	defer func() {
+		activeDriver = nil
+	}()
+
+	activeDriver = nil
+	if got := LookupTable("APIC"); got != nil {
+		t.Fatalf("expected LookupTable to return nil if the ACPI driver is not initialized; got %v", got)
+	}
+
+	header := &table.SDTHeader{Signature: [4]byte{'A', 'P', 'I', 'C'}}
+	activeDriver = &acpiDriver{tableMap: map[string]*table.SDTHeader{"APIC": header}}
+
+	var resolver table.Resolver = activeDriver
+	if got := resolver.LookupTable("APIC"); got != header {
+		t.Fatalf("expected LookupTable to return the APIC table header; got %v", got)
+	}
+
+	if got := LookupTable("APIC"); got != header {
+		t.Fatalf("expected LookupTable to return the APIC table header; got %v", got)
+	}
+
+	if got := LookupTable("SSDT"); got != nil {
+		t.Fatalf("expected LookupTable to return nil for a missing table; got %v", got)
+	}
+}
+
+func TestInitHPET(t *testing.T) {
+	defer func() {
+		useHPETFn = clock.UseHPET
+	}()
+
+	var (
+		buf         bytes.Buffer
+		hpetAddr    uintptr
+		hpetCalls   int
+		hpetTable   table.HPET
+		expHPETAddr = uintptr(0xfed00000)
+	)
+
+	hpetTable.AddressSpace = table.AddressSpaceSysMemory
+	hpetTable.AddressLo = uint32(expHPETAddr)
+	if exp, got := uintptr(44), unsafe.Offsetof(hpetTable.AddressLo); got != exp {
+		t.Fatalf("expected HPET address to be located at offset %d; got %d", exp, got)
+	}
+
+	useHPETFn = func(addr uintptr) *kernel.Error {
+		hpetCalls++
+		hpetAddr = addr
+		return nil
+	}
+
+	drv := &acpiDriver{tableMap: make(map[string]*table.SDTHeader)}
+
+	// No HPET table
+	drv.initHPET(&buf)
+	if hpetCalls != 0 {
+		t.Fatal("expected UseHPET not to be called when the HPET table is missing")
+	}
+
+	drv.tableMap[hpetSignature] = &hpetTable.SDTHeader
+	drv.initHPET(&buf)
+	if hpetCalls != 1 || hpetAddr != expHPETAddr {
+		t.Fatalf("expected UseHPET to be called once with address %x; got %d calls with address %x", expHPETAddr, hpetCalls, hpetAddr)
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		useHPETFn = func(_ uintptr) *kernel.Error {
+			return &kernel.Error{Module: "test", Message: "UseHPET failed"}
+		}
+
+		buf.Reset()
+		drv.initHPET(&buf)
+		if exp, got := "HPET init failed: UseHPET failed\n", buf.String(); got != exp {
+			t.Errorf("expected output %q; got %q", exp, got)
+		}
+
+		buf.Reset()
+		hpetTable.AddressSpace = table.AddressSpaceSysIO
+		drv.initHPET(&buf)
+		if exp, got := "HPET registers are not memory-mapped; skipping\n", buf.String(); got != exp {
+			t.Errorf("expected output %q; got %q", exp, got)
+		}
+	})
+}
+
 func TestEnumerateTables(t *testing.T) {
 	defer func() {
 		identityMapFn = vmm.IdentityMapRegion
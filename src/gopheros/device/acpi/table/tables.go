@@ -187,6 +187,32 @@ type FADT struct {
 	Ext FADT64
 }
 
+// HPET is an ACPI table that describes the location of the High Precision
+// Event Timer registers. As the table fields are not naturally aligned, the
+// register block address is split into two 32-bit fields and the minimum
+// clock tick is stored as a little-endian byte array.
+type HPET struct {
+	SDTHeader
+
+	EventTimerBlockID uint32
+
+	AddressSpace      AddressSpace
+	RegisterBitWidth  uint8
+	RegisterBitOffset uint8
+	reserved          uint8
+	AddressLo         uint32
+	AddressHi         uint32
+
+	HPETNumber     uint8
+	MinClockTick   [2]uint8
+	PageProtection uint8
+}
+
+// Address returns the physical address of the HPET register block.
+func (t *HPET) Address() uint64 {
+	return uint64(t.AddressHi)<<32 | uint64(t.AddressLo)
+}
+
 // MADT (Multiple APIC Description Table) is an ACPI table containing
 // information about the interrupt controllers and the number of installed
 // CPUs. Following the table header are a series of variable sized records
@@ -230,7 +256,8 @@ type MADTEntryInterruptSrcOverride struct {
 }
 
 // MADTEntryNMI describes a non-maskable interrupt that we need to set up for
-// a single processor or all processors.
+// a single processor or all processors. It corresponds to MADT records of type
+// MADTEntryTypeLocalAPICNMI.
 type MADTEntryNMI struct {
 	// Processor specifies the local APIC that we need to configure for
 	// this NMI. If set to 0xff we need to configure all processor APICs.
@@ -251,13 +278,29 @@ const (
 	MADTEntryTypeLocalAPIC MADTEntryType = iota
 	MADTEntryTypeIOAPIC
 	MADTEntryTypeIntSrcOverride
+
+	// MADTEntryTypeNMI describes a global system interrupt that should
+	// be configured as a non-maskable interrupt source.
 	MADTEntryTypeNMI
+
+	// MADTEntryTypeLocalAPICNMI describes the local APIC LINT pin that
+	// a non-maskable interrupt is connected to (see MADTEntryNMI).
+	MADTEntryTypeLocalAPICNMI
+
+	// MADTEntryTypeLocalAPICAddrOverride provides the 64-bit physical
+	// address of the local APIC registers. If present, it overrides the
+	// address in the MADT header.
+	MADTEntryTypeLocalAPICAddrOverride
 )
 
 // MADTEntry describes a MADT table entry that follows the MADT definition. As
 // MADT entries are variable sized records, this struct works as a union. The
 // consumer of this struct must check the type value before accessing the union
 // values.
+//
+// As the MADT records are packed, the layout of the MADTEntry* structs does
+// not necessarily match the layout of the records in memory. Consumers should
+// decode the record fields using their byte offsets.
 type MADTEntry struct {
 	Type   MADTEntryType
 	Length uint8
@@ -0,0 +1,245 @@
+package apic
+
+import (
+	"gopheros/device"
+	"gopheros/device/pic"
+	"gopheros/kernel"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"io"
+)
+
+const (
+	// The I/O APIC registers are accessed indirectly by writing the
+	// register index to the register select port and then accessing the
+	// register contents via the window port.
+	ioapicRegSelect = 0x00
+	ioapicRegWindow = 0x10
+
+	ioapicRegVersion   = 0x01
+	ioapicRegRedirBase = 0x10
+
+	// The following flags are used by the low dword of each redirection
+	// table entry.
+	redirActiveLow      = 1 << 13
+	redirLevelTriggered = 1 << 15
+	redirMasked         = 1 << 16
+
+	// numISAIRQs defines the number of IRQ lines that are mapped to ISA
+	// IRQs and are subject to the MADT interrupt source overrides.
+	numISAIRQs = 16
+)
+
+// ioapic describes a single I/O APIC.
+type ioapic struct {
+	id uint8
+
+	// regs holds the virtual address of the I/O APIC registers.
+	regs uintptr
+
+	// The I/O APIC handles the global system interrupts in the range
+	// [gsiBase, gsiBase+numEntries).
+	gsiBase    uint32
+	numEntries uint32
+}
+
+// ioapicDriver implements a device.Driver for the I/O APICs listed in the
+// MADT and registers itself as the active irq.InterruptController.
+//
+// IRQ lines 0-15 refer to the legacy ISA IRQs and are routed to the global
+// system interrupts specified by the MADT interrupt source overrides. All
+// other lines are mapped to the global system interrupt with the same number.
+// IRQ lines are delivered to the boot processor using vector
+// irq.FirstIRQVector+line.
+type ioapicDriver struct {
+	madt    *madtInfo
+	ioapics []ioapic
+}
+
+var (
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	maskAllPICFn    = pic.MaskAll
+	setControllerFn = irq.SetController
+
+	errInvalidLine  = &kernel.Error{Module: "apic", Message: "IRQ line cannot be mapped to a vector"}
+	errUnroutedLine = &kernel.Error{Module: "apic", Message: "no I/O APIC handles the global system interrupt for the IRQ line"}
+)
+
+// DriverInit maps the registers of each I/O APIC, masks all redirection
+// entries and replaces the 8259 PICs as the active interrupt controller.
+func (drv *ioapicDriver) DriverInit(w io.Writer) *kernel.Error {
+	drv.ioapics = make([]ioapic, 0, len(drv.madt.ioapics))
+
+	for _, entry := range drv.madt.ioapics {
+		regs, err := mapMMIO(uintptr(entry.Address))
+		if err != nil {
+			return err
+		}
+
+		ctrl := ioapic{
+			id:      entry.APICID,
+			regs:    regs,
+			gsiBase: entry.SysInterruptBase,
+		}
+		ctrl.numEntries = (ctrl.read(ioapicRegVersion)>>16)&0xff + 1
+
+		for pin := uint32(0); pin < ctrl.numEntries; pin++ {
+			ctrl.writeRedirEntry(pin, redirMasked, 0)
+		}
+
+		drv.ioapics = append(drv.ioapics, ctrl)
+		kfmt.Fprintf(w, "I/O APIC %d handles GSI %d-%d\n", ctrl.id, ctrl.gsiBase, ctrl.gsiBase+ctrl.numEntries-1)
+	}
+
+	maskAllPICFn()
+	setControllerFn(drv)
+
+	return nil
+}
+
+// DriverName returns the name of this driver.
+func (*ioapicDriver) DriverName() string {
+	return "I/O APIC"
+}
+
+// DriverVersion returns the version of this driver.
+func (*ioapicDriver) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// ControllerName returns the name of the interrupt controller.
+func (*ioapicDriver) ControllerName() string {
+	return "APIC"
+}
+
+// IRQVector returns the interrupt vector for the supplied IRQ line.
+func (*ioapicDriver) IRQVector(line uint8) uint8 {
+	return irq.FirstIRQVector + line
+}
+
+// MaskIRQ disables the delivery of interrupts for the supplied IRQ line.
+func (drv *ioapicDriver) MaskIRQ(line uint8) *kernel.Error {
+	ctrl, pin, entry, err := drv.route(line)
+	if err != nil {
+		return err
+	}
+
+	ctrl.writeRedirEntry(pin, entry|redirMasked, uint32(localAPIC.id)<<24)
+	return nil
+}
+
+// UnmaskIRQ enables the delivery of interrupts for the supplied IRQ line.
+func (drv *ioapicDriver) UnmaskIRQ(line uint8) *kernel.Error {
+	ctrl, pin, entry, err := drv.route(line)
+	if err != nil {
+		return err
+	}
+
+	ctrl.writeRedirEntry(pin, entry, uint32(localAPIC.id)<<24)
+	return nil
+}
+
+// EOI signals the end of an interrupt for the supplied vector.
+func (*ioapicDriver) EOI(vector uint8) {
+	if vector == SpuriousVector {
+		return
+	}
+
+	localAPIC.eoi()
+}
+
+// Spurious returns false as the local APIC reports spurious interrupts via
+// SpuriousVector which is serviced by its own handler.
+func (*ioapicDriver) Spurious(_ uint8) bool {
+	return false
+}
+
+// route returns the I/O APIC and pin that serve the supplied IRQ line
+// together with the low dword of the redirection entry (without the mask
+// flag) that delivers the line to its vector. The polarity and trigger mode
+// of ISA IRQs default to active-high and edge-triggered unless overridden by
+// the MADT. All other lines default to active-low and level-triggered.
+func (drv *ioapicDriver) route(line uint8) (*ioapic, uint32, uint32, *kernel.Error) {
+	if uint16(irq.FirstIRQVector)+uint16(line) >= SpuriousVector {
+		return nil, 0, 0, errInvalidLine
+	}
+
+	var (
+		gsi      = uint32(line)
+		polarity = uint16(mpsPolarityLow)
+		trigger  = uint16(mpsTriggerLevel)
+	)
+
+	if line < numISAIRQs {
+		polarity, trigger = mpsPolarityHigh, mpsTriggerEdge
+		if override, ok := drv.madt.override(line); ok {
+			gsi = override.GlobalInterrupt
+			if flags := override.Flags & mpsPolarityMask; flags != 0 {
+				polarity = flags
+			}
+			if flags := override.Flags & mpsTriggerMask; flags != 0 {
+				trigger = flags
+			}
+		}
+	}
+
+	entry := uint32(drv.IRQVector(line))
+	if polarity == mpsPolarityLow {
+		entry |= redirActiveLow
+	}
+	if trigger == mpsTriggerLevel {
+		entry |= redirLevelTriggered
+	}
+
+	for index := range drv.ioapics {
+		ctrl := &drv.ioapics[index]
+		if gsi >= ctrl.gsiBase && gsi < ctrl.gsiBase+ctrl.numEntries {
+			return ctrl, gsi - ctrl.gsiBase, entry, nil
+		}
+	}
+
+	return nil, 0, 0, errUnroutedLine
+}
+
+// writeRedirEntry updates the redirection table entry for the supplied pin.
+// The high dword, which contains the destination APIC ID, is written first
+// so that the entry is never unmasked with a stale destination.
+func (ctrl *ioapic) writeRedirEntry(pin, low, high uint32) {
+	ctrl.write(ioapicRegRedirBase+2*pin+1, high)
+	ctrl.write(ioapicRegRedirBase+2*pin, low)
+}
+
+// read returns the contents of the I/O APIC register with the supplied index.
+func (ctrl *ioapic) read(index uint32) uint32 {
+	mmioWrite32Fn(ctrl.regs+ioapicRegSelect, index)
+	return mmioRead32Fn(ctrl.regs + ioapicRegWindow)
+}
+
+// write updates the contents of the I/O APIC register with the supplied index.
+func (ctrl *ioapic) write(index, value uint32) {
+	mmioWrite32Fn(ctrl.regs+ioapicRegSelect, index)
+	mmioWrite32Fn(ctrl.regs+ioapicRegWindow, value)
+}
+
+func probeForIOAPIC() device.Driver {
+	if localAPIC == nil {
+		return nil
+	}
+
+	info := getMADT()
+	if info == nil || len(info.ioapics) == 0 {
+		return nil
+	}
+
+	return &ioapicDriver{madt: info}
+}
+
+func init() {
+	// The I/O APIC driver must be initialized after the local APIC
+	// driver.
+	device.RegisterDriver(&device.DriverInfo{
+		Order: device.DetectOrderACPI + 1,
+		Probe: probeForIOAPIC,
+	})
+}
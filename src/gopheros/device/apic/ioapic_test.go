@@ -0,0 +1,212 @@
+package apic
+
+import (
+	"bytes"
+	"gopheros/device"
+	"gopheros/kernel"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"gopheros/kernel/mem/vmm"
+	"testing"
+)
+
+// initTestIOAPIC initializes an I/O APIC driver using the MADT dump and a
+// fake I/O APIC with 24 redirection entries.
+func initTestIOAPIC(t *testing.T) (*ioapicDriver, *fakeMMIO) {
+	mmio := mockMMIO(3, 24)
+	madt = parseMADT(loadTestMADT(t))
+	localAPIC = &lapicDriver{regs: testLAPICAddr, id: 3}
+
+	drv := probeForIOAPIC()
+	if drv == nil {
+		t.Fatal("expected probe to return a driver")
+	}
+
+	if err := drv.DriverInit(&bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+
+	return drv.(*ioapicDriver), mmio
+}
+
+func TestIOAPICDriverInit(t *testing.T) {
+	defer func(origMaskAllPIC func(), origSetController func(irq.InterruptController)) {
+		maskAllPICFn = origMaskAllPIC
+		setControllerFn = origSetController
+	}(maskAllPICFn, setControllerFn)
+	defer restoreMocks(mapRegionFn, mmioRead32Fn, mmioWrite32Fn, registerHandlerFn)
+
+	var (
+		picMasked bool
+		ctrl      irq.InterruptController
+	)
+	maskAllPICFn = func() { picMasked = true }
+	setControllerFn = func(c irq.InterruptController) { ctrl = c }
+
+	drv, mmio := initTestIOAPIC(t)
+
+	if !picMasked {
+		t.Error("expected the PIC lines to be masked")
+	}
+
+	if ctrl != drv {
+		t.Error("expected the I/O APIC driver to be registered as the interrupt controller")
+	}
+
+	if exp, got := uint32(24), drv.ioapics[0].numEntries; got != exp {
+		t.Errorf("expected I/O APIC to have %d redirection entries; got %d", exp, got)
+	}
+
+	for pin := uint32(0); pin < 24; pin++ {
+		if got := mmio.ioapicRegs[ioapicRegRedirBase+2*pin]; got != redirMasked {
+			t.Errorf("expected redirection entry %d to be masked; got 0x%x", pin, got)
+		}
+	}
+
+	t.Run("map error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+		mapRegionFn = func(_ pmm.Frame, _ mem.Size, _ vmm.PageTableEntryFlag) (vmm.Page, *kernel.Error) {
+			return 0, expErr
+		}
+
+		if err := (&ioapicDriver{madt: madt}).DriverInit(&bytes.Buffer{}); err != expErr {
+			t.Errorf("expected to get error %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestIOAPICMaskUnmask(t *testing.T) {
+	defer func(origMaskAllPIC func(), origSetController func(irq.InterruptController)) {
+		maskAllPICFn = origMaskAllPIC
+		setControllerFn = origSetController
+	}(maskAllPICFn, setControllerFn)
+	defer restoreMocks(mapRegionFn, mmioRead32Fn, mmioWrite32Fn, registerHandlerFn)
+
+	maskAllPICFn = func() {}
+	setControllerFn = func(_ irq.InterruptController) {}
+	drv, mmio := initTestIOAPIC(t)
+
+	specs := []struct {
+		line     uint8
+		expPin   uint32
+		expEntry uint32
+	}{
+		// IRQ0 is overridden to GSI 2 using the ISA defaults
+		{0, 2, 32},
+		// ISA IRQ without an override
+		{1, 1, 33},
+		// IRQ9 is overridden to a level-triggered active-high GSI
+		{9, 9, 41 | redirLevelTriggered},
+		// PCI interrupts are level-triggered and active-low
+		{20, 20, 52 | redirLevelTriggered | redirActiveLow},
+	}
+
+	for _, spec := range specs {
+		if err := drv.UnmaskIRQ(spec.line); err != nil {
+			t.Errorf("[line %d] unexpected error: %v", spec.line, err)
+			continue
+		}
+
+		if got := mmio.ioapicRegs[ioapicRegRedirBase+2*spec.expPin]; got != spec.expEntry {
+			t.Errorf("[line %d] expected redirection entry %d to be 0x%x; got 0x%x", spec.line, spec.expPin, spec.expEntry, got)
+		}
+
+		if exp, got := uint32(3)<<24, mmio.ioapicRegs[ioapicRegRedirBase+2*spec.expPin+1]; got != exp {
+			t.Errorf("[line %d] expected redirection entry %d destination to be 0x%x; got 0x%x", spec.line, spec.expPin, exp, got)
+		}
+
+		if err := drv.MaskIRQ(spec.line); err != nil {
+			t.Errorf("[line %d] unexpected error: %v", spec.line, err)
+			continue
+		}
+
+		if exp, got := spec.expEntry|redirMasked, mmio.ioapicRegs[ioapicRegRedirBase+2*spec.expPin]; got != exp {
+			t.Errorf("[line %d] expected redirection entry %d to be 0x%x; got 0x%x", spec.line, spec.expPin, exp, got)
+		}
+
+		if exp, got := uint8(32)+spec.line, drv.IRQVector(spec.line); got != exp {
+			t.Errorf("[line %d] expected vector %d; got %d", spec.line, exp, got)
+		}
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		specs := []struct {
+			line   uint8
+			expErr *kernel.Error
+		}{
+			{24, errUnroutedLine},
+			{0xff - irq.FirstIRQVector, errInvalidLine},
+		}
+
+		for _, spec := range specs {
+			if err := drv.MaskIRQ(spec.line); err != spec.expErr {
+				t.Errorf("[line %d] expected MaskIRQ to return %v; got %v", spec.line, spec.expErr, err)
+			}
+
+			if err := drv.UnmaskIRQ(spec.line); err != spec.expErr {
+				t.Errorf("[line %d] expected UnmaskIRQ to return %v; got %v", spec.line, spec.expErr, err)
+			}
+		}
+	})
+}
+
+func TestIOAPICEOI(t *testing.T) {
+	defer restoreMocks(mapRegionFn, mmioRead32Fn, mmioWrite32Fn, registerHandlerFn)
+
+	mmio := mockMMIO(0, 24)
+	localAPIC = &lapicDriver{regs: testLAPICAddr}
+	drv := &ioapicDriver{}
+
+	mmio.lapicRegs[testLAPICAddr+lapicRegEOI] = 1
+	drv.EOI(SpuriousVector)
+	if mmio.lapicRegs[testLAPICAddr+lapicRegEOI] != 1 {
+		t.Fatal("expected spurious interrupts not to be acknowledged")
+	}
+
+	drv.EOI(33)
+	if mmio.lapicRegs[testLAPICAddr+lapicRegEOI] != 0 {
+		t.Fatal("expected EOI to be sent to the local APIC")
+	}
+
+	// Spurious interrupts are counted by the handler for SpuriousVector so
+	// they must be dispatched
+	if drv.Spurious(SpuriousVector) {
+		t.Fatal("expected SpuriousVector interrupts to be dispatched")
+	}
+}
+
+func TestProbeForIOAPIC(t *testing.T) {
+	defer restoreMocks(mapRegionFn, mmioRead32Fn, mmioWrite32Fn, registerHandlerFn)
+
+	madt = parseMADT(loadTestMADT(t))
+	if drv := probeForIOAPIC(); drv != nil {
+		t.Fatal("expected probe to return nil when the local APIC is not initialized")
+	}
+
+	localAPIC = &lapicDriver{}
+	madt = &madtInfo{}
+	if drv := probeForIOAPIC(); drv != nil {
+		t.Fatal("expected probe to return nil when no I/O APICs are available")
+	}
+
+	madt = parseMADT(loadTestMADT(t))
+	drv := probeForIOAPIC()
+	if drv == nil {
+		t.Fatal("expected probe to return a driver")
+	}
+
+	if drv.DriverName() == "" {
+		t.Fatal("DriverName() returned an empty string")
+	}
+
+	if major, minor, patch := drv.DriverVersion(); major+minor+patch == 0 {
+		t.Fatal("DriverVersion() returned an invalid version number")
+	}
+
+	if drv.(irq.InterruptController).ControllerName() == "" {
+		t.Fatal("ControllerName() returned an empty string")
+	}
+
+	var _ device.Driver = drv
+}
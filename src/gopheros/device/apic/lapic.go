@@ -0,0 +1,198 @@
+// Package apic implements drivers for the local APIC and the I/O APICs that
+// are described by the ACPI MADT. Once initialized, the I/O APIC driver
+// replaces the 8259 PICs as the active interrupt controller.
+package apic
+
+import (
+	"gopheros/device"
+	"gopheros/kernel"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"gopheros/kernel/mem/vmm"
+	"io"
+	"unsafe"
+)
+
+const (
+	lapicRegID    = 0x20
+	lapicRegTPR   = 0x80
+	lapicRegEOI   = 0xb0
+	lapicRegSVR   = 0xf0
+	lapicRegLINT0 = 0x350
+	lapicRegLINT1 = 0x360
+
+	// lapicSVREnable software-enables the local APIC when set in the
+	// spurious interrupt vector register.
+	lapicSVREnable = 1 << 8
+
+	// The following flags are used by the local vector table entries.
+	lvtDeliveryNMI = 0x4 << 8
+	lvtActiveLow   = 1 << 13
+
+	// SpuriousVector is the vector that the local APIC uses for reporting
+	// spurious interrupts. Spurious interrupts must not be acknowledged.
+	SpuriousVector = 0xff
+)
+
+// lapicDriver implements a device.Driver for the local APIC of the boot
+// processor.
+type lapicDriver struct {
+	// regs holds the virtual address of the local APIC registers.
+	regs uintptr
+
+	// id holds the APIC ID of the local APIC.
+	id uint8
+}
+
+var (
+	// localAPIC points to the initialized local APIC driver. It is used
+	// by the I/O APIC driver for routing interrupts and signaling EOIs.
+	localAPIC *lapicDriver
+
+	// spuriousCount tracks the number of spurious interrupts reported by
+	// the local APIC.
+	spuriousCount uint64
+
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	mapRegionFn       = vmm.MapRegion
+	mmioRead32Fn      = mmioRead32
+	mmioWrite32Fn     = mmioWrite32
+	registerHandlerFn = irq.Register
+)
+
+// DriverInit maps the local APIC registers, configures the local APIC NMI
+// sources listed in the MADT and enables the local APIC.
+func (drv *lapicDriver) DriverInit(w io.Writer) *kernel.Error {
+	info := getMADT()
+
+	regs, err := mapMMIO(info.lapicAddr)
+	if err != nil {
+		return err
+	}
+	drv.regs = regs
+	drv.id = uint8(drv.read(lapicRegID) >> 24)
+
+	if err = registerHandlerFn(SpuriousVector, spuriousHandler, "apic-spurious"); err != nil {
+		return err
+	}
+
+	nmiCount := drv.setupNMIs(info)
+
+	drv.write(lapicRegTPR, 0)
+	drv.write(lapicRegSVR, lapicSVREnable|SpuriousVector)
+	localAPIC = drv
+
+	kfmt.Fprintf(w, "APIC ID %d, registers at 0x%x, configured %d NMI source(s)\n", drv.id, info.lapicAddr, nmiCount)
+	return nil
+}
+
+// DriverName returns the name of this driver.
+func (*lapicDriver) DriverName() string {
+	return "Local APIC"
+}
+
+// DriverVersion returns the version of this driver.
+func (*lapicDriver) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// setupNMIs programs the LINT entries of the local vector table for the MADT
+// NMI records that apply to this local APIC and returns the number of
+// configured entries. NMIs are always edge-triggered so only the polarity
+// flags of each record are honoured.
+func (drv *lapicDriver) setupNMIs(info *madtInfo) int {
+	var (
+		count         int
+		procID, hasID = info.processorID(drv.id)
+		lintRegs      = [2]uintptr{lapicRegLINT0, lapicRegLINT1}
+	)
+
+	for _, nmi := range info.nmis {
+		if nmi.LINT >= uint8(len(lintRegs)) {
+			continue
+		}
+
+		if nmi.Processor != allProcessors && (!hasID || nmi.Processor != procID) {
+			continue
+		}
+
+		entry := uint32(lvtDeliveryNMI)
+		if nmi.Flags&mpsPolarityMask == mpsPolarityLow {
+			entry |= lvtActiveLow
+		}
+
+		drv.write(lintRegs[nmi.LINT], entry)
+		count++
+	}
+
+	return count
+}
+
+// eoi signals the end of an interrupt to the local APIC.
+func (drv *lapicDriver) eoi() {
+	drv.write(lapicRegEOI, 0)
+}
+
+// read returns the value of the local APIC register at the supplied offset.
+func (drv *lapicDriver) read(offset uintptr) uint32 {
+	return mmioRead32Fn(drv.regs + offset)
+}
+
+// write updates the value of the local APIC register at the supplied offset.
+func (drv *lapicDriver) write(offset uintptr, value uint32) {
+	mmioWrite32Fn(drv.regs+offset, value)
+}
+
+// SpuriousCount returns the number of spurious interrupts reported by the
+// local APIC.
+func SpuriousCount() uint64 {
+	return spuriousCount
+}
+
+// spuriousHandler is registered as the handler for SpuriousVector.
+func spuriousHandler(_ uint8, _ *irq.Frame, _ *irq.Regs) bool {
+	spuriousCount++
+	return true
+}
+
+// mapMMIO maps the page containing the registers at the supplied physical
+// address as uncacheable memory and returns the virtual address of the
+// registers.
+func mapMMIO(physAddr uintptr) (uintptr, *kernel.Error) {
+	page, err := mapRegionFn(
+		pmm.Frame(physAddr>>mem.PageShift),
+		mem.PageSize,
+		vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute|vmm.FlagDoNotCache,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return page.Address() + vmm.PageOffset(physAddr), nil
+}
+
+func mmioRead32(addr uintptr) uint32 {
+	return *(*uint32)(unsafe.Pointer(addr))
+}
+
+func mmioWrite32(addr uintptr, value uint32) {
+	*(*uint32)(unsafe.Pointer(addr)) = value
+}
+
+func probeForLocalAPIC() device.Driver {
+	if info := getMADT(); info == nil || info.lapicAddr == 0 {
+		return nil
+	}
+
+	return &lapicDriver{}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Order: device.DetectOrderACPI,
+		Probe: probeForLocalAPIC,
+	})
+}
@@ -0,0 +1,228 @@
+package apic
+
+import (
+	"bytes"
+	"gopheros/device"
+	"gopheros/device/acpi/table"
+	"gopheros/kernel"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"gopheros/kernel/mem/vmm"
+	"testing"
+)
+
+const (
+	testLAPICAddr  = 0xfee00000
+	testIOAPICAddr = 0xfec00000
+)
+
+// fakeMMIO emulates the local APIC registers and the indirectly accessed
+// registers of a single I/O APIC located at testIOAPICAddr.
+type fakeMMIO struct {
+	lapicRegs  map[uintptr]uint32
+	ioapicSel  uint32
+	ioapicRegs map[uint32]uint32
+}
+
+// mockMMIO installs a fakeMMIO and identity-maps all MMIO regions.
+func mockMMIO(lapicID uint8, ioapicEntries uint32) *fakeMMIO {
+	mmio := &fakeMMIO{
+		lapicRegs:  map[uintptr]uint32{testLAPICAddr + lapicRegID: uint32(lapicID) << 24},
+		ioapicRegs: map[uint32]uint32{ioapicRegVersion: (ioapicEntries-1)<<16 | 0x11},
+	}
+
+	mapRegionFn = func(frame pmm.Frame, _ mem.Size, _ vmm.PageTableEntryFlag) (vmm.Page, *kernel.Error) {
+		return vmm.Page(frame), nil
+	}
+	mmioRead32Fn = mmio.read
+	mmioWrite32Fn = mmio.write
+	return mmio
+}
+
+func (mmio *fakeMMIO) read(addr uintptr) uint32 {
+	switch addr {
+	case testIOAPICAddr + ioapicRegSelect:
+		return mmio.ioapicSel
+	case testIOAPICAddr + ioapicRegWindow:
+		return mmio.ioapicRegs[mmio.ioapicSel]
+	}
+
+	return mmio.lapicRegs[addr]
+}
+
+func (mmio *fakeMMIO) write(addr uintptr, value uint32) {
+	switch addr {
+	case testIOAPICAddr + ioapicRegSelect:
+		mmio.ioapicSel = value
+	case testIOAPICAddr + ioapicRegWindow:
+		mmio.ioapicRegs[mmio.ioapicSel] = value
+	default:
+		mmio.lapicRegs[addr] = value
+	}
+}
+
+func restoreMocks(origMapRegion func(pmm.Frame, mem.Size, vmm.PageTableEntryFlag) (vmm.Page, *kernel.Error), origRead func(uintptr) uint32, origWrite func(uintptr, uint32), origRegister func(uint8, irq.InterruptHandler, string) *kernel.Error) {
+	mapRegionFn = origMapRegion
+	mmioRead32Fn = origRead
+	mmioWrite32Fn = origWrite
+	registerHandlerFn = origRegister
+	madt = nil
+	localAPIC = nil
+}
+
+func TestLocalAPICDriverInit(t *testing.T) {
+	defer restoreMocks(mapRegionFn, mmioRead32Fn, mmioWrite32Fn, registerHandlerFn)
+
+	specs := []struct {
+		descr    string
+		nmis     [][]byte
+		expLINT0 uint32
+		expLINT1 uint32
+	}{
+		{"no NMI entries", nil, 0, 0},
+		{
+			"NMI for all processors",
+			[][]byte{lapicNMIEntry(allProcessors, 0x5, 1)},
+			0, lvtDeliveryNMI,
+		},
+		{
+			"active-low NMI for this processor",
+			[][]byte{lapicNMIEntry(0, 0xf, 0)},
+			lvtDeliveryNMI | lvtActiveLow, 0,
+		},
+		{
+			"NMI entries for other processors or invalid pins",
+			[][]byte{lapicNMIEntry(1, 0x5, 0), lapicNMIEntry(allProcessors, 0x5, 2)},
+			0, 0,
+		},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			var (
+				mmio       = mockMMIO(0, 24)
+				registered []uint8
+				buf        bytes.Buffer
+			)
+			madt = parseMADT(loadTestMADT(t, spec.nmis...))
+			localAPIC = nil
+			registerHandlerFn = func(vector uint8, _ irq.InterruptHandler, _ string) *kernel.Error {
+				registered = append(registered, vector)
+				return nil
+			}
+
+			drv := probeForLocalAPIC()
+			if drv == nil {
+				t.Fatal("expected probe to return a driver")
+			}
+
+			if err := drv.DriverInit(&buf); err != nil {
+				t.Fatal(err)
+			}
+
+			if localAPIC != drv {
+				t.Fatal("expected localAPIC to point to the initialized driver")
+			}
+
+			if len(registered) != 1 || registered[0] != SpuriousVector {
+				t.Fatalf("expected a handler to be registered for the spurious vector; got %v", registered)
+			}
+
+			if exp, got := uint32(lapicSVREnable|SpuriousVector), mmio.lapicRegs[testLAPICAddr+lapicRegSVR]; got != exp {
+				t.Errorf("expected SVR to be 0x%x; got 0x%x", exp, got)
+			}
+
+			if got := mmio.lapicRegs[testLAPICAddr+lapicRegLINT0]; got != spec.expLINT0 {
+				t.Errorf("expected LINT0 entry to be 0x%x; got 0x%x", spec.expLINT0, got)
+			}
+
+			if got := mmio.lapicRegs[testLAPICAddr+lapicRegLINT1]; got != spec.expLINT1 {
+				t.Errorf("expected LINT1 entry to be 0x%x; got 0x%x", spec.expLINT1, got)
+			}
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		madt = parseMADT(loadTestMADT(t))
+		expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+
+		mockMMIO(0, 24)
+		mapRegionFn = func(_ pmm.Frame, _ mem.Size, _ vmm.PageTableEntryFlag) (vmm.Page, *kernel.Error) {
+			return 0, expErr
+		}
+		if err := (&lapicDriver{}).DriverInit(&bytes.Buffer{}); err != expErr {
+			t.Errorf("expected to get error %v; got %v", expErr, err)
+		}
+
+		mockMMIO(0, 24)
+		registerHandlerFn = func(_ uint8, _ irq.InterruptHandler, _ string) *kernel.Error {
+			return expErr
+		}
+		if err := (&lapicDriver{}).DriverInit(&bytes.Buffer{}); err != expErr {
+			t.Errorf("expected to get error %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestLocalAPICEOI(t *testing.T) {
+	defer restoreMocks(mapRegionFn, mmioRead32Fn, mmioWrite32Fn, registerHandlerFn)
+
+	mmio := mockMMIO(0, 24)
+	mmio.lapicRegs[testLAPICAddr+lapicRegEOI] = 0xbadf00d
+
+	drv := &lapicDriver{regs: testLAPICAddr}
+	drv.eoi()
+
+	if got := mmio.lapicRegs[testLAPICAddr+lapicRegEOI]; got != 0 {
+		t.Fatalf("expected EOI register to be written; got 0x%x", got)
+	}
+}
+
+func TestSpuriousHandler(t *testing.T) {
+	defer func() { spuriousCount = 0 }()
+
+	for i := 0; i < 2; i++ {
+		if !spuriousHandler(SpuriousVector, nil, nil) {
+			t.Fatal("expected spurious handler to claim the interrupt")
+		}
+	}
+
+	if exp, got := uint64(2), SpuriousCount(); got != exp {
+		t.Fatalf("expected spurious count to be %d; got %d", exp, got)
+	}
+}
+
+func TestProbeForLocalAPIC(t *testing.T) {
+	defer func(origLookupTable func(string) *table.SDTHeader) {
+		lookupTableFn = origLookupTable
+		madt = nil
+	}(lookupTableFn)
+
+	madt = nil
+	lookupTableFn = func(_ string) *table.SDTHeader { return nil }
+	if drv := probeForLocalAPIC(); drv != nil {
+		t.Fatal("expected probe to return nil when the MADT is missing")
+	}
+
+	madt = &madtInfo{}
+	if drv := probeForLocalAPIC(); drv != nil {
+		t.Fatal("expected probe to return nil when the local APIC address is missing")
+	}
+
+	madt = &madtInfo{lapicAddr: testLAPICAddr}
+	drv := probeForLocalAPIC()
+	if drv == nil {
+		t.Fatal("expected probe to return a driver")
+	}
+
+	if drv.DriverName() == "" {
+		t.Fatal("DriverName() returned an empty string")
+	}
+
+	if major, minor, patch := drv.DriverVersion(); major+minor+patch == 0 {
+		t.Fatal("DriverVersion() returned an invalid version number")
+	}
+
+	var _ device.Driver = drv
+}
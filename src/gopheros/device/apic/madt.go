@@ -0,0 +1,158 @@
+package apic
+
+import (
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/table"
+	"unsafe"
+)
+
+const (
+	madtSignature = "APIC"
+
+	// The MPS INTI flags used by interrupt source override and NMI
+	// records encode the polarity in bits 0-1 and the trigger mode in
+	// bits 2-3. A value of 0 selects the default for the bus.
+	mpsPolarityMask = 0x3
+	mpsPolarityHigh = 0x1
+	mpsPolarityLow  = 0x3
+	mpsTriggerMask  = 0xc
+	mpsTriggerEdge  = 0x4
+	mpsTriggerLevel = 0xc
+
+	// allProcessors is the ACPI processor ID used by local APIC NMI
+	// records that apply to all processors.
+	allProcessors = 0xff
+)
+
+// madtInfo contains the interrupt controller configuration that is extracted
+// from the MADT.
+type madtInfo struct {
+	// lapicAddr holds the physical address of the local APIC registers.
+	lapicAddr uintptr
+
+	lapics    []table.MADTEntryLocalAPIC
+	ioapics   []table.MADTEntryIOAPIC
+	overrides []table.MADTEntryInterruptSrcOverride
+	nmis      []table.MADTEntryNMI
+}
+
+var (
+	// madt caches the parsed MADT contents so that the table only needs
+	// to be parsed once by the local APIC and IOAPIC drivers.
+	madt *madtInfo
+
+	// lookupTableFn is used by tests and is automatically inlined by the compiler.
+	lookupTableFn = acpi.LookupTable
+)
+
+// getMADT returns the parsed contents of the MADT or nil if the table is not
+// available.
+func getMADT() *madtInfo {
+	if madt != nil {
+		return madt
+	}
+
+	header := lookupTableFn(madtSignature)
+	if header == nil {
+		return nil
+	}
+
+	madt = parseMADT(header)
+	return madt
+}
+
+// parseMADT decodes the MADT records that follow the supplied table header.
+// The records are packed so their fields are decoded using byte offsets.
+func parseMADT(header *table.SDTHeader) *madtInfo {
+	var (
+		info      = &madtInfo{}
+		madtTable = (*table.MADT)(unsafe.Pointer(header))
+		entryPtr  = unsafe.Pointer(uintptr(unsafe.Pointer(header)) + unsafe.Sizeof(table.MADT{}))
+		tableEnd  = uintptr(unsafe.Pointer(header)) + uintptr(header.Length)
+	)
+
+	info.lapicAddr = uintptr(madtTable.LocalControllerAddress)
+
+	for uintptr(entryPtr)+2 <= tableEnd {
+		entry := (*table.MADTEntry)(entryPtr)
+		if entry.Length < 2 || uintptr(entryPtr)+uintptr(entry.Length) > tableEnd {
+			break
+		}
+
+		switch entry.Type {
+		case table.MADTEntryTypeLocalAPIC:
+			info.lapics = append(info.lapics, table.MADTEntryLocalAPIC{
+				ProcessorID: read8(entryPtr, 2),
+				APICID:      read8(entryPtr, 3),
+				Flags:       read32(entryPtr, 4),
+			})
+		case table.MADTEntryTypeIOAPIC:
+			info.ioapics = append(info.ioapics, table.MADTEntryIOAPIC{
+				APICID:           read8(entryPtr, 2),
+				Address:          read32(entryPtr, 4),
+				SysInterruptBase: read32(entryPtr, 8),
+			})
+		case table.MADTEntryTypeIntSrcOverride:
+			info.overrides = append(info.overrides, table.MADTEntryInterruptSrcOverride{
+				BusSrc:          read8(entryPtr, 2),
+				IRQSrc:          read8(entryPtr, 3),
+				GlobalInterrupt: read32(entryPtr, 4),
+				Flags:           read16(entryPtr, 8),
+			})
+		case table.MADTEntryTypeLocalAPICNMI:
+			info.nmis = append(info.nmis, table.MADTEntryNMI{
+				Processor: read8(entryPtr, 2),
+				Flags:     read16(entryPtr, 3),
+				LINT:      read8(entryPtr, 5),
+			})
+		case table.MADTEntryTypeLocalAPICAddrOverride:
+			info.lapicAddr = uintptr(read64(entryPtr, 4))
+		}
+
+		entryPtr = unsafe.Pointer(uintptr(entryPtr) + uintptr(entry.Length))
+	}
+
+	return info
+}
+
+// processorID returns the ACPI processor ID of the local APIC with the
+// supplied APIC ID.
+func (info *madtInfo) processorID(apicID uint8) (uint8, bool) {
+	for _, lapic := range info.lapics {
+		if lapic.APICID == apicID {
+			return lapic.ProcessorID, true
+		}
+	}
+
+	return 0, false
+}
+
+// override returns the interrupt source override for the supplied ISA IRQ.
+func (info *madtInfo) override(isaIRQ uint8) (*table.MADTEntryInterruptSrcOverride, bool) {
+	for index := range info.overrides {
+		if info.overrides[index].BusSrc == 0 && info.overrides[index].IRQSrc == isaIRQ {
+			return &info.overrides[index], true
+		}
+	}
+
+	return nil, false
+}
+
+// The following functions read a value from a packed MADT record at the
+// supplied byte offset.
+
+func read8(entryPtr unsafe.Pointer, offset uintptr) uint8 {
+	return *(*uint8)(unsafe.Pointer(uintptr(entryPtr) + offset))
+}
+
+func read16(entryPtr unsafe.Pointer, offset uintptr) uint16 {
+	return *(*uint16)(unsafe.Pointer(uintptr(entryPtr) + offset))
+}
+
+func read32(entryPtr unsafe.Pointer, offset uintptr) uint32 {
+	return *(*uint32)(unsafe.Pointer(uintptr(entryPtr) + offset))
+}
+
+func read64(entryPtr unsafe.Pointer, offset uintptr) uint64 {
+	return *(*uint64)(unsafe.Pointer(uintptr(entryPtr) + offset))
+}
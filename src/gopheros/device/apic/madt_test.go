@@ -0,0 +1,155 @@
+package apic
+
+import (
+	"encoding/binary"
+	"gopheros/device/acpi/table"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+// loadTestMADT loads the MADT dump used by the ACPI tests, appends the
+// supplied raw records to it and updates the table length.
+func loadTestMADT(t *testing.T, extraEntries ...[]byte) *table.SDTHeader {
+	data, err := ioutil.ReadFile("../acpi/table/tabletest/APIC.aml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range extraEntries {
+		data = append(data, entry...)
+	}
+
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(data)))
+	return (*table.SDTHeader)(unsafe.Pointer(&data[0]))
+}
+
+func lapicNMIEntry(processor uint8, flags uint16, lint uint8) []byte {
+	return []byte{uint8(table.MADTEntryTypeLocalAPICNMI), 6, processor, uint8(flags), uint8(flags >> 8), lint}
+}
+
+func lapicAddrOverrideEntry(addr uint64) []byte {
+	entry := make([]byte, 12)
+	entry[0], entry[1] = uint8(table.MADTEntryTypeLocalAPICAddrOverride), 12
+	binary.LittleEndian.PutUint64(entry[4:], addr)
+	return entry
+}
+
+func TestParseMADT(t *testing.T) {
+	t.Run("table dump", func(t *testing.T) {
+		info := parseMADT(loadTestMADT(t))
+
+		if exp := uintptr(0xfee00000); info.lapicAddr != exp {
+			t.Errorf("expected local APIC address to be 0x%x; got 0x%x", exp, info.lapicAddr)
+		}
+
+		expLAPICs := []table.MADTEntryLocalAPIC{{ProcessorID: 0, APICID: 0, Flags: 1}}
+		if !reflect.DeepEqual(info.lapics, expLAPICs) {
+			t.Errorf("expected local APICs to be %+v; got %+v", expLAPICs, info.lapics)
+		}
+
+		expIOAPICs := []table.MADTEntryIOAPIC{{APICID: 1, Address: 0xfec00000, SysInterruptBase: 0}}
+		if !reflect.DeepEqual(info.ioapics, expIOAPICs) {
+			t.Errorf("expected I/O APICs to be %+v; got %+v", expIOAPICs, info.ioapics)
+		}
+
+		expOverrides := []table.MADTEntryInterruptSrcOverride{
+			{BusSrc: 0, IRQSrc: 0, GlobalInterrupt: 2, Flags: 0},
+			{BusSrc: 0, IRQSrc: 9, GlobalInterrupt: 9, Flags: 0xd},
+		}
+		if !reflect.DeepEqual(info.overrides, expOverrides) {
+			t.Errorf("expected interrupt source overrides to be %+v; got %+v", expOverrides, info.overrides)
+		}
+
+		if len(info.nmis) != 0 {
+			t.Errorf("expected no NMI entries; got %d", len(info.nmis))
+		}
+	})
+
+	t.Run("NMI and address override entries", func(t *testing.T) {
+		info := parseMADT(loadTestMADT(t,
+			lapicNMIEntry(allProcessors, 0x5, 1),
+			lapicAddrOverrideEntry(0xfed00000),
+		))
+
+		if exp := uintptr(0xfed00000); info.lapicAddr != exp {
+			t.Errorf("expected local APIC address to be 0x%x; got 0x%x", exp, info.lapicAddr)
+		}
+
+		expNMIs := []table.MADTEntryNMI{{Processor: allProcessors, Flags: 0x5, LINT: 1}}
+		if !reflect.DeepEqual(info.nmis, expNMIs) {
+			t.Errorf("expected NMI entries to be %+v; got %+v", expNMIs, info.nmis)
+		}
+	})
+
+	t.Run("truncated entries", func(t *testing.T) {
+		for _, entry := range [][]byte{
+			{uint8(table.MADTEntryTypeLocalAPICNMI), 0},
+			{uint8(table.MADTEntryTypeLocalAPICNMI), 6, 0},
+		} {
+			if info := parseMADT(loadTestMADT(t, entry)); len(info.nmis) != 0 {
+				t.Errorf("expected truncated entry to be ignored")
+			}
+		}
+	})
+}
+
+func TestGetMADT(t *testing.T) {
+	defer func(origLookupTable func(string) *table.SDTHeader) {
+		lookupTableFn = origLookupTable
+		madt = nil
+	}(lookupTableFn)
+
+	var lookups int
+	lookupTableFn = func(name string) *table.SDTHeader {
+		lookups++
+		return nil
+	}
+
+	if getMADT() != nil {
+		t.Fatal("expected getMADT to return nil when the MADT is missing")
+	}
+
+	header := loadTestMADT(t)
+	lookupTableFn = func(name string) *table.SDTHeader {
+		lookups++
+		if name != madtSignature {
+			t.Errorf("expected lookup for table %q; got %q", madtSignature, name)
+		}
+		return header
+	}
+
+	info := getMADT()
+	if info == nil {
+		t.Fatal("expected getMADT to return the parsed MADT")
+	}
+
+	if getMADT() != info {
+		t.Fatal("expected the parsed MADT to be cached")
+	}
+
+	if lookups != 2 {
+		t.Fatalf("expected 2 table lookups; got %d", lookups)
+	}
+}
+
+func TestMADTLookups(t *testing.T) {
+	info := parseMADT(loadTestMADT(t))
+
+	if procID, ok := info.processorID(0); !ok || procID != 0 {
+		t.Errorf("expected APIC ID 0 to map to processor 0; got %d, %t", procID, ok)
+	}
+
+	if _, ok := info.processorID(1); ok {
+		t.Error("expected lookup for unknown APIC ID to fail")
+	}
+
+	if override, ok := info.override(9); !ok || override.GlobalInterrupt != 9 {
+		t.Errorf("expected to find override for IRQ9")
+	}
+
+	if _, ok := info.override(1); ok {
+		t.Error("expected lookup for IRQ1 override to fail")
+	}
+}
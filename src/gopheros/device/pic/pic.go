@@ -0,0 +1,250 @@
+// Package pic implements a driver for the legacy 8259 programmable interrupt
+// controllers (PIC). The master and slave PICs are remapped so that IRQ0-15
+// are delivered to vectors 32-47 instead of colliding with the CPU exception
+// vectors.
+package pic
+
+import (
+	"gopheros/device"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"io"
+)
+
+const (
+	masterCmdPort  = 0x20
+	masterDataPort = 0x21
+	slaveCmdPort   = 0xa0
+	slaveDataPort  = 0xa1
+
+	// ioWaitPort is an unused port that is written to for introducing a
+	// small delay between PIC commands.
+	ioWaitPort = 0x80
+
+	// icw1Init starts the initialization sequence and indicates that
+	// ICW4 will be provided.
+	icw1Init = 0x11
+
+	// icw4Mode8086 selects the 8086/88 mode.
+	icw4Mode8086 = 0x01
+
+	// ocw3ReadISR requests the contents of the in-service register on the
+	// next read from the command port.
+	ocw3ReadISR = 0x0b
+
+	cmdEOI = 0x20
+
+	// cascadeLine is the master PIC line that the slave PIC is connected to.
+	cascadeLine = 2
+
+	// spuriousLine is the line reported by each PIC for spurious
+	// interrupts.
+	spuriousLine = 7
+
+	// VectorOffset is the vector that IRQ0 is remapped to. IRQ lines
+	// 0-15 are mapped to vectors VectorOffset to VectorOffset+15.
+	VectorOffset = irq.FirstIRQVector
+
+	// NumLines is the number of IRQ lines served by the master and slave
+	// PICs.
+	NumLines = 16
+)
+
+// picDriver implements a device.Driver for the 8259 PICs and registers itself
+// as the active irq.InterruptController.
+type picDriver struct{}
+
+var (
+	// masks caches the interrupt mask register contents for both PICs.
+	// Bit N corresponds to IRQ line N.
+	masks uint16
+
+	// spuriousCount tracks the number of spurious interrupts detected via
+	// the in-service registers.
+	spuriousCount uint64
+
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	portWriteByteFn = cpu.PortWriteByte
+	portReadByteFn  = cpu.PortReadByte
+	setControllerFn = irq.SetController
+
+	errInvalidLine = &kernel.Error{Module: "pic", Message: "IRQ line must be in the range 0-15"}
+)
+
+// DriverInit remaps the PICs and masks all IRQ lines except the one used for
+// cascading the slave PIC.
+func (drv *picDriver) DriverInit(w io.Writer) *kernel.Error {
+	remap()
+	setControllerFn(drv)
+
+	kfmt.Fprintf(w, "remapped IRQ0-15 to vectors %d-%d\n", VectorOffset, VectorOffset+NumLines-1)
+	return nil
+}
+
+// DriverName returns the name of this driver.
+func (*picDriver) DriverName() string {
+	return "8259 PIC"
+}
+
+// DriverVersion returns the version of this driver.
+func (*picDriver) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// ControllerName returns the name of the interrupt controller.
+func (*picDriver) ControllerName() string {
+	return "8259 PIC"
+}
+
+// IRQVector returns the interrupt vector for the supplied IRQ line.
+func (*picDriver) IRQVector(line uint8) uint8 {
+	return Vector(line)
+}
+
+// MaskIRQ disables the delivery of interrupts for the supplied IRQ line.
+func (*picDriver) MaskIRQ(line uint8) *kernel.Error {
+	return Mask(line)
+}
+
+// UnmaskIRQ enables the delivery of interrupts for the supplied IRQ line.
+func (*picDriver) UnmaskIRQ(line uint8) *kernel.Error {
+	return Unmask(line)
+}
+
+// EOI signals the end of an interrupt for the supplied vector.
+func (*picDriver) EOI(vector uint8) {
+	EOI(vector)
+}
+
+// Spurious returns true if the interrupt delivered on the supplied vector is
+// spurious.
+func (*picDriver) Spurious(vector uint8) bool {
+	return Spurious(vector)
+}
+
+// remap reinitializes both PICs using VectorOffset as the base vector and
+// masks all lines except the cascade line.
+func remap() {
+	writeAndWait(masterCmdPort, icw1Init)
+	writeAndWait(slaveCmdPort, icw1Init)
+	writeAndWait(masterDataPort, VectorOffset)
+	writeAndWait(slaveDataPort, VectorOffset+8)
+	writeAndWait(masterDataPort, 1<<cascadeLine)
+	writeAndWait(slaveDataPort, cascadeLine)
+	writeAndWait(masterDataPort, icw4Mode8086)
+	writeAndWait(slaveDataPort, icw4Mode8086)
+
+	setMasks(^uint16(1 << cascadeLine))
+}
+
+// writeAndWait writes a value to a PIC port and waits for the PIC to process
+// it.
+func writeAndWait(port uint16, value uint8) {
+	portWriteByteFn(port, value)
+	portWriteByteFn(ioWaitPort, 0)
+}
+
+// setMasks updates the interrupt mask registers of both PICs.
+func setMasks(newMasks uint16) {
+	masks = newMasks
+	portWriteByteFn(masterDataPort, uint8(masks))
+	portWriteByteFn(slaveDataPort, uint8(masks>>8))
+}
+
+// Mask disables the delivery of interrupts for the supplied IRQ line.
+func Mask(line uint8) *kernel.Error {
+	if line >= NumLines {
+		return errInvalidLine
+	}
+
+	setMasks(masks | 1<<line)
+	return nil
+}
+
+// Unmask enables the delivery of interrupts for the supplied IRQ line. Lines
+// served by the slave PIC also require the cascade line to be unmasked which
+// happens when the PICs are initialized.
+func Unmask(line uint8) *kernel.Error {
+	if line >= NumLines {
+		return errInvalidLine
+	}
+
+	setMasks(masks &^ (1 << line))
+	return nil
+}
+
+// MaskAll disables the delivery of interrupts for all IRQ lines. It should be
+// invoked when another interrupt controller such as the APIC takes over.
+func MaskAll() {
+	setMasks(0xffff)
+}
+
+// Vector returns the interrupt vector for the supplied IRQ line.
+func Vector(line uint8) uint8 {
+	return VectorOffset + line
+}
+
+// EOI signals the end of an interrupt for the supplied vector. Vectors that
+// are not mapped to the PICs are ignored. EOI must not be invoked for
+// spurious interrupts.
+func EOI(vector uint8) {
+	if vector < VectorOffset || vector >= VectorOffset+NumLines {
+		return
+	}
+
+	if vector-VectorOffset >= 8 {
+		portWriteByteFn(slaveCmdPort, cmdEOI)
+	}
+
+	portWriteByteFn(masterCmdPort, cmdEOI)
+}
+
+// Spurious returns true if the interrupt delivered on the supplied vector is
+// spurious. Spurious interrupts are reported on IRQ7 and IRQ15 without the
+// corresponding in-service register bit being set and must not be
+// acknowledged. In the case of a spurious IRQ15, the master PIC still needs to
+// receive an EOI as it is not aware that the slave interrupt was spurious.
+func Spurious(vector uint8) bool {
+	switch vector {
+	case Vector(spuriousLine):
+		if inService(masterCmdPort, spuriousLine) {
+			return false
+		}
+	case Vector(8 + spuriousLine):
+		if inService(slaveCmdPort, spuriousLine) {
+			return false
+		}
+		portWriteByteFn(masterCmdPort, cmdEOI)
+	default:
+		return false
+	}
+
+	spuriousCount++
+	return true
+}
+
+// SpuriousCount returns the number of spurious interrupts that were detected.
+func SpuriousCount() uint64 {
+	return spuriousCount
+}
+
+// inService returns true if the in-service register bit for the supplied line
+// of the PIC with the given command port is set.
+func inService(cmdPort uint16, line uint8) bool {
+	portWriteByteFn(cmdPort, ocw3ReadISR)
+	return portReadByteFn(cmdPort)&(1<<line) != 0
+}
+
+func probeForPIC() device.Driver {
+	return &picDriver{}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Order: device.DetectOrderBeforeACPI,
+		Probe: probeForPIC,
+	})
+}
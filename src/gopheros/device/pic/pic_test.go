@@ -0,0 +1,265 @@
+package pic
+
+import (
+	"bytes"
+	"gopheros/device"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"testing"
+)
+
+type portWrite struct {
+	port  uint16
+	value uint8
+}
+
+// mockPorts records all port writes (excluding the I/O delay writes) and
+// returns the supplied ISR values when the command ports are read.
+func mockPorts(masterISR, slaveISR uint8) *[]portWrite {
+	var writes []portWrite
+	portWriteByteFn = func(port uint16, value uint8) {
+		if port != ioWaitPort {
+			writes = append(writes, portWrite{port, value})
+		}
+	}
+	portReadByteFn = func(port uint16) uint8 {
+		switch port {
+		case masterCmdPort:
+			return masterISR
+		case slaveCmdPort:
+			return slaveISR
+		}
+		return 0
+	}
+	return &writes
+}
+
+func restorePorts() {
+	portWriteByteFn = cpu.PortWriteByte
+	portReadByteFn = cpu.PortReadByte
+	setControllerFn = irq.SetController
+	masks = 0
+	spuriousCount = 0
+}
+
+func TestDriverInit(t *testing.T) {
+	defer restorePorts()
+
+	var (
+		buf        bytes.Buffer
+		writes     = mockPorts(0, 0)
+		controller irq.InterruptController
+	)
+	setControllerFn = func(ctrl irq.InterruptController) { controller = ctrl }
+
+	drv := probeForPIC()
+	if err := drv.DriverInit(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []portWrite{
+		{masterCmdPort, icw1Init},
+		{slaveCmdPort, icw1Init},
+		{masterDataPort, 32},
+		{slaveDataPort, 40},
+		{masterDataPort, 4},
+		{slaveDataPort, 2},
+		{masterDataPort, icw4Mode8086},
+		{slaveDataPort, icw4Mode8086},
+		{masterDataPort, 0xfb},
+		{slaveDataPort, 0xff},
+	}
+
+	if len(*writes) != len(exp) {
+		t.Fatalf("expected %d port writes; got %d: %v", len(exp), len(*writes), *writes)
+	}
+
+	for index, write := range *writes {
+		if write != exp[index] {
+			t.Errorf("[write %d] expected %+v; got %+v", index, exp[index], write)
+		}
+	}
+
+	if controller != drv.(irq.InterruptController) {
+		t.Error("expected the driver to be registered as the interrupt controller")
+	}
+
+	if exp, got := "remapped IRQ0-15 to vectors 32-47\n", buf.String(); got != exp {
+		t.Errorf("expected output %q; got %q", exp, got)
+	}
+
+	if drv.DriverName() == "" || controller.ControllerName() == "" {
+		t.Error("expected driver and controller names to be non-empty")
+	}
+
+	if major, minor, patch := drv.DriverVersion(); major != 0 || minor != 0 || patch != 1 {
+		t.Errorf("unexpected driver version %d.%d.%d", major, minor, patch)
+	}
+}
+
+func TestMaskUnmask(t *testing.T) {
+	defer restorePorts()
+
+	writes := mockPorts(0, 0)
+	MaskAll()
+	if masks != 0xffff {
+		t.Fatalf("expected all lines to be masked; got %x", masks)
+	}
+
+	if err := Unmask(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Unmask(12); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := uint16(0xeffd); masks != exp {
+		t.Fatalf("expected masks to be %x; got %x", exp, masks)
+	}
+
+	if err := Mask(12); err != nil {
+		t.Fatal(err)
+	}
+
+	last := (*writes)[len(*writes)-2:]
+	if last[0] != (portWrite{masterDataPort, 0xfd}) || last[1] != (portWrite{slaveDataPort, 0xff}) {
+		t.Fatalf("expected mask registers to be updated; got %v", last)
+	}
+
+	for _, fn := range []func(uint8) *kernel.Error{Mask, Unmask} {
+		if err := fn(NumLines); err != errInvalidLine {
+			t.Errorf("expected to get errInvalidLine; got %v", err)
+		}
+	}
+
+	t.Run("via interrupt controller interface", func(t *testing.T) {
+		var ctrl irq.InterruptController = &picDriver{}
+
+		if err := ctrl.UnmaskIRQ(4); err != nil {
+			t.Fatal(err)
+		}
+
+		if masks&(1<<4) != 0 {
+			t.Fatal("expected line 4 to be unmasked")
+		}
+
+		if err := ctrl.MaskIRQ(4); err != nil {
+			t.Fatal(err)
+		}
+
+		if masks&(1<<4) == 0 {
+			t.Fatal("expected line 4 to be masked")
+		}
+
+		if exp, got := uint8(36), ctrl.IRQVector(4); got != exp {
+			t.Fatalf("expected IRQ4 to be mapped to vector %d; got %d", exp, got)
+		}
+	})
+}
+
+func TestEOI(t *testing.T) {
+	defer restorePorts()
+
+	specs := []struct {
+		descr       string
+		vector      uint8
+		masterISR   uint8
+		slaveISR    uint8
+		expWrites   []portWrite
+		expSpurious uint64
+	}{
+		{"not a PIC vector", 31, 0, 0, nil, 0},
+		{"not a PIC vector", 48, 0, 0, nil, 0},
+		{"master IRQ", Vector(1), 0, 0, []portWrite{{masterCmdPort, cmdEOI}}, 0},
+		{"slave IRQ", Vector(12), 0, 0, []portWrite{{slaveCmdPort, cmdEOI}, {masterCmdPort, cmdEOI}}, 0},
+		{"IRQ15", Vector(15), 0, 0, []portWrite{{slaveCmdPort, cmdEOI}, {masterCmdPort, cmdEOI}}, 0},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			spuriousCount = 0
+			writes := mockPorts(spec.masterISR, spec.slaveISR)
+
+			(&picDriver{}).EOI(spec.vector)
+
+			if len(*writes) != len(spec.expWrites) {
+				t.Fatalf("expected port writes %v; got %v", spec.expWrites, *writes)
+			}
+
+			for index, write := range *writes {
+				if write != spec.expWrites[index] {
+					t.Errorf("[write %d] expected %+v; got %+v", index, spec.expWrites[index], write)
+				}
+			}
+
+			if got := SpuriousCount(); got != spec.expSpurious {
+				t.Errorf("expected spurious count to be %d; got %d", spec.expSpurious, got)
+			}
+		})
+	}
+}
+
+func TestSpurious(t *testing.T) {
+	defer restorePorts()
+
+	specs := []struct {
+		descr       string
+		vector      uint8
+		masterISR   uint8
+		slaveISR    uint8
+		expWrites   []portWrite
+		expSpurious bool
+	}{
+		{"not a spurious line", Vector(1), 0, 0, nil, false},
+		{"not a PIC vector", 48, 0, 0, nil, false},
+		{"IRQ7", Vector(7), 1 << 7, 0, []portWrite{{masterCmdPort, ocw3ReadISR}}, false},
+		{"spurious IRQ7", Vector(7), 0, 0, []portWrite{{masterCmdPort, ocw3ReadISR}}, true},
+		{"IRQ15", Vector(15), 0, 1 << 7, []portWrite{{slaveCmdPort, ocw3ReadISR}}, false},
+		{"spurious IRQ15", Vector(15), 0, 0, []portWrite{{slaveCmdPort, ocw3ReadISR}, {masterCmdPort, cmdEOI}}, true},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			spuriousCount = 0
+			writes := mockPorts(spec.masterISR, spec.slaveISR)
+
+			if got := (&picDriver{}).Spurious(spec.vector); got != spec.expSpurious {
+				t.Fatalf("expected Spurious to return %t; got %t", spec.expSpurious, got)
+			}
+
+			if len(*writes) != len(spec.expWrites) {
+				t.Fatalf("expected port writes %v; got %v", spec.expWrites, *writes)
+			}
+
+			for index, write := range *writes {
+				if write != spec.expWrites[index] {
+					t.Errorf("[write %d] expected %+v; got %+v", index, spec.expWrites[index], write)
+				}
+			}
+
+			var expCount uint64
+			if spec.expSpurious {
+				expCount = 1
+			}
+
+			if got := SpuriousCount(); got != expCount {
+				t.Errorf("expected spurious count to be %d; got %d", expCount, got)
+			}
+		})
+	}
+}
+
+func TestProbe(t *testing.T) {
+	var found bool
+	for _, info := range device.DriverList() {
+		if drv := info.Probe(); drv != nil && drv.DriverName() == "8259 PIC" {
+			found = info.Order == device.DetectOrderBeforeACPI
+		}
+	}
+
+	if !found {
+		t.Fatal("expected the PIC driver to be registered")
+	}
+}
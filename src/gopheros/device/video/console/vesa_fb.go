@@ -242,14 +242,26 @@ func (cons *VesaFbConsole) Scroll(dir ScrollDir, lines uint32) {
 	case ScrollDirUp:
 		startOffset := cons.fbOffset(0, 0)
 		endOffset := cons.fbOffset(0, cons.height-lines*cons.font.GlyphHeight-cons.offsetY)
-		for i := startOffset; i < endOffset; i++ {
-			cons.fb[i] = cons.fb[i+offset]
+		if endOffset <= startOffset {
+			return
 		}
+
+		mem.Memmove(
+			uintptr(unsafe.Pointer(&cons.fb[startOffset+offset])),
+			uintptr(unsafe.Pointer(&cons.fb[startOffset])),
+			mem.Size(endOffset-startOffset),
+		)
 	case ScrollDirDown:
 		startOffset := cons.fbOffset(0, lines*cons.font.GlyphHeight)
-		for i := uint32(len(cons.fb) - 1); i >= startOffset; i-- {
-			cons.fb[i] = cons.fb[i-offset]
+		if startOffset >= uint32(len(cons.fb)) {
+			return
 		}
+
+		mem.Memmove(
+			uintptr(unsafe.Pointer(&cons.fb[startOffset-offset])),
+			uintptr(unsafe.Pointer(&cons.fb[startOffset])),
+			mem.Size(uint32(len(cons.fb))-startOffset),
+		)
 	}
 }
 
@@ -564,7 +576,7 @@ func (cons *VesaFbConsole) DriverInit(w io.Writer) *kernel.Error {
 	fbPage, err := mapRegionFn(
 		pmm.Frame(cons.fbPhysAddr>>mem.PageShift),
 		fbSize,
-		vmm.FlagPresent|vmm.FlagRW,
+		vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute,
 	)
 
 	if err != nil {
@@ -138,18 +138,26 @@ func (cons *VgaTextConsole) Scroll(dir ScrollDir, lines uint32) {
 		return
 	}
 
-	var i uint32
 	offset := lines * cons.width
+	count := (cons.height - lines) * cons.width
+	if count == 0 {
+		return
+	}
 
+	// Each framebuffer entry occupies 2 bytes
 	switch dir {
 	case ScrollDirUp:
-		for ; i < (cons.height-lines)*cons.width; i++ {
-			cons.fb[i] = cons.fb[i+offset]
-		}
+		mem.Memmove(
+			uintptr(unsafe.Pointer(&cons.fb[offset])),
+			uintptr(unsafe.Pointer(&cons.fb[0])),
+			mem.Size(count<<1),
+		)
 	case ScrollDirDown:
-		for i = cons.height*cons.width - 1; i >= lines*cons.width; i-- {
-			cons.fb[i] = cons.fb[i-offset]
-		}
+		mem.Memmove(
+			uintptr(unsafe.Pointer(&cons.fb[0])),
+			uintptr(unsafe.Pointer(&cons.fb[offset])),
+			mem.Size(count<<1),
+		)
 	}
 }
 
@@ -213,7 +221,7 @@ func (cons *VgaTextConsole) DriverInit(w io.Writer) *kernel.Error {
 	fbPage, err := mapRegionFn(
 		pmm.Frame(cons.fbPhysAddr>>mem.PageShift),
 		fbSize,
-		vmm.FlagPresent|vmm.FlagRW,
+		vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute,
 	)
 
 	if err != nil {
@@ -0,0 +1,115 @@
+// Package clock provides the monotonic and wall clocks used by the kernel and
+// the Go runtime. The monotonic clock is driven by a clock source that is
+// selected by Init whereas the wall clock is seeded from the CMOS real-time
+// clock.
+package clock
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/kfmt"
+)
+
+const (
+	nanosPerSecond = uint64(1000000000)
+)
+
+// Source is implemented by hardware counters that can drive the monotonic
+// clock.
+type Source interface {
+	// Name returns the name of the clock source.
+	Name() string
+
+	// Ticks returns the current counter value. The counter must increase
+	// monotonically.
+	Ticks() uint64
+
+	// Frequency returns the number of counter ticks per second.
+	Frequency() uint64
+}
+
+var (
+	// activeSource is the clock source that drives the monotonic clock.
+	activeSource Source
+
+	// baseTicks and baseNanos record the counter value of the active
+	// source and the monotonic clock value at the time the source was
+	// activated.
+	baseTicks uint64
+	baseNanos uint64
+
+	// bootWallNanos holds the wall clock time, in nanoseconds since the
+	// Unix epoch, that corresponds to a zero monotonic clock value.
+	bootWallNanos int64
+
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	hasTSCFn       = cpu.HasTSC
+	readTSCFn      = cpu.ReadTSC
+	readRTCFn      = readRTC
+	calibrateTSCFn = calibrateTSC
+
+	errNoClockSource = &kernel.Error{Module: "clock", Message: "no usable clock source detected"}
+)
+
+// Init selects the clock source that drives the monotonic clock and seeds the
+// wall clock using the CMOS real-time clock.
+//
+// The TSC is preferred if it is supported by the CPU. Its frequency is
+// calibrated against the PIT and can be refined by a subsequent call to
+// UseHPET. If the TSC is not available, the PIT counter is used instead.
+func Init() *kernel.Error {
+	switch {
+	case hasTSCFn():
+		tsc.freq = calibrateTSCFn(pitBusyWait)
+		if tsc.freq == 0 {
+			return errNoClockSource
+		}
+		setSource(&tsc)
+	default:
+		initPITCounter()
+		setSource(&pit)
+	}
+
+	bootWallNanos = readRTCFn() * int64(nanosPerSecond)
+
+	kfmt.Printf("[clock] using %s clock source (%d Hz)\n", activeSource.Name(), activeSource.Frequency())
+	return nil
+}
+
+// Nanotime returns the number of nanoseconds that elapsed since the clock was
+// initialized. Nanotime returns 0 if Init has not been invoked yet.
+//
+//go:nosplit
+func Nanotime() int64 {
+	if activeSource == nil {
+		return 0
+	}
+
+	return int64(baseNanos + ticksToNanos(activeSource.Ticks()-baseTicks, activeSource.Frequency()))
+}
+
+// Walltime returns the current wall clock time as the number of seconds and
+// nanoseconds elapsed since the Unix epoch.
+//
+//go:nosplit
+func Walltime() (int64, int32) {
+	now := bootWallNanos + Nanotime()
+	return now / int64(nanosPerSecond), int32(now % int64(nanosPerSecond))
+}
+
+// setSource switches the monotonic clock to the supplied clock source. The
+// clock value is preserved so the monotonic clock never goes backwards.
+func setSource(src Source) {
+	baseNanos = uint64(Nanotime())
+	baseTicks = src.Ticks()
+	activeSource = src
+}
+
+// ticksToNanos converts a tick count for a counter with the supplied frequency
+// into nanoseconds without overflowing for large tick counts.
+//
+//go:nosplit
+func ticksToNanos(ticks, freq uint64) uint64 {
+	return (ticks/freq)*nanosPerSecond + (ticks%freq)*nanosPerSecond/freq
+}
@@ -0,0 +1,148 @@
+package clock
+
+import (
+	"gopheros/kernel/cpu"
+	"testing"
+)
+
+// fakeSource is a clock source whose counter value is controlled by tests.
+type fakeSource struct {
+	ticks, freq uint64
+}
+
+func (*fakeSource) Name() string          { return "fake" }
+func (src *fakeSource) Ticks() uint64     { return src.ticks }
+func (src *fakeSource) Frequency() uint64 { return src.freq }
+
+func resetClock() {
+	activeSource = nil
+	baseTicks = 0
+	baseNanos = 0
+	bootWallNanos = 0
+	tsc = tscSource{}
+	pit = pitSource{}
+	hpet = hpetSource{}
+}
+
+func TestInit(t *testing.T) {
+	defer func() {
+		hasTSCFn = cpu.HasTSC
+		readTSCFn = cpu.ReadTSC
+		readRTCFn = readRTC
+		calibrateTSCFn = calibrateTSC
+		portWriteByteFn = cpu.PortWriteByte
+		portReadByteFn = cpu.PortReadByte
+		resetClock()
+	}()
+
+	readRTCFn = func() int64 { return 1500000000 }
+
+	t.Run("tsc", func(t *testing.T) {
+		resetClock()
+
+		var tscValue uint64 = 1000
+		hasTSCFn = func() bool { return true }
+		readTSCFn = func() uint64 { return tscValue }
+		calibrateTSCFn = func(_ busyWaitFn) uint64 { return 2000000000 }
+
+		if err := Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if activeSource != Source(&tsc) {
+			t.Fatalf("expected active source to be tsc; got %s", activeSource.Name())
+		}
+
+		tscValue += 3000000000
+		if exp, got := int64(1500000000), Nanotime(); got != exp {
+			t.Errorf("expected Nanotime to return %d; got %d", exp, got)
+		}
+
+		if sec, nsec := Walltime(); sec != 1500000001 || nsec != 500000000 {
+			t.Errorf("expected Walltime to return (1500000001, 500000000); got (%d, %d)", sec, nsec)
+		}
+	})
+
+	t.Run("tsc calibration fails", func(t *testing.T) {
+		resetClock()
+
+		hasTSCFn = func() bool { return true }
+		calibrateTSCFn = func(_ busyWaitFn) uint64 { return 0 }
+
+		if err := Init(); err != errNoClockSource {
+			t.Fatalf("expected to get errNoClockSource; got %v", err)
+		}
+	})
+
+	t.Run("pit", func(t *testing.T) {
+		resetClock()
+
+		var count uint16 = 0xffff
+		hasTSCFn = func() bool { return false }
+		portWriteByteFn = func(_ uint16, _ uint8) {}
+		portReadByteFn = mockPITCounter(&count)
+
+		if err := Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if activeSource != Source(&pit) {
+			t.Fatalf("expected active source to be pit; got %s", activeSource.Name())
+		}
+
+		count -= 1193
+		if exp, got := int64(999847), Nanotime(); got != exp {
+			t.Errorf("expected Nanotime to return %d; got %d", exp, got)
+		}
+	})
+}
+
+func TestNanotimeWithoutSource(t *testing.T) {
+	resetClock()
+	if got := Nanotime(); got != 0 {
+		t.Fatalf("expected Nanotime to return 0; got %d", got)
+	}
+}
+
+func TestSetSource(t *testing.T) {
+	defer resetClock()
+	resetClock()
+
+	src1 := &fakeSource{ticks: 100, freq: 1000}
+	setSource(src1)
+
+	src1.ticks += 500
+	if exp, got := int64(500000000), Nanotime(); got != exp {
+		t.Fatalf("expected Nanotime to return %d; got %d", exp, got)
+	}
+
+	// Switching sources must not affect the clock value
+	src2 := &fakeSource{ticks: 42, freq: 1000000}
+	setSource(src2)
+	if exp, got := int64(500000000), Nanotime(); got != exp {
+		t.Fatalf("expected Nanotime to return %d after switching sources; got %d", exp, got)
+	}
+
+	src2.ticks += 10
+	if exp, got := int64(500010000), Nanotime(); got != exp {
+		t.Fatalf("expected Nanotime to return %d; got %d", exp, got)
+	}
+}
+
+func TestTicksToNanos(t *testing.T) {
+	specs := []struct {
+		ticks, freq, exp uint64
+	}{
+		{0, 1000, 0},
+		{1, 3, 333333333},
+		{3000000000, 3000000000, 1000000000},
+		// Would overflow if the ticks were multiplied before dividing
+		{1 << 62, 3000000000, 1537228672809129301},
+	}
+
+	for specIndex, spec := range specs {
+		if got := ticksToNanos(spec.ticks, spec.freq); got != spec.exp {
+			t.Errorf("[spec %d] expected to get %d; got %d", specIndex, spec.exp, got)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package clock
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"gopheros/kernel/mem/vmm"
+	"unsafe"
+)
+
+const (
+	hpetRegCapabilities = 0x00
+	hpetRegConfig       = 0x10
+	hpetRegMainCounter  = 0xf0
+
+	// hpetCap64Bit is set in the capabilities register if the main
+	// counter is 64 bits wide.
+	hpetCap64Bit = 1 << 13
+
+	// hpetCfgEnable enables the main counter.
+	hpetCfgEnable = 1 << 0
+
+	// hpetMaxPeriodFemtos defines the maximum counter period (100ns)
+	// allowed by the HPET specification.
+	hpetMaxPeriodFemtos = 100000000
+
+	femtosPerSecond = uint64(1000000000000000)
+)
+
+// hpetSource is a clock source that reads the HPET main counter.
+type hpetSource struct {
+	regs uintptr
+	freq uint64
+}
+
+var (
+	hpet hpetSource
+
+	// mapRegionFn is used by tests and is automatically inlined by the compiler.
+	mapRegionFn = vmm.MapRegion
+
+	errInvalidHPET = &kernel.Error{Module: "clock", Message: "HPET reports an invalid counter period"}
+)
+
+// Name returns the name of the clock source.
+func (*hpetSource) Name() string {
+	return "hpet"
+}
+
+// Ticks returns the current value of the HPET main counter.
+//
+//go:nosplit
+func (src *hpetSource) Ticks() uint64 {
+	return src.reg(hpetRegMainCounter)
+}
+
+// Frequency returns the HPET counter frequency.
+//
+//go:nosplit
+func (src *hpetSource) Frequency() uint64 {
+	return src.freq
+}
+
+// reg returns the value of the HPET register at the supplied offset.
+//
+//go:nosplit
+func (src *hpetSource) reg(offset uintptr) uint64 {
+	return *(*uint64)(unsafe.Pointer(src.regs + offset))
+}
+
+// setReg updates the value of the HPET register at the supplied offset.
+func (src *hpetSource) setReg(offset uintptr, value uint64) {
+	*(*uint64)(unsafe.Pointer(src.regs + offset)) = value
+}
+
+// UseHPET enables the HPET whose registers are located at the supplied
+// physical address and uses it to improve the accuracy of the monotonic
+// clock. If the TSC drives the monotonic clock, its frequency is recalibrated
+// against the HPET. Otherwise, the HPET replaces the PIT as the clock source
+// if its main counter is 64 bits wide.
+func UseHPET(physAddr uintptr) *kernel.Error {
+	page, err := mapRegionFn(
+		pmm.Frame(physAddr>>mem.PageShift),
+		mem.PageSize,
+		vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute|vmm.FlagDoNotCache,
+	)
+	if err != nil {
+		return err
+	}
+
+	hpet.regs = page.Address() + vmm.PageOffset(physAddr)
+
+	caps := hpet.reg(hpetRegCapabilities)
+	periodFemtos := caps >> 32
+	if periodFemtos == 0 || periodFemtos > hpetMaxPeriodFemtos {
+		return errInvalidHPET
+	}
+
+	hpet.freq = femtosPerSecond / periodFemtos
+	hpet.setReg(hpetRegConfig, hpet.reg(hpetRegConfig)|hpetCfgEnable)
+
+	switch {
+	case activeSource == Source(&tsc):
+		recalibrateTSC(hpetBusyWait)
+		kfmt.Printf("[clock] recalibrated tsc clock source against hpet (%d Hz)\n", tsc.freq)
+	case caps&hpetCap64Bit != 0:
+		setSource(&hpet)
+		kfmt.Printf("[clock] using hpet clock source (%d Hz)\n", hpet.freq)
+	}
+
+	return nil
+}
+
+// hpetBusyWait spins for the requested number of nanoseconds using the HPET
+// main counter. Only the lower 32 bits of the counter are used so the wait
+// works with both 32-bit and 64-bit counters.
+func hpetBusyWait(nanos uint64) {
+	var (
+		ticks = uint32(hpet.freq * nanos / nanosPerSecond)
+		start = uint32(hpet.Ticks())
+	)
+
+	for uint32(hpet.Ticks())-start < ticks {
+	}
+}
@@ -0,0 +1,119 @@
+package clock
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"gopheros/kernel/mem/vmm"
+	"testing"
+	"unsafe"
+)
+
+func TestUseHPET(t *testing.T) {
+	defer func() {
+		mapRegionFn = vmm.MapRegion
+		calibrateTSCFn = calibrateTSC
+		resetClock()
+	}()
+
+	var (
+		// fakeRegs emulates the HPET register block
+		fakeRegs [32]uint64
+		physAddr = uintptr(0xfed00000)
+	)
+
+	mapRegionFn = func(frame pmm.Frame, size mem.Size, flags vmm.PageTableEntryFlag) (vmm.Page, *kernel.Error) {
+		if exp := pmm.Frame(physAddr >> mem.PageShift); frame != exp {
+			t.Errorf("expected frame %d to be mapped; got %d", exp, frame)
+		}
+
+		if flags&vmm.FlagDoNotCache == 0 {
+			t.Error("expected HPET registers to be mapped as uncacheable")
+		}
+
+		return vmm.PageFromAddress(uintptr(unsafe.Pointer(&fakeRegs[0]))), nil
+	}
+
+	regsOffset := vmm.PageOffset(uintptr(unsafe.Pointer(&fakeRegs[0])))
+	physAddr += regsOffset
+
+	t.Run("recalibrate tsc", func(t *testing.T) {
+		resetClock()
+		fakeRegs = [32]uint64{}
+		fakeRegs[hpetRegCapabilities/8] = 69841279 << 32
+
+		tsc.freq = 1000
+		setSource(&tsc)
+		calibrateTSCFn = func(busyWait busyWaitFn) uint64 { return 3000000000 }
+
+		if err := UseHPET(physAddr); err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := uint64(14318179); hpet.freq != exp {
+			t.Errorf("expected HPET frequency to be %d; got %d", exp, hpet.freq)
+		}
+
+		if fakeRegs[hpetRegConfig/8]&hpetCfgEnable == 0 {
+			t.Error("expected HPET counter to be enabled")
+		}
+
+		if activeSource != Source(&tsc) || tsc.freq != 3000000000 {
+			t.Errorf("expected TSC to remain the active source with a recalibrated frequency; got %s (%d Hz)", activeSource.Name(), tsc.freq)
+		}
+	})
+
+	t.Run("replace pit", func(t *testing.T) {
+		resetClock()
+		fakeRegs = [32]uint64{}
+		fakeRegs[hpetRegCapabilities/8] = 100000000<<32 | hpetCap64Bit
+
+		setSource(&fakeSource{freq: 1000})
+		if err := UseHPET(physAddr); err != nil {
+			t.Fatal(err)
+		}
+
+		if activeSource != Source(&hpet) {
+			t.Fatalf("expected active source to be hpet; got %s", activeSource.Name())
+		}
+
+		fakeRegs[hpetRegMainCounter/8] = 10000000
+		if exp, got := int64(1000000000), Nanotime(); got != exp {
+			t.Errorf("expected Nanotime to return %d; got %d", exp, got)
+		}
+	})
+
+	t.Run("32-bit counter", func(t *testing.T) {
+		resetClock()
+		fakeRegs = [32]uint64{}
+		fakeRegs[hpetRegCapabilities/8] = 100000000 << 32
+
+		src := &fakeSource{freq: 1000}
+		setSource(src)
+		if err := UseHPET(physAddr); err != nil {
+			t.Fatal(err)
+		}
+
+		if activeSource != Source(src) {
+			t.Fatal("expected active source not to be changed")
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, period := range []uint64{0, hpetMaxPeriodFemtos + 1} {
+			fakeRegs[hpetRegCapabilities/8] = period << 32
+			if err := UseHPET(physAddr); err != errInvalidHPET {
+				t.Errorf("expected to get errInvalidHPET; got %v", err)
+			}
+		}
+
+		expErr := &kernel.Error{Module: "test", Message: "map failed"}
+		mapRegionFn = func(_ pmm.Frame, _ mem.Size, _ vmm.PageTableEntryFlag) (vmm.Page, *kernel.Error) {
+			return 0, expErr
+		}
+
+		if err := UseHPET(physAddr); err != expErr {
+			t.Errorf("expected to get error %v; got %v", expErr, err)
+		}
+	})
+}
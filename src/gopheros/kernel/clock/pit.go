@@ -0,0 +1,114 @@
+package clock
+
+import "gopheros/kernel/cpu"
+
+const (
+	// pitFrequency is the frequency of the oscillator that drives the
+	// PIT counters.
+	pitFrequency = uint64(1193182)
+
+	pitChannel0Port = 0x40
+	pitChannel2Port = 0x42
+	pitCommandPort  = 0x43
+
+	// pitGatePort controls the gate input of PIT channel 2 (bit 0) and
+	// the PC speaker (bit 1). Bit 5 reflects the output of channel 2.
+	pitGatePort    = 0x61
+	pitGateEnable  = 1 << 0
+	pitSpeakerData = 1 << 1
+	pitOut2        = 1 << 5
+
+	// pitCmdChannel0Rate selects channel 0, lobyte/hibyte access and the
+	// rate generator mode.
+	pitCmdChannel0Rate = 0x34
+
+	// pitCmdChannel0Latch latches the current value of channel 0.
+	pitCmdChannel0Latch = 0x00
+
+	// pitCmdChannel2OneShot selects channel 2, lobyte/hibyte access and
+	// the interrupt on terminal count mode.
+	pitCmdChannel2OneShot = 0xb0
+)
+
+// pitSource is a clock source that reads the PIT channel 0 counter.
+//
+// Channel 0 counts down from 65536 and wraps roughly every 55ms. The source
+// accumulates the elapsed ticks each time it is read so the monotonic clock
+// remains accurate as long as it is read at least once per counter period.
+type pitSource struct {
+	lastCount uint16
+	ticks     uint64
+}
+
+var (
+	pit pitSource
+
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	portWriteByteFn = cpu.PortWriteByte
+	portReadByteFn  = cpu.PortReadByte
+)
+
+// Name returns the name of the clock source.
+func (*pitSource) Name() string {
+	return "pit"
+}
+
+// Ticks returns the number of PIT ticks that elapsed since the counter was
+// initialized.
+//
+//go:nosplit
+func (src *pitSource) Ticks() uint64 {
+	count := readPITCounter()
+	src.ticks += uint64(src.lastCount - count)
+	src.lastCount = count
+	return src.ticks
+}
+
+// Frequency returns the PIT frequency.
+//
+//go:nosplit
+func (*pitSource) Frequency() uint64 {
+	return pitFrequency
+}
+
+// initPITCounter programs PIT channel 0 as a free-running counter with the
+// maximum period.
+func initPITCounter() {
+	portWriteByteFn(pitCommandPort, pitCmdChannel0Rate)
+	portWriteByteFn(pitChannel0Port, 0)
+	portWriteByteFn(pitChannel0Port, 0)
+
+	pit.ticks = 0
+	pit.lastCount = readPITCounter()
+}
+
+// readPITCounter latches and returns the current value of PIT channel 0.
+//
+//go:nosplit
+func readPITCounter() uint16 {
+	portWriteByteFn(pitCommandPort, pitCmdChannel0Latch)
+	lo := portReadByteFn(pitChannel0Port)
+	hi := portReadByteFn(pitChannel0Port)
+	return uint16(hi)<<8 | uint16(lo)
+}
+
+// pitBusyWait spins for the requested number of nanoseconds using PIT
+// channel 2 in one-shot mode. The maximum supported wait period is ~54ms.
+func pitBusyWait(nanos uint64) {
+	count := pitFrequency * nanos / nanosPerSecond
+	if count > 0xffff {
+		count = 0xffff
+	}
+
+	// Enable the channel 2 gate and keep the PC speaker off
+	portWriteByteFn(pitGatePort, (portReadByteFn(pitGatePort)&^pitSpeakerData)|pitGateEnable)
+
+	// Writing the count starts the countdown
+	portWriteByteFn(pitCommandPort, pitCmdChannel2OneShot)
+	portWriteByteFn(pitChannel2Port, uint8(count))
+	portWriteByteFn(pitChannel2Port, uint8(count>>8))
+
+	for portReadByteFn(pitGatePort)&pitOut2 == 0 {
+	}
+}
@@ -0,0 +1,116 @@
+package clock
+
+import (
+	"gopheros/kernel/cpu"
+	"testing"
+)
+
+// mockPITCounter returns a port read function that reports the supplied
+// channel 0 counter value.
+func mockPITCounter(count *uint16) func(uint16) uint8 {
+	var readHi bool
+	return func(port uint16) uint8 {
+		if port != pitChannel0Port {
+			return 0
+		}
+
+		readHi = !readHi
+		if readHi {
+			return uint8(*count)
+		}
+		return uint8(*count >> 8)
+	}
+}
+
+func TestPITSource(t *testing.T) {
+	defer func() {
+		portWriteByteFn = cpu.PortWriteByte
+		portReadByteFn = cpu.PortReadByte
+		resetClock()
+	}()
+
+	var (
+		count  uint16 = 100
+		writes []uint8
+	)
+
+	portWriteByteFn = func(port uint16, val uint8) {
+		if port == pitCommandPort {
+			writes = append(writes, val)
+		}
+	}
+	portReadByteFn = mockPITCounter(&count)
+
+	initPITCounter()
+	if writes[0] != pitCmdChannel0Rate {
+		t.Fatalf("expected channel 0 to be programmed in rate generator mode; got command %x", writes[0])
+	}
+
+	if got := pit.Ticks(); got != 0 {
+		t.Fatalf("expected initial tick count to be 0; got %d", got)
+	}
+
+	// The counter wraps around
+	count = 0xfff0
+	if exp, got := uint64(100+0x10), pit.Ticks(); got != exp {
+		t.Fatalf("expected tick count to be %d; got %d", exp, got)
+	}
+
+	if pit.Frequency() != pitFrequency || pit.Name() != "pit" {
+		t.Fatal("unexpected PIT source name or frequency")
+	}
+}
+
+func TestPITBusyWait(t *testing.T) {
+	defer func() {
+		portWriteByteFn = cpu.PortWriteByte
+		portReadByteFn = cpu.PortReadByte
+	}()
+
+	specs := []struct {
+		nanos    uint64
+		expCount uint16
+	}{
+		{10000000, 11931},
+		{100000000, 0xffff},
+	}
+
+	for specIndex, spec := range specs {
+		var (
+			gate      uint8 = pitSpeakerData
+			count     []uint8
+			gatePolls int
+		)
+
+		portWriteByteFn = func(port uint16, val uint8) {
+			switch port {
+			case pitGatePort:
+				gate = val
+			case pitChannel2Port:
+				count = append(count, val)
+			}
+		}
+		portReadByteFn = func(port uint16) uint8 {
+			if port != pitGatePort {
+				return 0
+			}
+
+			// Report that the countdown completed after a few polls
+			gatePolls++
+			if gatePolls > 3 {
+				return gate | pitOut2
+			}
+			return gate
+		}
+
+		pitBusyWait(spec.nanos)
+
+		if gate != pitGateEnable {
+			t.Errorf("[spec %d] expected gate to be enabled and the speaker to be disabled; got %x", specIndex, gate)
+		}
+
+		if got := uint16(count[1])<<8 | uint16(count[0]); got != spec.expCount {
+			t.Errorf("[spec %d] expected PIT count to be %d; got %d", specIndex, spec.expCount, got)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package clock
+
+const (
+	cmosIndexPort = 0x70
+	cmosDataPort  = 0x71
+
+	// cmosNMIDisable is ORed with the register index to keep NMIs
+	// disabled while accessing the CMOS.
+	cmosNMIDisable = 0x80
+
+	rtcRegSeconds = 0x00
+	rtcRegMinutes = 0x02
+	rtcRegHours   = 0x04
+	rtcRegDay     = 0x07
+	rtcRegMonth   = 0x08
+	rtcRegYear    = 0x09
+	rtcRegCentury = 0x32
+	rtcRegStatusA = 0x0a
+	rtcRegStatusB = 0x0b
+
+	// rtcUpdateInProgress is set in status register A while the RTC
+	// updates its registers.
+	rtcUpdateInProgress = 1 << 7
+
+	// rtcFormat24Hour and rtcFormatBinary are set in status register B if
+	// the RTC reports hours in 24-hour format and values in binary rather
+	// than BCD.
+	rtcFormat24Hour = 1 << 1
+	rtcFormatBinary = 1 << 2
+
+	// rtcHourPM is set in the hours register for PM times when the RTC
+	// uses the 12-hour format.
+	rtcHourPM = 1 << 7
+
+	secondsPerDay = 86400
+)
+
+// rtcTime contains the raw date and time registers of the RTC.
+type rtcTime struct {
+	second, minute, hour uint8
+	day, month, year     uint8
+	century              uint8
+}
+
+// readRTC returns the time reported by the CMOS real-time clock as the number
+// of seconds since the Unix epoch. The RTC is assumed to be set to UTC.
+func readRTC() int64 {
+	// The registers are read repeatedly until two consecutive reads
+	// return the same values to ensure that an RTC update did not occur
+	// while reading them.
+	cur := readRTCRegisters()
+	for {
+		prev := cur
+		if cur = readRTCRegisters(); cur == prev {
+			break
+		}
+	}
+
+	return rtcToUnix(cur, readCMOS(rtcRegStatusB))
+}
+
+// readRTCRegisters waits for any in-progress RTC update to complete and
+// returns the contents of the RTC date and time registers.
+func readRTCRegisters() rtcTime {
+	for readCMOS(rtcRegStatusA)&rtcUpdateInProgress != 0 {
+	}
+
+	return rtcTime{
+		second:  readCMOS(rtcRegSeconds),
+		minute:  readCMOS(rtcRegMinutes),
+		hour:    readCMOS(rtcRegHours),
+		day:     readCMOS(rtcRegDay),
+		month:   readCMOS(rtcRegMonth),
+		year:    readCMOS(rtcRegYear),
+		century: readCMOS(rtcRegCentury),
+	}
+}
+
+// readCMOS returns the value of a CMOS register.
+func readCMOS(reg uint8) uint8 {
+	portWriteByteFn(cmosIndexPort, cmosNMIDisable|reg)
+	return portReadByteFn(cmosDataPort)
+}
+
+// rtcToUnix converts the raw RTC registers into the number of seconds since
+// the Unix epoch using the value of status register B to decode them.
+func rtcToUnix(t rtcTime, statusB uint8) int64 {
+	pm := t.hour&rtcHourPM != 0
+	t.hour &^= rtcHourPM
+
+	if statusB&rtcFormatBinary == 0 {
+		t.second = bcdToBinary(t.second)
+		t.minute = bcdToBinary(t.minute)
+		t.hour = bcdToBinary(t.hour)
+		t.day = bcdToBinary(t.day)
+		t.month = bcdToBinary(t.month)
+		t.year = bcdToBinary(t.year)
+		t.century = bcdToBinary(t.century)
+	}
+
+	// In 12-hour mode, midnight and noon are both reported as 12
+	if statusB&rtcFormat24Hour == 0 {
+		t.hour %= 12
+		if pm {
+			t.hour += 12
+		}
+	}
+
+	// The century register is not available on all systems
+	year := int64(t.century)*100 + int64(t.year)
+	if t.century < 19 || t.century > 99 {
+		year = 2000 + int64(t.year)
+		if t.year >= 70 {
+			year -= 100
+		}
+	}
+
+	return daysFromCivil(year, int64(t.month), int64(t.day))*secondsPerDay +
+		int64(t.hour)*3600 + int64(t.minute)*60 + int64(t.second)
+}
+
+// bcdToBinary converts a BCD-encoded value to binary.
+func bcdToBinary(v uint8) uint8 {
+	return (v>>4)*10 + v&0xf
+}
+
+// daysFromCivil returns the number of days between the Unix epoch and the
+// supplied date in the proleptic Gregorian calendar.
+func daysFromCivil(year, month, day int64) int64 {
+	if month <= 2 {
+		year--
+	}
+
+	era := year / 400
+	if year < 0 && year%400 != 0 {
+		era--
+	}
+
+	yearOfEra := year - era*400
+	monthIndex := month + 9
+	if month > 2 {
+		monthIndex = month - 3
+	}
+	dayOfYear := (153*monthIndex+2)/5 + day - 1
+	dayOfEra := yearOfEra*365 + yearOfEra/4 - yearOfEra/100 + dayOfYear
+
+	return era*146097 + dayOfEra - 719468
+}
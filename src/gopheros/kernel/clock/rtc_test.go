@@ -0,0 +1,123 @@
+package clock
+
+import (
+	"gopheros/kernel/cpu"
+	"testing"
+)
+
+func TestReadRTC(t *testing.T) {
+	defer func() {
+		portWriteByteFn = cpu.PortWriteByte
+		portReadByteFn = cpu.PortReadByte
+	}()
+
+	var (
+		cmos        [128]uint8
+		selectedReg uint8
+		updatePolls int
+	)
+
+	// 2017-07-14 02:40:00 UTC (BCD, 24-hour format)
+	cmos[rtcRegSeconds] = 0x00
+	cmos[rtcRegMinutes] = 0x40
+	cmos[rtcRegHours] = 0x02
+	cmos[rtcRegDay] = 0x14
+	cmos[rtcRegMonth] = 0x07
+	cmos[rtcRegYear] = 0x17
+	cmos[rtcRegCentury] = 0x20
+	cmos[rtcRegStatusB] = rtcFormat24Hour
+
+	portWriteByteFn = func(port uint16, val uint8) {
+		if port != cmosIndexPort {
+			t.Fatalf("unexpected write to port %x", port)
+		}
+
+		if val&cmosNMIDisable == 0 {
+			t.Error("expected NMIs to remain disabled while accessing the CMOS")
+		}
+		selectedReg = val &^ cmosNMIDisable
+	}
+	portReadByteFn = func(port uint16) uint8 {
+		// Report an update in progress for the first couple of polls
+		if selectedReg == rtcRegStatusA {
+			updatePolls++
+			if updatePolls < 3 {
+				return rtcUpdateInProgress
+			}
+			return 0
+		}
+
+		return cmos[selectedReg]
+	}
+
+	if exp, got := int64(1500000000), readRTC(); got != exp {
+		t.Fatalf("expected readRTC to return %d; got %d", exp, got)
+	}
+}
+
+func TestRTCToUnix(t *testing.T) {
+	specs := []struct {
+		descr   string
+		t       rtcTime
+		statusB uint8
+		exp     int64
+	}{
+		{
+			"binary, 24-hour",
+			rtcTime{second: 0, minute: 40, hour: 2, day: 14, month: 7, year: 17, century: 20},
+			rtcFormatBinary | rtcFormat24Hour,
+			1500000000,
+		},
+		{
+			"BCD, 12-hour PM",
+			rtcTime{second: 0x59, minute: 0x59, hour: 0x11 | rtcHourPM, day: 0x31, month: 0x12, year: 0x99, century: 0x19},
+			0,
+			946684799,
+		},
+		{
+			"BCD, 12-hour midnight",
+			rtcTime{second: 0, minute: 0, hour: 0x12, day: 0x01, month: 0x01, year: 0x70, century: 0x19},
+			0,
+			0,
+		},
+		{
+			"missing century register",
+			rtcTime{second: 0, minute: 0, hour: 0, day: 1, month: 3, year: 0, century: 0xff},
+			rtcFormatBinary | rtcFormat24Hour,
+			951868800,
+		},
+		{
+			"missing century register (20th century)",
+			rtcTime{second: 0, minute: 0, hour: 0, day: 2, month: 1, year: 70},
+			rtcFormatBinary | rtcFormat24Hour,
+			86400,
+		},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			if got := rtcToUnix(spec.t, spec.statusB); got != spec.exp {
+				t.Errorf("expected to get %d; got %d", spec.exp, got)
+			}
+		})
+	}
+}
+
+func TestDaysFromCivil(t *testing.T) {
+	specs := []struct {
+		year, month, day int64
+		exp              int64
+	}{
+		{1970, 1, 1, 0},
+		{1969, 12, 31, -1},
+		{2000, 2, 29, 11016},
+		{2000, 3, 1, 11017},
+		{2100, 3, 1, 47541},
+	}
+
+	for specIndex, spec := range specs {
+		if got := daysFromCivil(spec.year, spec.month, spec.day); got != spec.exp {
+			t.Errorf("[spec %d] expected to get %d; got %d", specIndex, spec.exp, got)
+		}
+	}
+}
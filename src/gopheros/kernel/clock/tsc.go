@@ -0,0 +1,77 @@
+package clock
+
+const (
+	// calibrationPeriodNanos defines the duration of each TSC calibration
+	// round.
+	calibrationPeriodNanos = uint64(10000000)
+
+	// calibrationRounds defines the number of TSC calibration rounds. The
+	// round with the shortest TSC delta is used for calculating the TSC
+	// frequency as the other rounds may have been delayed by SMIs.
+	calibrationRounds = 3
+)
+
+// busyWaitFn spins for the requested number of nanoseconds using a reference
+// timer.
+type busyWaitFn func(nanos uint64)
+
+// tscSource is a clock source that reads the CPU time-stamp counter.
+type tscSource struct {
+	freq uint64
+}
+
+var tsc tscSource
+
+// Name returns the name of the clock source.
+func (*tscSource) Name() string {
+	return "tsc"
+}
+
+// Ticks returns the current value of the time-stamp counter.
+//
+//go:nosplit
+func (*tscSource) Ticks() uint64 {
+	return readTSCFn()
+}
+
+// Frequency returns the calibrated frequency of the time-stamp counter.
+//
+//go:nosplit
+func (src *tscSource) Frequency() uint64 {
+	return src.freq
+}
+
+// calibrateTSC measures the TSC frequency using the supplied busy-wait
+// function which is backed by a reference timer.
+func calibrateTSC(busyWait busyWaitFn) uint64 {
+	minDelta := ^uint64(0)
+	for round := 0; round < calibrationRounds; round++ {
+		start := readTSCFn()
+		busyWait(calibrationPeriodNanos)
+		if delta := readTSCFn() - start; delta < minDelta {
+			minDelta = delta
+		}
+	}
+
+	return minDelta * (nanosPerSecond / calibrationPeriodNanos)
+}
+
+// recalibrateTSC refines the TSC frequency using the supplied busy-wait
+// function. The monotonic clock value is preserved if the TSC is the active
+// clock source.
+func recalibrateTSC(busyWait busyWaitFn) {
+	freq := calibrateTSCFn(busyWait)
+	if freq == 0 {
+		return
+	}
+
+	if activeSource != Source(&tsc) {
+		tsc.freq = freq
+		return
+	}
+
+	// Rebase the clock using the previous frequency before switching
+	// to the new one.
+	setSource(&tsc)
+	tsc.freq = freq
+}
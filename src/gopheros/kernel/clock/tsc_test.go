@@ -0,0 +1,80 @@
+package clock
+
+import (
+	"gopheros/kernel/cpu"
+	"testing"
+)
+
+func TestCalibrateTSC(t *testing.T) {
+	defer func() {
+		readTSCFn = cpu.ReadTSC
+	}()
+
+	var (
+		tscValue uint64
+		round    int
+		deltas   = []uint64{30000000, 20000000, 25000000}
+	)
+
+	readTSCFn = func() uint64 { return tscValue }
+	busyWait := func(nanos uint64) {
+		if nanos != calibrationPeriodNanos {
+			t.Errorf("expected busy-wait period to be %d; got %d", calibrationPeriodNanos, nanos)
+		}
+		tscValue += deltas[round]
+		round++
+	}
+
+	// The shortest round should be used
+	if exp, got := uint64(2000000000), calibrateTSC(busyWait); got != exp {
+		t.Fatalf("expected calibrated frequency to be %d; got %d", exp, got)
+	}
+}
+
+func TestRecalibrateTSC(t *testing.T) {
+	defer func() {
+		readTSCFn = cpu.ReadTSC
+		calibrateTSCFn = calibrateTSC
+		resetClock()
+	}()
+
+	var tscValue uint64
+	readTSCFn = func() uint64 { return tscValue }
+
+	t.Run("tsc not active", func(t *testing.T) {
+		resetClock()
+		calibrateTSCFn = func(_ busyWaitFn) uint64 { return 42 }
+		recalibrateTSC(nil)
+		if tsc.freq != 42 || activeSource != nil {
+			t.Fatal("expected TSC frequency to be updated without activating the TSC")
+		}
+	})
+
+	t.Run("tsc active", func(t *testing.T) {
+		resetClock()
+		tsc.freq = 1000
+		setSource(&tsc)
+
+		tscValue += 1000
+		calibrateTSCFn = func(_ busyWaitFn) uint64 { return 2000 }
+		recalibrateTSC(nil)
+
+		if exp, got := int64(1000000000), Nanotime(); got != exp {
+			t.Fatalf("expected Nanotime to return %d after recalibration; got %d", exp, got)
+		}
+
+		tscValue += 1000
+		if exp, got := int64(1500000000), Nanotime(); got != exp {
+			t.Fatalf("expected Nanotime to return %d; got %d", exp, got)
+		}
+	})
+
+	t.Run("calibration fails", func(t *testing.T) {
+		tsc.freq = 1000
+		calibrateTSCFn = func(_ busyWaitFn) uint64 { return 0 }
+		recalibrateTSC(nil)
+		if tsc.freq != 1000 {
+			t.Fatal("expected TSC frequency to remain unchanged")
+		}
+	})
+}
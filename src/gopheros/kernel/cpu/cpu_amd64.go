@@ -1,5 +1,29 @@
 package cpu
 
+const (
+	// CR4UMIP prevents user-mode code from executing the SGDT, SIDT,
+	// SLDT, SMSW and STR instructions.
+	CR4UMIP = uint64(1 << 11)
+
+	// CR4PGE enables support for global pages.
+	CR4PGE = uint64(1 << 7)
+
+	// CR4PCIDE enables support for process-context identifiers.
+	CR4PCIDE = uint64(1 << 17)
+
+	// CR4SMEP prevents the kernel from executing code in user-accessible
+	// pages.
+	CR4SMEP = uint64(1 << 20)
+
+	// CR4SMAP prevents the kernel from accessing user-accessible pages
+	// unless access is explicitly enabled via Stac.
+	CR4SMAP = uint64(1 << 21)
+
+	// CR3NoFlush can be combined with the value passed to SwitchPDT to
+	// preserve the TLB entries tagged with the selected PCID.
+	CR3NoFlush = uintptr(1 << 63)
+)
+
 var (
 	cpuidFn = ID
 )
@@ -16,21 +40,61 @@ func Halt()
 // FlushTLBEntry flushes a TLB entry for a particular virtual address.
 func FlushTLBEntry(virtAddr uintptr)
 
+// FlushTLB flushes all non-global TLB entries for the active PCID.
+func FlushTLB()
+
+// FlushTLBGlobal flushes all TLB entries including global entries and
+// entries tagged with any PCID.
+func FlushTLBGlobal()
+
 // SwitchPDT sets the root page table directory to point to the specified
-// physical address and flushes the TLB.
+// physical address and flushes the TLB. If PCIDs are enabled, the lower 12
+// bits of the supplied value select the PCID to be used and the TLB flush can
+// be skipped by setting the CR3NoFlush bit.
 func SwitchPDT(pdtPhysAddr uintptr)
 
 // ActivePDT returns the physical address of the currently active page table.
+// The PCID bits of the CR3 register are not included in the returned value.
 func ActivePDT() uintptr
 
 // ReadCR2 returns the value stored in the CR2 register.
 func ReadCR2() uint64
 
+// ReadCR4 returns the value stored in the CR4 register.
+func ReadCR4() uint64
+
+// WriteCR4 stores the supplied value to the CR4 register.
+func WriteCR4(value uint64)
+
+// Stac sets the AC flag in RFLAGS allowing the kernel to access
+// user-accessible pages while SMAP is enabled. Stac must only be used if the
+// CPU supports SMAP.
+func Stac()
+
+// Clac clears the AC flag in RFLAGS. Clac must only be used if the CPU
+// supports SMAP.
+func Clac()
+
 // ID returns information about the CPU and its features. It
-// is implemented as a CPUID instruction with EAX=leaf and
+// is implemented as a CPUID instruction with EAX=leaf and ECX=0 and
 // returns the values in EAX, EBX, ECX and EDX.
 func ID(leaf uint32) (uint32, uint32, uint32, uint32)
 
+// ReadRDRAND returns a random value generated by the RDRAND instruction. The
+// second return value is false if the hardware random number generator could
+// not provide a value. Callers must ensure that RDRAND is supported via a call
+// to HasRDRAND before invoking this function.
+func ReadRDRAND() (uint64, bool)
+
+// ReadRDSEED returns a random seed value generated by the RDSEED instruction.
+// The second return value is false if the hardware entropy source could not
+// provide a value. Callers must ensure that RDSEED is supported via a call to
+// HasRDSEED before invoking this function.
+func ReadRDSEED() (uint64, bool)
+
+// ReadTSC returns the value of the time-stamp counter.
+func ReadTSC() uint64
+
 // IsIntel returns true if the code is running on an Intel processor.
 func IsIntel() bool {
 	_, ebx, ecx, edx := cpuidFn(0)
@@ -39,6 +103,83 @@ func IsIntel() bool {
 		ecx == 0x6c65746e // "ntel"
 }
 
+// HasGigabytePages returns true if the CPU supports mapping 1G pages.
+func HasGigabytePages() bool {
+	if maxLeaf, _, _, _ := cpuidFn(0x80000000); maxLeaf < 0x80000001 {
+		return false
+	}
+
+	_, _, _, edx := cpuidFn(0x80000001)
+	return edx&(1<<26) != 0
+}
+
+// HasTSC returns true if the CPU supports the RDTSC instruction.
+func HasTSC() bool {
+	_, _, _, edx := cpuidFn(1)
+	return edx&(1<<4) != 0
+}
+
+// HasRDRAND returns true if the CPU supports the RDRAND instruction.
+func HasRDRAND() bool {
+	_, _, ecx, _ := cpuidFn(1)
+	return ecx&(1<<30) != 0
+}
+
+// HasRDSEED returns true if the CPU supports the RDSEED instruction.
+func HasRDSEED() bool {
+	ebx, _ := structuredFeatures()
+	return ebx&(1<<18) != 0
+}
+
+// HasERMS returns true if the CPU supports enhanced REP MOVSB/STOSB
+// operations.
+func HasERMS() bool {
+	ebx, _ := structuredFeatures()
+	return ebx&(1<<9) != 0
+}
+
+// HasPGE returns true if the CPU supports global pages.
+func HasPGE() bool {
+	_, _, _, edx := cpuidFn(1)
+	return edx&(1<<13) != 0
+}
+
+// HasPCID returns true if the CPU supports process-context identifiers.
+func HasPCID() bool {
+	_, _, ecx, _ := cpuidFn(1)
+	return ecx&(1<<17) != 0
+}
+
+// HasSMEP returns true if the CPU supports supervisor-mode execution
+// prevention.
+func HasSMEP() bool {
+	ebx, _ := structuredFeatures()
+	return ebx&(1<<7) != 0
+}
+
+// HasSMAP returns true if the CPU supports supervisor-mode access prevention.
+func HasSMAP() bool {
+	ebx, _ := structuredFeatures()
+	return ebx&(1<<20) != 0
+}
+
+// HasUMIP returns true if the CPU supports user-mode instruction prevention.
+func HasUMIP() bool {
+	_, ecx := structuredFeatures()
+	return ecx&(1<<2) != 0
+}
+
+// structuredFeatures returns the EBX and ECX feature flags reported by CPUID
+// leaf 7. If the leaf is not supported by the CPU, no features are reported.
+func structuredFeatures() (uint32, uint32) {
+	if maxLeaf, _, _, _ := cpuidFn(0); maxLeaf < 7 {
+		return 0, 0
+	}
+
+	_, ebx, ecx, _ := cpuidFn(7)
+	return ebx, ecx
+}
+
 // PortWriteByte writes a uint8 value to the requested port.
 func PortWriteByte(port uint16, val uint8)
 
@@ -26,21 +26,77 @@ TEXT ·SwitchPDT(SB),NOSPLIT,$0
 
 TEXT ·ActivePDT(SB),NOSPLIT,$0
 	MOVQ CR3, AX
+	ANDQ $~0xfff, AX // mask PCID bits
 	MOVQ AX, ret+0(FP)
 	RET
 
+TEXT ·FlushTLB(SB),NOSPLIT,$0
+	// reloading CR3 flushes the non-global entries for the active PCID
+	MOVQ CR3, AX
+	MOVQ AX, CR3
+	RET
+
+TEXT ·FlushTLBGlobal(SB),NOSPLIT,$0
+	// toggling CR4.PGE flushes all TLB entries
+	MOVQ CR4, AX
+	MOVQ AX, BX
+	XORQ $0x80, BX
+	MOVQ BX, CR4
+	MOVQ AX, CR4
+	RET
+
 TEXT ·ReadCR2(SB),NOSPLIT,$0
 	MOVQ CR2, AX
 	MOVQ AX, ret+0(FP)
 	RET
 
+TEXT ·ReadCR4(SB),NOSPLIT,$0
+	MOVQ CR4, AX
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·WriteCR4(SB),NOSPLIT,$0
+	MOVQ value+0(FP), AX
+	MOVQ AX, CR4
+	RET
+
+TEXT ·Stac(SB),NOSPLIT,$0
+	BYTE $0x0f; BYTE $0x01; BYTE $0xcb // stac
+	RET
+
+TEXT ·Clac(SB),NOSPLIT,$0
+	BYTE $0x0f; BYTE $0x01; BYTE $0xca // clac
+	RET
+
+TEXT ·ReadRDRAND(SB),NOSPLIT,$0
+	BYTE $0x48; BYTE $0x0f; BYTE $0xc7; BYTE $0xf0 // rdrand rax
+	SETCS BX // CF is set if a random value was available
+	MOVQ AX, ret+0(FP)
+	MOVB BX, ret1+8(FP)
+	RET
+
+TEXT ·ReadRDSEED(SB),NOSPLIT,$0
+	BYTE $0x48; BYTE $0x0f; BYTE $0xc7; BYTE $0xf8 // rdseed rax
+	SETCS BX // CF is set if a random value was available
+	MOVQ AX, ret+0(FP)
+	MOVB BX, ret1+8(FP)
+	RET
+
+TEXT ·ReadTSC(SB),NOSPLIT,$0
+	RDTSC
+	SHLQ $32, DX
+	ORQ DX, AX
+	MOVQ AX, ret+0(FP)
+	RET
+
 TEXT ·ID(SB),NOSPLIT,$0
-	MOVQ leaf+0(FP), AX
+	MOVL leaf+0(FP), AX
+	XORQ CX, CX
 	CPUID
-	MOVL AX, ret+0(FP)
-	MOVL BX, ret+4(FP)
-	MOVL CX, ret+8(FP)
-	MOVL DX, ret+12(FP)
+	MOVL AX, ret+8(FP)
+	MOVL BX, ret1+12(FP)
+	MOVL CX, ret2+16(FP)
+	MOVL DX, ret3+20(FP)
 	RET
 
 TEXT ·PortWriteByte(SB),NOSPLIT,$0
@@ -58,25 +114,39 @@ TEXT ·PortWriteWord(SB),NOSPLIT,$0
 
 TEXT ·PortWriteDword(SB),NOSPLIT,$0
 	MOVW port+0(FP), DX
-	MOVL val+2(FP), AX
+	MOVL val+4(FP), AX
 	BYTE $0xef  // out eax, dx
 	RET
 
 TEXT ·PortReadByte(SB),NOSPLIT,$0
 	MOVW port+0(FP), DX
 	BYTE $0xec  // in al, dx
-	MOVB AX, ret+0(FP)
+	MOVB AX, ret+8(FP)
 	RET
 
 TEXT ·PortReadWord(SB),NOSPLIT,$0
 	MOVW port+0(FP), DX
 	BYTE $0x66  
 	BYTE $0xed  // in ax, dx
-	MOVW AX, ret+0(FP)
+	MOVW AX, ret+8(FP)
 	RET
 
 TEXT ·PortReadDword(SB),NOSPLIT,$0
 	MOVW port+0(FP), DX
 	BYTE $0xed  // in eax, dx
-	MOVL AX, ret+0(FP)
+	MOVL AX, ret+8(FP)
+	RET
+
+TEXT ·loadGDT(SB),NOSPLIT,$16-10
+	// Build the 10-byte GDT descriptor (limit followed by base) on the stack
+	MOVW limit+8(FP), AX
+	MOVW AX, 0(SP)
+	MOVQ base+0(FP), AX
+	MOVQ AX, 2(SP)
+	LGDT 0(SP)
+	RET
+
+TEXT ·loadTR(SB),NOSPLIT,$0
+	MOVW selector+0(FP), AX
+	LTR AX
 	RET
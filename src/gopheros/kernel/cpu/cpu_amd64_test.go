@@ -1,6 +1,48 @@
 package cpu
 
-import "testing"
+import (
+	"bufio"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestID(t *testing.T) {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		t.Skip("unable to read host CPU vendor; skipping test")
+	}
+	defer f.Close()
+
+	var expVendor string
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		if line := scanner.Text(); strings.HasPrefix(line, "vendor_id") {
+			expVendor = strings.TrimSpace(line[strings.Index(line, ":")+1:])
+			break
+		}
+	}
+
+	if expVendor == "" {
+		t.Skip("unable to read host CPU vendor; skipping test")
+	}
+
+	// The vendor string is returned by leaf 0 in EBX, EDX and ECX
+	maxLeaf, ebx, ecx, edx := ID(0)
+	if maxLeaf == 0 {
+		t.Fatal("expected leaf 0 to report a non-zero max supported leaf")
+	}
+
+	var vendor [12]byte
+	for i, reg := range []uint32{ebx, edx, ecx} {
+		for j := uint(0); j < 4; j++ {
+			vendor[i*4+int(j)] = byte(reg >> (8 * j))
+		}
+	}
+
+	if got := string(vendor[:]); got != expVendor {
+		t.Fatalf("expected CPU vendor to be %q; got %q", expVendor, got)
+	}
+}
 
 func TestIsIntel(t *testing.T) {
 	defer func() {
@@ -27,3 +69,89 @@ func TestIsIntel(t *testing.T) {
 		}
 	}
 }
+
+func TestHasGigabytePages(t *testing.T) {
+	defer func() {
+		cpuidFn = ID
+	}()
+
+	specs := []struct {
+		maxExtLeaf uint32
+		extEdx     uint32
+		exp        bool
+	}{
+		// extended leaf 0x80000001 not supported
+		{0x80000000, 1 << 26, false},
+		// 1G pages not supported
+		{0x80000008, 0, false},
+		// 1G pages supported
+		{0x80000008, 1 << 26, true},
+	}
+
+	for specIndex, spec := range specs {
+		cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+			if leaf == 0x80000000 {
+				return spec.maxExtLeaf, 0, 0, 0
+			}
+			return 0, 0, 0, spec.extEdx
+		}
+
+		if got := HasGigabytePages(); got != spec.exp {
+			t.Errorf("[spec %d] expected HasGigabytePages to return %t; got %t", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestFeatureDetection(t *testing.T) {
+	defer func() {
+		cpuidFn = ID
+	}()
+
+	specs := []struct {
+		descr     string
+		detectFn  func() bool
+		leaf      uint32
+		ebx, ecx  uint32
+		edx       uint32
+		maxLeaf   uint32
+		expResult bool
+	}{
+		{"TSC supported", HasTSC, 1, 0, 0, 1 << 4, 0xd, true},
+		{"TSC not supported", HasTSC, 1, 0, 0, 0, 0xd, false},
+		{"RDRAND supported", HasRDRAND, 1, 0, 1 << 30, 0, 0xd, true},
+		{"RDRAND not supported", HasRDRAND, 1, 0, 0, 0, 0xd, false},
+		{"RDSEED supported", HasRDSEED, 7, 1 << 18, 0, 0, 0xd, true},
+		{"RDSEED not supported", HasRDSEED, 7, 0, 0, 0, 0xd, false},
+		{"ERMS supported", HasERMS, 7, 1 << 9, 0, 0, 0xd, true},
+		{"ERMS not supported", HasERMS, 7, 0, 0, 0, 0xd, false},
+		{"PGE supported", HasPGE, 1, 0, 0, 1 << 13, 0xd, true},
+		{"PGE not supported", HasPGE, 1, 0, 0, 0, 0xd, false},
+		{"PCID supported", HasPCID, 1, 0, 1 << 17, 0, 0xd, true},
+		{"PCID not supported", HasPCID, 1, 0, 0, 0, 0xd, false},
+		{"SMEP supported", HasSMEP, 7, 1 << 7, 0, 0, 0xd, true},
+		{"SMEP not supported", HasSMEP, 7, 0, 0, 0, 0xd, false},
+		{"SMAP supported", HasSMAP, 7, 1 << 20, 0, 0, 0xd, true},
+		{"SMAP not supported", HasSMAP, 7, 0, 0, 0, 0xd, false},
+		{"UMIP supported", HasUMIP, 7, 0, 1 << 2, 0, 0xd, true},
+		{"UMIP not supported", HasUMIP, 7, 0, 0, 0, 0xd, false},
+		{"leaf 7 not supported", HasSMEP, 7, 1 << 7, 0, 0, 0x6, false},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+				switch leaf {
+				case 0:
+					return spec.maxLeaf, 0, 0, 0
+				case spec.leaf:
+					return 0, spec.ebx, spec.ecx, spec.edx
+				}
+				return 0, 0, 0, 0
+			}
+
+			if got := spec.detectFn(); got != spec.expResult {
+				t.Errorf("expected feature detection to return %t; got %t", spec.expResult, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package cpu
+
+import "unsafe"
+
+const (
+	// DoubleFaultIST is the index of the interrupt stack table entry that
+	// is reserved for the double-fault handler.
+	DoubleFaultIST = 1
+
+	// maxIST is the number of interrupt stack table entries supported by
+	// the 64-bit TSS.
+	maxIST = 7
+
+	// tssSelector is the GDT selector for the TSS descriptor.
+	tssSelector = 0x18
+
+	// tssSize is the size of the 64-bit TSS in bytes.
+	tssSize = 104
+
+	// tssISTWord is the index of the uint32 word in the TSS where the
+	// first interrupt stack table entry is stored.
+	tssISTWord = 9
+
+	// tssIOMapWord is the index of the uint32 word in the TSS whose upper
+	// 16 bits contain the offset to the I/O permission bitmap.
+	tssIOMapWord = 25
+)
+
+var (
+	// gdt is the global descriptor table loaded by LoadTSS. The code and
+	// data segment descriptors match the ones set up by the rt0 code so
+	// the segment registers do not need to be reloaded. The last two
+	// entries hold the 16-byte TSS descriptor.
+	gdt = [5]uint64{
+		0,
+		0x00209a0000000000, // 64-bit ring 0 code segment
+		0x0000920000000000, // ring 0 data segment
+	}
+
+	// tss holds the contents of the 64-bit task state segment. As the
+	// fields of the TSS are not naturally aligned, its contents are
+	// stored as an array of 32-bit words.
+	tss [tssSize / 4]uint32
+
+	loadGDTFn = loadGDT
+	loadTRFn  = loadTR
+)
+
+// SetInterruptStack sets the stack top address for the interrupt stack table
+// entry with the specified index. Valid indices are in the range [1, 7]; any
+// other value is ignored. The CPU switches to the specified stack when
+// invoking an interrupt handler whose IDT entry references the same IST
+// index.
+func SetInterruptStack(index uint8, stackTop uintptr) {
+	if index == 0 || index > maxIST {
+		return
+	}
+
+	word := tssISTWord + 2*(int(index)-1)
+	tss[word] = uint32(stackTop)
+	tss[word+1] = uint32(stackTop >> 32)
+}
+
+// LoadTSS installs a GDT that contains a descriptor for the kernel's task
+// state segment and loads the task register with it. It must be called after
+// any interrupt stacks have been set up via SetInterruptStack.
+func LoadTSS() {
+	var (
+		base  = uint64(uintptr(unsafe.Pointer(&tss[0])))
+		limit = uint64(tssSize - 1)
+	)
+
+	// Point the I/O bitmap past the end of the TSS as it is not used
+	tss[tssIOMapWord] = tssSize << 16
+
+	// Available 64-bit TSS descriptor (type 0x9) that is present
+	gdt[3] = limit&0xffff | (base&0xffffff)<<16 | 0x89<<40 | (limit>>16&0xf)<<48 | (base>>24&0xff)<<56
+	gdt[4] = base >> 32
+
+	loadGDTFn(uintptr(unsafe.Pointer(&gdt[0])), uint16(len(gdt)*8-1))
+	loadTRFn(tssSelector)
+}
+
+// loadGDT loads the GDT register with the specified table address and limit.
+func loadGDT(base uintptr, limit uint16)
+
+// loadTR loads the task register with the specified GDT selector.
+func loadTR(selector uint16)
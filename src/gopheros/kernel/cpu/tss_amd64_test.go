@@ -0,0 +1,91 @@
+package cpu
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestSetInterruptStack(t *testing.T) {
+	defer func() {
+		tss = [tssSize / 4]uint32{}
+	}()
+
+	specs := []struct {
+		index    uint8
+		stackTop uintptr
+		expWord  int
+	}{
+		{1, 0xffffc00000004000, tssISTWord},
+		{7, 0xffffc00000008000, tssISTWord + 12},
+	}
+
+	for specIndex, spec := range specs {
+		SetInterruptStack(spec.index, spec.stackTop)
+
+		if got := uintptr(tss[spec.expWord]) | uintptr(tss[spec.expWord+1])<<32; got != spec.stackTop {
+			t.Errorf("[spec %d] expected IST entry %d to be %x; got %x", specIndex, spec.index, spec.stackTop, got)
+		}
+	}
+
+	// Invalid indices should be ignored
+	tss = [tssSize / 4]uint32{}
+	SetInterruptStack(0, 0xbadf00d)
+	SetInterruptStack(maxIST+1, 0xbadf00d)
+	for wordIndex, word := range tss {
+		if word != 0 {
+			t.Errorf("expected TSS word %d to be 0; got %x", wordIndex, word)
+		}
+	}
+}
+
+func TestLoadTSS(t *testing.T) {
+	defer func() {
+		loadGDTFn = loadGDT
+		loadTRFn = loadTR
+	}()
+
+	var (
+		gdtBase     uintptr
+		gdtLimit    uint16
+		trSelector  uint16
+		expTSSBase  = uint64(uintptr(unsafe.Pointer(&tss[0])))
+		expGDTBase  = uintptr(unsafe.Pointer(&gdt[0]))
+		expGDTLimit = uint16(5*8 - 1)
+	)
+
+	loadGDTFn = func(base uintptr, limit uint16) { gdtBase, gdtLimit = base, limit }
+	loadTRFn = func(selector uint16) { trSelector = selector }
+
+	LoadTSS()
+
+	if gdtBase != expGDTBase || gdtLimit != expGDTLimit {
+		t.Errorf("expected GDT to be loaded with (%x, %d); got (%x, %d)", expGDTBase, expGDTLimit, gdtBase, gdtLimit)
+	}
+
+	if trSelector != tssSelector {
+		t.Errorf("expected task register to be loaded with selector %x; got %x", tssSelector, trSelector)
+	}
+
+	// Decode the TSS descriptor
+	var (
+		limit  = gdt[3]&0xffff | (gdt[3]>>48&0xf)<<16
+		base   = gdt[3]>>16&0xffffff | (gdt[3]>>56&0xff)<<24 | gdt[4]<<32
+		access = gdt[3] >> 40 & 0xff
+	)
+
+	if exp := uint64(tssSize - 1); limit != exp {
+		t.Errorf("expected TSS descriptor limit to be %d; got %d", exp, limit)
+	}
+
+	if base != expTSSBase {
+		t.Errorf("expected TSS descriptor base to be %x; got %x", expTSSBase, base)
+	}
+
+	if exp := uint64(0x89); access != exp {
+		t.Errorf("expected TSS descriptor type/attribute byte to be %x; got %x", exp, access)
+	}
+
+	if exp, got := uint32(tssSize), tss[tssIOMapWord]>>16; got != exp {
+		t.Errorf("expected I/O map base to be %d; got %d", exp, got)
+	}
+}
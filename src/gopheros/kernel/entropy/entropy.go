@@ -0,0 +1,202 @@
+// Package entropy implements the kernel entropy pool. The pool is seeded from
+// the CPU hardware random number generators (if available) and the jitter of
+// the time-stamp counter while interrupt timings are mixed into it as the
+// kernel runs. The pool can be used before the Go runtime is initialized as
+// it does not perform any heap allocations.
+package entropy
+
+import (
+	"gopheros/kernel/cpu"
+)
+
+const (
+	// hwRandomRetries defines the number of attempts for obtaining a value
+	// from a hardware random number generator before giving up.
+	hwRandomRetries = 10
+
+	// hwSeedWords defines the number of words requested from each
+	// hardware random number generator when the pool gets seeded.
+	hwSeedWords = 4
+
+	// jitterSamples defines the number of TSC jitter samples that are
+	// mixed into the pool when it gets seeded.
+	jitterSamples = 64
+)
+
+// pool holds the entropy pool state. The state is mixed using SipHash rounds
+// while output words are generated by applying the SipHash finalization
+// rounds to a copy of the state combined with a counter.
+type pool struct {
+	v       [4]uint64
+	counter uint64
+}
+
+var (
+	state  pool
+	seeded bool
+
+	// rdrandSupported is set to true when the pool gets seeded if the CPU
+	// supports RDRAND. In that case, a RDRAND value is mixed into the pool
+	// each time it is read.
+	rdrandSupported bool
+
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	hasRDSEEDFn  = cpu.HasRDSEED
+	hasRDRANDFn  = cpu.HasRDRAND
+	readRDSEEDFn = cpu.ReadRDSEED
+	readRDRANDFn = cpu.ReadRDRAND
+	readTSCFn    = cpu.ReadTSC
+)
+
+// Read fills p with random bytes obtained from the entropy pool. The pool is
+// automatically seeded the first time it is accessed. Read always fills the
+// entire slice and returns len(p) and a nil error.
+func Read(p []byte) (int, error) {
+	ensureSeeded()
+	reseedFromRDRAND()
+
+	for offset := 0; offset < len(p); offset += 8 {
+		word := state.next()
+		for index := offset; index < offset+8 && index < len(p); index, word = index+1, word>>8 {
+			p[index] = byte(word)
+		}
+	}
+
+	// Mix the output back into the pool so that a future compromise of
+	// the pool state does not reveal previously generated values.
+	state.mix(state.next())
+
+	return len(p), nil
+}
+
+// Uint64 returns a random 64-bit value obtained from the entropy pool.
+func Uint64() uint64 {
+	ensureSeeded()
+	reseedFromRDRAND()
+
+	value := state.next()
+	state.mix(state.next())
+	return value
+}
+
+// AddInterruptTiming mixes the arrival time of an interrupt into the entropy
+// pool. It is meant to be invoked by the interrupt dispatch code.
+//
+//go:nosplit
+func AddInterruptTiming(vector uint8) {
+	state.mix(readTSCFn() ^ uint64(vector)<<56)
+}
+
+// ensureSeeded seeds the entropy pool unless it has already been seeded.
+func ensureSeeded() {
+	if seeded {
+		return
+	}
+
+	// Initialize the state using the SipHash initialization constants
+	state.v = [4]uint64{0x736f6d6570736575, 0x646f72616e646f6d, 0x6c7967656e657261, 0x7465646279746573}
+
+	if hasRDSEEDFn() {
+		mixHWRandom(readRDSEEDFn)
+	}
+
+	if rdrandSupported = hasRDRANDFn(); rdrandSupported {
+		mixHWRandom(readRDRANDFn)
+	}
+
+	// The number of cycles required for mixing values into the pool
+	// varies due to cache effects, interrupts and SMIs.
+	for sample := 0; sample < jitterSamples; sample++ {
+		start := readTSCFn()
+		state.mix(start)
+		state.mix(readTSCFn() - start)
+	}
+
+	seeded = true
+}
+
+// mixHWRandom mixes hwSeedWords values obtained via readFn into the pool.
+func mixHWRandom(readFn func() (uint64, bool)) {
+	for word := 0; word < hwSeedWords; word++ {
+		if value, ok := readHWRandom(readFn); ok {
+			state.mix(value)
+		}
+	}
+}
+
+// reseedFromRDRAND mixes a RDRAND value into the pool if RDRAND is supported.
+func reseedFromRDRAND() {
+	if !rdrandSupported {
+		return
+	}
+
+	if value, ok := readHWRandom(readRDRANDFn); ok {
+		state.mix(value)
+	}
+}
+
+// readHWRandom invokes readFn until it returns a random value or the maximum
+// number of retries is reached.
+func readHWRandom(readFn func() (uint64, bool)) (uint64, bool) {
+	for attempt := 0; attempt < hwRandomRetries; attempt++ {
+		if value, ok := readFn(); ok {
+			return value, true
+		}
+	}
+
+	return 0, false
+}
+
+// mix combines value with the pool state.
+//
+//go:nosplit
+func (p *pool) mix(value uint64) {
+	p.v[3] ^= value
+	p.round()
+	p.round()
+	p.v[0] ^= value
+}
+
+// next generates an output word from the pool state.
+func (p *pool) next() uint64 {
+	p.counter++
+
+	out := *p
+	out.v[3] ^= p.counter
+	out.round()
+	out.round()
+	out.v[0] ^= p.counter
+	out.v[2] ^= 0xff
+	out.round()
+	out.round()
+	out.round()
+	out.round()
+
+	// Advance the pool state so each output word depends on all
+	// previously generated words.
+	p.v[1] ^= out.v[0]
+	p.round()
+
+	return out.v[0] ^ out.v[1] ^ out.v[2] ^ out.v[3]
+}
+
+// round applies a SipHash round to the pool state.
+//
+//go:nosplit
+func (p *pool) round() {
+	p.v[0] += p.v[1]
+	p.v[1] = p.v[1]<<13 | p.v[1]>>51
+	p.v[1] ^= p.v[0]
+	p.v[0] = p.v[0]<<32 | p.v[0]>>32
+	p.v[2] += p.v[3]
+	p.v[3] = p.v[3]<<16 | p.v[3]>>48
+	p.v[3] ^= p.v[2]
+	p.v[0] += p.v[3]
+	p.v[3] = p.v[3]<<21 | p.v[3]>>43
+	p.v[3] ^= p.v[0]
+	p.v[2] += p.v[1]
+	p.v[1] = p.v[1]<<17 | p.v[1]>>47
+	p.v[1] ^= p.v[2]
+	p.v[2] = p.v[2]<<32 | p.v[2]>>32
+}
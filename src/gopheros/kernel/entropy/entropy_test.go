@@ -0,0 +1,150 @@
+package entropy
+
+import (
+	"bytes"
+	"gopheros/kernel/cpu"
+	"testing"
+)
+
+func resetPool() {
+	state = pool{}
+	seeded = false
+	rdrandSupported = false
+}
+
+func mockHWRandom(hasRDSEED, hasRDRAND bool, tsc uint64) {
+	hasRDSEEDFn = func() bool { return hasRDSEED }
+	hasRDRANDFn = func() bool { return hasRDRAND }
+	readRDSEEDFn = func() (uint64, bool) { return 0x1234, true }
+	readRDRANDFn = func() (uint64, bool) { return 0x5678, true }
+	readTSCFn = func() uint64 { tsc += 17; return tsc }
+}
+
+func restoreHWRandom() {
+	hasRDSEEDFn = cpu.HasRDSEED
+	hasRDRANDFn = cpu.HasRDRAND
+	readRDSEEDFn = cpu.ReadRDSEED
+	readRDRANDFn = cpu.ReadRDRAND
+	readTSCFn = cpu.ReadTSC
+	resetPool()
+}
+
+func TestRead(t *testing.T) {
+	defer restoreHWRandom()
+	resetPool()
+	mockHWRandom(true, true, 0)
+
+	for _, size := range []int{0, 1, 7, 8, 9, 64} {
+		buf := make([]byte, size)
+		if n, err := Read(buf); err != nil || n != size {
+			t.Fatalf("expected Read to return (%d, nil); got (%d, %v)", size, n, err)
+		}
+	}
+
+	if !seeded {
+		t.Fatal("expected pool to be seeded")
+	}
+
+	var buf1, buf2 [32]byte
+	Read(buf1[:])
+	Read(buf2[:])
+
+	if bytes.Equal(buf1[:], buf2[:]) {
+		t.Fatal("expected consecutive reads to return different values")
+	}
+
+	if bytes.Equal(buf1[:], make([]byte, len(buf1))) {
+		t.Fatal("expected Read to populate the buffer")
+	}
+}
+
+func TestUint64(t *testing.T) {
+	defer restoreHWRandom()
+	resetPool()
+	mockHWRandom(false, false, 0)
+
+	seen := make(map[uint64]bool)
+	for i := 0; i < 1000; i++ {
+		seen[Uint64()] = true
+	}
+
+	if len(seen) != 1000 {
+		t.Fatalf("expected Uint64 to return 1000 distinct values; got %d", len(seen))
+	}
+}
+
+func TestSeedSources(t *testing.T) {
+	defer restoreHWRandom()
+
+	specs := []struct {
+		hasRDSEED, hasRDRAND bool
+		tsc                  uint64
+	}{
+		{false, false, 0},
+		{false, false, 1},
+		{true, false, 0},
+		{false, true, 0},
+		{true, true, 0},
+	}
+
+	// Each combination of entropy sources should result in a different
+	// pool state
+	seen := make(map[uint64]bool)
+	for specIndex, spec := range specs {
+		resetPool()
+		mockHWRandom(spec.hasRDSEED, spec.hasRDRAND, spec.tsc)
+
+		value := Uint64()
+		if seen[value] {
+			t.Errorf("[spec %d] expected a different output for each set of entropy sources", specIndex)
+		}
+		seen[value] = true
+
+		if rdrandSupported != spec.hasRDRAND {
+			t.Errorf("[spec %d] expected rdrandSupported to be %t", specIndex, spec.hasRDRAND)
+		}
+	}
+}
+
+func TestAddInterruptTiming(t *testing.T) {
+	defer restoreHWRandom()
+	resetPool()
+	mockHWRandom(false, false, 0)
+
+	ensureSeeded()
+	before := state
+	AddInterruptTiming(32)
+
+	if state == before {
+		t.Fatal("expected interrupt timing to be mixed into the pool")
+	}
+}
+
+func TestReadHWRandom(t *testing.T) {
+	specs := []struct {
+		failures  int
+		expOK     bool
+		expReads  int
+		expResult uint64
+	}{
+		{0, true, 1, 42},
+		{3, true, 4, 42},
+		{hwRandomRetries, false, hwRandomRetries, 0},
+	}
+
+	for specIndex, spec := range specs {
+		var reads int
+		readFn := func() (uint64, bool) {
+			reads++
+			if reads <= spec.failures {
+				return 0, false
+			}
+			return 42, true
+		}
+
+		value, ok := readHWRandom(readFn)
+		if ok != spec.expOK || value != spec.expResult || reads != spec.expReads {
+			t.Errorf("[spec %d] expected (%d, %t) after %d reads; got (%d, %t) after %d reads", specIndex, spec.expResult, spec.expOK, spec.expReads, value, ok, reads)
+		}
+	}
+}
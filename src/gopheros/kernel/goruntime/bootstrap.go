@@ -4,15 +4,18 @@ package goruntime
 
 import (
 	"gopheros/kernel"
+	"gopheros/kernel/entropy"
 	"gopheros/kernel/mem"
 	"gopheros/kernel/mem/pmm/allocator"
 	"gopheros/kernel/mem/vmm"
+	"time"
 	"unsafe"
 )
 
 var (
 	mapFn                = vmm.Map
 	earlyReserveRegionFn = vmm.EarlyReserveRegion
+	reserveHeapRegionFn  = vmm.ReserveHeapRegion
 	memsetFn             = mem.Memset
 	frameAllocFn         = allocator.AllocFrame
 	mallocInitFn         = mallocInit
@@ -22,9 +25,7 @@ var (
 	itabsInitFn          = itabsInit
 	initGoPackagesFn     = initGoPackages
 	procResizeFn         = procResize
-
-	// A seed for the pseudo-random number generator used by getRandomData
-	prngSeed = 0xdeadc0de
+	readEntropyFn        = entropy.Read
 )
 
 //go:linkname algInit runtime.alginit
@@ -66,7 +67,8 @@ func runtimeInit() {
 }
 
 // sysReserve reserves address space without allocating any memory or
-// establishing any page mappings.
+// establishing any page mappings. The address space is reserved below the
+// heap arena end address of the (possibly randomized) kernel layout.
 //
 // This function replaces runtime.sysReserve and is required for initializing
 // the Go allocator.
@@ -75,7 +77,7 @@ func runtimeInit() {
 //go:nosplit
 func sysReserve(_ unsafe.Pointer, size uintptr, reserved *bool) unsafe.Pointer {
 	regionSize := (mem.Size(size) + mem.PageSize - 1) & ^(mem.PageSize - 1)
-	regionStartAddr, err := earlyReserveRegionFn(regionSize)
+	regionStartAddr, err := reserveHeapRegionFn(regionSize)
 	if err != nil {
 		panic(err)
 	}
@@ -148,32 +150,17 @@ func sysAlloc(size uintptr, sysStat *uint64) unsafe.Pointer {
 	return unsafe.Pointer(regionStartAddr)
 }
 
-// nanotime returns a monotonically increasing clock value. This is a dummy
-// implementation and will be replaced when the timekeeper package is
-// implemented.
+// getRandomData populates the given slice with random data. The
+// implementation in the runtime package reads a random stream from
+// /dev/urandom but since this is not available, the data is obtained from the
+// kernel entropy pool instead.
 //
-// This function replaces runtime.nanotime and is invoked by the Go allocator
-// when a span allocation is performed.
-//
-//go:redirect-from runtime.nanotime
-//go:nosplit
-func nanotime() uint64 {
-	// Use a dummy loop to prevent the compiler from inlining this function.
-	for i := 0; i < 100; i++ {
-	}
-	return 1
-}
-
-// getRandomData populates the given slice with random data. The implementation
-// is the runtime package reads a random stream from /dev/random but since this
-// is not available, we use a prng instead.
+// The Go runtime uses this function for seeding the hash functions used by
+// maps and the fastrand generator.
 //
 //go:redirect-from runtime.getRandomData
 func getRandomData(r []byte) {
-	for i := 0; i < len(r); i++ {
-		prngSeed = (prngSeed * 58321) + 11113
-		r[i] = byte((prngSeed >> 16) & 255)
-	}
+	readEntropyFn(r)
 }
 
 // Init enables support for various Go runtime features. After a call to init
@@ -181,12 +168,17 @@ func getRandomData(r []byte) {
 //  - heap memory allocation (new, make e.t.c)
 //  - map primitives
 //  - interfaces
+//  - explicit garbage collection via GC
+//  - goroutines, channels and sync primitives (once Start is invoked)
 func Init() *kernel.Error {
+	schedInitFn()     // registers the running thread as the boot thread
+	setClockFn(nanotimeFn)
 	mallocInitFn()
 	algInitFn()       // setup hash implementation for map keys
 	modulesInitFn()   // provides activeModules
 	typeLinksInitFn() // uses maps, activeModules
 	itabsInitFn()     // uses activeModules
+	gcInitFn()        // uses activeModules; sets up the GC state
 
 	// Set processor count to 1. This initializes the p pointer in the
 	// currently active m allowing the kernel to register defer functions
@@ -209,12 +201,29 @@ func init() {
 		reserved bool
 		stat     uint64
 		zeroPtr  = unsafe.Pointer(uintptr(0))
+		zeroVal  uint32
 	)
 
 	runtimeInit()
 	sysReserve(zeroPtr, 0, &reserved)
 	sysMap(zeroPtr, 0, reserved, &stat)
 	sysAlloc(0, &stat)
+	sysFree(zeroPtr, 0, &stat)
+	sysUnused(zeroPtr, 0)
+	sysUsed(zeroPtr, 0)
 	getRandomData(nil)
-	stat = nanotime()
+	newosproc(zeroPtr, zeroPtr)
+	futexsleep(&zeroVal, 1, 0)
+	futexwakeup(&zeroVal, 0)
+	usleep(0)
+	osyield()
+	minit()
+	initsig(false)
+	stat = uint64(nanotime())
+	sec, _ := walltime()
+	stat = uint64(sec)
+
+	// Ensure that time.now is linked into the kernel image so it can be
+	// redirected to walltime.
+	stat = uint64(time.Now().Unix())
 }
@@ -6,6 +6,7 @@ import (
 	"gopheros/kernel/mem/pmm"
 	"gopheros/kernel/mem/pmm/allocator"
 	"gopheros/kernel/mem/vmm"
+	"gopheros/kernel/sched"
 	"reflect"
 	"testing"
 	"unsafe"
@@ -13,7 +14,7 @@ import (
 
 func TestSysReserve(t *testing.T) {
 	defer func() {
-		earlyReserveRegionFn = vmm.EarlyReserveRegion
+		reserveHeapRegionFn = vmm.ReserveHeapRegion
 	}()
 	var reserved bool
 
@@ -29,7 +30,7 @@ func TestSysReserve(t *testing.T) {
 		}
 
 		for specIndex, spec := range specs {
-			earlyReserveRegionFn = func(rsvSize mem.Size) (uintptr, *kernel.Error) {
+			reserveHeapRegionFn = func(rsvSize mem.Size) (uintptr, *kernel.Error) {
 				if rsvSize != spec.expRegionSize {
 					t.Errorf("[spec %d] expected reservation size to be %d; got %d", specIndex, spec.expRegionSize, rsvSize)
 				}
@@ -52,7 +53,7 @@ func TestSysReserve(t *testing.T) {
 			}
 		}()
 
-		earlyReserveRegionFn = func(rsvSize mem.Size) (uintptr, *kernel.Error) {
+		reserveHeapRegionFn = func(rsvSize mem.Size) (uintptr, *kernel.Error) {
 			return 0, &kernel.Error{Module: "test", Message: "consumed available address space"}
 		}
 
@@ -261,20 +262,26 @@ func TestGetRandomData(t *testing.T) {
 
 func TestInit(t *testing.T) {
 	defer func() {
+		schedInitFn = sched.Init
+		setClockFn = sched.SetClock
 		mallocInitFn = mallocInit
 		algInitFn = algInit
 		modulesInitFn = modulesInit
 		typeLinksInitFn = typeLinksInit
 		itabsInitFn = itabsInit
+		gcInitFn = gcInit
 		initGoPackagesFn = initGoPackages
 		procResizeFn = procResize
 	}()
 
+	schedInitFn = func() {}
+	setClockFn = func(_ func() int64) {}
 	mallocInitFn = func() {}
 	algInitFn = func() {}
 	modulesInitFn = func() {}
 	typeLinksInitFn = func() {}
 	itabsInitFn = func() {}
+	gcInitFn = func() {}
 	initGoPackagesFn = func() {}
 	procResizeFn = func(_ int32) uintptr { return 0 }
 	if err := Init(); err != nil {
@@ -0,0 +1,148 @@
+package goruntime
+
+import (
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"gopheros/kernel/mem/vmm"
+	"runtime"
+	"unsafe"
+)
+
+// HeapStats describes the state of the Go heap.
+type HeapStats struct {
+	// Alloc is the number of bytes used by allocated heap objects.
+	Alloc uint64
+
+	// Sys is the number of bytes of virtual memory obtained by the Go
+	// runtime for the heap.
+	Sys uint64
+
+	// Idle is the number of bytes in heap spans that contain no objects.
+	Idle uint64
+
+	// Released is the number of idle bytes whose physical frames have
+	// been returned to the physical frame allocator via sysUnused.
+	Released uint64
+
+	// Objects is the number of allocated heap objects.
+	Objects uint64
+
+	// NumGC is the number of completed GC cycles.
+	NumGC uint32
+}
+
+var (
+	gcInitFn       = gcInit
+	gcFn           = runtime.GC
+	readMemStatsFn = runtime.ReadMemStats
+	translateFn    = vmm.Translate
+	unmapAndFreeFn = vmm.UnmapAndFree
+	releaseFn      = vmm.ReleaseRegion
+
+	// memStats is populated by ReadHeapStats. It is defined as a global
+	// variable as runtime.MemStats is too large to be allocated on the
+	// kernel stack.
+	memStats runtime.MemStats
+)
+
+//go:linkname gcInit runtime.gcinit
+func gcInit()
+
+//go:linkname mSysStatDec runtime.mSysStatDec
+func mSysStatDec(*uint64, uintptr)
+
+// GC runs a garbage collection cycle and blocks until it completes.
+//
+// As the kernel does not run the background mark and sweep workers, the
+// runtime performs the collection with the world stopped using the single P
+// that is set up by Init. The runtime ignores collection requests while
+// running on the g0 stack so GC must be invoked from a goroutine.
+func GC() {
+	gcFn()
+}
+
+// ReadHeapStats returns the current Go heap statistics.
+func ReadHeapStats() HeapStats {
+	readMemStatsFn(&memStats)
+
+	return HeapStats{
+		Alloc:    memStats.HeapAlloc,
+		Sys:      memStats.HeapSys,
+		Idle:     memStats.HeapIdle,
+		Released: memStats.HeapReleased,
+		Objects:  memStats.HeapObjects,
+		NumGC:    memStats.NumGC,
+	}
+}
+
+// sysFree unmaps a memory region previously obtained via sysAlloc or
+// sysReserve, returns the backing physical frames to the frame allocator and
+// releases the virtual address range.
+//
+// This function replaces runtime.sysFree and is invoked by the Go allocator
+// when it no longer needs a memory region.
+//
+//go:redirect-from runtime.sysFree
+//go:nosplit
+func sysFree(virtAddr unsafe.Pointer, size uintptr, sysStat *uint64) {
+	regionStartAddr := uintptr(virtAddr) & ^uintptr(mem.PageSize-1)
+	regionSize := (mem.Size(size) + mem.PageSize - 1) & ^(mem.PageSize - 1)
+	if regionSize == 0 {
+		return
+	}
+
+	// Reserved regions may contain pages that were never mapped
+	pageCount := regionSize >> mem.PageShift
+	for page := vmm.PageFromAddress(regionStartAddr); pageCount > 0; pageCount, page = pageCount-1, page+1 {
+		if _, err := translateFn(page.Address()); err != nil {
+			continue
+		}
+
+		unmapAndFreeFn(page)
+	}
+
+	releaseFn(regionStartAddr, regionSize)
+	mSysStatDec(sysStat, uintptr(regionSize))
+}
+
+// sysUnused notifies the kernel that the contents of a memory region are no
+// longer needed. The physical frames backing the region are returned to the
+// frame allocator and the pages are replaced with copy-on-write mappings to
+// the reserved zeroed frame so that a new frame is allocated the next time the
+// page is written to.
+//
+// This function replaces runtime.sysUnused and is invoked by the Go allocator
+// when it scavenges idle heap spans.
+//
+//go:redirect-from runtime.sysUnused
+//go:nosplit
+func sysUnused(virtAddr unsafe.Pointer, size uintptr) {
+	regionStartAddr := (uintptr(virtAddr) + uintptr(mem.PageSize-1)) & ^uintptr(mem.PageSize-1)
+	regionEndAddr := (uintptr(virtAddr) + size) & ^uintptr(mem.PageSize-1)
+
+	mapFlags := vmm.FlagPresent | vmm.FlagNoExecute | vmm.FlagCopyOnWrite
+	for page := vmm.PageFromAddress(regionStartAddr); page.Address() < regionEndAddr; page++ {
+		physAddr, err := translateFn(page.Address())
+		if err != nil || pmm.Frame(physAddr>>mem.PageShift) == vmm.ReservedZeroedFrame {
+			continue
+		}
+
+		if err = unmapAndFreeFn(page); err != nil {
+			continue
+		}
+
+		mapFn(page, vmm.ReservedZeroedFrame, mapFlags)
+	}
+}
+
+// sysUsed notifies the kernel that the contents of a memory region passed to
+// sysUnused are needed again. As the pages of such regions are backed by
+// copy-on-write mappings, physical frames are allocated on demand by the page
+// fault handler and no further action is required.
+//
+// This function replaces runtime.sysUsed.
+//
+//go:redirect-from runtime.sysUsed
+//go:nosplit
+func sysUsed(_ unsafe.Pointer, _ uintptr) {
+}
@@ -0,0 +1,153 @@
+package goruntime
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"gopheros/kernel/mem/vmm"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+func TestGC(t *testing.T) {
+	defer func() {
+		gcFn = runtime.GC
+	}()
+
+	gcCallCount := 0
+	gcFn = func() { gcCallCount++ }
+
+	GC()
+	if gcCallCount != 1 {
+		t.Fatalf("expected runtime.GC to be called once; called %d", gcCallCount)
+	}
+}
+
+func TestReadHeapStats(t *testing.T) {
+	defer func() {
+		readMemStatsFn = runtime.ReadMemStats
+	}()
+
+	readMemStatsFn = func(stats *runtime.MemStats) {
+		stats.HeapAlloc = 1
+		stats.HeapSys = 2
+		stats.HeapIdle = 3
+		stats.HeapReleased = 4
+		stats.HeapObjects = 5
+		stats.NumGC = 6
+	}
+
+	exp := HeapStats{Alloc: 1, Sys: 2, Idle: 3, Released: 4, Objects: 5, NumGC: 6}
+	if got := ReadHeapStats(); got != exp {
+		t.Fatalf("expected to get heap stats %+v; got %+v", exp, got)
+	}
+}
+
+func TestSysFree(t *testing.T) {
+	defer func() {
+		translateFn = vmm.Translate
+		unmapAndFreeFn = vmm.UnmapAndFree
+		releaseFn = vmm.ReleaseRegion
+	}()
+
+	var (
+		regionAddr   = uintptr(10 * mem.PageSize)
+		sysStat      = uint64(3 * mem.PageSize)
+		freedPages   []vmm.Page
+		releasedSize mem.Size
+	)
+
+	// The second page of the region is not mapped
+	translateFn = func(virtAddr uintptr) (uintptr, *kernel.Error) {
+		if virtAddr == regionAddr+uintptr(mem.PageSize) {
+			return 0, vmm.ErrInvalidMapping
+		}
+		return virtAddr, nil
+	}
+	unmapAndFreeFn = func(page vmm.Page) *kernel.Error {
+		freedPages = append(freedPages, page)
+		return nil
+	}
+	releaseFn = func(addr uintptr, size mem.Size) *kernel.Error {
+		if addr != regionAddr {
+			t.Errorf("expected released region to start at %x; got %x", regionAddr, addr)
+		}
+		releasedSize = size
+		return nil
+	}
+
+	sysFree(unsafe.Pointer(regionAddr), uintptr(3*mem.PageSize-1), &sysStat)
+
+	if exp := 2; len(freedPages) != exp {
+		t.Fatalf("expected %d pages to be freed; got %d", exp, len(freedPages))
+	}
+
+	if exp := 3 * mem.PageSize; releasedSize != exp {
+		t.Fatalf("expected released region size to be %d; got %d", exp, releasedSize)
+	}
+
+	if sysStat != 0 {
+		t.Fatalf("expected sysStat to be decreased to 0; got %d", sysStat)
+	}
+
+	// Freeing an empty region should be a no-op
+	releasedSize = 0
+	sysFree(unsafe.Pointer(regionAddr), 0, &sysStat)
+	if releasedSize != 0 {
+		t.Fatal("expected empty region not to be released")
+	}
+}
+
+func TestSysUnused(t *testing.T) {
+	defer func() {
+		translateFn = vmm.Translate
+		unmapAndFreeFn = vmm.UnmapAndFree
+		mapFn = vmm.Map
+	}()
+
+	var (
+		regionAddr  = uintptr(10 * mem.PageSize)
+		freedPages  []vmm.Page
+		mappedPages []vmm.Page
+	)
+
+	translateFn = func(virtAddr uintptr) (uintptr, *kernel.Error) {
+		switch virtAddr {
+		case regionAddr:
+			// already backed by the reserved zeroed frame
+			return vmm.ReservedZeroedFrame.Address(), nil
+		case regionAddr + uintptr(mem.PageSize):
+			return 0, vmm.ErrInvalidMapping
+		}
+		return virtAddr, nil
+	}
+	unmapAndFreeFn = func(page vmm.Page) *kernel.Error {
+		freedPages = append(freedPages, page)
+		return nil
+	}
+	mapFn = func(page vmm.Page, frame pmm.Frame, flags vmm.PageTableEntryFlag) *kernel.Error {
+		if frame != vmm.ReservedZeroedFrame {
+			t.Errorf("expected page to be mapped to the reserved zeroed frame; got frame %d", frame)
+		}
+
+		if exp := vmm.FlagPresent | vmm.FlagNoExecute | vmm.FlagCopyOnWrite; flags != exp {
+			t.Errorf("expected map flags to be %d; got %d", exp, flags)
+		}
+
+		mappedPages = append(mappedPages, page)
+		return nil
+	}
+
+	// Only the pages fully covered by the region are released
+	sysUnused(unsafe.Pointer(regionAddr), uintptr(4*mem.PageSize-1))
+
+	expPages := []vmm.Page{vmm.PageFromAddress(regionAddr + 2*uintptr(mem.PageSize))}
+	if len(freedPages) != 1 || freedPages[0] != expPages[0] {
+		t.Fatalf("expected freed pages to be %v; got %v", expPages, freedPages)
+	}
+
+	if len(mappedPages) != 1 || mappedPages[0] != expPages[0] {
+		t.Fatalf("expected remapped pages to be %v; got %v", expPages, mappedPages)
+	}
+}
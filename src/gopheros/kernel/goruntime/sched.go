@@ -0,0 +1,120 @@
+package goruntime
+
+import (
+	"gopheros/kernel/sched"
+	"unsafe"
+)
+
+var (
+	schedInitFn = sched.Init
+	spawnFn     = sched.Spawn
+	waitFn      = sched.Wait
+	wakeFn      = sched.Wake
+	sleepFn     = sched.Sleep
+	yieldFn     = sched.Yield
+	mstartFn    = mstart
+)
+
+//go:linkname mstart runtime.mstart
+func mstart()
+
+// Start runs fn in a new goroutine and turns the calling thread into an M
+// that executes goroutines. Start never returns and must be invoked after
+// Init once the kernel is ready to schedule goroutines.
+func Start(fn func()) {
+	go fn()
+	mstartFn()
+}
+
+// mstartPC returns the address of runtime.mstart which serves as the entry
+// point for the kernel threads that back the Ms created by the Go runtime.
+func mstartPC() uintptr {
+	fn := mstart
+	return **(**uintptr)(unsafe.Pointer(&fn))
+}
+
+// newosproc spawns a kernel thread for the M pointed to by mp using the stack
+// whose top is located at stk. The thread starts executing runtime.mstart
+// with its g0 as the TLS g pointer.
+//
+// This function replaces runtime.newosproc and is invoked by the Go runtime
+// scheduler when it needs an additional M for running goroutines.
+//
+//go:redirect-from runtime.newosproc
+//go:nosplit
+func newosproc(mp, stk unsafe.Pointer) {
+	if mp == nil {
+		return
+	}
+
+	// The first field of runtime.m points to the g0 of the M.
+	g0 := *(*uintptr)(mp)
+	if err := spawnFn(mstartPC(), stk, g0); err != nil {
+		panic(err)
+	}
+}
+
+// futexsleep blocks the running kernel thread until addr is woken up via
+// futexwakeup or ns nanoseconds elapse. A negative ns value disables the
+// timeout. futexsleep returns immediately if *addr != val.
+//
+// This function replaces runtime.futexsleep and is used by the Go runtime for
+// implementing notes and locks.
+//
+//go:redirect-from runtime.futexsleep
+//go:nosplit
+func futexsleep(addr *uint32, val uint32, ns int64) {
+	waitFn(addr, val, ns)
+}
+
+// futexwakeup wakes up to cnt kernel threads that sleep on addr.
+//
+// This function replaces runtime.futexwakeup and is used by the Go runtime for
+// implementing notes and locks.
+//
+//go:redirect-from runtime.futexwakeup
+//go:nosplit
+func futexwakeup(addr *uint32, cnt uint32) {
+	wakeFn(addr, cnt)
+}
+
+// usleep suspends the running kernel thread for at least usec microseconds.
+//
+// This function replaces runtime.usleep.
+//
+//go:redirect-from runtime.usleep
+//go:nosplit
+func usleep(usec uint32) {
+	sleepFn(int64(usec) * 1000)
+}
+
+// osyield yields the CPU to the next runnable kernel thread.
+//
+// This function replaces runtime.osyield.
+//
+//go:redirect-from runtime.osyield
+//go:nosplit
+func osyield() {
+	yieldFn()
+}
+
+// minit is invoked by each new M before it starts running goroutines. The
+// runtime implementation sets up the signal stack and mask of the calling
+// thread which does not apply to kernel threads.
+//
+// This function replaces runtime.minit.
+//
+//go:redirect-from runtime.minit
+//go:nosplit
+func minit() {
+}
+
+// initsig installs the signal handlers used by the Go runtime. As the kernel
+// does not deliver signals, this is a no-op.
+//
+// This function replaces runtime.initsig.
+//
+//go:redirect-from runtime.initsig
+//go:nosplit
+func initsig(_ bool) {
+}
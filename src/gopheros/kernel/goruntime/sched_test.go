@@ -0,0 +1,115 @@
+package goruntime
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/sched"
+	"testing"
+	"unsafe"
+)
+
+func TestStart(t *testing.T) {
+	defer func() {
+		mstartFn = mstart
+	}()
+
+	mstartCalled := false
+	mstartFn = func() { mstartCalled = true }
+
+	done := make(chan struct{})
+	Start(func() { close(done) })
+	<-done
+
+	if !mstartCalled {
+		t.Fatal("expected runtime.mstart to be called")
+	}
+}
+
+func TestNewosproc(t *testing.T) {
+	defer func() {
+		spawnFn = sched.Spawn
+	}()
+
+	var (
+		fakeM     = [2]uintptr{0xbadf00d, 0}
+		fakeStack [16]uintptr
+		stackTop  = unsafe.Pointer(&fakeStack[15])
+	)
+
+	spawnFn = func(entryPC uintptr, stk unsafe.Pointer, g uintptr) *kernel.Error {
+		if exp := mstartPC(); entryPC != exp {
+			t.Errorf("expected entry PC to be %x; got %x", exp, entryPC)
+		}
+
+		if stk != stackTop {
+			t.Errorf("expected stack top to be %x; got %x", uintptr(stackTop), uintptr(stk))
+		}
+
+		if g != fakeM[0] {
+			t.Errorf("expected g to be %x; got %x", fakeM[0], g)
+		}
+		return nil
+	}
+
+	newosproc(unsafe.Pointer(&fakeM), stackTop)
+
+	t.Run("spawn error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "spawn failed"}
+		spawnFn = func(_ uintptr, _ unsafe.Pointer, _ uintptr) *kernel.Error {
+			return expErr
+		}
+
+		defer func() {
+			if err := recover(); err != expErr {
+				t.Errorf("expected to get error: %v; got %v", expErr, err)
+			}
+		}()
+
+		newosproc(unsafe.Pointer(&fakeM), stackTop)
+	})
+}
+
+func TestFutexAndSleepRedirects(t *testing.T) {
+	defer func() {
+		waitFn = sched.Wait
+		wakeFn = sched.Wake
+		sleepFn = sched.Sleep
+		yieldFn = sched.Yield
+	}()
+
+	var (
+		addr       uint32
+		waitCalls  int
+		wakeCalls  int
+		sleptNs    int64
+		yieldCalls int
+	)
+
+	waitFn = func(a *uint32, val uint32, ns int64) {
+		if a != &addr || val != 1 || ns != 42 {
+			t.Errorf("unexpected Wait args: %p, %d, %d", a, val, ns)
+		}
+		waitCalls++
+	}
+	wakeFn = func(a *uint32, cnt uint32) uint32 {
+		if a != &addr || cnt != 2 {
+			t.Errorf("unexpected Wake args: %p, %d", a, cnt)
+		}
+		wakeCalls++
+		return 0
+	}
+	sleepFn = func(ns int64) { sleptNs = ns }
+	yieldFn = func() { yieldCalls++ }
+
+	futexsleep(&addr, 1, 42)
+	futexwakeup(&addr, 2)
+	usleep(3)
+	osyield()
+
+	if waitCalls != 1 || wakeCalls != 1 || yieldCalls != 1 {
+		t.Errorf("expected Wait, Wake and Yield to be called once; got %d, %d, %d", waitCalls, wakeCalls, yieldCalls)
+	}
+
+	if exp := int64(3000); sleptNs != exp {
+		t.Errorf("expected Sleep to be called with %d ns; got %d", exp, sleptNs)
+	}
+}
@@ -0,0 +1,45 @@
+package goruntime
+
+import (
+	"gopheros/kernel/clock"
+	"gopheros/kernel/sched"
+	"time"
+)
+
+var (
+	nanotimeFn = clock.Nanotime
+	walltimeFn = clock.Walltime
+	setClockFn = sched.SetClock
+)
+
+// nanotime returns a monotonically increasing clock value in nanoseconds.
+//
+// This function replaces runtime.nanotime and is invoked by the Go allocator
+// when a span allocation is performed as well as by the Go scheduler and
+// timers.
+//
+//go:redirect-from runtime.nanotime
+//go:nosplit
+func nanotime() int64 {
+	return nanotimeFn()
+}
+
+// walltime returns the current wall clock time as the number of seconds and
+// nanoseconds elapsed since the Unix epoch.
+//
+// This function replaces time.now which the Go runtime implements on behalf
+// of the time package. It allows time.Now and time.Since to be used by
+// kernel code.
+//
+//go:redirect-from time.now
+//go:nosplit
+func walltime() (int64, int32) {
+	return walltimeFn()
+}
+
+func init() {
+	// The kernel does not ship a timezone database and reports the wall
+	// clock in UTC. Setting the local timezone to UTC also prevents the
+	// time package from trying to load it from the filesystem.
+	time.Local = time.UTC
+}
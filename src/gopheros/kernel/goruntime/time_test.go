@@ -0,0 +1,33 @@
+package goruntime
+
+import (
+	"gopheros/kernel/clock"
+	"testing"
+	"time"
+)
+
+func TestNanotime(t *testing.T) {
+	defer func() {
+		nanotimeFn = clock.Nanotime
+	}()
+
+	nanotimeFn = func() int64 { return 42 }
+	if got := nanotime(); got != 42 {
+		t.Fatalf("expected nanotime to return 42; got %d", got)
+	}
+}
+
+func TestWalltime(t *testing.T) {
+	defer func() {
+		walltimeFn = clock.Walltime
+	}()
+
+	walltimeFn = func() (int64, int32) { return 1500000000, 123 }
+	if sec, nsec := walltime(); sec != 1500000000 || nsec != 123 {
+		t.Fatalf("expected walltime to return (1500000000, 123); got (%d, %d)", sec, nsec)
+	}
+
+	if time.Local != time.UTC {
+		t.Fatal("expected the local timezone to be set to UTC")
+	}
+}
@@ -13,6 +13,12 @@ import (
 
 	// import and register acpi driver
 	_ "gopheros/device/acpi"
+
+	// import and register the 8259 PIC driver
+	_ "gopheros/device/pic"
+
+	// import and register the local APIC and I/O APIC drivers
+	_ "gopheros/device/apic"
 )
 
 // managedDevices contains the devices discovered by the HAL.
@@ -319,6 +319,13 @@ func GetFramebufferInfo() *FramebufferInfo {
 	return info
 }
 
+// BootCmdLineVisitor defines a visitor function that gets invoked by
+// VisitBootCmdLine for each key-value pair in the kernel command line. Command
+// line arguments without a value (e.g. "nofoo") are reported using the
+// argument name as both the key and the value. The visitor must return true to
+// continue or false to abort the scan.
+type BootCmdLineVisitor func(key, value string) bool
+
 // GetBootCmdLine returns the command line key-value pairs passed to the
 // kernel.  This function must only be invoked after bootstrapping the memory
 // allocator.
@@ -329,27 +336,92 @@ func GetBootCmdLine() map[string]string {
 
 	cmdLineKV = make(map[string]string)
 
+	// Work on a copy of the command line so that the returned key-value
+	// pairs do not reference the multiboot info data.
+	parseBootCmdLine(string(bootCmdLine()), func(key, value string) bool {
+		cmdLineKV[key] = value
+		return true
+	})
+
+	return cmdLineKV
+}
+
+// VisitBootCmdLine invokes visitor for each key-value pair in the kernel
+// command line. Contrary to GetBootCmdLine, this function does not allocate
+// any memory and can be used before the memory allocator is bootstrapped. The
+// strings passed to the visitor point to the multiboot info data and must not
+// be retained by the visitor.
+func VisitBootCmdLine(visitor BootCmdLineVisitor) {
+	rawCmdLine := bootCmdLine()
+	if len(rawCmdLine) == 0 {
+		return
+	}
+
+	var (
+		cmdLine       string
+		cmdLineHeader = (*reflect.StringHeader)(unsafe.Pointer(&cmdLine))
+	)
+
+	cmdLineHeader.Data = uintptr(unsafe.Pointer(&rawCmdLine[0]))
+	cmdLineHeader.Len = len(rawCmdLine)
+
+	parseBootCmdLine(cmdLine, visitor)
+}
+
+// bootCmdLine returns a byte slice that points to the kernel command line
+// stored in the multiboot info data.
+func bootCmdLine() []byte {
 	curPtr, size := findTagByType(tagBootCmdLine)
-	if size != 0 {
-		// The command line is a C-style NULL-terminated string
-		cmdLine := *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
-			Len:  int(size - 1),
-			Cap:  int(size - 1),
-			Data: curPtr,
-		}))
-		pairs := strings.Fields(string(cmdLine))
-		for _, pair := range pairs {
-			kv := strings.Split(pair, "=")
-			switch len(kv) {
-			case 2: // foo=bar
-				cmdLineKV[kv[0]] = kv[1]
-			case 1: // nofoo
-				cmdLineKV[kv[0]] = kv[0]
+	if size == 0 {
+		return nil
+	}
+
+	// The command line is a C-style NULL-terminated string
+	return *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+		Len:  int(size - 1),
+		Cap:  int(size - 1),
+		Data: curPtr,
+	}))
+}
+
+// parseBootCmdLine splits cmdLine into whitespace-separated arguments and
+// invokes visitor for each argument that is either a "key=value" pair or a
+// single key. Arguments containing more than one '=' are ignored.
+func parseBootCmdLine(cmdLine string, visitor BootCmdLineVisitor) {
+	for start, end := 0, 0; start < len(cmdLine); start = end {
+		for ; start < len(cmdLine) && isCmdLineSpace(cmdLine[start]); start++ {
+		}
+
+		for end = start; end < len(cmdLine) && !isCmdLineSpace(cmdLine[end]); end++ {
+		}
+
+		if start == end {
+			return
+		}
+
+		arg := cmdLine[start:end]
+		switch strings.Count(arg, "=") {
+		case 0: // nofoo
+			if !visitor(arg, arg) {
+				return
+			}
+		case 1: // foo=bar
+			sepIndex := strings.IndexByte(arg, '=')
+			if !visitor(arg[:sepIndex], arg[sepIndex+1:]) {
+				return
 			}
 		}
 	}
+}
 
-	return cmdLineKV
+// isCmdLineSpace returns true if b is an ASCII whitespace character.
+func isCmdLineSpace(b byte) bool {
+	switch b {
+	case ' ', '\t', '\n', '\v', '\f', '\r':
+		return true
+	}
+
+	return false
 }
 
 // findTagByType scans the multiboot info data looking for the start of of the
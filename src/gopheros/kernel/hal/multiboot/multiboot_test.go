@@ -193,6 +193,66 @@ func TestGetBootCmdLine(t *testing.T) {
 	}
 }
 
+func TestVisitBootCmdLine(t *testing.T) {
+	SetInfoPtr(uintptr(unsafe.Pointer(&emptyInfoData[0])))
+	VisitBootCmdLine(func(_, _ string) bool {
+		t.Fatal("expected visitor not to be invoked when no command line tag is present")
+		return false
+	})
+
+	SetInfoPtr(uintptr(unsafe.Pointer(&multibootInfoTestData[0])))
+
+	var (
+		expKV = [][2]string{{"param1", "param1"}, {"param2", "value2"}}
+		gotKV [][2]string
+	)
+
+	VisitBootCmdLine(func(key, value string) bool {
+		gotKV = append(gotKV, [2]string{key, value})
+		return true
+	})
+
+	if !reflect.DeepEqual(gotKV, expKV) {
+		t.Errorf("expected to get: %v; got %v", expKV, gotKV)
+	}
+
+	t.Run("abort scan", func(t *testing.T) {
+		visitCount := 0
+		VisitBootCmdLine(func(_, _ string) bool {
+			visitCount++
+			return false
+		})
+
+		if visitCount != 1 {
+			t.Errorf("expected visitor to be invoked once; got %d", visitCount)
+		}
+	})
+}
+
+func TestParseBootCmdLine(t *testing.T) {
+	specs := []struct {
+		cmdLine string
+		expKV   [][2]string
+	}{
+		{"", nil},
+		{"  \t ", nil},
+		{"nokaslr", [][2]string{{"nokaslr", "nokaslr"}}},
+		{" foo=bar\tbaz  a=b=c consoleFont= ", [][2]string{{"foo", "bar"}, {"baz", "baz"}, {"consoleFont", ""}}},
+	}
+
+	for specIndex, spec := range specs {
+		var gotKV [][2]string
+		parseBootCmdLine(spec.cmdLine, func(key, value string) bool {
+			gotKV = append(gotKV, [2]string{key, value})
+			return true
+		})
+
+		if !reflect.DeepEqual(gotKV, spec.expKV) {
+			t.Errorf("[spec %d] expected to get: %v; got %v", specIndex, spec.expKV, gotKV)
+		}
+	}
+}
+
 func TestGetElfSections(t *testing.T) {
 	SetInfoPtr(uintptr(unsafe.Pointer(&emptyInfoData[0])))
 
@@ -0,0 +1,221 @@
+package irq
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/entropy"
+)
+
+const (
+	// FirstIRQVector is the first interrupt vector that can be claimed
+	// via Register. Vectors 0-31 are reserved for CPU exceptions.
+	FirstIRQVector = 32
+
+	// maxSharedHandlers defines the maximum number of handlers that can
+	// share an interrupt vector.
+	maxSharedHandlers = 4
+
+	numVectors = 256
+)
+
+// InterruptHandler is a function that services a hardware interrupt. Handlers
+// that share a vector must check whether the device they service raised the
+// interrupt and return false if it did not.
+type InterruptHandler func(vector uint8, frame *Frame, regs *Regs) bool
+
+// InterruptController is implemented by drivers for interrupt controllers
+// such as the 8259 PIC or the APIC.
+//
+// Controllers route IRQ lines to interrupt vectors. Lines 0-15 correspond to
+// the legacy ISA IRQs; controllers that support additional lines map them to
+// the matching global system interrupt.
+type InterruptController interface {
+	// ControllerName returns the name of the interrupt controller.
+	ControllerName() string
+
+	// IRQVector returns the interrupt vector that the supplied IRQ line
+	// is delivered to.
+	IRQVector(line uint8) uint8
+
+	// MaskIRQ disables the delivery of interrupts for an IRQ line.
+	MaskIRQ(line uint8) *kernel.Error
+
+	// UnmaskIRQ enables the delivery of interrupts for an IRQ line.
+	UnmaskIRQ(line uint8) *kernel.Error
+
+	// EOI signals the end of the processing of an interrupt for the
+	// supplied vector.
+	EOI(vector uint8)
+
+	// Spurious returns true if the interrupt delivered on the supplied
+	// vector is spurious. Spurious interrupts are not passed to the
+	// registered handlers and do not receive an EOI signal; the
+	// controller performs any acknowledgement that they require.
+	Spurious(vector uint8) bool
+}
+
+// VectorStats contains the interrupt counters for a vector.
+type VectorStats struct {
+	// Count is the number of interrupts received for the vector.
+	Count uint64
+
+	// Unhandled is the number of interrupts that were not claimed by any
+	// of the registered handlers.
+	Unhandled uint64
+
+	// Spurious is the number of interrupts that were reported as spurious
+	// by the interrupt controller and were not dispatched.
+	Spurious uint64
+}
+
+// registration describes a handler registered for an interrupt vector.
+type registration struct {
+	name    string
+	handler InterruptHandler
+}
+
+// vectorInfo tracks the handlers and counters for an interrupt vector.
+type vectorInfo struct {
+	handlers     [maxSharedHandlers]registration
+	handlerCount int
+	stats        VectorStats
+
+	// dispatcherInstalled is set to true once the IDT entry for the vector
+	// has been pointed to dispatchInterrupt.
+	dispatcherInstalled bool
+}
+
+var (
+	// vectors is statically allocated so interrupts can be dispatched
+	// without touching the Go allocator.
+	vectors [numVectors]vectorInfo
+
+	// controller is the interrupt controller that receives EOI signals.
+	controller InterruptController
+
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	handleExceptionWithCodeFn = HandleExceptionWithCode
+	addInterruptTimingFn      = entropy.AddInterruptTiming
+
+	errInvalidVector    = &kernel.Error{Module: "irq", Message: "vectors below 32 are reserved for CPU exceptions"}
+	errTooManyHandlers  = &kernel.Error{Module: "irq", Message: "maximum number of shared handlers for vector reached"}
+	errHandlerNotFound  = &kernel.Error{Module: "irq", Message: "no handler with the supplied name is registered for vector"}
+	errDuplicateHandler = &kernel.Error{Module: "irq", Message: "a handler with the supplied name is already registered for vector"}
+)
+
+// SetController registers the interrupt controller that receives an EOI
+// signal after each hardware interrupt is dispatched.
+func SetController(ctrl InterruptController) {
+	controller = ctrl
+}
+
+// Controller returns the active interrupt controller or nil if no controller
+// has been registered.
+func Controller() InterruptController {
+	return controller
+}
+
+// Register installs a handler for the supplied interrupt vector. Vectors can
+// be shared by up to maxSharedHandlers handlers which are invoked in
+// registration order each time the vector is raised. The name argument is
+// used for identifying the handler when calling Unregister and must be unique
+// for each vector.
+func Register(vector uint8, handler InterruptHandler, name string) *kernel.Error {
+	if vector < FirstIRQVector {
+		return errInvalidVector
+	}
+
+	info := &vectors[vector]
+	if findHandler(info, name) != -1 {
+		return errDuplicateHandler
+	}
+
+	if info.handlerCount == maxSharedHandlers {
+		return errTooManyHandlers
+	}
+
+	// The handler count is updated after populating the entry so that
+	// the dispatcher never observes a partially initialized entry.
+	info.handlers[info.handlerCount] = registration{name: name, handler: handler}
+	info.handlerCount++
+
+	if !info.dispatcherInstalled {
+		handleExceptionWithCodeFn(ExceptionNum(vector), dispatchInterrupt)
+		info.dispatcherInstalled = true
+	}
+
+	return nil
+}
+
+// Unregister removes the handler with the supplied name from the list of
+// handlers for an interrupt vector.
+func Unregister(vector uint8, name string) *kernel.Error {
+	if vector < FirstIRQVector {
+		return errInvalidVector
+	}
+
+	info := &vectors[vector]
+	index := findHandler(info, name)
+	if index == -1 {
+		return errHandlerNotFound
+	}
+
+	copy(info.handlers[index:info.handlerCount], info.handlers[index+1:info.handlerCount])
+	info.handlerCount--
+	info.handlers[info.handlerCount] = registration{}
+
+	return nil
+}
+
+// Stats returns the interrupt counters for a vector.
+func Stats(vector uint8) VectorStats {
+	return vectors[vector].stats
+}
+
+// findHandler returns the index of the handler with the supplied name or -1
+// if no such handler is registered.
+func findHandler(info *vectorInfo, name string) int {
+	for index := 0; index < info.handlerCount; index++ {
+		if info.handlers[index].name == name {
+			return index
+		}
+	}
+
+	return -1
+}
+
+// dispatchInterrupt is installed as the IDT handler for each vector claimed
+// via Register. The rt0 gate entries for hardware interrupts pass the vector
+// number in place of an exception error code. After invoking the registered
+// handlers, dispatchInterrupt signals the end of the interrupt to the active
+// interrupt controller. Interrupts that the controller reports as spurious
+// are dropped before reaching the handlers.
+func dispatchInterrupt(code uint64, frame *Frame, regs *Regs) {
+	var (
+		vector  = uint8(code)
+		info    = &vectors[vector]
+		handled bool
+	)
+
+	if controller != nil && controller.Spurious(vector) {
+		info.stats.Spurious++
+		return
+	}
+
+	info.stats.Count++
+	addInterruptTimingFn(vector)
+
+	for index := 0; index < info.handlerCount; index++ {
+		if info.handlers[index].handler(vector, frame, regs) {
+			handled = true
+		}
+	}
+
+	if !handled {
+		info.stats.Unhandled++
+	}
+
+	if controller != nil {
+		controller.EOI(vector)
+	}
+}
@@ -0,0 +1,180 @@
+package irq
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/entropy"
+	"strings"
+	"testing"
+)
+
+type fakeController struct {
+	eoiVectors     []uint8
+	spuriousVector uint8
+}
+
+func (*fakeController) ControllerName() string          { return "fake" }
+func (*fakeController) IRQVector(line uint8) uint8      { return FirstIRQVector + line }
+func (*fakeController) MaskIRQ(_ uint8) *kernel.Error   { return nil }
+func (*fakeController) UnmaskIRQ(_ uint8) *kernel.Error { return nil }
+func (c *fakeController) EOI(vector uint8)              { c.eoiVectors = append(c.eoiVectors, vector) }
+func (c *fakeController) Spurious(vector uint8) bool    { return vector == c.spuriousVector }
+
+func resetVectors() {
+	vectors = [numVectors]vectorInfo{}
+	controller = nil
+}
+
+func TestRegister(t *testing.T) {
+	defer func() {
+		handleExceptionWithCodeFn = HandleExceptionWithCode
+		resetVectors()
+	}()
+
+	var installedVectors []ExceptionNum
+	handleExceptionWithCodeFn = func(num ExceptionNum, _ ExceptionHandlerWithCode) {
+		installedVectors = append(installedVectors, num)
+	}
+
+	handler := func(_ uint8, _ *Frame, _ *Regs) bool { return true }
+
+	if err := Register(40, handler, "dev0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Register(40, handler, "dev1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(installedVectors) != 1 || installedVectors[0] != 40 {
+		t.Fatalf("expected the dispatcher to be installed once for vector 40; got %v", installedVectors)
+	}
+
+	if got := vectors[40].handlerCount; got != 2 {
+		t.Fatalf("expected 2 handlers to be registered; got %d", got)
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		if err := Register(FirstIRQVector-1, handler, "dev"); err != errInvalidVector {
+			t.Errorf("expected to get errInvalidVector; got %v", err)
+		}
+
+		if err := Register(40, handler, "dev0"); err != errDuplicateHandler {
+			t.Errorf("expected to get errDuplicateHandler; got %v", err)
+		}
+
+		for _, name := range []string{"dev2", "dev3"} {
+			if err := Register(40, handler, name); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := Register(40, handler, "dev4"); err != errTooManyHandlers {
+			t.Errorf("expected to get errTooManyHandlers; got %v", err)
+		}
+	})
+}
+
+func TestUnregister(t *testing.T) {
+	defer func() {
+		handleExceptionWithCodeFn = HandleExceptionWithCode
+		resetVectors()
+	}()
+
+	handleExceptionWithCodeFn = func(_ ExceptionNum, _ ExceptionHandlerWithCode) {}
+	handler := func(_ uint8, _ *Frame, _ *Regs) bool { return true }
+
+	for _, name := range []string{"dev0", "dev1", "dev2"} {
+		if err := Register(255, handler, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Unregister(255, "dev1"); err != nil {
+		t.Fatal(err)
+	}
+
+	info := &vectors[255]
+	if info.handlerCount != 2 || info.handlers[0].name != "dev0" || info.handlers[1].name != "dev2" {
+		t.Fatalf("expected remaining handlers to be [dev0 dev2]; got %d handlers", info.handlerCount)
+	}
+
+	if info.handlers[2].handler != nil {
+		t.Fatal("expected the unused handler slot to be cleared")
+	}
+
+	if err := Unregister(255, "dev1"); err != errHandlerNotFound {
+		t.Errorf("expected to get errHandlerNotFound; got %v", err)
+	}
+
+	if err := Unregister(0, "dev0"); err != errInvalidVector {
+		t.Errorf("expected to get errInvalidVector; got %v", err)
+	}
+}
+
+func TestDispatchInterrupt(t *testing.T) {
+	defer func() {
+		handleExceptionWithCodeFn = HandleExceptionWithCode
+		addInterruptTimingFn = entropy.AddInterruptTiming
+		resetVectors()
+	}()
+
+	var (
+		calls         []string
+		timingVectors []uint8
+		ctrl          fakeController
+		claimDev1     bool
+	)
+
+	handleExceptionWithCodeFn = func(_ ExceptionNum, _ ExceptionHandlerWithCode) {}
+	addInterruptTimingFn = func(vector uint8) { timingVectors = append(timingVectors, vector) }
+
+	Register(33, func(vector uint8, _ *Frame, _ *Regs) bool {
+		calls = append(calls, "dev0")
+		return false
+	}, "dev0")
+	Register(33, func(vector uint8, _ *Frame, _ *Regs) bool {
+		if vector != 33 {
+			t.Errorf("expected handler to receive vector 33; got %d", vector)
+		}
+		calls = append(calls, "dev1")
+		return claimDev1
+	}, "dev1")
+
+	// Dispatch without an interrupt controller
+	dispatchInterrupt(33, &Frame{}, &Regs{})
+
+	SetController(&ctrl)
+	if Controller() != &ctrl {
+		t.Fatal("expected Controller to return the registered controller")
+	}
+
+	claimDev1 = true
+	dispatchInterrupt(33, &Frame{}, &Regs{})
+
+	// Unclaimed vector
+	dispatchInterrupt(34, &Frame{}, &Regs{})
+
+	// Spurious interrupts must not reach the handlers
+	ctrl.spuriousVector = 33
+	dispatchInterrupt(33, &Frame{}, &Regs{})
+
+	if exp := "dev0,dev1,dev0,dev1"; strings.Join(calls, ",") != exp {
+		t.Fatalf("expected handler calls %v; got %v", exp, calls)
+	}
+
+	if exp, got := (VectorStats{Count: 2, Unhandled: 1, Spurious: 1}), Stats(33); got != exp {
+		t.Errorf("expected vector 33 stats to be %+v; got %+v", exp, got)
+	}
+
+	if exp, got := (VectorStats{Count: 1, Unhandled: 1}), Stats(34); got != exp {
+		t.Errorf("expected vector 34 stats to be %+v; got %+v", exp, got)
+	}
+
+	if len(ctrl.eoiVectors) != 2 || ctrl.eoiVectors[0] != 33 || ctrl.eoiVectors[1] != 34 {
+		t.Errorf("expected EOI to be signaled for vectors [33 34]; got %v", ctrl.eoiVectors)
+	}
+
+	if len(timingVectors) != 3 {
+		t.Errorf("expected interrupt timings to be mixed into the entropy pool for each interrupt; got %v", timingVectors)
+	}
+}
@@ -0,0 +1,301 @@
+package irq
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+)
+
+// exceptionInfo describes a CPU exception vector.
+type exceptionInfo struct {
+	// mnemonic is the short name of the exception (e.g. "#GP").
+	mnemonic string
+
+	// name is a human-readable description of the exception.
+	name string
+
+	// hasErrorCode is true if the CPU pushes an error code to the stack
+	// when raising the exception.
+	hasErrorCode bool
+
+	// hasSelectorCode is true if the error code references a segment
+	// selector.
+	hasSelectorCode bool
+}
+
+// The following bits are used by selector error codes.
+const (
+	selectorErrExternal = 1 << 0
+	selectorErrTableIDT = 1 << 1
+	selectorErrTableLDT = 1 << 2
+	selectorErrIndex    = 3
+)
+
+var (
+	exceptions = [NumExceptions]exceptionInfo{
+		DivideError:               {"#DE", "divide error", false, false},
+		DebugException:            {"#DB", "debug exception", false, false},
+		NMIException:              {"NMI", "non-maskable interrupt", false, false},
+		Breakpoint:                {"#BP", "breakpoint", false, false},
+		Overflow:                  {"#OF", "overflow", false, false},
+		BoundRangeExceeded:        {"#BR", "bound range exceeded", false, false},
+		InvalidOpcode:             {"#UD", "invalid opcode", false, false},
+		DeviceNotAvailable:        {"#NM", "device not available", false, false},
+		DoubleFault:               {"#DF", "double fault", true, false},
+		CoprocessorSegmentOverrun: {"---", "coprocessor segment overrun", false, false},
+		InvalidTSS:                {"#TS", "invalid TSS", true, true},
+		SegmentNotPresent:         {"#NP", "segment not present", true, true},
+		StackSegmentFault:         {"#SS", "stack-segment fault", true, true},
+		GPFException:              {"#GP", "general protection fault", true, true},
+		PageFaultException:        {"#PF", "page fault", true, false},
+		ReservedException15:       {"---", "reserved", false, false},
+		FPUError:                  {"#MF", "x87 floating-point error", false, false},
+		AlignmentCheck:            {"#AC", "alignment check", true, false},
+		MachineCheck:              {"#MC", "machine check", false, false},
+		SIMDException:             {"#XM", "SIMD floating-point exception", false, false},
+		VirtualizationException:   {"#VE", "virtualization exception", false, false},
+		ControlProtection:         {"#CP", "control protection exception", true, false},
+		ReservedException22:       {"---", "reserved", false, false},
+		ReservedException23:       {"---", "reserved", false, false},
+		ReservedException24:       {"---", "reserved", false, false},
+		ReservedException25:       {"---", "reserved", false, false},
+		ReservedException26:       {"---", "reserved", false, false},
+		ReservedException27:       {"---", "reserved", false, false},
+		HypervisorInjection:       {"#HV", "hypervisor injection exception", false, false},
+		VMMCommunication:          {"#VC", "VMM communication exception", true, false},
+		SecurityException:         {"#SX", "security exception", true, false},
+		ReservedException31:       {"---", "reserved", false, false},
+	}
+
+	// defaultHandlers contains the handlers installed by InstallDefaultHandlers.
+	// Exception handlers are invoked via their code address and cannot
+	// determine the exception number that triggered them so each vector
+	// needs its own handler functions. Both handler variants are provided
+	// for each vector; the exceptions table specifies which one is used.
+	defaultHandlers = [NumExceptions]struct {
+		handler         ExceptionHandler
+		handlerWithCode ExceptionHandlerWithCode
+	}{
+		DivideError: {
+			func(f *Frame, r *Regs) { unhandledException(DivideError, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(DivideError, c, f, r) },
+		},
+		DebugException: {
+			func(f *Frame, r *Regs) { unhandledException(DebugException, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(DebugException, c, f, r) },
+		},
+		NMIException: {
+			func(f *Frame, r *Regs) { unhandledException(NMIException, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(NMIException, c, f, r) },
+		},
+		Breakpoint: {
+			func(f *Frame, r *Regs) { unhandledException(Breakpoint, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(Breakpoint, c, f, r) },
+		},
+		Overflow: {
+			func(f *Frame, r *Regs) { unhandledException(Overflow, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(Overflow, c, f, r) },
+		},
+		BoundRangeExceeded: {
+			func(f *Frame, r *Regs) { unhandledException(BoundRangeExceeded, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(BoundRangeExceeded, c, f, r) },
+		},
+		InvalidOpcode: {
+			func(f *Frame, r *Regs) { unhandledException(InvalidOpcode, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(InvalidOpcode, c, f, r) },
+		},
+		DeviceNotAvailable: {
+			func(f *Frame, r *Regs) { unhandledException(DeviceNotAvailable, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(DeviceNotAvailable, c, f, r) },
+		},
+		DoubleFault: {
+			func(f *Frame, r *Regs) { unhandledException(DoubleFault, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(DoubleFault, c, f, r) },
+		},
+		CoprocessorSegmentOverrun: {
+			func(f *Frame, r *Regs) { unhandledException(CoprocessorSegmentOverrun, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(CoprocessorSegmentOverrun, c, f, r) },
+		},
+		InvalidTSS: {
+			func(f *Frame, r *Regs) { unhandledException(InvalidTSS, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(InvalidTSS, c, f, r) },
+		},
+		SegmentNotPresent: {
+			func(f *Frame, r *Regs) { unhandledException(SegmentNotPresent, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(SegmentNotPresent, c, f, r) },
+		},
+		StackSegmentFault: {
+			func(f *Frame, r *Regs) { unhandledException(StackSegmentFault, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(StackSegmentFault, c, f, r) },
+		},
+		GPFException: {
+			func(f *Frame, r *Regs) { unhandledException(GPFException, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(GPFException, c, f, r) },
+		},
+		PageFaultException: {
+			func(f *Frame, r *Regs) { unhandledException(PageFaultException, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(PageFaultException, c, f, r) },
+		},
+		ReservedException15: {
+			func(f *Frame, r *Regs) { unhandledException(ReservedException15, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(ReservedException15, c, f, r) },
+		},
+		FPUError: {
+			func(f *Frame, r *Regs) { unhandledException(FPUError, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(FPUError, c, f, r) },
+		},
+		AlignmentCheck: {
+			func(f *Frame, r *Regs) { unhandledException(AlignmentCheck, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(AlignmentCheck, c, f, r) },
+		},
+		MachineCheck: {
+			func(f *Frame, r *Regs) { unhandledException(MachineCheck, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(MachineCheck, c, f, r) },
+		},
+		SIMDException: {
+			func(f *Frame, r *Regs) { unhandledException(SIMDException, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(SIMDException, c, f, r) },
+		},
+		VirtualizationException: {
+			func(f *Frame, r *Regs) { unhandledException(VirtualizationException, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(VirtualizationException, c, f, r) },
+		},
+		ControlProtection: {
+			func(f *Frame, r *Regs) { unhandledException(ControlProtection, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(ControlProtection, c, f, r) },
+		},
+		ReservedException22: {
+			func(f *Frame, r *Regs) { unhandledException(ReservedException22, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(ReservedException22, c, f, r) },
+		},
+		ReservedException23: {
+			func(f *Frame, r *Regs) { unhandledException(ReservedException23, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(ReservedException23, c, f, r) },
+		},
+		ReservedException24: {
+			func(f *Frame, r *Regs) { unhandledException(ReservedException24, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(ReservedException24, c, f, r) },
+		},
+		ReservedException25: {
+			func(f *Frame, r *Regs) { unhandledException(ReservedException25, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(ReservedException25, c, f, r) },
+		},
+		ReservedException26: {
+			func(f *Frame, r *Regs) { unhandledException(ReservedException26, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(ReservedException26, c, f, r) },
+		},
+		ReservedException27: {
+			func(f *Frame, r *Regs) { unhandledException(ReservedException27, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(ReservedException27, c, f, r) },
+		},
+		HypervisorInjection: {
+			func(f *Frame, r *Regs) { unhandledException(HypervisorInjection, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(HypervisorInjection, c, f, r) },
+		},
+		VMMCommunication: {
+			func(f *Frame, r *Regs) { unhandledException(VMMCommunication, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(VMMCommunication, c, f, r) },
+		},
+		SecurityException: {
+			func(f *Frame, r *Regs) { unhandledException(SecurityException, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(SecurityException, c, f, r) },
+		},
+		ReservedException31: {
+			func(f *Frame, r *Regs) { unhandledException(ReservedException31, 0, f, r) },
+			func(c uint64, f *Frame, r *Regs) { unhandledException(ReservedException31, c, f, r) },
+		},
+	}
+
+	// handleExceptionFn is used by tests and is automatically inlined by the compiler.
+	handleExceptionFn = HandleException
+
+	errUnhandledException = &kernel.Error{Module: "irq", Message: "unhandled CPU exception"}
+)
+
+// String returns the name of the exception.
+func (num ExceptionNum) String() string {
+	if num >= NumExceptions {
+		return "hardware interrupt"
+	}
+
+	return exceptions[num].name
+}
+
+// HasErrorCode returns true if the CPU pushes an error code to the stack when
+// raising the exception. Handlers for such exceptions must be installed via
+// HandleExceptionWithCode.
+func (num ExceptionNum) HasErrorCode() bool {
+	return num >= NumExceptions || exceptions[num].hasErrorCode
+}
+
+// PrintException outputs the name of the exception, a breakdown of its error
+// code and a dump of the exception frame and registers to the active console.
+func PrintException(num ExceptionNum, errorCode uint64, frame *Frame, regs *Regs) {
+	if num >= NumExceptions {
+		kfmt.Printf("\nUnexpected interrupt %d\n", uint8(num))
+	} else {
+		kfmt.Printf("\nException %d (%s): %s\n", uint8(num), exceptions[num].mnemonic, exceptions[num].name)
+	}
+
+	if num < NumExceptions && exceptions[num].hasErrorCode {
+		kfmt.Printf("Error code: 0x%x", errorCode)
+		if exceptions[num].hasSelectorCode {
+			printSelectorErrorCode(errorCode)
+		}
+		kfmt.Printf("\n")
+	}
+
+	kfmt.Printf("Registers:\n")
+	regs.Print()
+	frame.Print()
+}
+
+// printSelectorErrorCode decodes an error code that references the segment
+// selector (or IDT entry) that caused an exception.
+func printSelectorErrorCode(errorCode uint64) {
+	if errorCode == 0 {
+		kfmt.Printf(" (no selector)")
+		return
+	}
+
+	var table string
+	switch {
+	case errorCode&selectorErrTableIDT != 0:
+		table = "IDT"
+	case errorCode&selectorErrTableLDT != 0:
+		table = "LDT"
+	default:
+		table = "GDT"
+	}
+
+	kfmt.Printf(" (%s index %d", table, (errorCode&0xffff)>>selectorErrIndex)
+	if errorCode&selectorErrExternal != 0 {
+		kfmt.Printf(", external event")
+	}
+	kfmt.Printf(")")
+}
+
+// unhandledException prints the details of an exception without a dedicated
+// handler and panics. Breakpoints are reported and execution resumes at the
+// instruction following the breakpoint.
+func unhandledException(num ExceptionNum, errorCode uint64, frame *Frame, regs *Regs) {
+	PrintException(num, errorCode, frame, regs)
+	if num == Breakpoint {
+		return
+	}
+
+	panic(errUnhandledException)
+}
+
+// InstallDefaultHandlers installs a handler for each CPU exception vector
+// that prints a decoded description of the exception and panics. Subsystems
+// may override the default handlers for the exceptions they can recover from
+// by installing their own handlers.
+func InstallDefaultHandlers() {
+	for num := ExceptionNum(0); num < NumExceptions; num++ {
+		if num.HasErrorCode() {
+			handleExceptionWithCodeFn(num, defaultHandlers[num].handlerWithCode)
+		} else {
+			handleExceptionFn(num, defaultHandlers[num].handler)
+		}
+	}
+}
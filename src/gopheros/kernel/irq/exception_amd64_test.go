@@ -0,0 +1,152 @@
+package irq
+
+import (
+	"bytes"
+	"fmt"
+	"gopheros/kernel/kfmt"
+	"strings"
+	"testing"
+)
+
+func TestExceptionNumInfo(t *testing.T) {
+	expWithCode := map[ExceptionNum]bool{
+		DoubleFault: true, InvalidTSS: true, SegmentNotPresent: true,
+		StackSegmentFault: true, GPFException: true, PageFaultException: true,
+		AlignmentCheck: true, ControlProtection: true, VMMCommunication: true,
+		SecurityException: true,
+	}
+
+	for num := ExceptionNum(0); num < NumExceptions; num++ {
+		if num.String() == "" || exceptions[num].mnemonic == "" {
+			t.Errorf("[exception %d] missing exception name", num)
+		}
+
+		if exp, got := expWithCode[num], num.HasErrorCode(); got != exp {
+			t.Errorf("[exception %d] expected HasErrorCode() to return %t; got %t", num, exp, got)
+		}
+	}
+
+	if got := ExceptionNum(FirstIRQVector).String(); got != "hardware interrupt" {
+		t.Errorf("expected vector %d to be reported as a hardware interrupt; got %q", FirstIRQVector, got)
+	}
+
+	if !ExceptionNum(FirstIRQVector).HasErrorCode() {
+		t.Error("expected hardware interrupt vectors to receive a code")
+	}
+}
+
+func TestPrintException(t *testing.T) {
+	defer kfmt.SetOutputSink(nil)
+
+	specs := []struct {
+		num       ExceptionNum
+		errorCode uint64
+		exp       string
+	}{
+		{InvalidOpcode, 0, "\nException 6 (#UD): invalid opcode\nRegisters:\n"},
+		{AlignmentCheck, 0, "\nException 17 (#AC): alignment check\nError code: 0x0\nRegisters:\n"},
+		{GPFException, 0, "\nException 13 (#GP): general protection fault\nError code: 0x0 (no selector)\nRegisters:\n"},
+		{GPFException, 0x10, "Error code: 0x10 (GDT index 2)\n"},
+		{StackSegmentFault, 0x1c, "Error code: 0x1c (LDT index 3)\n"},
+		{InvalidTSS, 0x43, "Error code: 0x43 (IDT index 8, external event)\n"},
+		{ExceptionNum(40), 40, "\nUnexpected interrupt 40\nRegisters:\n"},
+	}
+
+	var buf bytes.Buffer
+	for specIndex, spec := range specs {
+		buf.Reset()
+		kfmt.SetOutputSink(&buf)
+
+		PrintException(spec.num, spec.errorCode, &Frame{}, &Regs{})
+
+		if got := buf.String(); !strings.Contains(got, spec.exp) {
+			t.Errorf("[spec %d] expected output to contain %q; got:\n%s", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestInstallDefaultHandlers(t *testing.T) {
+	defer func(origHandleException func(ExceptionNum, ExceptionHandler), origHandleExceptionWithCode func(ExceptionNum, ExceptionHandlerWithCode)) {
+		handleExceptionFn = origHandleException
+		handleExceptionWithCodeFn = origHandleExceptionWithCode
+		kfmt.SetOutputSink(nil)
+	}(handleExceptionFn, handleExceptionWithCodeFn)
+
+	var (
+		handlers         = make(map[ExceptionNum]ExceptionHandler)
+		handlersWithCode = make(map[ExceptionNum]ExceptionHandlerWithCode)
+		buf              bytes.Buffer
+	)
+
+	handleExceptionFn = func(num ExceptionNum, handler ExceptionHandler) {
+		handlers[num] = handler
+	}
+	handleExceptionWithCodeFn = func(num ExceptionNum, handler ExceptionHandlerWithCode) {
+		handlersWithCode[num] = handler
+	}
+	kfmt.SetOutputSink(&buf)
+
+	InstallDefaultHandlers()
+
+	if got := len(handlers) + len(handlersWithCode); got != NumExceptions {
+		t.Fatalf("expected %d handlers to be installed; got %d", NumExceptions, got)
+	}
+
+	for num := ExceptionNum(0); num < NumExceptions; num++ {
+		buf.Reset()
+
+		var invoke func()
+		if num.HasErrorCode() {
+			handler, ok := handlersWithCode[num]
+			if !ok {
+				t.Errorf("[exception %d] expected handler with code to be installed", num)
+				continue
+			}
+			invoke = func() { handler(0, &Frame{}, &Regs{}) }
+		} else {
+			handler, ok := handlers[num]
+			if !ok {
+				t.Errorf("[exception %d] expected handler without code to be installed", num)
+				continue
+			}
+			invoke = func() { handler(&Frame{}, &Regs{}) }
+		}
+
+		err := func() (err interface{}) {
+			defer func() { err = recover() }()
+			invoke()
+			return nil
+		}()
+
+		switch {
+		case num == Breakpoint && err != nil:
+			t.Errorf("[exception %d] expected handler to return; got panic %v", num, err)
+		case num != Breakpoint && err != errUnhandledException:
+			t.Errorf("[exception %d] expected a panic with errUnhandledException; got %v", num, err)
+		}
+
+		if exp := exceptions[num].name; !strings.Contains(buf.String(), exp) {
+			t.Errorf("[exception %d] expected output to contain %q; got:\n%s", num, exp, buf.String())
+		}
+	}
+
+	// Both handler variants for each vector must report the vector they
+	// are registered for.
+	for num := ExceptionNum(0); num < NumExceptions; num++ {
+		exp := fmt.Sprintf("Exception %d (", num)
+		for _, invoke := range []func(){
+			func() { defaultHandlers[num].handler(&Frame{}, &Regs{}) },
+			func() { defaultHandlers[num].handlerWithCode(0, &Frame{}, &Regs{}) },
+		} {
+			buf.Reset()
+			func() {
+				defer func() { _ = recover() }()
+				invoke()
+			}()
+
+			if !strings.Contains(buf.String(), exp) {
+				t.Errorf("[exception %d] expected output to contain %q; got:\n%s", num, exp, buf.String())
+			}
+		}
+	}
+}
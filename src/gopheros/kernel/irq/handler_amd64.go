@@ -1,16 +1,63 @@
 package irq
 
+import "unsafe"
+
 // ExceptionNum defines an exception number that can be
 // passed to the HandleException and HandleExceptionWithCode
 // functions.
 type ExceptionNum uint8
 
 const (
+	// DivideError is raised when dividing by zero or when the result of
+	// a division does not fit in the destination operand.
+	DivideError = ExceptionNum(0)
+
+	// DebugException is raised by the debug facilities of the CPU (e.g.
+	// hardware breakpoints or single-stepping).
+	DebugException = ExceptionNum(1)
+
+	// NMIException is raised when a non-maskable interrupt occurs.
+	NMIException = ExceptionNum(2)
+
+	// Breakpoint is raised by the INT3 instruction.
+	Breakpoint = ExceptionNum(3)
+
+	// Overflow is raised by the INTO instruction when the overflow flag
+	// is set.
+	Overflow = ExceptionNum(4)
+
+	// BoundRangeExceeded is raised by the BOUND instruction when its
+	// operand is out of range.
+	BoundRangeExceeded = ExceptionNum(5)
+
+	// InvalidOpcode is raised when the CPU tries to execute an invalid
+	// or reserved opcode.
+	InvalidOpcode = ExceptionNum(6)
+
+	// DeviceNotAvailable is raised when executing an FPU/SIMD instruction
+	// while the FPU is disabled or its state has not been restored.
+	DeviceNotAvailable = ExceptionNum(7)
+
 	// DoubleFault occurs when an exception is unhandled
 	// or when an exception occurs while the CPU is
 	// trying to call an exception handler.
 	DoubleFault = ExceptionNum(8)
 
+	// CoprocessorSegmentOverrun is no longer raised by modern CPUs.
+	CoprocessorSegmentOverrun = ExceptionNum(9)
+
+	// InvalidTSS is raised when a task switch or a stack switch via the
+	// TSS references an invalid segment selector.
+	InvalidTSS = ExceptionNum(10)
+
+	// SegmentNotPresent is raised when loading a segment or gate whose
+	// present bit is cleared.
+	SegmentNotPresent = ExceptionNum(11)
+
+	// StackSegmentFault is raised when loading a non-present stack
+	// segment or when a stack access uses a non-canonical address.
+	StackSegmentFault = ExceptionNum(12)
+
 	// GPFException is raised when a general protection fault occurs.
 	GPFException = ExceptionNum(13)
 
@@ -18,6 +65,57 @@ const (
 	// PDT-entry is not present or when a privilege
 	// and/or RW protection check fails.
 	PageFaultException = ExceptionNum(14)
+
+	// ReservedException15 is reserved by the CPU.
+	ReservedException15 = ExceptionNum(15)
+
+	// FPUError is raised by x87 FPU instructions when an unmasked
+	// floating-point exception is pending.
+	FPUError = ExceptionNum(16)
+
+	// AlignmentCheck is raised for unaligned memory accesses while
+	// alignment checking is enabled.
+	AlignmentCheck = ExceptionNum(17)
+
+	// MachineCheck is raised when the CPU detects an internal or bus
+	// error.
+	MachineCheck = ExceptionNum(18)
+
+	// SIMDException is raised by SSE instructions when an unmasked
+	// floating-point exception occurs.
+	SIMDException = ExceptionNum(19)
+
+	// VirtualizationException is raised on EPT violations.
+	VirtualizationException = ExceptionNum(20)
+
+	// ControlProtection is raised on control-flow enforcement violations.
+	ControlProtection = ExceptionNum(21)
+
+	// The following exception numbers are reserved by the CPU.
+	ReservedException22 = ExceptionNum(22)
+	ReservedException23 = ExceptionNum(23)
+	ReservedException24 = ExceptionNum(24)
+	ReservedException25 = ExceptionNum(25)
+	ReservedException26 = ExceptionNum(26)
+	ReservedException27 = ExceptionNum(27)
+
+	// HypervisorInjection is injected by a hypervisor to notify a guest
+	// about events.
+	HypervisorInjection = ExceptionNum(28)
+
+	// VMMCommunication is raised by SEV-ES guests when they need to
+	// communicate with the hypervisor.
+	VMMCommunication = ExceptionNum(29)
+
+	// SecurityException is raised by SVM for security-sensitive events.
+	SecurityException = ExceptionNum(30)
+
+	// ReservedException31 is reserved by the CPU.
+	ReservedException31 = ExceptionNum(31)
+
+	// NumExceptions is the number of exception vectors reserved by the
+	// CPU.
+	NumExceptions = 32
 )
 
 // ExceptionHandler is a function that handles an exception that does not push
@@ -33,9 +131,39 @@ type ExceptionHandler func(*Frame, *Regs)
 type ExceptionHandlerWithCode func(uint64, *Frame, *Regs)
 
 // HandleException registers an exception handler (without an error code) for
-// the given interrupt number.
+// the given interrupt number. It must only be used for CPU exceptions; hardware
+// interrupt handlers should be installed via Register.
 func HandleException(exceptionNum ExceptionNum, handler ExceptionHandler)
 
 // HandleExceptionWithCode registers an exception handler (with an error code)
-// for the given interrupt number.
+// for the given interrupt number. For interrupt numbers greater than or equal
+// to FirstIRQVector, the handler receives the interrupt number as the code.
 func HandleExceptionWithCode(exceptionNum ExceptionNum, handler ExceptionHandlerWithCode)
+
+// SetInterruptStack configures the IDT entry for the given interrupt number
+// so that the CPU switches to the stack stored in the specified interrupt
+// stack table entry of the TSS before invoking the handler. Passing 0 as the
+// ist argument restores the default behavior of using the current stack.
+func SetInterruptStack(exceptionNum ExceptionNum, ist uint8)
+
+// gStack mirrors the fields at the beginning of the runtime g struct that
+// describe the bounds of the goroutine stack and the stack guards checked by
+// the prologue of Go functions.
+type gStack struct {
+	lo, hi      uintptr
+	stackguard0 uintptr
+	stackguard1 uintptr
+}
+
+// SetDoubleFaultStack sets the stack bounds of the g that the rt0 code installs
+// as the current g while the double-fault handler runs. The bounds must cover
+// the interrupt stack that the CPU switches to before invoking the handler;
+// otherwise, the stack checks in the handler's function prologues will fail.
+func SetDoubleFaultStack(bottom, top uintptr) {
+	g := (*gStack)(doubleFaultG())
+	g.lo, g.hi = bottom, top
+	g.stackguard0, g.stackguard1 = bottom, bottom
+}
+
+// doubleFaultG returns a pointer to the g used by the double-fault handler.
+func doubleFaultG() unsafe.Pointer
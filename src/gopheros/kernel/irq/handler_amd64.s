@@ -5,6 +5,13 @@
 // can be accessed by the gate entries defined in the rt0 assembly code.
 GLOBL _rt0_interrupt_handlers(SB), NOPTR, $2048
 
+// Storage for the g that the rt0 code installs as the current g while the
+// double-fault handler runs on its dedicated interrupt stack. This symbol is
+// made global by the Makefile so it can be accessed by the double-fault gate
+// dispatcher. Only the stack bounds and the m pointer of this g are populated;
+// 1K is more than enough to hold a runtime g struct.
+GLOBL _rt0_double_fault_g(SB), NOPTR, $1024
+
 // In 64-bit mode SIDT stores 8+2 bytes for the IDT address and limit
 GLOBL _rt0_idtr<>(SB), NOPTR, $10
 
@@ -34,3 +41,24 @@ TEXT ·HandleExceptionWithCode(SB),NOSPLIT,$0
 	                   // see: http://wiki.osdev.org/Interrupt_Descriptor_Table
 
 	RET
+
+TEXT ·SetInterruptStack(SB),NOSPLIT,$0
+	// Lookup the IDT entry for exceptionNum using the IDT base address
+	// returned by the SIDT instruction
+	MOVQ IDTR, _rt0_idtr<>+0(SB)
+	LEAQ _rt0_idtr<>(SB), CX
+	MOVQ 2(CX), CX     // CX points to IDT base address
+	MOVBQZX exceptionNum+0(FP), AX
+	SHLQ $4, AX        // Each IDT entry uses 16 bytes
+	ADDQ AX, CX
+
+	// The IST index is stored in bits 0-2 of the 5th byte of the IDT entry
+	MOVBQZX ist+1(FP), AX
+	ANDQ $7, AX
+	MOVB AX, 4(CX)
+	RET
+
+TEXT ·doubleFaultG(SB),NOSPLIT,$0-8
+	LEAQ _rt0_double_fault_g+0(SB), AX
+	MOVQ AX, ret+0(FP)
+	RET
@@ -0,0 +1,23 @@
+package irq
+
+import "testing"
+
+func TestSetDoubleFaultStack(t *testing.T) {
+	defer SetDoubleFaultStack(0, 0)
+
+	var (
+		bottom = uintptr(0xffffc00000101000)
+		top    = uintptr(0xffffc00000105000)
+	)
+
+	SetDoubleFaultStack(bottom, top)
+
+	g := (*gStack)(doubleFaultG())
+	if g.lo != bottom || g.hi != top {
+		t.Errorf("expected double-fault g stack bounds to be [%x, %x); got [%x, %x)", bottom, top, g.lo, g.hi)
+	}
+
+	if g.stackguard0 != bottom || g.stackguard1 != bottom {
+		t.Errorf("expected double-fault g stack guards to be set to %x; got %x, %x", bottom, g.stackguard0, g.stackguard1)
+	}
+}
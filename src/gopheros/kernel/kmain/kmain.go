@@ -2,10 +2,13 @@ package kmain
 
 import (
 	"gopheros/kernel"
+	"gopheros/kernel/clock"
 	"gopheros/kernel/goruntime"
 	"gopheros/kernel/hal"
 	"gopheros/kernel/hal/multiboot"
+	"gopheros/kernel/irq"
 	"gopheros/kernel/kfmt"
+	"gopheros/kernel/ksym"
 	"gopheros/kernel/mem/pmm/allocator"
 	"gopheros/kernel/mem/vmm"
 )
@@ -16,29 +19,56 @@ var (
 
 // Kmain is the only Go symbol that is visible (exported) from the rt0 initialization
 // code. This function is invoked by the rt0 assembly code after setting up the GDT
-// and setting up a a minimal g0 struct that allows Go code using the 4K stack
+// and setting up a a minimal g0 struct that allows Go code using the 16K stack
 // allocated by the assembly code.
 //
 // The rt0 code passes the address of the multiboot info payload provided by the
 // bootloader as well as the physical addresses for the kernel start/end. In
 // addition, the start of the kernel virtual address space is passed to the
-// kernelPageOffset argument.
+// kernelPageOffset argument while the bootStackBottom and bootStackTop
+// arguments contain the virtual address range of the stack allocated by the
+// rt0 code.
 //
-// Kmain is not expected to return. If it does, the rt0 code will halt the CPU.
+// Once the Go runtime has been initialized, Kmain runs the remaining kernel
+// initialization code in a goroutine and hands the boot thread over to the Go
+// scheduler. Kmain is not expected to return. If it does, the rt0 code will
+// halt the CPU.
 //
 //go:noinline
-func Kmain(multibootInfoPtr, kernelStart, kernelEnd, kernelPageOffset uintptr) {
+func Kmain(multibootInfoPtr, kernelStart, kernelEnd, kernelPageOffset, bootStackBottom, bootStackTop uintptr) {
 	multiboot.SetInfoPtr(multibootInfoPtr)
+	irq.InstallDefaultHandlers()
+
+	// The kernel symbol table is optional; without it, faulting addresses
+	// are reported without symbol names. ksym.Init must run before
+	// allocator.Init so that the frames holding the tables are reserved.
+	if err := ksym.Init(vmm.PhysToVirt, allocator.ReserveFrames); err != nil {
+		kfmt.Printf("[ksym] %s\n", err.Message)
+	}
 
 	var err *kernel.Error
-	if err = allocator.Init(kernelStart, kernelEnd); err != nil {
+	if err = vmm.InitLayout(); err != nil {
+		panic(err)
+	} else if err = allocator.Init(kernelStart, kernelEnd); err != nil {
 		panic(err)
 	} else if err = vmm.Init(kernelPageOffset); err != nil {
 		panic(err)
+	} else if err = vmm.ProtectBootStack(bootStackBottom, bootStackTop); err != nil {
+		panic(err)
+	} else if err = clock.Init(); err != nil {
+		panic(err)
 	} else if err = goruntime.Init(); err != nil {
 		panic(err)
+	} else if err = vmm.Seal(); err != nil {
+		panic(err)
 	}
 
+	goruntime.Start(kmain)
+}
+
+// kmain runs in the first kernel goroutine and completes the kernel
+// initialization.
+func kmain() {
 	// After goruntime.Init returns we can safely use defer
 	defer func() {
 		// Use kfmt.Panic instead of panic to prevent the compiler from
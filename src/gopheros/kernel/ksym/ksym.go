@@ -0,0 +1,191 @@
+// Package ksym resolves kernel addresses to the names of the functions that
+// contain them using the ELF symbol table that the bootloader loads together
+// with the kernel image.
+package ksym
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/hal/multiboot"
+	"gopheros/kernel/mem"
+	"reflect"
+	"unsafe"
+)
+
+const (
+	symtabSectionName = ".symtab"
+	strtabSectionName = ".strtab"
+
+	// sttFunc is the ELF symbol type for functions.
+	sttFunc = 2
+)
+
+// elfSymbol64 describes an entry of an ELF64 symbol table.
+type elfSymbol64 struct {
+	nameIndex    uint32
+	info         uint8
+	other        uint8
+	sectionIndex uint16
+	value        uint64
+	size         uint64
+}
+
+// elfTable describes the location of an ELF table that has been loaded by
+// the bootloader.
+type elfTable struct {
+	physAddr uintptr
+	size     uint64
+}
+
+var (
+	// symtab and strtab hold the physical location of the kernel symbol
+	// table and the string table that contains the symbol names.
+	symtab, strtab elfTable
+
+	// physToVirt translates the physical address of the symbol and
+	// string tables into a virtual address that can be accessed by the
+	// kernel.
+	physToVirt func(uintptr) (uintptr, *kernel.Error)
+
+	// visitElfSectionsFn is used by tests and is automatically inlined by the compiler.
+	visitElfSectionsFn = multiboot.VisitElfSections
+
+	errMissingSymbolTable = &kernel.Error{Module: "ksym", Message: "kernel image does not include an ELF symbol table"}
+)
+
+// Init locates the kernel symbol and string tables using the ELF section
+// information provided by the bootloader. As the bootloader reports the
+// physical address of the loaded tables, the supplied physToVirtFn is used
+// for translating them into virtual addresses when looking up symbols. The
+// translation is deferred until a symbol is looked up so Init can be invoked
+// before the physical memory direct map has been set up.
+//
+// The bootloader loads the tables outside the kernel image so the supplied
+// reserveFn is used for preventing the physical memory allocator from
+// handing out the frames that hold them.
+//
+// Init must be invoked while the ELF section headers are still accessible
+// via the identity mapping that is established by the rt0 code.
+func Init(physToVirtFn func(uintptr) (uintptr, *kernel.Error), reserveFn func(uintptr, mem.Size) *kernel.Error) *kernel.Error {
+	symtab, strtab = elfTable{}, elfTable{}
+	physToVirt = physToVirtFn
+
+	var visitor = func(name string, _ multiboot.ElfSectionFlag, address uintptr, size uint64) {
+		switch name {
+		case symtabSectionName:
+			symtab = elfTable{physAddr: address, size: size}
+		case strtabSectionName:
+			strtab = elfTable{physAddr: address, size: size}
+		}
+	}
+
+	// Use the noescape hack to prevent the compiler from leaking the visitor
+	// function literal to the heap.
+	visitElfSectionsFn(
+		*(*multiboot.ElfSectionVisitor)(noEscape(unsafe.Pointer(&visitor))),
+	)
+
+	if symtab.physAddr == 0 || strtab.physAddr == 0 {
+		return errMissingSymbolTable
+	}
+
+	for _, table := range [...]elfTable{symtab, strtab} {
+		if err := reserveFn(table.physAddr, mem.Size(table.size)); err != nil {
+			symtab, strtab = elfTable{}, elfTable{}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Lookup returns the name of the function that contains the supplied address
+// and the offset of the address from the start of the function. If no
+// function symbol contains the address, Lookup falls back to the closest
+// function symbol that precedes it. Lookup returns false if the symbol table
+// is not available or the address cannot be resolved.
+//
+// Lookup does not allocate any memory and can be safely invoked by exception
+// handlers.
+func Lookup(addr uintptr) (string, uintptr, bool) {
+	symtabAddr, strtabAddr, ok := tableAddresses()
+	if !ok {
+		return "", 0, false
+	}
+
+	var (
+		best      *elfSymbol64
+		symSize   = unsafe.Sizeof(elfSymbol64{})
+		symCount  = uintptr(symtab.size) / symSize
+		target    = uint64(addr)
+		bestFound bool
+	)
+
+	for index := uintptr(0); index < symCount; index++ {
+		sym := (*elfSymbol64)(unsafe.Pointer(symtabAddr + index*symSize))
+		if sym.info&0xf != sttFunc || sym.value > target {
+			continue
+		}
+
+		if target < sym.value+sym.size {
+			best, bestFound = sym, true
+			break
+		}
+
+		if !bestFound || sym.value > best.value {
+			best, bestFound = sym, true
+		}
+	}
+
+	if !bestFound || uint64(best.nameIndex) >= strtab.size {
+		return "", 0, false
+	}
+
+	return symbolName(strtabAddr, best.nameIndex), uintptr(target - best.value), true
+}
+
+// tableAddresses returns the virtual addresses of the symbol and string
+// tables.
+func tableAddresses() (uintptr, uintptr, bool) {
+	if physToVirt == nil || symtab.physAddr == 0 || strtab.physAddr == 0 {
+		return 0, 0, false
+	}
+
+	symtabAddr, err := physToVirt(symtab.physAddr)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	strtabAddr, err := physToVirt(strtab.physAddr)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return symtabAddr, strtabAddr, true
+}
+
+// symbolName returns the NULL-terminated symbol name that starts at the
+// supplied string table offset. The returned string points to the string
+// table contents.
+func symbolName(strtabAddr uintptr, nameIndex uint32) string {
+	var (
+		name       string
+		nameHeader = (*reflect.StringHeader)(unsafe.Pointer(&name))
+		end        = uint64(nameIndex)
+	)
+
+	for ; end < strtab.size && *(*byte)(unsafe.Pointer(strtabAddr + uintptr(end))) != 0; end++ {
+	}
+
+	nameHeader.Len = int(end - uint64(nameIndex))
+	nameHeader.Data = strtabAddr + uintptr(nameIndex)
+	return name
+}
+
+// noEscape hides a pointer from escape analysis. This function is copied over
+// from runtime/stubs.go
+//
+//go:nosplit
+func noEscape(p unsafe.Pointer) unsafe.Pointer {
+	x := uintptr(p)
+	return unsafe.Pointer(x ^ 0)
+}
@@ -0,0 +1,163 @@
+package ksym
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/hal/multiboot"
+	"gopheros/kernel/mem"
+	"testing"
+	"unsafe"
+)
+
+func identityPhysToVirt(physAddr uintptr) (uintptr, *kernel.Error) {
+	return physAddr, nil
+}
+
+func noopReserve(_ uintptr, _ mem.Size) *kernel.Error {
+	return nil
+}
+
+// mockSymbolTable installs a visitElfSectionsFn mock that reports a symbol
+// table with the supplied symbols and the matching string table.
+func mockSymbolTable(symbols []elfSymbol64, strtabData []byte) {
+	visitElfSectionsFn = func(visitor multiboot.ElfSectionVisitor) {
+		visitor(".text", multiboot.ElfSectionAllocated|multiboot.ElfSectionExecutable, 0xffff800000100000, 0x1000)
+		visitor(symtabSectionName, 0, uintptr(unsafe.Pointer(&symbols[0])), uint64(uintptr(len(symbols))*unsafe.Sizeof(symbols[0])))
+		visitor(strtabSectionName, 0, uintptr(unsafe.Pointer(&strtabData[0])), uint64(len(strtabData)))
+	}
+}
+
+func TestInit(t *testing.T) {
+	defer func() {
+		visitElfSectionsFn = multiboot.VisitElfSections
+		symtab, strtab, physToVirt = elfTable{}, elfTable{}, nil
+	}()
+
+	visitElfSectionsFn = func(visitor multiboot.ElfSectionVisitor) {
+		visitor(".text", multiboot.ElfSectionAllocated|multiboot.ElfSectionExecutable, 0xffff800000100000, 0x1000)
+	}
+
+	if err := Init(identityPhysToVirt, noopReserve); err != errMissingSymbolTable {
+		t.Fatalf("expected to get errMissingSymbolTable; got %v", err)
+	}
+
+	if _, _, ok := Lookup(0xffff800000100000); ok {
+		t.Fatal("expected Lookup to fail when the symbol table is missing")
+	}
+
+	mockSymbolTable([]elfSymbol64{{}}, []byte{0})
+	if err := Init(identityPhysToVirt, noopReserve); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := unsafe.Sizeof(elfSymbol64{}); symtab.size != uint64(exp) {
+		t.Fatalf("expected symbol table size to be %d; got %d", exp, symtab.size)
+	}
+
+	t.Run("reserve tables", func(t *testing.T) {
+		type region struct {
+			physAddr uintptr
+			size     mem.Size
+		}
+
+		var reserved []region
+		err := Init(identityPhysToVirt, func(physAddr uintptr, size mem.Size) *kernel.Error {
+			reserved = append(reserved, region{physAddr, size})
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exp := []region{
+			{symtab.physAddr, mem.Size(symtab.size)},
+			{strtab.physAddr, mem.Size(strtab.size)},
+		}
+		if len(reserved) != len(exp) || reserved[0] != exp[0] || reserved[1] != exp[1] {
+			t.Fatalf("expected the symbol and string tables to be reserved (%v); got %v", exp, reserved)
+		}
+
+		expErr := &kernel.Error{Module: "test", Message: "too many reservations"}
+		err = Init(identityPhysToVirt, func(_ uintptr, _ mem.Size) *kernel.Error { return expErr })
+		if err != expErr {
+			t.Fatalf("expected to get error %v; got %v", expErr, err)
+		}
+
+		if _, _, ok := Lookup(0xffff800000100000); ok {
+			t.Fatal("expected Lookup to fail when the tables cannot be reserved")
+		}
+	})
+}
+
+func TestLookup(t *testing.T) {
+	defer func() {
+		visitElfSectionsFn = multiboot.VisitElfSections
+		symtab, strtab, physToVirt = elfTable{}, elfTable{}, nil
+	}()
+
+	var (
+		strtabData = []byte("\x00main.main\x00runtime.memmove\x00data\x00asm_stub\x00")
+		symbols    = []elfSymbol64{
+			{},
+			{nameIndex: 1, info: sttFunc, value: 0x1000, size: 0x100},
+			{nameIndex: 11, info: sttFunc, value: 0x1100, size: 0x80},
+			// Data symbols are ignored
+			{nameIndex: 27, info: 1, value: 0x2000, size: 0x100},
+			// Assembly functions may not have a size
+			{nameIndex: 32, info: sttFunc, value: 0x3000},
+		}
+	)
+
+	mockSymbolTable(symbols, strtabData)
+	if err := Init(identityPhysToVirt, noopReserve); err != nil {
+		t.Fatal(err)
+	}
+
+	specs := []struct {
+		addr      uintptr
+		expName   string
+		expOffset uintptr
+		expOK     bool
+	}{
+		{0x1000, "main.main", 0, true},
+		{0x10ff, "main.main", 0xff, true},
+		{0x1142, "runtime.memmove", 0x42, true},
+		// Falls back to the closest preceding function
+		{0x2010, "runtime.memmove", 0xf10, true},
+		{0x3020, "asm_stub", 0x20, true},
+		{0x800, "", 0, false},
+	}
+
+	for specIndex, spec := range specs {
+		name, offset, ok := Lookup(spec.addr)
+		if ok != spec.expOK || name != spec.expName || offset != spec.expOffset {
+			t.Errorf("[spec %d] expected Lookup(0x%x) to return (%q, 0x%x, %t); got (%q, 0x%x, %t)",
+				specIndex, spec.addr, spec.expName, spec.expOffset, spec.expOK, name, offset, ok,
+			)
+		}
+	}
+
+	t.Run("untranslatable tables", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "not mapped"}
+		for _, tableAddr := range []uintptr{symtab.physAddr, strtab.physAddr} {
+			physToVirt = func(physAddr uintptr) (uintptr, *kernel.Error) {
+				if physAddr == tableAddr {
+					return 0, expErr
+				}
+				return physAddr, nil
+			}
+
+			if _, _, ok := Lookup(0x1000); ok {
+				t.Errorf("expected Lookup to fail when table at 0x%x cannot be translated", tableAddr)
+			}
+		}
+	})
+
+	t.Run("invalid name index", func(t *testing.T) {
+		symbols[1].nameIndex = uint32(len(strtabData))
+		physToVirt = identityPhysToVirt
+
+		if _, _, ok := Lookup(0x1000); ok {
+			t.Error("expected Lookup to fail for symbols with an invalid name index")
+		}
+	})
+}
@@ -1,49 +1,127 @@
 package mem
 
 import (
+	"bytes"
+	"gopheros/kernel/cpu"
 	"reflect"
 	"unsafe"
 )
 
-// Memset sets size bytes at the given address to the supplied value. The implementation
-// is based on bytes.Repeat; instead of using a for loop, this function uses
-// log2(size) copy calls which should give us a speed boost as page addresses
-// are always aligned.
+var (
+	// featuresDetected is set to true once the CPU features used by the
+	// memory functions in this package have been detected. As these
+	// functions are invoked before the Go runtime is initialized, the
+	// detection is performed when they are first used instead of from an
+	// init() block.
+	featuresDetected bool
+
+	// ermsSupported is set to true if the CPU supports enhanced
+	// REP MOVSB/STOSB operations which outperform their quad-word
+	// counterparts.
+	ermsSupported bool
+
+	// hasERMSFn is used by tests and is automatically inlined by the compiler.
+	hasERMSFn = cpu.HasERMS
+)
+
+// useERMS returns true if the enhanced REP MOVSB/STOSB operations should be
+// used for setting and copying memory blocks.
+func useERMS() bool {
+	if !featuresDetected {
+		ermsSupported = hasERMSFn()
+		featuresDetected = true
+	}
+
+	return ermsSupported
+}
+
+// Memset sets size bytes at the given address to the supplied value. The
+// implementation uses REP STOSB if the CPU supports ERMS or REP STOSQ followed
+// by REP STOSB for any trailing bytes.
 func Memset(addr uintptr, value byte, size Size) {
 	if size == 0 {
 		return
 	}
 
-	// overlay a slice on top of this address region
-	target := *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
-		Len:  int(size),
-		Cap:  int(size),
-		Data: addr,
-	}))
-
-	// Set first element and make log2(size) optimized copies
-	target[0] = value
-	for index := Size(1); index < size; index *= 2 {
-		copy(target[index:], target[:index])
+	if useERMS() {
+		memsetERMS(addr, value, size)
+		return
 	}
+
+	memsetQuad(addr, value, size)
 }
 
-// Memcopy copies size bytes from src to dst.
+// Memcopy copies size bytes from src to dst. The implementation uses REP MOVSB
+// if the CPU supports ERMS or REP MOVSQ followed by REP MOVSB for any trailing
+// bytes. As the data is copied in ascending address order, Memcopy can only be
+// used with overlapping regions if dst < src; use Memmove for the general case.
 func Memcopy(src, dst uintptr, size Size) {
 	if size == 0 {
 		return
 	}
 
-	srcSlice := *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+	if useERMS() {
+		memcopyERMS(src, dst, size)
+		return
+	}
+
+	memcopyQuad(src, dst, size)
+}
+
+// Memmove copies size bytes from src to dst. Contrary to Memcopy, the src and
+// dst regions may overlap.
+func Memmove(src, dst uintptr, size Size) {
+	if size == 0 || src == dst {
+		return
+	}
+
+	// Copying in ascending address order is only unsafe if dst points
+	// inside the src region.
+	if dst < src || dst >= src+uintptr(size) {
+		Memcopy(src, dst, size)
+		return
+	}
+
+	memmoveBackward(src, dst, size)
+}
+
+// Memcmp compares size bytes at addresses a and b. It returns 0 if both
+// regions contain the same data, -1 if the contents of a are lexicographically
+// smaller than the contents of b and +1 otherwise.
+func Memcmp(a, b uintptr, size Size) int {
+	if size == 0 {
+		return 0
+	}
+
+	aSlice := *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
 		Len:  int(size),
 		Cap:  int(size),
-		Data: src,
+		Data: a,
 	}))
-	dstSlice := *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+	bSlice := *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
 		Len:  int(size),
 		Cap:  int(size),
-		Data: dst,
+		Data: b,
 	}))
 
-	copy(dstSlice, srcSlice)
+	return bytes.Compare(aSlice, bSlice)
 }
+
+// memsetERMS sets size bytes at addr to value using REP STOSB.
+func memsetERMS(addr uintptr, value byte, size Size)
+
+// memsetQuad sets size bytes at addr to value using REP STOSQ for the bulk of
+// the region and REP STOSB for any trailing bytes.
+func memsetQuad(addr uintptr, value byte, size Size)
+
+// memcopyERMS copies size bytes from src to dst using REP MOVSB.
+func memcopyERMS(src, dst uintptr, size Size)
+
+// memcopyQuad copies size bytes from src to dst using REP MOVSQ for the bulk
+// of the region and REP MOVSB for any trailing bytes.
+func memcopyQuad(src, dst uintptr, size Size)
+
+// memmoveBackward copies size bytes from src to dst in descending address
+// order. The copy loop does not rely on the direction flag as interrupt
+// handlers are not guaranteed to clear it.
+func memmoveBackward(src, dst uintptr, size Size)
@@ -0,0 +1,90 @@
+#include "textflag.h"
+
+TEXT ·memsetERMS(SB),NOSPLIT,$0-24
+	MOVQ addr+0(FP), DI
+	MOVBQZX value+8(FP), AX
+	MOVQ size+16(FP), CX
+	CLD
+	REP; STOSB
+	RET
+
+TEXT ·memsetQuad(SB),NOSPLIT,$0-24
+	MOVQ addr+0(FP), DI
+	MOVBQZX value+8(FP), AX
+	MOVQ size+16(FP), DX
+
+	// replicate the value to all bytes of AX
+	MOVQ $0x0101010101010101, BX
+	IMULQ BX, AX
+
+	CLD
+	MOVQ DX, CX
+	SHRQ $3, CX
+	REP; STOSQ
+	MOVQ DX, CX
+	ANDQ $7, CX
+	REP; STOSB
+	RET
+
+TEXT ·memcopyERMS(SB),NOSPLIT,$0-24
+	MOVQ src+0(FP), SI
+	MOVQ dst+8(FP), DI
+	MOVQ size+16(FP), CX
+	CLD
+	REP; MOVSB
+	RET
+
+TEXT ·memcopyQuad(SB),NOSPLIT,$0-24
+	MOVQ src+0(FP), SI
+	MOVQ dst+8(FP), DI
+	MOVQ size+16(FP), DX
+	CLD
+	MOVQ DX, CX
+	SHRQ $3, CX
+	REP; MOVSQ
+	MOVQ DX, CX
+	ANDQ $7, CX
+	REP; MOVSB
+	RET
+
+TEXT ·memmoveBackward(SB),NOSPLIT,$0-24
+	MOVQ src+0(FP), SI
+	MOVQ dst+8(FP), DI
+	MOVQ size+16(FP), CX
+
+	// copy blocks of 4 quad words starting from the end of the region.
+	// Each block is read in full before being written so that overlapping
+	// regions are handled correctly. Any remaining quad words and leading
+	// bytes are copied last.
+blockLoop:
+	CMPQ CX, $32
+	JB quadLoop
+	SUBQ $32, CX
+	MOVQ 24(SI)(CX*1), AX
+	MOVQ 16(SI)(CX*1), BX
+	MOVQ 8(SI)(CX*1), DX
+	MOVQ 0(SI)(CX*1), R8
+	MOVQ AX, 24(DI)(CX*1)
+	MOVQ BX, 16(DI)(CX*1)
+	MOVQ DX, 8(DI)(CX*1)
+	MOVQ R8, 0(DI)(CX*1)
+	JMP blockLoop
+
+quadLoop:
+	CMPQ CX, $8
+	JB byteLoop
+	SUBQ $8, CX
+	MOVQ (SI)(CX*1), AX
+	MOVQ AX, (DI)(CX*1)
+	JMP quadLoop
+
+byteLoop:
+	TESTQ CX, CX
+	JZ done
+	DECQ CX
+	MOVB (SI)(CX*1), AX
+	MOVB AX, (DI)(CX*1)
+	JMP byteLoop
+
+done:
+	RET
@@ -1,52 +1,258 @@
 package mem
 
 import (
+	"gopheros/kernel/cpu"
+	"reflect"
 	"testing"
 	"unsafe"
 )
 
+// withERMSModes runs fn once with ERMS support disabled and once with ERMS
+// support enabled.
+func withERMSModes(t *testing.T, fn func(t *testing.T)) {
+	defer func() {
+		hasERMSFn = cpu.HasERMS
+		featuresDetected = false
+	}()
+
+	for _, erms := range []bool{false, true} {
+		featuresDetected = false
+		hasERMSFn = func() bool { return erms }
+
+		name := "rep stosq/movsq"
+		if erms {
+			name = "erms"
+		}
+		t.Run(name, fn)
+	}
+}
+
+func TestUseERMS(t *testing.T) {
+	defer func() {
+		hasERMSFn = cpu.HasERMS
+		featuresDetected = false
+	}()
+
+	detectCount := 0
+	featuresDetected = false
+	hasERMSFn = func() bool {
+		detectCount++
+		return true
+	}
+
+	for i := 0; i < 3; i++ {
+		if !useERMS() {
+			t.Fatal("expected useERMS to return true")
+		}
+	}
+
+	if detectCount != 1 {
+		t.Fatalf("expected ERMS detection to be performed once; got %d", detectCount)
+	}
+}
+
 func TestMemset(t *testing.T) {
-	// memset with a 0 size should be a no-op
-	Memset(uintptr(0), 0x00, 0)
+	withERMSModes(t, func(t *testing.T) {
+		// memset with a 0 size should be a no-op
+		Memset(uintptr(0), 0x00, 0)
+
+		for pageCount := uint32(1); pageCount <= 10; pageCount++ {
+			buf := make([]byte, PageSize<<pageCount)
+			for i := 0; i < len(buf); i++ {
+				buf[i] = 0xFE
+			}
+
+			addr := uintptr(unsafe.Pointer(&buf[0]))
+			Memset(addr, 0x00, Size(len(buf)))
+
+			for i := 0; i < len(buf); i++ {
+				if got := buf[i]; got != 0x00 {
+					t.Errorf("[block with %d pages] expected byte: %d to be 0x00; got 0x%x", pageCount, i, got)
+				}
+			}
+		}
 
-	for pageCount := uint32(1); pageCount <= 10; pageCount++ {
-		buf := make([]byte, PageSize<<pageCount)
+		// Unaligned blocks whose size is not a multiple of 8
+		buf := make([]byte, 64)
+		Memset(uintptr(unsafe.Pointer(&buf[3])), 0xAB, 13)
 		for i := 0; i < len(buf); i++ {
-			buf[i] = 0xFE
+			exp := byte(0)
+			if i >= 3 && i < 16 {
+				exp = 0xAB
+			}
+
+			if buf[i] != exp {
+				t.Errorf("expected byte %d to be 0x%x; got 0x%x", i, exp, buf[i])
+			}
 		}
+	})
+}
 
-		addr := uintptr(unsafe.Pointer(&buf[0]))
-		Memset(addr, 0x00, Size(len(buf)))
+func TestMemcopy(t *testing.T) {
+	withERMSModes(t, func(t *testing.T) {
+		// memcopy with a 0 size should be a no-op
+		Memcopy(uintptr(0), uintptr(0), 0)
 
-		for i := 0; i < len(buf); i++ {
-			if got := buf[i]; got != 0x00 {
-				t.Errorf("[block with %d pages] expected byte: %d to be 0x00; got 0x%x", pageCount, i, got)
+		for _, size := range []Size{PageSize, PageSize - 3, 7} {
+			var (
+				src = make([]byte, PageSize)
+				dst = make([]byte, PageSize)
+			)
+			for i := 0; i < len(src); i++ {
+				src[i] = byte(i % 256)
+			}
+
+			Memcopy(
+				uintptr(unsafe.Pointer(&src[0])),
+				uintptr(unsafe.Pointer(&dst[0])),
+				size,
+			)
+
+			for i := 0; i < len(src); i++ {
+				exp := src[i]
+				if Size(i) >= size {
+					exp = 0
+				}
+
+				if got := dst[i]; got != exp {
+					t.Errorf("[size %d] value mismatch between src and dst at index %d", size, i)
+				}
 			}
 		}
+	})
+}
+
+func TestMemmove(t *testing.T) {
+	withERMSModes(t, func(t *testing.T) {
+		// memmove with a 0 size or the same src and dst should be a no-op
+		Memmove(uintptr(0), uintptr(0), 0)
+		Memmove(uintptr(1), uintptr(1), 32)
+
+		specs := []struct {
+			srcOffset, dstOffset, size int
+		}{
+			// non-overlapping
+			{0, 128, 64},
+			{128, 0, 64},
+			// overlapping with dst < src
+			{16, 3, 77},
+			// overlapping with dst > src
+			{3, 16, 77},
+			{0, 1, 8},
+			{0, 8, 120},
+			{5, 6, 3},
+			{1, 9, 200},
+		}
+
+		for specIndex, spec := range specs {
+			buf := make([]byte, 256)
+			for i := 0; i < len(buf); i++ {
+				buf[i] = byte(i)
+			}
+
+			exp := make([]byte, len(buf))
+			copy(exp, buf)
+			copy(exp[spec.dstOffset:spec.dstOffset+spec.size], exp[spec.srcOffset:spec.srcOffset+spec.size])
+
+			Memmove(
+				uintptr(unsafe.Pointer(&buf[spec.srcOffset])),
+				uintptr(unsafe.Pointer(&buf[spec.dstOffset])),
+				Size(spec.size),
+			)
+
+			if !reflect.DeepEqual(buf, exp) {
+				t.Errorf("[spec %d] expected buffer contents to be:\n%v\ngot:\n%v", specIndex, exp, buf)
+			}
+		}
+	})
+}
+
+func TestMemcmp(t *testing.T) {
+	// memcmp with a 0 size should report equal regions
+	if got := Memcmp(uintptr(0), uintptr(0), 0); got != 0 {
+		t.Fatalf("expected Memcmp to return 0; got %d", got)
+	}
+
+	specs := []struct {
+		a, b string
+		exp  int
+	}{
+		{"gopher", "gopher", 0},
+		{"gopheR", "gopher", -1},
+		{"gopher", "Gopher", 1},
+		{"\x00\x01", "\x00\x00", 1},
+	}
+
+	for specIndex, spec := range specs {
+		a, b := []byte(spec.a), []byte(spec.b)
+		got := Memcmp(uintptr(unsafe.Pointer(&a[0])), uintptr(unsafe.Pointer(&b[0])), Size(len(a)))
+		if got != spec.exp {
+			t.Errorf("[spec %d] expected Memcmp to return %d; got %d", specIndex, spec.exp, got)
+		}
 	}
 }
 
-func TestMemcopy(t *testing.T) {
-	// memcopy with a 0 size should be a no-op
-	Memcopy(uintptr(0), uintptr(0), 0)
+// memsetLoop and memcopyLoop contain the copy-based implementations that
+// were used before switching to the assembly versions. They are only used
+// as a baseline by the benchmarks below.
+func memsetLoop(addr uintptr, value byte, size Size) {
+	target := *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+		Len:  int(size),
+		Cap:  int(size),
+		Data: addr,
+	}))
 
-	var (
-		src = make([]byte, PageSize)
-		dst = make([]byte, PageSize)
-	)
-	for i := 0; i < len(src); i++ {
-		src[i] = byte(i % 256)
+	target[0] = value
+	for index := Size(1); index < size; index *= 2 {
+		copy(target[index:], target[:index])
 	}
+}
+
+func memcopyLoop(src, dst uintptr, size Size) {
+	srcSlice := *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+		Len:  int(size),
+		Cap:  int(size),
+		Data: src,
+	}))
+	dstSlice := *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+		Len:  int(size),
+		Cap:  int(size),
+		Data: dst,
+	}))
+
+	copy(dstSlice, srcSlice)
+}
 
-	Memcopy(
-		uintptr(unsafe.Pointer(&src[0])),
-		uintptr(unsafe.Pointer(&dst[0])),
-		PageSize,
+func benchmarkMemset(b *testing.B, fn func(uintptr, byte, Size)) {
+	buf := make([]byte, PageSize)
+	addr := uintptr(unsafe.Pointer(&buf[0]))
+
+	b.SetBytes(int64(PageSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fn(addr, 0, PageSize)
+	}
+}
+
+func benchmarkMemcopy(b *testing.B, fn func(uintptr, uintptr, Size)) {
+	var (
+		src     = make([]byte, PageSize)
+		dst     = make([]byte, PageSize)
+		srcAddr = uintptr(unsafe.Pointer(&src[0]))
+		dstAddr = uintptr(unsafe.Pointer(&dst[0]))
 	)
 
-	for i := 0; i < len(src); i++ {
-		if got := dst[i]; got != src[i] {
-			t.Errorf("value mismatch between src and dst at index %d", i)
-		}
+	b.SetBytes(int64(PageSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fn(srcAddr, dstAddr, PageSize)
 	}
 }
+
+func BenchmarkMemsetLoop(b *testing.B)      { benchmarkMemset(b, memsetLoop) }
+func BenchmarkMemsetQuad(b *testing.B)      { benchmarkMemset(b, memsetQuad) }
+func BenchmarkMemsetERMS(b *testing.B)      { benchmarkMemset(b, memsetERMS) }
+func BenchmarkMemcopyLoop(b *testing.B)     { benchmarkMemcopy(b, memcopyLoop) }
+func BenchmarkMemcopyQuad(b *testing.B)     { benchmarkMemcopy(b, memcopyQuad) }
+func BenchmarkMemcopyERMS(b *testing.B)     { benchmarkMemcopy(b, memcopyERMS) }
+func BenchmarkMemmoveBackward(b *testing.B) { benchmarkMemcopy(b, memmoveBackward) }
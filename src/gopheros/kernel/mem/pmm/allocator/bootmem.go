@@ -8,14 +8,24 @@ import (
 	"gopheros/kernel/mem/pmm"
 )
 
+// maxReservedRanges defines the maximum number of physical memory ranges,
+// besides the kernel image, that can be reserved via ReserveFrames.
+const maxReservedRanges = 8
+
 var (
 	// earlyAllocator is a boot mem allocator instance used for page
 	// allocations before switching to a more advanced allocator.
 	earlyAllocator bootMemAllocator
 
-	errBootAllocOutOfMemory = &kernel.Error{Module: "boot_mem_alloc", Message: "out of memory"}
+	errBootAllocOutOfMemory         = &kernel.Error{Module: "boot_mem_alloc", Message: "out of memory"}
+	errBootAllocTooManyReservations = &kernel.Error{Module: "boot_mem_alloc", Message: "too many reserved memory ranges"}
 )
 
+// frameRange describes the inclusive frame range [start, end].
+type frameRange struct {
+	start, end pmm.Frame
+}
+
 // bootMemAllocator implements a rudimentary physical memory allocator which is
 // used to bootstrap the kernel.
 //
@@ -38,6 +48,11 @@ type bootMemAllocator struct {
 	// Keep track of kernel location so we exclude this region.
 	kernelStartAddr, kernelEndAddr   uintptr
 	kernelStartFrame, kernelEndFrame pmm.Frame
+
+	// Keep track of any other memory ranges that must be excluded (e.g.
+	// data loaded by the bootloader outside the kernel image).
+	reservedRanges     [maxReservedRanges]frameRange
+	reservedRangeCount int
 }
 
 // init sets up the boot memory allocator internal state.
@@ -52,6 +67,45 @@ func (alloc *bootMemAllocator) init(kernelStart, kernelEnd uintptr) {
 
 }
 
+// reserve excludes the frames that overlap the physical memory range
+// [physAddr, physAddr+size) from allocations.
+func (alloc *bootMemAllocator) reserve(physAddr uintptr, size mem.Size) *kernel.Error {
+	if size == 0 {
+		return nil
+	}
+
+	if alloc.reservedRangeCount == maxReservedRanges {
+		return errBootAllocTooManyReservations
+	}
+
+	alloc.reservedRanges[alloc.reservedRangeCount] = frameRange{
+		start: pmm.Frame(physAddr >> mem.PageShift),
+		end:   pmm.Frame((physAddr + uintptr(size) - 1) >> mem.PageShift),
+	}
+	alloc.reservedRangeCount++
+	return nil
+}
+
+// skipReserved returns the first frame, starting at frame, that does not
+// belong to one of the ranges reserved via a call to reserve.
+func (alloc *bootMemAllocator) skipReserved(frame pmm.Frame) pmm.Frame {
+	for skipped := true; skipped; {
+		skipped = false
+		for index := 0; index < alloc.reservedRangeCount; index++ {
+			if r := alloc.reservedRanges[index]; frame >= r.start && frame <= r.end {
+				frame, skipped = r.end+1, true
+			}
+		}
+
+		// Skipping a reserved range may land on the kernel image
+		if alloc.kernelStartFrame <= alloc.kernelEndFrame && frame >= alloc.kernelStartFrame && frame <= alloc.kernelEndFrame {
+			frame, skipped = alloc.kernelEndFrame+1, true
+		}
+	}
+
+	return frame
+}
+
 // AllocFrame scans the system memory regions reported by the bootloader and
 // reserves the next available free frame.
 //
@@ -96,7 +150,11 @@ func (alloc *bootMemAllocator) AllocFrame() (pmm.Frame, *kernel.Error) {
 			alloc.lastAllocFrame++
 		}
 
-		// The above adjustment might push lastAllocFrame outside of the
+		if alloc.reservedRangeCount != 0 {
+			alloc.lastAllocFrame = alloc.skipReserved(alloc.lastAllocFrame)
+		}
+
+		// The above adjustments might push lastAllocFrame outside of the
 		// region end (e.g kernel ends at last page in the region)
 		if alloc.lastAllocFrame > regionEndFrame {
 			return true
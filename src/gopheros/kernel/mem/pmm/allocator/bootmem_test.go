@@ -90,6 +90,58 @@ func TestBootMemoryAllocator(t *testing.T) {
 	}
 }
 
+func TestBootMemoryAllocatorReservedRanges(t *testing.T) {
+	multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&multibootMemoryMap[0])))
+
+	var alloc bootMemAllocator
+
+	// the kernel is loaded at region 2 start + 2K taking 1.5 pages
+	alloc.init(0x100800, 0x102000)
+
+	// reserve frame 0 and frames 258-261 which immediately follow the kernel
+	if err := alloc.reserve(0x500, 0x10); err != nil {
+		t.Fatal(err)
+	}
+	if err := alloc.reserve(0x102000, 0x3800); err != nil {
+		t.Fatal(err)
+	}
+	if err := alloc.reserve(0x200000, 0); err != nil || alloc.reservedRangeCount != 2 {
+		t.Fatalf("expected empty reservation to be ignored; got error %v and %d ranges", err, alloc.reservedRangeCount)
+	}
+
+	for {
+		frame, err := alloc.AllocFrame()
+		if err != nil {
+			if err != errBootAllocOutOfMemory {
+				t.Errorf("[frame %d] unexpected allocator error: %v", alloc.allocCount, err)
+			}
+			break
+		}
+
+		if frame == 0 || (frame >= 256 && frame <= 261) {
+			t.Errorf("[frame %d] allocated reserved frame %d", alloc.allocCount, frame)
+		}
+	}
+
+	// region 1 provides 159 frames out of which frame 0 is reserved
+	// region 2 provides 32480 frames out of which frames 256-261 are reserved
+	if exp := uint64(159 - 1 + 32480 - 6); alloc.allocCount != exp {
+		t.Errorf("expected allocator to allocate %d frames; allocated %d", exp, alloc.allocCount)
+	}
+
+	t.Run("too many reservations", func(t *testing.T) {
+		for alloc.reservedRangeCount < maxReservedRanges {
+			if err := alloc.reserve(0x300000, 0x10); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := alloc.reserve(0x300000, 0x10); err != errBootAllocTooManyReservations {
+			t.Fatalf("expected to get errBootAllocTooManyReservations; got %v", err)
+		}
+	})
+}
+
 var (
 	// A dump of multiboot data when running under qemu containing only the
 	// memory region tag.  The dump encodes the following available memory
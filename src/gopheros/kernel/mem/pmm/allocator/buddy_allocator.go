@@ -0,0 +1,731 @@
+package allocator
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/hal/multiboot"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"gopheros/kernel/mem/vmm"
+	"reflect"
+	"unsafe"
+)
+
+const (
+	// MaxOrder defines the largest block order supported by the buddy
+	// allocator. A block of order n spans (1 << n) physically contiguous
+	// frames so the largest block that can be allocated is 4M.
+	MaxOrder = 10
+
+	// pinnedRefCount is a special reference count value for frames that
+	// should never be released (e.g. frames occupied by the kernel image).
+	pinnedRefCount = uint16(0xffff)
+)
+
+var (
+	// buddyAllocator is a BuddyAllocator instance that serves as the
+	// primary allocator for reserving pages.
+	buddyAllocator BuddyAllocator
+
+	errBuddyAllocOutOfMemory     = &kernel.Error{Module: "buddy_alloc", Message: "out of memory"}
+	errBuddyAllocFrameNotManaged = &kernel.Error{Module: "buddy_alloc", Message: "frame not managed by this allocator"}
+	errBuddyAllocDoubleFree      = &kernel.Error{Module: "buddy_alloc", Message: "frame is already free"}
+	errBuddyAllocInvalidOrder    = &kernel.Error{Module: "buddy_alloc", Message: "requested block order exceeds MaxOrder"}
+	errBuddyAllocMisalignedFrame = &kernel.Error{Module: "buddy_alloc", Message: "frame is not aligned to the requested block order"}
+	errBuddyAllocInvalidZone     = &kernel.Error{Module: "buddy_alloc", Message: "zone mask does not match any memory zone"}
+	errBuddyAllocRefFreeFrame    = &kernel.Error{Module: "buddy_alloc", Message: "cannot add a reference to a free frame"}
+	errBuddyAllocRefOverflow     = &kernel.Error{Module: "buddy_alloc", Message: "frame reference count overflow"}
+
+	// The followning functions are used by tests to mock calls to the vmm package
+	// and are automatically inlined by the compiler.
+	reserveRegionFn = vmm.EarlyReserveRegion
+	mapFn           = vmm.Map
+)
+
+type markAs bool
+
+const (
+	markReserved markAs = false
+	markFree            = true
+)
+
+type framePool struct {
+	// startFrame is the frame number for the first page in this pool.
+	// each free bitmap entry i corresponds to frame (startFrame + i).
+	startFrame pmm.Frame
+
+	// endFrame tracks the last frame in the pool. The total number of
+	// frames is given by: (endFrame - startFrame) + 1
+	endFrame pmm.Frame
+
+	// zone specifies the memory zone that contains all pool frames.
+	zone Zone
+
+	// freeCount tracks the available pages in this pool. The allocator
+	// can use this field to skip fully allocated pools without the need
+	// to scan the free bitmap.
+	freeCount uint32
+
+	// freeBitmap tracks used/free pages in the pool.
+	freeBitmap    []uint64
+	freeBitmapHdr reflect.SliceHeader
+
+	// orderBitmaps tracks the free blocks for each supported block order.
+	// If bit i of orderBitmaps[n] is set, then the block of (1 << n)
+	// frames that starts at frame ((startFrame >> n) + i) << n is free and
+	// not part of a larger free block. Only blocks that are fully
+	// contained inside the pool are ever flagged as free.
+	orderBitmaps    [MaxOrder + 1][]uint64
+	orderBitmapHdrs [MaxOrder + 1]reflect.SliceHeader
+
+	// refCounts tracks the number of references (e.g. page table
+	// entries) to each reserved frame in the pool. Frames whose reference
+	// count is set to pinnedRefCount are never released.
+	refCounts    []uint16
+	refCountsHdr reflect.SliceHeader
+}
+
+// BuddyAllocator implements a physical frame allocator that can reserve
+// blocks of physically contiguous frames. Each block contains a power of 2
+// frames; the exponent is referred to as the block order. Blocks are always
+// aligned to their size and whenever a block is released it is merged with
+// its free "buddy" block into a block of the next order.
+//
+// In addition to the per-order free block bitmaps, the allocator tracks the
+// reservation state for each individual frame using a free bitmap. This
+// bitmap is used for detecting double frees and for reserving the frames
+// occupied by the kernel image and the early allocator.
+//
+// The allocator also maintains a reference count for each reserved frame so
+// that frames can be shared (e.g. by copy-on-write mappings in different
+// address spaces) and only get released when their last reference is dropped.
+type BuddyAllocator struct {
+	// totalPages tracks the total number of pages across all pools.
+	totalPages uint32
+
+	// reservedPages tracks the number of reserved pages across all pools.
+	reservedPages uint32
+
+	pools    []framePool
+	poolsHdr reflect.SliceHeader
+}
+
+// init allocates space for the allocator structures using the early bootmem
+// allocator and flags any allocated pages as reserved.
+func (alloc *BuddyAllocator) init() *kernel.Error {
+	if err := alloc.setupPoolBitmaps(); err != nil {
+		return err
+	}
+
+	alloc.reserveKernelFrames()
+	alloc.reserveEarlyAllocatorFrames()
+	alloc.initFreeBlocks()
+	alloc.printStats()
+	return nil
+}
+
+// regionFrames returns the first and last frame that are fully contained in
+// the supplied memory region. Reported addresses may not be page-aligned so
+// the region start is rounded up and the region end is rounded down to the
+// nearest page boundary. If the region does not contain at least one full
+// frame, regionFrames returns false.
+func regionFrames(region *multiboot.MemoryMapEntry) (pmm.Frame, pmm.Frame, bool) {
+	pageSizeMinus1 := uint64(mem.PageSize - 1)
+	startFrame := pmm.Frame(((region.PhysAddress + pageSizeMinus1) & ^pageSizeMinus1) >> mem.PageShift)
+	endFrame := pmm.Frame((region.PhysAddress + region.Length) >> mem.PageShift)
+	if endFrame <= startFrame {
+		return 0, 0, false
+	}
+
+	return startFrame, endFrame - 1, true
+}
+
+// bitmapWords returns the number of uint64 words required by a bitmap that
+// tracks the blocks of the specified order that overlap the frame range
+// [startFrame, endFrame].
+func bitmapWords(startFrame, endFrame pmm.Frame, order uint8) uintptr {
+	blockCount := uintptr(endFrame>>order) - uintptr(startFrame>>order) + 1
+	return (blockCount + 63) >> 6
+}
+
+// refCountWords returns the number of uint64 words required for storing the
+// reference counters for the frame range [startFrame, endFrame].
+func refCountWords(startFrame, endFrame pmm.Frame) uintptr {
+	return (uintptr(endFrame-startFrame) + 4) >> 2
+}
+
+// setupPoolBitmaps uses the early allocator and vmm region reservation helper
+// to initialize the list of available pools and their free bitmap slices.
+func (alloc *BuddyAllocator) setupPoolBitmaps() *kernel.Error {
+	var (
+		err                 *kernel.Error
+		sizeofPool          = unsafe.Sizeof(framePool{})
+		pageSizeMinus1      = uintptr(mem.PageSize - 1)
+		requiredBitmapWords uintptr
+	)
+
+	// Detect available memory regions and calculate their pool bitmap
+	// requirements. Regions that span multiple zones are split into one
+	// pool per zone.
+	visitAvailableRanges(func(startFrame, endFrame pmm.Frame, _ Zone) {
+		alloc.poolsHdr.Len++
+		alloc.poolsHdr.Cap++
+		alloc.totalPages += uint32(endFrame - startFrame + 1)
+
+		// Each pool requires a bitmap for tracking the reservation
+		// state of its frames and one bitmap per supported block order.
+		requiredBitmapWords += bitmapWords(startFrame, endFrame, 0)
+		for order := uint8(0); order <= MaxOrder; order++ {
+			requiredBitmapWords += bitmapWords(startFrame, endFrame, order)
+		}
+
+		// Each pool also requires a reference counter for each frame
+		requiredBitmapWords += refCountWords(startFrame, endFrame)
+	})
+
+	// Reserve enough pages to hold the allocator state
+	requiredBytes := mem.Size((uintptr(alloc.poolsHdr.Len)*sizeofPool + requiredBitmapWords<<3 + pageSizeMinus1) & ^pageSizeMinus1)
+	requiredPages := requiredBytes >> mem.PageShift
+	alloc.poolsHdr.Data, err = reserveRegionFn(requiredBytes)
+	if err != nil {
+		return err
+	}
+
+	for page, index := vmm.PageFromAddress(alloc.poolsHdr.Data), mem.Size(0); index < requiredPages; page, index = page+1, index+1 {
+		nextFrame, err := earlyAllocFrame()
+		if err != nil {
+			return err
+		}
+
+		if err = mapFn(page, nextFrame, vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute); err != nil {
+			return err
+		}
+
+		mem.Memset(page.Address(), 0, mem.PageSize)
+	}
+
+	alloc.pools = *(*[]framePool)(unsafe.Pointer(&alloc.poolsHdr))
+
+	// Run a second pass to initialize the bitmap slices for all pools
+	bitmapStartAddr := alloc.poolsHdr.Data + uintptr(alloc.poolsHdr.Len)*sizeofPool
+	poolIndex := 0
+	visitAvailableRanges(func(startFrame, endFrame pmm.Frame, zone Zone) {
+		pool := &alloc.pools[poolIndex]
+		pool.startFrame = startFrame
+		pool.endFrame = endFrame
+		pool.zone = zone
+		pool.freeCount = uint32(endFrame - startFrame + 1)
+		bitmapStartAddr = overlayBitmap(&pool.freeBitmap, &pool.freeBitmapHdr, bitmapStartAddr, bitmapWords(startFrame, endFrame, 0))
+		for order := uint8(0); order <= MaxOrder; order++ {
+			bitmapStartAddr = overlayBitmap(&pool.orderBitmaps[order], &pool.orderBitmapHdrs[order], bitmapStartAddr, bitmapWords(startFrame, endFrame, order))
+		}
+
+		pool.refCountsHdr.Len = int(endFrame - startFrame + 1)
+		pool.refCountsHdr.Cap = pool.refCountsHdr.Len
+		pool.refCountsHdr.Data = bitmapStartAddr
+		pool.refCounts = *(*[]uint16)(unsafe.Pointer(&pool.refCountsHdr))
+		bitmapStartAddr += refCountWords(startFrame, endFrame) << 3
+
+		poolIndex++
+	})
+
+	return nil
+}
+
+// overlayBitmap points the supplied bitmap slice to a block of wordCount
+// uint64 values starting at addr. It returns back the address that follows
+// the end of the overlaid block.
+func overlayBitmap(bitmap *[]uint64, hdr *reflect.SliceHeader, addr, wordCount uintptr) uintptr {
+	hdr.Len = int(wordCount)
+	hdr.Cap = hdr.Len
+	hdr.Data = addr
+	*bitmap = *(*[]uint64)(unsafe.Pointer(hdr))
+
+	return addr + wordCount<<3
+}
+
+// markFrame updates the reservation flag for the bitmap entry that corresponds
+// to the supplied frame. Frames marked as reserved start with a reference
+// count of 1 whereas frames marked as free have their reference count reset.
+func (alloc *BuddyAllocator) markFrame(poolIndex int, frame pmm.Frame, flag markAs) {
+	if poolIndex < 0 || frame > alloc.pools[poolIndex].endFrame {
+		return
+	}
+
+	// The offset in the block is given by: frame % 64. As the bitmap uses a
+	// big-ending representation we need to set the bit at index: 63 - offset
+	relFrame := frame - alloc.pools[poolIndex].startFrame
+	block := relFrame >> 6
+	mask := uint64(1 << (63 - (relFrame - block<<6)))
+	switch flag {
+	case markFree:
+		alloc.pools[poolIndex].freeBitmap[block] &^= mask
+		alloc.pools[poolIndex].refCounts[relFrame] = 0
+		alloc.pools[poolIndex].freeCount++
+		alloc.reservedPages--
+	case markReserved:
+		alloc.pools[poolIndex].freeBitmap[block] |= mask
+		alloc.pools[poolIndex].refCounts[relFrame] = 1
+		alloc.pools[poolIndex].freeCount--
+		alloc.reservedPages++
+	}
+}
+
+// poolForFrame returns the index of the pool that contains frame or -1 if
+// the frame is not contained in any of the available memory pools (e.g it
+// points to a reserved memory region).
+func (alloc *BuddyAllocator) poolForFrame(frame pmm.Frame) int {
+	for poolIndex, pool := range alloc.pools {
+		if frame >= pool.startFrame && frame <= pool.endFrame {
+			return poolIndex
+		}
+	}
+
+	return -1
+}
+
+// reserveKernelFrames makes as reserved the bitmap entries for the frames
+// occupied by the kernel image and pins them so they can never be released.
+// The frames in any range reserved via ReserveFrames are also reserved and
+// pinned.
+func (alloc *BuddyAllocator) reserveKernelFrames() {
+	// Flag frames used by kernel image as reserved. Since the kernel must
+	// occupy a contiguous memory block we assume that all its frames will
+	// fall into one of the available memory pools
+	poolIndex := alloc.poolForFrame(earlyAllocator.kernelStartFrame)
+	for frame := earlyAllocator.kernelStartFrame; frame <= earlyAllocator.kernelEndFrame; frame++ {
+		alloc.markFrame(poolIndex, frame, markReserved)
+		if poolIndex >= 0 && frame <= alloc.pools[poolIndex].endFrame {
+			alloc.pools[poolIndex].refCounts[frame-alloc.pools[poolIndex].startFrame] = pinnedRefCount
+		}
+	}
+
+	// Reserved ranges may span multiple pools or overlap the kernel image
+	for index := 0; index < earlyAllocator.reservedRangeCount; index++ {
+		r := earlyAllocator.reservedRanges[index]
+		for frame := r.start; frame <= r.end; frame++ {
+			if poolIndex = alloc.poolForFrame(frame); poolIndex < 0 {
+				continue
+			}
+
+			pool := &alloc.pools[poolIndex]
+			if !pool.isReserved(frame) {
+				alloc.markFrame(poolIndex, frame, markReserved)
+			}
+			pool.refCounts[frame-pool.startFrame] = pinnedRefCount
+		}
+	}
+}
+
+// reserveEarlyAllocatorFrames makes as reserved the bitmap entries for the frames
+// already allocated by the early allocator.
+func (alloc *BuddyAllocator) reserveEarlyAllocatorFrames() {
+	// We now need to decomission the early allocator by flagging all frames
+	// allocated by it as reserved. The allocator itself does not track
+	// individual frames but only a counter of allocated frames. To get
+	// the list of frames we reset its internal state and "replay" the
+	// allocation requests to get the correct frames.
+	allocCount := earlyAllocator.allocCount
+	earlyAllocator.allocCount, earlyAllocator.lastAllocFrame = 0, 0
+	for i := uint64(0); i < allocCount; i++ {
+		frame, _ := earlyAllocator.AllocFrame()
+		alloc.markFrame(
+			alloc.poolForFrame(frame),
+			frame,
+			markReserved,
+		)
+	}
+}
+
+// initFreeBlocks populates the per-order free block bitmaps using the frame
+// reservation information stored in the free bitmap of each pool. Each free
+// frame is released individually so that adjacent free frames get coalesced
+// into the largest possible free blocks.
+func (alloc *BuddyAllocator) initFreeBlocks() {
+	for poolIndex := 0; poolIndex < len(alloc.pools); poolIndex++ {
+		pool := &alloc.pools[poolIndex]
+		for frame := pool.startFrame; frame <= pool.endFrame; frame++ {
+			if !pool.isReserved(frame) {
+				pool.releaseBlock(frame, 0)
+			}
+		}
+	}
+}
+
+func (alloc *BuddyAllocator) printStats() {
+	kfmt.Printf(
+		"[buddy_alloc] page stats: free: %d/%d (%d reserved)\n",
+		alloc.totalPages-alloc.reservedPages,
+		alloc.totalPages,
+		alloc.reservedPages,
+	)
+
+	for zone := ZoneDMA; zone <= ZoneNormal; zone <<= 1 {
+		var zoneFree, zoneTotal uint32
+		for poolIndex := 0; poolIndex < len(alloc.pools); poolIndex++ {
+			if alloc.pools[poolIndex].zone != zone {
+				continue
+			}
+
+			zoneFree += alloc.pools[poolIndex].freeCount
+			zoneTotal += uint32(alloc.pools[poolIndex].endFrame - alloc.pools[poolIndex].startFrame + 1)
+		}
+
+		if zoneTotal != 0 {
+			kfmt.Printf("[buddy_alloc] zone %6s: free: %d/%d\n", zone.String(), zoneFree, zoneTotal)
+		}
+	}
+}
+
+// AllocFrames reserves a block of (1 << order) physically contiguous frames
+// and returns the first frame in the block. The returned frame is always
+// aligned to the block size. An error will be returned if order exceeds
+// MaxOrder or if no free block of the requested order can be found.
+//
+// AllocFrames will try to satisfy the request using frames from the Normal
+// zone before falling back to the DMA32 and DMA zones.
+func (alloc *BuddyAllocator) AllocFrames(order uint8) (pmm.Frame, *kernel.Error) {
+	return alloc.AllocFramesIn(order, ZoneAny)
+}
+
+// AllocFramesIn behaves like AllocFrames but only reserves frames from the
+// zones that are present in the supplied zone mask. If the mask contains
+// multiple zones, they are checked in the following order: Normal, DMA32
+// and DMA.
+func (alloc *BuddyAllocator) AllocFramesIn(order uint8, zones Zone) (pmm.Frame, *kernel.Error) {
+	if order > MaxOrder {
+		return pmm.InvalidFrame, errBuddyAllocInvalidOrder
+	}
+
+	if zones&ZoneAny == 0 {
+		return pmm.InvalidFrame, errBuddyAllocInvalidZone
+	}
+
+	blockFrames := pmm.Frame(1 << order)
+	for _, zone := range zoneAllocOrder {
+		if zones&zone == 0 {
+			continue
+		}
+
+		for poolIndex := 0; poolIndex < len(alloc.pools); poolIndex++ {
+			if alloc.pools[poolIndex].zone != zone || alloc.pools[poolIndex].freeCount < uint32(blockFrames) {
+				continue
+			}
+
+			frame, ok := alloc.pools[poolIndex].reserveBlock(order)
+			if !ok {
+				continue
+			}
+
+			for offset := pmm.Frame(0); offset < blockFrames; offset++ {
+				alloc.markFrame(poolIndex, frame+offset, markReserved)
+			}
+			return frame, nil
+		}
+	}
+
+	return pmm.InvalidFrame, errBuddyAllocOutOfMemory
+}
+
+// FreeFrames releases a block of frames previously allocated via a call to
+// AllocFrames with the same order argument. The released block is merged
+// with any free buddy blocks. Trying to release a block that is not part of
+// the allocator pools, is not aligned to its order or contains frames that
+// are already marked as free will cause an error to be returned.
+//
+// FreeFrames releases the block regardless of the reference counts of its
+// frames. Callers that share frames should use DecRef instead.
+func (alloc *BuddyAllocator) FreeFrames(frame pmm.Frame, order uint8) *kernel.Error {
+	if order > MaxOrder {
+		return errBuddyAllocInvalidOrder
+	}
+
+	blockFrames := pmm.Frame(1 << order)
+	if frame&(blockFrames-1) != 0 {
+		return errBuddyAllocMisalignedFrame
+	}
+
+	poolIndex := alloc.poolForFrame(frame)
+	if poolIndex < 0 || frame+blockFrames-1 > alloc.pools[poolIndex].endFrame {
+		return errBuddyAllocFrameNotManaged
+	}
+
+	pool := &alloc.pools[poolIndex]
+	for offset := pmm.Frame(0); offset < blockFrames; offset++ {
+		if !pool.isReserved(frame + offset) {
+			return errBuddyAllocDoubleFree
+		}
+	}
+
+	for offset := pmm.Frame(0); offset < blockFrames; offset++ {
+		alloc.markFrame(poolIndex, frame+offset, markFree)
+	}
+
+	pool.releaseBlock(frame, order)
+	return nil
+}
+
+// AllocFrame reserves and returns a physical memory frame. An error will be
+// returned if no more memory can be allocated.
+func (alloc *BuddyAllocator) AllocFrame() (pmm.Frame, *kernel.Error) {
+	return alloc.AllocFramesIn(0, ZoneAny)
+}
+
+// AllocFrameIn reserves and returns a physical memory frame from one of the
+// zones in the supplied zone mask.
+func (alloc *BuddyAllocator) AllocFrameIn(zones Zone) (pmm.Frame, *kernel.Error) {
+	return alloc.AllocFramesIn(0, zones)
+}
+
+// FreeFrame releases a frame previously allocated via a call to AllocFrame.
+// Trying to release a frame not part of the allocator pools or a frame that
+// is already marked as free will cause an error to be returned.
+func (alloc *BuddyAllocator) FreeFrame(frame pmm.Frame) *kernel.Error {
+	return alloc.FreeFrames(frame, 0)
+}
+
+// IncRef increments the reference count for a reserved frame. Calls to IncRef
+// for pinned frames have no effect.
+func (alloc *BuddyAllocator) IncRef(frame pmm.Frame) *kernel.Error {
+	refCount, err := alloc.refCountFor(frame)
+	if err != nil {
+		return err
+	}
+
+	switch *refCount {
+	case 0:
+		return errBuddyAllocRefFreeFrame
+	case pinnedRefCount:
+		return nil
+	case pinnedRefCount - 1:
+		return errBuddyAllocRefOverflow
+	}
+
+	*refCount++
+	return nil
+}
+
+// DecRef decrements the reference count for a reserved frame and releases
+// the frame once its reference count reaches zero. Calls to DecRef for
+// pinned frames have no effect.
+func (alloc *BuddyAllocator) DecRef(frame pmm.Frame) *kernel.Error {
+	refCount, err := alloc.refCountFor(frame)
+	if err != nil {
+		return err
+	}
+
+	switch *refCount {
+	case 0:
+		return errBuddyAllocDoubleFree
+	case pinnedRefCount:
+		return nil
+	case 1:
+		return alloc.FreeFrames(frame, 0)
+	}
+
+	*refCount--
+	return nil
+}
+
+// PinFrame marks a reserved frame as pinned. Pinned frames are never released
+// by the allocator.
+func (alloc *BuddyAllocator) PinFrame(frame pmm.Frame) *kernel.Error {
+	refCount, err := alloc.refCountFor(frame)
+	if err != nil {
+		return err
+	}
+
+	if *refCount == 0 {
+		return errBuddyAllocRefFreeFrame
+	}
+
+	*refCount = pinnedRefCount
+	return nil
+}
+
+// RefCount returns the reference count for the supplied frame. Free frames
+// and frames not managed by the allocator have a reference count of zero.
+func (alloc *BuddyAllocator) RefCount(frame pmm.Frame) uint16 {
+	refCount, err := alloc.refCountFor(frame)
+	if err != nil {
+		return 0
+	}
+
+	return *refCount
+}
+
+// refCountFor returns a pointer to the reference counter for frame.
+func (alloc *BuddyAllocator) refCountFor(frame pmm.Frame) (*uint16, *kernel.Error) {
+	poolIndex := alloc.poolForFrame(frame)
+	if poolIndex < 0 {
+		return nil, errBuddyAllocFrameNotManaged
+	}
+
+	return &alloc.pools[poolIndex].refCounts[frame-alloc.pools[poolIndex].startFrame], nil
+}
+
+// isReserved returns true if the free bitmap entry for frame is set.
+func (pool *framePool) isReserved(frame pmm.Frame) bool {
+	relFrame := frame - pool.startFrame
+	block := relFrame >> 6
+	mask := uint64(1 << (63 - (relFrame - block<<6)))
+	return pool.freeBitmap[block]&mask != 0
+}
+
+// blockBit returns the word index and bit mask for the entry in the order
+// bitmap that corresponds to the block of the given order containing frame.
+func (pool *framePool) blockBit(frame pmm.Frame, order uint8) (uintptr, uint64) {
+	relBlock := uintptr(frame>>order) - uintptr(pool.startFrame>>order)
+	word := relBlock >> 6
+	return word, uint64(1 << (63 - (relBlock - word<<6)))
+}
+
+// reserveBlock removes a free block of the requested order from the pool and
+// returns its first frame. If no block of the requested order is available,
+// reserveBlock splits the smallest available larger block returning each
+// unused upper half to the free bitmap of the appropriate order.
+func (pool *framePool) reserveBlock(order uint8) (pmm.Frame, bool) {
+	for curOrder := order; curOrder <= MaxOrder; curOrder++ {
+		for wordIndex, word := range pool.orderBitmaps[curOrder] {
+			if word == 0 {
+				continue
+			}
+
+			// Word has at least one free block; we need to scan its bits
+			for wordOffset, mask := uintptr(0), uint64(1<<63); mask > 0; wordOffset, mask = wordOffset+1, mask>>1 {
+				if word&mask == 0 {
+					continue
+				}
+
+				pool.orderBitmaps[curOrder][wordIndex] &^= mask
+				frame := pmm.Frame((uintptr(pool.startFrame>>curOrder) + uintptr(wordIndex<<6) + wordOffset) << curOrder)
+
+				// Split the block until we reach the requested order
+				for curOrder > order {
+					curOrder--
+					splitWord, splitMask := pool.blockBit(frame+(1<<curOrder), curOrder)
+					pool.orderBitmaps[curOrder][splitWord] |= splitMask
+				}
+
+				return frame, true
+			}
+		}
+	}
+
+	return pmm.InvalidFrame, false
+}
+
+// releaseBlock returns a block of the given order to the pool. If the buddy
+// of the block is also free, the two blocks are merged into a block of the
+// next order and the process repeats until either a buddy is not free or
+// MaxOrder is reached.
+func (pool *framePool) releaseBlock(frame pmm.Frame, order uint8) {
+	for ; order < MaxOrder; order++ {
+		// Buddy blocks that start outside the pool can never be free
+		buddy := frame ^ (1 << order)
+		if buddy < pool.startFrame || buddy > pool.endFrame {
+			break
+		}
+
+		word, mask := pool.blockBit(buddy, order)
+		if pool.orderBitmaps[order][word]&mask == 0 {
+			break
+		}
+
+		pool.orderBitmaps[order][word] &^= mask
+		frame &^= 1 << order
+	}
+
+	word, mask := pool.blockBit(frame, order)
+	pool.orderBitmaps[order][word] |= mask
+}
+
+// earlyAllocFrame is a helper that delegates a frame allocation request to the
+// early allocator instance. This function is passed as an argument to
+// vmm.SetFrameAllocator instead of earlyAllocator.AllocFrame. The latter
+// confuses the compiler's escape analysis into thinking that
+// earlyAllocator.Frame escapes to heap.
+func earlyAllocFrame() (pmm.Frame, *kernel.Error) {
+	return earlyAllocator.AllocFrame()
+}
+
+// AllocFrame is a helper that delegates a frame allocation request to the
+// buddy allocator instance.
+func AllocFrame() (pmm.Frame, *kernel.Error) {
+	return buddyAllocator.AllocFrame()
+}
+
+// AllocFrames is a helper that delegates a request for a block of (1 << order)
+// physically contiguous frames to the buddy allocator instance.
+func AllocFrames(order uint8) (pmm.Frame, *kernel.Error) {
+	return buddyAllocator.AllocFrames(order)
+}
+
+// FreeFrame is a helper that drops a reference to a frame allocated by the
+// buddy allocator instance. The frame is released once its last reference
+// is dropped.
+func FreeFrame(frame pmm.Frame) *kernel.Error {
+	return buddyAllocator.DecRef(frame)
+}
+
+// FreeFrames is a helper that delegates a request for releasing a block of
+// (1 << order) physically contiguous frames to the buddy allocator instance.
+func FreeFrames(frame pmm.Frame, order uint8) *kernel.Error {
+	return buddyAllocator.FreeFrames(frame, order)
+}
+
+// IncRef is a helper that increments the reference count for a frame
+// allocated by the buddy allocator instance.
+func IncRef(frame pmm.Frame) *kernel.Error {
+	return buddyAllocator.IncRef(frame)
+}
+
+// PinFrame is a helper that pins a frame allocated by the buddy allocator
+// instance so that it can never be released.
+func PinFrame(frame pmm.Frame) *kernel.Error {
+	return buddyAllocator.PinFrame(frame)
+}
+
+// RefCount is a helper that returns the reference count for a frame managed
+// by the buddy allocator instance.
+func RefCount(frame pmm.Frame) uint16 {
+	return buddyAllocator.RefCount(frame)
+}
+
+// AllocFrameIn is a helper that delegates a frame allocation request for a
+// frame in one of the zones specified by the zone mask to the buddy allocator
+// instance.
+func AllocFrameIn(zones Zone) (pmm.Frame, *kernel.Error) {
+	return buddyAllocator.AllocFrameIn(zones)
+}
+
+// AllocFramesIn is a helper that delegates a request for a block of
+// (1 << order) physically contiguous frames in one of the zones specified by
+// the zone mask to the buddy allocator instance.
+func AllocFramesIn(order uint8, zones Zone) (pmm.Frame, *kernel.Error) {
+	return buddyAllocator.AllocFramesIn(order, zones)
+}
+
+// ReserveFrames prevents the frames that overlap the physical memory range
+// [physAddr, physAddr+size) from ever being allocated. It allows the kernel to
+// protect data that the bootloader loads outside the kernel image (e.g. the
+// kernel symbol tables) and must be invoked before Init.
+func ReserveFrames(physAddr uintptr, size mem.Size) *kernel.Error {
+	return earlyAllocator.reserve(physAddr, size)
+}
+
+// Init sets up the kernel physical memory allocation sub-system.
+func Init(kernelStart, kernelEnd uintptr) *kernel.Error {
+	earlyAllocator.init(kernelStart, kernelEnd)
+	earlyAllocator.printMemoryMap()
+
+	vmm.SetFrameAllocator(earlyAllocFrame)
+	if err := buddyAllocator.init(); err != nil {
+		return err
+	}
+	vmm.SetFrameAllocator(AllocFrame)
+	vmm.SetFrameFreer(FreeFrame)
+	vmm.SetFrameRefCounter(IncRef, PinFrame, RefCount)
+
+	return nil
+}
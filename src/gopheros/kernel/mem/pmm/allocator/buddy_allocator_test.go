@@ -0,0 +1,845 @@
+package allocator
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/hal/multiboot"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"gopheros/kernel/mem/vmm"
+	"math"
+	"strconv"
+	"testing"
+	"unsafe"
+)
+
+func TestSetupPoolBitmaps(t *testing.T) {
+	defer func() {
+		mapFn = vmm.Map
+		reserveRegionFn = vmm.EarlyReserveRegion
+	}()
+
+	multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&multibootMemoryMap[0])))
+
+	// The captured multiboot data corresponds to qemu running with 128M RAM.
+	// The allocator will need to reserve 20 pages to store the pool,
+	// bitmap and reference count data.
+	var (
+		alloc   BuddyAllocator
+		physMem = make([]byte, 20*mem.PageSize)
+	)
+
+	// Init phys mem with junk
+	for i := 0; i < len(physMem); i++ {
+		physMem[i] = 0xf0
+	}
+
+	mapCallCount := 0
+	mapFn = func(page vmm.Page, frame pmm.Frame, flags vmm.PageTableEntryFlag) *kernel.Error {
+		mapCallCount++
+		return nil
+	}
+
+	reserveCallCount := 0
+	reserveRegionFn = func(_ mem.Size) (uintptr, *kernel.Error) {
+		reserveCallCount++
+		return uintptr(unsafe.Pointer(&physMem[0])), nil
+	}
+
+	if err := alloc.setupPoolBitmaps(); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := 20; mapCallCount != exp {
+		t.Fatalf("expected allocator to call vmm.Map %d times; called %d", exp, mapCallCount)
+	}
+
+	if exp := 1; reserveCallCount != exp {
+		t.Fatalf("expected allocator to call vmm.EarlyReserveRegion %d times; called %d", exp, reserveCallCount)
+	}
+
+	// The second memory region crosses the 16M boundary and should be
+	// split into a DMA and a DMA32 pool.
+	expPools := []struct {
+		startFrame, endFrame pmm.Frame
+		zone                 Zone
+	}{
+		{0x0, 0x9e, ZoneDMA},
+		{0x100, 0xfff, ZoneDMA},
+		{0x1000, 0x7fdf, ZoneDMA32},
+	}
+
+	if exp, got := len(expPools), len(alloc.pools); got != exp {
+		t.Fatalf("expected allocator to initialize %d pools; got %d", exp, got)
+	}
+
+	for poolIndex, pool := range alloc.pools {
+		if exp := expPools[poolIndex]; pool.startFrame != exp.startFrame || pool.endFrame != exp.endFrame || pool.zone != exp.zone {
+			t.Errorf("[pool %d] expected pool to span frames [%x, %x] in zone %s; got [%x, %x] in zone %s",
+				poolIndex, exp.startFrame, exp.endFrame, exp.zone, pool.startFrame, pool.endFrame, pool.zone,
+			)
+		}
+
+		if expFreeCount := uint32(pool.endFrame - pool.startFrame + 1); pool.freeCount != expFreeCount {
+			t.Errorf("[pool %d] expected free count to be %d; got %d", poolIndex, expFreeCount, pool.freeCount)
+		}
+
+		if exp, got := int(math.Ceil(float64(pool.freeCount)/64.0)), len(pool.freeBitmap); got != exp {
+			t.Errorf("[pool %d] expected bitmap len to be %d; got %d", poolIndex, exp, got)
+		}
+
+		for blockIndex, block := range pool.freeBitmap {
+			if block != 0 {
+				t.Errorf("[pool %d] expected bitmap block %d to be cleared; got %d", poolIndex, blockIndex, block)
+			}
+		}
+
+		if exp, got := int(pool.endFrame-pool.startFrame+1), len(pool.refCounts); got != exp {
+			t.Errorf("[pool %d] expected ref count table len to be %d; got %d", poolIndex, exp, got)
+		}
+
+		for frameIndex, refCount := range pool.refCounts {
+			if refCount != 0 {
+				t.Errorf("[pool %d] expected ref count for frame %d to be cleared; got %d", poolIndex, frameIndex, refCount)
+			}
+		}
+
+		for order, bitmap := range pool.orderBitmaps {
+			if exp, got := int(bitmapWords(pool.startFrame, pool.endFrame, uint8(order))), len(bitmap); got != exp {
+				t.Errorf("[pool %d] expected order %d bitmap len to be %d; got %d", poolIndex, order, exp, got)
+			}
+
+			for blockIndex, block := range bitmap {
+				if block != 0 {
+					t.Errorf("[pool %d] expected order %d bitmap block %d to be cleared; got %d", poolIndex, order, blockIndex, block)
+				}
+			}
+		}
+	}
+}
+
+func TestSetupPoolBitmapsErrors(t *testing.T) {
+	defer func() {
+		mapFn = vmm.Map
+		reserveRegionFn = vmm.EarlyReserveRegion
+	}()
+
+	multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&multibootMemoryMap[0])))
+	var alloc BuddyAllocator
+
+	t.Run("vmm.EarlyReserveRegion returns an error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+
+		reserveRegionFn = func(_ mem.Size) (uintptr, *kernel.Error) {
+			return 0, expErr
+		}
+
+		if err := alloc.setupPoolBitmaps(); err != expErr {
+			t.Fatalf("expected to get error: %v; got %v", expErr, err)
+		}
+	})
+	t.Run("vmm.Map returns an error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+
+		reserveRegionFn = func(_ mem.Size) (uintptr, *kernel.Error) {
+			return 0, nil
+		}
+
+		mapFn = func(page vmm.Page, frame pmm.Frame, flags vmm.PageTableEntryFlag) *kernel.Error {
+			return expErr
+		}
+
+		if err := alloc.setupPoolBitmaps(); err != expErr {
+			t.Fatalf("expected to get error: %v; got %v", expErr, err)
+		}
+	})
+
+	t.Run("earlyAllocator returns an error", func(t *testing.T) {
+		emptyInfoData := []byte{
+			0, 0, 0, 0, // size
+			0, 0, 0, 0, // reserved
+			0, 0, 0, 0, // tag with type zero and length zero
+			0, 0, 0, 0,
+		}
+
+		multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&emptyInfoData[0])))
+
+		if err := alloc.setupPoolBitmaps(); err != errBootAllocOutOfMemory {
+			t.Fatalf("expected to get error: %v; got %v", errBootAllocOutOfMemory, err)
+		}
+	})
+}
+
+func TestBuddyAllocatorMarkFrame(t *testing.T) {
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			{
+				startFrame: pmm.Frame(0),
+				endFrame:   pmm.Frame(127),
+				freeCount:  128,
+				freeBitmap: make([]uint64, 2),
+				refCounts:  make([]uint16, 128),
+			},
+		},
+		totalPages: 128,
+	}
+
+	lastFrame := pmm.Frame(alloc.totalPages)
+	for frame := pmm.Frame(0); frame < lastFrame; frame++ {
+		alloc.markFrame(0, frame, markReserved)
+
+		block := uint64(frame / 64)
+		blockOffset := uint64(frame % 64)
+		bitIndex := (63 - blockOffset)
+		bitMask := uint64(1 << bitIndex)
+
+		if alloc.pools[0].freeBitmap[block]&bitMask != bitMask {
+			t.Errorf("[frame %d] expected block[%d], bit %d to be set", frame, block, bitIndex)
+		}
+
+		alloc.markFrame(0, frame, markFree)
+
+		if alloc.pools[0].freeBitmap[block]&bitMask != 0 {
+			t.Errorf("[frame %d] expected block[%d], bit %d to be unset", frame, block, bitIndex)
+		}
+	}
+
+	// Calling markFrame with a frame not part of the pool should be a no-op
+	alloc.markFrame(0, pmm.Frame(0xbadf00d), markReserved)
+	for blockIndex, block := range alloc.pools[0].freeBitmap {
+		if block != 0 {
+			t.Errorf("expected all blocks to be set to 0; block %d is set to %d", blockIndex, block)
+		}
+	}
+
+	// Calling markFrame with a negative pool index should be a no-op
+	alloc.markFrame(-1, pmm.Frame(0), markReserved)
+	for blockIndex, block := range alloc.pools[0].freeBitmap {
+		if block != 0 {
+			t.Errorf("expected all blocks to be set to 0; block %d is set to %d", blockIndex, block)
+		}
+	}
+}
+
+func TestBuddyAllocatorPoolForFrame(t *testing.T) {
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			{
+				startFrame: pmm.Frame(0),
+				endFrame:   pmm.Frame(63),
+				freeCount:  64,
+				freeBitmap: make([]uint64, 1),
+				refCounts:  make([]uint16, 64),
+			},
+			{
+				startFrame: pmm.Frame(128),
+				endFrame:   pmm.Frame(191),
+				freeCount:  64,
+				freeBitmap: make([]uint64, 1),
+				refCounts:  make([]uint16, 64),
+			},
+		},
+		totalPages: 128,
+	}
+
+	specs := []struct {
+		frame    pmm.Frame
+		expIndex int
+	}{
+		{pmm.Frame(0), 0},
+		{pmm.Frame(63), 0},
+		{pmm.Frame(64), -1},
+		{pmm.Frame(128), 1},
+		{pmm.Frame(192), -1},
+	}
+
+	for specIndex, spec := range specs {
+		if got := alloc.poolForFrame(spec.frame); got != spec.expIndex {
+			t.Errorf("[spec %d] expected to get pool index %d; got %d", specIndex, spec.expIndex, got)
+		}
+	}
+}
+
+func TestBuddyAllocatorReserveKernelFrames(t *testing.T) {
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			{
+				startFrame: pmm.Frame(0),
+				endFrame:   pmm.Frame(7),
+				freeCount:  8,
+				freeBitmap: make([]uint64, 1),
+				refCounts:  make([]uint16, 8),
+			},
+			{
+				startFrame: pmm.Frame(64),
+				endFrame:   pmm.Frame(191),
+				freeCount:  128,
+				freeBitmap: make([]uint64, 2),
+				refCounts:  make([]uint16, 128),
+			},
+		},
+		totalPages: 136,
+	}
+
+	// kernel occupies 16 frames and starts at the beginning of pool 1
+	earlyAllocator.kernelStartFrame = pmm.Frame(64)
+	earlyAllocator.kernelEndFrame = pmm.Frame(79)
+	kernelSizePages := uint32(earlyAllocator.kernelEndFrame - earlyAllocator.kernelStartFrame + 1)
+	alloc.reserveKernelFrames()
+
+	if exp, got := kernelSizePages, alloc.reservedPages; got != exp {
+		t.Fatalf("expected reserved page counter to be %d; got %d", exp, got)
+	}
+
+	if exp, got := uint32(8), alloc.pools[0].freeCount; got != exp {
+		t.Fatalf("expected free count for pool 0 to be %d; got %d", exp, got)
+	}
+
+	if exp, got := 128-kernelSizePages, alloc.pools[1].freeCount; got != exp {
+		t.Fatalf("expected free count for pool 1 to be %d; got %d", exp, got)
+	}
+
+	// The first 16 bits of block 0 in pool 1 should all be set to 1
+	if exp, got := uint64(((1<<16)-1)<<48), alloc.pools[1].freeBitmap[0]; got != exp {
+		t.Fatalf("expected block 0 in pool 1 to be:\n%064s\ngot:\n%064s",
+			strconv.FormatUint(exp, 2),
+			strconv.FormatUint(got, 2),
+		)
+	}
+
+	// Kernel frames should be pinned
+	for frameIndex := 0; frameIndex < int(kernelSizePages); frameIndex++ {
+		if got := alloc.pools[1].refCounts[frameIndex]; got != pinnedRefCount {
+			t.Errorf("expected kernel frame %d to be pinned; got ref count %d", frameIndex, got)
+		}
+	}
+	t.Run("reserved ranges", func(t *testing.T) {
+		defer func() { earlyAllocator.reservedRangeCount = 0 }()
+
+		for poolIndex := range alloc.pools {
+			pool := &alloc.pools[poolIndex]
+			pool.freeCount = uint32(pool.endFrame - pool.startFrame + 1)
+			for index := range pool.freeBitmap {
+				pool.freeBitmap[index] = 0
+			}
+			for index := range pool.refCounts {
+				pool.refCounts[index] = 0
+			}
+		}
+		alloc.reservedPages = 0
+
+		// The ranges span the end of pool 0 and the frames that are
+		// not managed by any pool, and overlap the end of the kernel
+		earlyAllocator.reservedRanges[0] = frameRange{start: 6, end: 9}
+		earlyAllocator.reservedRanges[1] = frameRange{start: 78, end: 81}
+		earlyAllocator.reservedRangeCount = 2
+		alloc.reserveKernelFrames()
+
+		if exp, got := kernelSizePages+4, alloc.reservedPages; got != exp {
+			t.Fatalf("expected reserved page counter to be %d; got %d", exp, got)
+		}
+
+		if exp, got := uint32(6), alloc.pools[0].freeCount; got != exp {
+			t.Fatalf("expected free count for pool 0 to be %d; got %d", exp, got)
+		}
+
+		if exp, got := 128-kernelSizePages-2, alloc.pools[1].freeCount; got != exp {
+			t.Fatalf("expected free count for pool 1 to be %d; got %d", exp, got)
+		}
+
+		for _, frame := range []pmm.Frame{6, 7, 80, 81} {
+			poolIndex := alloc.poolForFrame(frame)
+			pool := &alloc.pools[poolIndex]
+			if !pool.isReserved(frame) || pool.refCounts[frame-pool.startFrame] != pinnedRefCount {
+				t.Errorf("expected frame %d to be reserved and pinned", frame)
+			}
+		}
+	})
+}
+
+func TestBuddyAllocatorReserveEarlyAllocatorFrames(t *testing.T) {
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			{
+				startFrame: pmm.Frame(0),
+				endFrame:   pmm.Frame(63),
+				freeCount:  64,
+				freeBitmap: make([]uint64, 1),
+				refCounts:  make([]uint16, 64),
+			},
+			{
+				startFrame: pmm.Frame(64),
+				endFrame:   pmm.Frame(191),
+				freeCount:  128,
+				freeBitmap: make([]uint64, 2),
+				refCounts:  make([]uint16, 128),
+			},
+		},
+		totalPages: 64,
+	}
+
+	multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&multibootMemoryMap[0])))
+
+	// Simulate 16 allocations made using the early allocator in region 0
+	// as reported by the multiboot data and move the kernel to pool 1
+	allocCount := uint32(16)
+	earlyAllocator.allocCount = uint64(allocCount)
+	earlyAllocator.kernelStartFrame = pmm.Frame(256)
+	earlyAllocator.kernelEndFrame = pmm.Frame(256)
+	alloc.reserveEarlyAllocatorFrames()
+
+	if exp, got := allocCount, alloc.reservedPages; got != exp {
+		t.Fatalf("expected reserved page counter to be %d; got %d", exp, got)
+	}
+
+	if exp, got := 64-allocCount, alloc.pools[0].freeCount; got != exp {
+		t.Fatalf("expected free count for pool 0 to be %d; got %d", exp, got)
+	}
+
+	if exp, got := uint32(128), alloc.pools[1].freeCount; got != exp {
+		t.Fatalf("expected free count for pool 1 to be %d; got %d", exp, got)
+	}
+
+	// The first 16 bits of block 0 in pool 0 should all be set to 1
+	if exp, got := uint64(((1<<16)-1)<<48), alloc.pools[0].freeBitmap[0]; got != exp {
+		t.Fatalf("expected block 0 in pool 0 to be:\n%064s\ngot:\n%064s",
+			strconv.FormatUint(exp, 2),
+			strconv.FormatUint(got, 2),
+		)
+	}
+}
+
+func TestBuddyAllocatorAllocAndFreeFrame(t *testing.T) {
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			newTestPool(0, 7),
+			newTestPool(64, 191),
+		},
+		totalPages: 136,
+	}
+	alloc.initFreeBlocks()
+
+	// Test Alloc
+	for poolIndex, pool := range alloc.pools {
+		for expFrame := pool.startFrame; expFrame <= pool.endFrame; expFrame++ {
+			got, err := alloc.AllocFrame()
+			if err != nil {
+				t.Fatalf("[pool %d] unexpected error: %v", poolIndex, err)
+			}
+
+			if got != expFrame {
+				t.Errorf("[pool %d] expected allocated frame to be %d; got %d", poolIndex, expFrame, got)
+			}
+		}
+
+		if alloc.pools[poolIndex].freeCount != 0 {
+			t.Errorf("[pool %d] expected free count to be 0; got %d", poolIndex, alloc.pools[poolIndex].freeCount)
+		}
+	}
+
+	if alloc.reservedPages != alloc.totalPages {
+		t.Errorf("expected reservedPages to match totalPages(%d); got %d", alloc.totalPages, alloc.reservedPages)
+	}
+
+	if _, err := alloc.AllocFrame(); err != errBuddyAllocOutOfMemory {
+		t.Fatalf("expected error errBuddyAllocOutOfMemory; got %v", err)
+	}
+
+	// Test Free
+	expFreeCount := []uint32{8, 128}
+	for poolIndex, pool := range alloc.pools {
+		for frame := pool.startFrame; frame <= pool.endFrame; frame++ {
+			if err := alloc.FreeFrame(frame); err != nil {
+				t.Fatalf("[pool %d] unexpected error: %v", poolIndex, err)
+			}
+		}
+
+		if alloc.pools[poolIndex].freeCount != expFreeCount[poolIndex] {
+			t.Errorf("[pool %d] expected free count to be %d; got %d", poolIndex, expFreeCount[poolIndex], alloc.pools[poolIndex].freeCount)
+		}
+	}
+
+	if alloc.reservedPages != 0 {
+		t.Errorf("expected reservedPages to be 0; got %d", alloc.reservedPages)
+	}
+
+	// Test Free errors
+	if err := alloc.FreeFrame(pmm.Frame(0)); err != errBuddyAllocDoubleFree {
+		t.Fatalf("expected error errBuddyAllocDoubleFree; got %v", err)
+	}
+
+	if err := alloc.FreeFrame(pmm.Frame(0xbadf00d)); err != errBuddyAllocFrameNotManaged {
+		t.Fatalf("expected error errBuddyAllocFrameNotManaged; got %v", err)
+	}
+}
+
+func TestBuddyAllocatorAllocAndFreeFrames(t *testing.T) {
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			// 3 frames; none of them can be combined into an order 2 block
+			newTestPool(5, 7),
+			// 96 frames; can hold one order 6 and one order 5 block
+			newTestPool(64, 159),
+		},
+		totalPages: 99,
+	}
+	alloc.initFreeBlocks()
+
+	t.Run("coalesce on init", func(t *testing.T) {
+		specs := []struct {
+			poolIndex int
+			frame     pmm.Frame
+			order     uint8
+		}{
+			{0, 5, 0},
+			{0, 6, 1},
+			{1, 64, 6},
+			{1, 128, 5},
+		}
+
+		for specIndex, spec := range specs {
+			pool := &alloc.pools[spec.poolIndex]
+			word, mask := pool.blockBit(spec.frame, spec.order)
+			if pool.orderBitmaps[spec.order][word]&mask == 0 {
+				t.Errorf("[spec %d] expected block at frame %d with order %d to be free", specIndex, spec.frame, spec.order)
+			}
+		}
+	})
+
+	t.Run("split and merge", func(t *testing.T) {
+		// The smallest block that can satisfy the request is the order
+		// 5 block at frame 128 which needs to be split once.
+		frame, err := alloc.AllocFrames(4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := pmm.Frame(128); frame != exp {
+			t.Fatalf("expected allocated block to start at frame %d; got %d", exp, frame)
+		}
+
+		pool := &alloc.pools[1]
+		for _, spec := range []struct {
+			frame pmm.Frame
+			order uint8
+		}{{144, 4}, {64, 6}} {
+			word, mask := pool.blockBit(spec.frame, spec.order)
+			if pool.orderBitmaps[spec.order][word]&mask == 0 {
+				t.Errorf("expected split block at frame %d with order %d to be free", spec.frame, spec.order)
+			}
+		}
+
+		if exp, got := uint32(96-16), pool.freeCount; got != exp {
+			t.Errorf("expected pool free count to be %d; got %d", exp, got)
+		}
+
+		if err = alloc.FreeFrames(frame, 4); err != nil {
+			t.Fatal(err)
+		}
+
+		word, mask := pool.blockBit(128, 5)
+		if pool.orderBitmaps[5][word]&mask == 0 {
+			t.Error("expected released block to be merged back into an order 5 block")
+		}
+
+		if exp, got := uint32(96), pool.freeCount; got != exp {
+			t.Errorf("expected pool free count to be %d; got %d", exp, got)
+		}
+	})
+
+	t.Run("skip pools without large enough blocks", func(t *testing.T) {
+		frame, err := alloc.AllocFrames(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := pmm.Frame(6); frame != exp {
+			t.Fatalf("expected allocated block to start at frame %d; got %d", exp, frame)
+		}
+
+		// pool 0 only has 1 free frame left
+		if frame, err = alloc.AllocFrames(1); err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := pmm.Frame(128); frame != exp {
+			t.Fatalf("expected allocated block to start at frame %d; got %d", exp, frame)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		if _, err := alloc.AllocFrames(MaxOrder + 1); err != errBuddyAllocInvalidOrder {
+			t.Errorf("expected to get errBuddyAllocInvalidOrder; got %v", err)
+		}
+
+		if _, err := alloc.AllocFrames(7); err != errBuddyAllocOutOfMemory {
+			t.Errorf("expected to get errBuddyAllocOutOfMemory; got %v", err)
+		}
+
+		if err := alloc.FreeFrames(64, MaxOrder+1); err != errBuddyAllocInvalidOrder {
+			t.Errorf("expected to get errBuddyAllocInvalidOrder; got %v", err)
+		}
+
+		if err := alloc.FreeFrames(65, 1); err != errBuddyAllocMisalignedFrame {
+			t.Errorf("expected to get errBuddyAllocMisalignedFrame; got %v", err)
+		}
+
+		// block extends past the end of the pool
+		if err := alloc.FreeFrames(128, 6); err != errBuddyAllocFrameNotManaged {
+			t.Errorf("expected to get errBuddyAllocFrameNotManaged; got %v", err)
+		}
+
+		// only the first two frames of the block are reserved
+		if err := alloc.FreeFrames(128, 2); err != errBuddyAllocDoubleFree {
+			t.Errorf("expected to get errBuddyAllocDoubleFree; got %v", err)
+		}
+	})
+}
+
+func TestBuddyAllocatorRefCounting(t *testing.T) {
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			newTestPool(0, 7),
+		},
+		totalPages: 8,
+	}
+	alloc.initFreeBlocks()
+
+	frame, err := alloc.AllocFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, got := uint16(1), alloc.RefCount(frame); got != exp {
+		t.Fatalf("expected allocated frame ref count to be %d; got %d", exp, got)
+	}
+
+	t.Run("shared frame", func(t *testing.T) {
+		if err := alloc.IncRef(frame); err != nil {
+			t.Fatal(err)
+		}
+
+		if exp, got := uint16(2), alloc.RefCount(frame); got != exp {
+			t.Fatalf("expected ref count to be %d; got %d", exp, got)
+		}
+
+		// Dropping the first reference should not release the frame
+		if err := alloc.DecRef(frame); err != nil {
+			t.Fatal(err)
+		}
+
+		if !alloc.pools[0].isReserved(frame) {
+			t.Fatal("expected frame to remain reserved while it is still referenced")
+		}
+
+		// Dropping the last reference should release the frame
+		if err := alloc.DecRef(frame); err != nil {
+			t.Fatal(err)
+		}
+
+		if alloc.pools[0].isReserved(frame) {
+			t.Fatal("expected frame to be released after dropping its last reference")
+		}
+
+		if exp, got := uint16(0), alloc.RefCount(frame); got != exp {
+			t.Fatalf("expected ref count to be %d; got %d", exp, got)
+		}
+	})
+
+	t.Run("pinned frame", func(t *testing.T) {
+		if frame, err = alloc.AllocFrame(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = alloc.PinFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = alloc.IncRef(frame); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 3; i++ {
+			if err = alloc.DecRef(frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if !alloc.pools[0].isReserved(frame) || alloc.RefCount(frame) != pinnedRefCount {
+			t.Fatal("expected pinned frame to remain reserved")
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		freeFrame := pmm.Frame(7)
+
+		if err := alloc.IncRef(freeFrame); err != errBuddyAllocRefFreeFrame {
+			t.Errorf("expected to get errBuddyAllocRefFreeFrame; got %v", err)
+		}
+
+		if err := alloc.PinFrame(freeFrame); err != errBuddyAllocRefFreeFrame {
+			t.Errorf("expected to get errBuddyAllocRefFreeFrame; got %v", err)
+		}
+
+		if err := alloc.DecRef(freeFrame); err != errBuddyAllocDoubleFree {
+			t.Errorf("expected to get errBuddyAllocDoubleFree; got %v", err)
+		}
+
+		for _, refFn := range []func(pmm.Frame) *kernel.Error{alloc.IncRef, alloc.DecRef, alloc.PinFrame} {
+			if err := refFn(pmm.Frame(0xbadf00d)); err != errBuddyAllocFrameNotManaged {
+				t.Errorf("expected to get errBuddyAllocFrameNotManaged; got %v", err)
+			}
+		}
+
+		if got := alloc.RefCount(pmm.Frame(0xbadf00d)); got != 0 {
+			t.Errorf("expected ref count for unmanaged frame to be 0; got %d", got)
+		}
+
+		overflowFrame, err := alloc.AllocFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		alloc.pools[0].refCounts[overflowFrame] = pinnedRefCount - 1
+		if err := alloc.IncRef(overflowFrame); err != errBuddyAllocRefOverflow {
+			t.Errorf("expected to get errBuddyAllocRefOverflow; got %v", err)
+		}
+	})
+}
+
+func TestBuddyAllocatorZones(t *testing.T) {
+	var (
+		dma32Start  = zoneDMALastFrame + 1
+		normalStart = zoneDMA32LastFrame + 1
+		alloc       = BuddyAllocator{
+			pools: []framePool{
+				newTestPool(0, 7),
+				newTestPool(dma32Start, dma32Start+7),
+				newTestPool(normalStart, normalStart+7),
+			},
+			totalPages: 24,
+		}
+	)
+	alloc.initFreeBlocks()
+
+	specs := []struct {
+		zones    Zone
+		expFrame pmm.Frame
+	}{
+		// default allocations should be served from the Normal zone
+		{ZoneAny, normalStart},
+		{ZoneDMA, 0},
+		{ZoneDMA | ZoneDMA32, dma32Start},
+		{ZoneDMA32 | ZoneNormal, normalStart + 1},
+	}
+
+	for specIndex, spec := range specs {
+		frame, err := alloc.AllocFrameIn(spec.zones)
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if frame != spec.expFrame {
+			t.Errorf("[spec %d] expected allocated frame to be %x; got %x", specIndex, spec.expFrame, frame)
+		}
+	}
+
+	if _, err := alloc.AllocFrameIn(0); err != errBuddyAllocInvalidZone {
+		t.Errorf("expected to get errBuddyAllocInvalidZone; got %v", err)
+	}
+
+	// Exhaust the DMA zone; allocations from other zones should still work
+	for i := 1; i < 8; i++ {
+		if _, err := alloc.AllocFrameIn(ZoneDMA); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := alloc.AllocFramesIn(0, ZoneDMA); err != errBuddyAllocOutOfMemory {
+		t.Errorf("expected to get errBuddyAllocOutOfMemory; got %v", err)
+	}
+
+	frame, err := alloc.AllocFramesIn(2, ZoneDMA|ZoneDMA32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := dma32Start + 4; frame != exp {
+		t.Errorf("expected allocated block to start at frame %x; got %x", exp, frame)
+	}
+}
+
+func TestAllocatorPackageInit(t *testing.T) {
+	defer func() {
+		mapFn = vmm.Map
+		reserveRegionFn = vmm.EarlyReserveRegion
+	}()
+
+	var (
+		physMem = make([]byte, 20*mem.PageSize)
+	)
+	multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&multibootMemoryMap[0])))
+
+	t.Run("success", func(t *testing.T) {
+		mapFn = func(page vmm.Page, frame pmm.Frame, flags vmm.PageTableEntryFlag) *kernel.Error {
+			return nil
+		}
+
+		reserveRegionFn = func(_ mem.Size) (uintptr, *kernel.Error) {
+			return uintptr(unsafe.Pointer(&physMem[0])), nil
+		}
+
+		if err := Init(0x100000, 0x1fa7c8); err != nil {
+			t.Fatal(err)
+		}
+
+		// At this point sysAllocFrame should work
+		frame, err := AllocFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = FreeFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+
+		if frame, err = AllocFrames(1); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = FreeFrames(frame, 1); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+
+		mapFn = func(page vmm.Page, frame pmm.Frame, flags vmm.PageTableEntryFlag) *kernel.Error {
+			return expErr
+		}
+
+		if err := Init(0x100000, 0x1fa7c8); err != expErr {
+			t.Fatalf("expected to get error: %v; got %v", expErr, err)
+		}
+	})
+}
+
+// newTestPool returns a framePool for the frame range [startFrame, endFrame]
+// whose bitmaps are allocated on the Go heap.
+func newTestPool(startFrame, endFrame pmm.Frame) framePool {
+	pool := framePool{
+		startFrame: startFrame,
+		endFrame:   endFrame,
+		zone:       zoneForFrame(startFrame),
+		freeCount:  uint32(endFrame - startFrame + 1),
+		freeBitmap: make([]uint64, bitmapWords(startFrame, endFrame, 0)),
+		refCounts:  make([]uint16, endFrame-startFrame+1),
+	}
+
+	for order := uint8(0); order <= MaxOrder; order++ {
+		pool.orderBitmaps[order] = make([]uint64, bitmapWords(startFrame, endFrame, order))
+	}
+
+	return pool
+}
@@ -0,0 +1,111 @@
+package allocator
+
+import (
+	"gopheros/kernel/hal/multiboot"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+)
+
+// Zone describes a range of physical memory whose frames share the same
+// addressing constraints. Zone values can be OR-ed together to build a zone
+// mask that is passed to the zone-aware allocation functions.
+type Zone uint8
+
+const (
+	// ZoneDMA contains the frames below 16M which can be accessed by
+	// legacy ISA DMA controllers.
+	ZoneDMA Zone = 1 << iota
+
+	// ZoneDMA32 contains the frames between 16M and 4G which can be
+	// accessed by devices that only support 32-bit physical addresses.
+	ZoneDMA32
+
+	// ZoneNormal contains all frames above 4G.
+	ZoneNormal
+
+	// ZoneAny is a zone mask that matches all available zones.
+	ZoneAny = ZoneDMA | ZoneDMA32 | ZoneNormal
+)
+
+const (
+	zoneDMALastFrame   = pmm.Frame(16*mem.Mb>>mem.PageShift) - 1
+	zoneDMA32LastFrame = pmm.Frame(4*mem.Gb>>mem.PageShift) - 1
+)
+
+var (
+	// zoneAllocOrder specifies the order in which zones are checked when
+	// servicing an allocation request. Normal memory is always preferred
+	// so that low memory is preserved for drivers that really need it.
+	zoneAllocOrder = [...]Zone{ZoneNormal, ZoneDMA32, ZoneDMA}
+)
+
+// String implements fmt.Stringer for Zone.
+func (z Zone) String() string {
+	switch z {
+	case ZoneDMA:
+		return "DMA"
+	case ZoneDMA32:
+		return "DMA32"
+	case ZoneNormal:
+		return "Normal"
+	default:
+		return "unknown"
+	}
+}
+
+// lastFrame returns the last frame that belongs to the zone.
+func (z Zone) lastFrame() pmm.Frame {
+	switch z {
+	case ZoneDMA:
+		return zoneDMALastFrame
+	case ZoneDMA32:
+		return zoneDMA32LastFrame
+	default:
+		return pmm.InvalidFrame - 1
+	}
+}
+
+// zoneForFrame returns the zone that contains the supplied frame.
+func zoneForFrame(frame pmm.Frame) Zone {
+	switch {
+	case frame <= zoneDMALastFrame:
+		return ZoneDMA
+	case frame <= zoneDMA32LastFrame:
+		return ZoneDMA32
+	default:
+		return ZoneNormal
+	}
+}
+
+// visitAvailableRanges invokes visitor for each range of frames that is fully
+// contained inside an available memory region reported by the bootloader.
+// Regions that cross a zone boundary are split so that each visited range
+// belongs to a single zone.
+func visitAvailableRanges(visitor func(startFrame, endFrame pmm.Frame, zone Zone)) {
+	multiboot.VisitMemRegions(func(region *multiboot.MemoryMapEntry) bool {
+		if region.Type != multiboot.MemAvailable {
+			return true
+		}
+
+		startFrame, endFrame, ok := regionFrames(region)
+		if !ok {
+			return true
+		}
+
+		for startFrame <= endFrame {
+			zone := zoneForFrame(startFrame)
+			rangeEndFrame := zone.lastFrame()
+			if rangeEndFrame > endFrame {
+				rangeEndFrame = endFrame
+			}
+
+			visitor(startFrame, rangeEndFrame, zone)
+			if rangeEndFrame == endFrame {
+				break
+			}
+			startFrame = rangeEndFrame + 1
+		}
+
+		return true
+	})
+}
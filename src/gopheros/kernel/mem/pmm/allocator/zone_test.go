@@ -0,0 +1,78 @@
+package allocator
+
+import (
+	"gopheros/kernel/hal/multiboot"
+	"gopheros/kernel/mem/pmm"
+	"testing"
+	"unsafe"
+)
+
+func TestZoneForFrame(t *testing.T) {
+	specs := []struct {
+		frame   pmm.Frame
+		expZone Zone
+	}{
+		{0, ZoneDMA},
+		{0xfff, ZoneDMA},
+		{0x1000, ZoneDMA32},
+		{0xfffff, ZoneDMA32},
+		{0x100000, ZoneNormal},
+		{pmm.InvalidFrame - 1, ZoneNormal},
+	}
+
+	for specIndex, spec := range specs {
+		if got := zoneForFrame(spec.frame); got != spec.expZone {
+			t.Errorf("[spec %d] expected frame %x to belong to zone %s; got %s", specIndex, spec.frame, spec.expZone, got)
+		}
+	}
+}
+
+func TestZoneString(t *testing.T) {
+	specs := []struct {
+		zone Zone
+		exp  string
+	}{
+		{ZoneDMA, "DMA"},
+		{ZoneDMA32, "DMA32"},
+		{ZoneNormal, "Normal"},
+		{ZoneAny, "unknown"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.zone.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected to get %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestVisitAvailableRanges(t *testing.T) {
+	multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&multibootMemoryMap[0])))
+
+	type visitedRange struct {
+		startFrame, endFrame pmm.Frame
+		zone                 Zone
+	}
+
+	var (
+		visited []visitedRange
+		exp     = []visitedRange{
+			{0x0, 0x9e, ZoneDMA},
+			{0x100, 0xfff, ZoneDMA},
+			{0x1000, 0x7fdf, ZoneDMA32},
+		}
+	)
+
+	visitAvailableRanges(func(startFrame, endFrame pmm.Frame, zone Zone) {
+		visited = append(visited, visitedRange{startFrame, endFrame, zone})
+	})
+
+	if len(visited) != len(exp) {
+		t.Fatalf("expected visitor to be invoked %d times; got %d", len(exp), len(visited))
+	}
+
+	for index, got := range visited {
+		if got != exp[index] {
+			t.Errorf("[range %d] expected %+v; got %+v", index, exp[index], got)
+		}
+	}
+}
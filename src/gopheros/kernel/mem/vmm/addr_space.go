@@ -8,11 +8,26 @@ import (
 var (
 	// earlyReserveLastUsed tracks the last reserved page address and is
 	// decreased after each allocation request. Initially, it points to
-	// tempMappingAddr which coincides with the end of the kernel address
-	// space.
-	earlyReserveLastUsed = tempMappingAddr
+	// the EarlyReserveEnd address of the kernel layout.
+	earlyReserveLastUsed = defaultTempMappingAddr
+
+	// kernelRanges manages the kernel virtual address space once the
+	// early reservations have been handed over to it by
+	// setupPDTForKernel.
+	kernelRanges RangeAllocator
+
+	// kernelRangesReady is set to true after the early reservations have
+	// been handed over to kernelRanges.
+	kernelRangesReady bool
 
 	errEarlyReserveNoSpace = &kernel.Error{Module: "early_reserve", Message: "remaining virtual address space not large enough to satisfy reservation request"}
+	errEarlyReserveRelease = &kernel.Error{Module: "early_reserve", Message: "regions cannot be released before the kernel range allocator is initialized"}
+)
+
+const (
+	// kernelGuardSize defines the size of the guard gap that is kept
+	// around each region reserved via ReserveRegion.
+	kernelGuardSize = mem.PageSize
 )
 
 // EarlyReserveRegion reserves a page-aligned contiguous virtual memory region
@@ -20,9 +35,30 @@ var (
 // address. If size is not a multiple of mem.PageSize it will be automatically
 // rounded up.
 //
-// This function allocates regions starting at the end of the kernel address
-// space. It should only be used during the early stages of kernel initialization.
+// This function allocates regions below the EarlyReserveEnd address of the
+// kernel layout. Once the vmm package is initialized, calls to EarlyReserveRegion are
+// forwarded to ReserveRegion.
 func EarlyReserveRegion(size mem.Size) (uintptr, *kernel.Error) {
+	return ReserveRegion(size, uintptr(mem.PageSize))
+}
+
+// ReserveRegion reserves a contiguous virtual memory region with the
+// requested size in the kernel address space and returns its virtual address.
+// The size is rounded up to the nearest page boundary and the region start is
+// aligned to align which must be a power of 2 multiple of mem.PageSize.
+//
+// Regions reserved after the vmm package is initialized are surrounded by
+// unmapped guard gaps and can be returned to the kernel address space via a
+// call to ReleaseRegion.
+func ReserveRegion(size mem.Size, align uintptr) (uintptr, *kernel.Error) {
+	if kernelRangesReady {
+		return kernelRanges.Reserve(size, align)
+	}
+
+	if align < uintptr(mem.PageSize) || align&(align-1) != 0 {
+		return 0, errRangeAllocInvalidAlign
+	}
+
 	size = (size + (mem.PageSize - 1)) & ^(mem.PageSize - 1)
 
 	// reserving a region of the requested size will cause an underflow
@@ -30,6 +66,38 @@ func EarlyReserveRegion(size mem.Size) (uintptr, *kernel.Error) {
 		return 0, errEarlyReserveNoSpace
 	}
 
-	earlyReserveLastUsed -= uintptr(size)
+	earlyReserveLastUsed = (earlyReserveLastUsed - uintptr(size)) &^ (align - 1)
 	return earlyReserveLastUsed, nil
 }
+
+// ReserveHeapRegion reserves a page-aligned contiguous virtual memory region
+// for the Go heap arena. Once the vmm package is initialized, the region is
+// reserved below the HeapArenaEnd address of the kernel layout; before that,
+// calls to ReserveHeapRegion are forwarded to EarlyReserveRegion.
+func ReserveHeapRegion(size mem.Size) (uintptr, *kernel.Error) {
+	if !kernelRangesReady {
+		return EarlyReserveRegion(size)
+	}
+
+	return kernelRanges.ReserveBelow(kernelLayout.HeapArenaEnd, size, uintptr(mem.PageSize))
+}
+
+// ReleaseRegion returns a region previously reserved via a call to
+// ReserveRegion or ReserveHeapRegion back to the kernel address space. The
+// caller is responsible for unmapping any pages in the region before
+// releasing it. Regions obtained via EarlyReserveRegion are never released.
+func ReleaseRegion(addr uintptr, size mem.Size) *kernel.Error {
+	if !kernelRangesReady {
+		return errEarlyReserveRelease
+	}
+
+	return kernelRanges.Release(addr, size)
+}
+
+// handOverEarlyReservations initializes the kernel range allocator so that it
+// manages the kernel virtual address space that has not been claimed by
+// EarlyReserveRegion.
+func handOverEarlyReservations() {
+	kernelRanges.Init(kernelRangesStart, earlyReserveLastUsed, kernelGuardSize)
+	kernelRangesReady = true
+}
@@ -1,6 +1,7 @@
 package vmm
 
 import (
+	"gopheros/kernel/mem"
 	"runtime"
 	"testing"
 )
@@ -27,3 +28,62 @@ func TestEarlyReserveAmd64(t *testing.T) {
 		t.Fatalf("expected to get errEarlyReserveNoSpace; got %v", err)
 	}
 }
+
+func TestReserveRegionAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origLastUsed uintptr) {
+		earlyReserveLastUsed = origLastUsed
+		kernelRangesReady = false
+		kernelRanges = RangeAllocator{}
+	}(earlyReserveLastUsed)
+
+	t.Run("early reservations", func(t *testing.T) {
+		earlyReserveLastUsed = 0x10000
+
+		next, err := ReserveRegion(mem.PageSize, 0x4000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := uintptr(0xc000); next != exp {
+			t.Fatalf("expected reserved region address to be %x; got %x", exp, next)
+		}
+
+		if _, err = ReserveRegion(mem.PageSize, 0x1234); err != errRangeAllocInvalidAlign {
+			t.Fatalf("expected to get errRangeAllocInvalidAlign; got %v", err)
+		}
+
+		if err = ReleaseRegion(next, mem.PageSize); err != errEarlyReserveRelease {
+			t.Fatalf("expected to get errEarlyReserveRelease; got %v", err)
+		}
+	})
+
+	t.Run("after handover", func(t *testing.T) {
+		earlyReserveLastUsed = kernelRangesStart + 0x100000
+		handOverEarlyReservations()
+
+		next, err := ReserveRegion(mem.PageSize, uintptr(mem.PageSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The region should be reserved below the upper guard gap
+		if exp := earlyReserveLastUsed - 2*uintptr(mem.PageSize); next != exp {
+			t.Fatalf("expected reserved region address to be %x; got %x", exp, next)
+		}
+
+		if err = ReleaseRegion(next, mem.PageSize); err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := 1; kernelRanges.freeCount != exp {
+			t.Fatalf("expected released region to be merged with the free range; got %d free ranges", kernelRanges.freeCount)
+		}
+
+		if got, _ := EarlyReserveRegion(mem.PageSize); got != next {
+			t.Fatalf("expected EarlyReserveRegion to be forwarded to the range allocator and return %x; got %x", next, got)
+		}
+	})
+}
@@ -0,0 +1,174 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+)
+
+// AllocFlag controls the behavior of Alloc.
+type AllocFlag uint8
+
+const (
+	// AllocLazy defers the allocation of physical frames until the pages
+	// of the region are written to. Until then, all pages are backed by
+	// ReservedZeroedFrame.
+	AllocLazy AllocFlag = 1 << iota
+
+	// AllocGuardLow places an unmapped guard page before the start of
+	// the region so that underruns trigger a page fault.
+	AllocGuardLow
+
+	// AllocGuardHigh places an unmapped guard page after the end of the
+	// region so that overruns trigger a page fault.
+	AllocGuardHigh
+)
+
+var (
+	// unmapAndFreeFn is used by tests and is automatically inlined by the
+	// compiler.
+	unmapAndFreeFn = UnmapAndFree
+
+	// memsetFn is used by tests to override calls to mem.Memset and is
+	// automatically inlined by the compiler.
+	memsetFn = mem.Memset
+
+	errAllocInvalidSize = &kernel.Error{Module: "vmm", Message: "allocation size must be greater than zero"}
+)
+
+// Region describes a virtually contiguous memory region allocated via a call
+// to Alloc.
+type Region struct {
+	start uintptr
+	size  mem.Size
+	flags AllocFlag
+}
+
+// Address returns the virtual address of the first byte in the region.
+func (r Region) Address() uintptr {
+	return r.start
+}
+
+// Size returns the size of the region which is always a multiple of
+// mem.PageSize.
+func (r Region) Size() mem.Size {
+	return r.size
+}
+
+// guardPages returns the number of guard pages before and after the region.
+func (r Region) guardPages() (uintptr, uintptr) {
+	var low, high uintptr
+	if r.flags&AllocGuardLow != 0 {
+		low = 1
+	}
+	if r.flags&AllocGuardHigh != 0 {
+		high = 1
+	}
+
+	return low, high
+}
+
+// Alloc reserves a virtually contiguous region of the requested size in the
+// kernel address space and backs it with physical frames obtained from the
+// registered frame allocator. The frames backing the region do not need to be
+// physically contiguous. The size is rounded up to the nearest page boundary.
+//
+// If the AllocLazy flag is specified, the region is mapped to
+// ReservedZeroedFrame using copy-on-write semantics and physical frames are
+// only allocated when the pages are written to. Otherwise, frames are
+// allocated and cleared before Alloc returns. The AllocGuardLow and
+// AllocGuardHigh flags reserve an extra unmapped page before and after the
+// region respectively.
+//
+// Memory allocated via Alloc is mapped as non-executable and must be
+// released via a call to Free.
+func Alloc(size mem.Size, flags AllocFlag) (Region, *kernel.Error) {
+	if size == 0 {
+		return Region{}, errAllocInvalidSize
+	}
+
+	region := Region{
+		size:  (size + (mem.PageSize - 1)) & ^(mem.PageSize - 1),
+		flags: flags,
+	}
+
+	lowGuard, highGuard := region.guardPages()
+	reservedSize := region.size + mem.Size((lowGuard+highGuard)<<mem.PageShift)
+	reservedAddr, err := reserveRegionFn(reservedSize, uintptr(mem.PageSize))
+	if err != nil {
+		return Region{}, err
+	}
+
+	region.start = reservedAddr + lowGuard<<mem.PageShift
+
+	var (
+		page      = PageFromAddress(region.start)
+		pageCount = region.size >> mem.PageShift
+		mapped    mem.Size
+	)
+
+	for ; pageCount > 0; pageCount, page = pageCount-1, page+1 {
+		if err = allocPage(page, flags); err != nil {
+			break
+		}
+		mapped++
+	}
+
+	if err != nil {
+		// Undo any mappings established so far and give the reserved
+		// address space back to the kernel.
+		region.size = mapped << mem.PageShift
+		_ = releaseRegion(region, reservedSize)
+		return Region{}, err
+	}
+
+	return region, nil
+}
+
+// allocPage maps a single page of a region allocated via Alloc.
+func allocPage(page Page, flags AllocFlag) *kernel.Error {
+	if flags&AllocLazy != 0 {
+		return mapFn(page, ReservedZeroedFrame, FlagPresent|FlagNoExecute|FlagCopyOnWrite)
+	}
+
+	frame, err := frameAllocator()
+	if err != nil {
+		return err
+	}
+
+	if err = mapFn(page, frame, FlagPresent|FlagRW|FlagNoExecute); err != nil {
+		if frameFreer != nil {
+			_ = frameFreer(frame)
+		}
+		return err
+	}
+
+	memsetFn(page.Address(), 0, mem.PageSize)
+	return nil
+}
+
+// Free unmaps a region previously allocated via a call to Alloc, releases
+// the physical frames backing it and returns its virtual address range
+// (including any guard pages) back to the kernel address space.
+func Free(region Region) *kernel.Error {
+	lowGuard, highGuard := region.guardPages()
+	return releaseRegion(region, region.size+mem.Size((lowGuard+highGuard)<<mem.PageShift))
+}
+
+// releaseRegion unmaps and frees the pages of region and releases the
+// reserved address range of the specified size that contains it.
+func releaseRegion(region Region, reservedSize mem.Size) *kernel.Error {
+	var (
+		page         = PageFromAddress(region.start)
+		pageCount    = region.size >> mem.PageShift
+		lowGuard, _  = region.guardPages()
+		reservedAddr = region.start - lowGuard<<mem.PageShift
+	)
+
+	for ; pageCount > 0; pageCount, page = pageCount-1, page+1 {
+		if err := unmapAndFreeFn(page); err != nil {
+			return err
+		}
+	}
+
+	return releaseRegionFn(reservedAddr, reservedSize)
+}
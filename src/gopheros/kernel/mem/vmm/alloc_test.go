@@ -0,0 +1,212 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"testing"
+)
+
+func TestAlloc(t *testing.T) {
+	defer func() {
+		mapFn = Map
+		unmapAndFreeFn = UnmapAndFree
+		memsetFn = mem.Memset
+		reserveRegionFn = ReserveRegion
+		releaseRegionFn = ReleaseRegion
+		frameAllocator = nil
+		frameFreer = nil
+	}()
+
+	var (
+		reservedAddr = uintptr(0xffffc00000100000)
+		reservedSize mem.Size
+		mappedPages  []Page
+		mappedFlags  []PageTableEntryFlag
+		clearedPages int
+		nextFrame    pmm.Frame
+		freedPages   []Page
+		releasedAddr uintptr
+		releasedSize mem.Size
+		freedFrames  int
+	)
+
+	reset := func() {
+		reservedSize, releasedAddr, releasedSize = 0, 0, 0
+		mappedPages, mappedFlags, freedPages = nil, nil, nil
+		clearedPages, freedFrames, nextFrame = 0, 0, 1
+	}
+
+	reserveRegionFn = func(size mem.Size, _ uintptr) (uintptr, *kernel.Error) {
+		reservedSize = size
+		return reservedAddr, nil
+	}
+	releaseRegionFn = func(addr uintptr, size mem.Size) *kernel.Error {
+		releasedAddr, releasedSize = addr, size
+		return nil
+	}
+	mapFn = func(page Page, _ pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
+		mappedPages = append(mappedPages, page)
+		mappedFlags = append(mappedFlags, flags)
+		return nil
+	}
+	unmapAndFreeFn = func(page Page) *kernel.Error {
+		freedPages = append(freedPages, page)
+		return nil
+	}
+	memsetFn = func(_ uintptr, _ byte, _ mem.Size) { clearedPages++ }
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+		nextFrame++
+		return nextFrame, nil
+	})
+	SetFrameFreer(func(_ pmm.Frame) *kernel.Error {
+		freedFrames++
+		return nil
+	})
+
+	specs := []struct {
+		size            mem.Size
+		flags           AllocFlag
+		expRegionOffset uintptr
+		expReserved     mem.Size
+		expCleared      int
+		expFlags        PageTableEntryFlag
+	}{
+		{
+			4097, 0,
+			0, 2 * mem.PageSize,
+			2, FlagPresent | FlagRW | FlagNoExecute,
+		},
+		{
+			3 * mem.PageSize, AllocLazy,
+			0, 3 * mem.PageSize,
+			0, FlagPresent | FlagNoExecute | FlagCopyOnWrite,
+		},
+		{
+			mem.PageSize, AllocGuardLow,
+			uintptr(mem.PageSize), 2 * mem.PageSize,
+			1, FlagPresent | FlagRW | FlagNoExecute,
+		},
+		{
+			mem.PageSize, AllocGuardLow | AllocGuardHigh | AllocLazy,
+			uintptr(mem.PageSize), 3 * mem.PageSize,
+			0, FlagPresent | FlagNoExecute | FlagCopyOnWrite,
+		},
+	}
+
+	for specIndex, spec := range specs {
+		reset()
+
+		region, err := Alloc(spec.size, spec.flags)
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if exp := reservedAddr + spec.expRegionOffset; region.Address() != exp {
+			t.Errorf("[spec %d] expected region address to be %x; got %x", specIndex, exp, region.Address())
+		}
+
+		if reservedSize != spec.expReserved {
+			t.Errorf("[spec %d] expected to reserve %d bytes; got %d", specIndex, spec.expReserved, reservedSize)
+		}
+
+		if exp := int(region.Size() >> mem.PageShift); len(mappedPages) != exp {
+			t.Errorf("[spec %d] expected %d page(s) to be mapped; got %d", specIndex, exp, len(mappedPages))
+		}
+
+		for pageIndex, page := range mappedPages {
+			if exp := PageFromAddress(region.Address()) + Page(pageIndex); page != exp {
+				t.Errorf("[spec %d] expected mapped page %d to be %x; got %x", specIndex, pageIndex, exp, page)
+			}
+
+			if mappedFlags[pageIndex] != spec.expFlags {
+				t.Errorf("[spec %d] expected page %d to be mapped with flags %x; got %x", specIndex, pageIndex, spec.expFlags, mappedFlags[pageIndex])
+			}
+		}
+
+		if clearedPages != spec.expCleared {
+			t.Errorf("[spec %d] expected %d page(s) to be cleared; got %d", specIndex, spec.expCleared, clearedPages)
+		}
+
+		if err = Free(region); err != nil {
+			t.Errorf("[spec %d] unexpected error while freeing region: %v", specIndex, err)
+			continue
+		}
+
+		if len(freedPages) != len(mappedPages) {
+			t.Errorf("[spec %d] expected %d page(s) to be unmapped; got %d", specIndex, len(mappedPages), len(freedPages))
+		}
+
+		if releasedAddr != reservedAddr || releasedSize != reservedSize {
+			t.Errorf("[spec %d] expected to release region (%x, %d); got (%x, %d)", specIndex, reservedAddr, reservedSize, releasedAddr, releasedSize)
+		}
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+
+		reset()
+		if _, err := Alloc(0, 0); err != errAllocInvalidSize {
+			t.Errorf("expected to get errAllocInvalidSize; got %v", err)
+		}
+
+		reserveRegionFn = func(_ mem.Size, _ uintptr) (uintptr, *kernel.Error) {
+			return 0, expErr
+		}
+		if _, err := Alloc(mem.PageSize, 0); err != expErr {
+			t.Errorf("expected to get error %v; got %v", expErr, err)
+		}
+
+		reserveRegionFn = func(size mem.Size, _ uintptr) (uintptr, *kernel.Error) {
+			reservedSize = size
+			return reservedAddr, nil
+		}
+
+		// Frame allocation fails after mapping the first page; the
+		// mapped page should be released along with the address range.
+		reset()
+		frameCount := 0
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			if frameCount++; frameCount > 1 {
+				return pmm.InvalidFrame, expErr
+			}
+			return pmm.Frame(1), nil
+		})
+		if _, err := Alloc(2*mem.PageSize, AllocGuardHigh); err != expErr {
+			t.Errorf("expected to get error %v; got %v", expErr, err)
+		}
+
+		if exp := 1; len(freedPages) != exp {
+			t.Errorf("expected %d page(s) to be unmapped; got %d", exp, len(freedPages))
+		}
+
+		if releasedAddr != reservedAddr || releasedSize != 3*mem.PageSize {
+			t.Errorf("expected to release region (%x, %d); got (%x, %d)", reservedAddr, 3*mem.PageSize, releasedAddr, releasedSize)
+		}
+
+		// Map fails; the allocated frame should be released
+		reset()
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			return pmm.Frame(1), nil
+		})
+		mapFn = func(_ Page, _ pmm.Frame, _ PageTableEntryFlag) *kernel.Error {
+			return expErr
+		}
+		if _, err := Alloc(mem.PageSize, 0); err != expErr {
+			t.Errorf("expected to get error %v; got %v", expErr, err)
+		}
+
+		if exp := 1; freedFrames != exp {
+			t.Errorf("expected %d frame(s) to be freed; got %d", exp, freedFrames)
+		}
+
+		// UnmapAndFree fails while freeing a region
+		unmapAndFreeFn = func(_ Page) *kernel.Error {
+			return expErr
+		}
+		if err := Free(Region{start: reservedAddr, size: mem.PageSize}); err != expErr {
+			t.Errorf("expected to get error %v; got %v", expErr, err)
+		}
+	})
+}
@@ -0,0 +1,312 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"unsafe"
+)
+
+var (
+	// physToVirtFn is used by tests and is automatically inlined by the compiler.
+	physToVirtFn = PhysToVirt
+
+	errDestroyActivePDT = &kernel.Error{Module: "vmm", Message: "cannot destroy the active page directory table"}
+)
+
+// pageTable describes the layout of a page table at any paging level.
+type pageTable [mem.PageSize >> mem.PointerShift]pageTableEntry
+
+// Clone creates a copy of this PDT that is suitable for implementing fork
+// semantics. The kernel half of the address space is shared with the clone by
+// copying the top-level PDT entries; as these entries are pre-allocated by
+// preallocKernelTables when the kernel boots, any kernel mappings that get
+// established after the clone is made are visible to both PDTs. The user half
+// is duplicated: each page table gets copied and every writable page is marked
+// as read-only and copy-on-write in both tables so that the first write to a
+// page by either address space triggers a page fault that gives the writer its
+// own copy.
+//
+// Pages whose frames are not tracked by the registered frame reference
+// counter (e.g. memory-mapped devices) are shared by both tables without
+// copy-on-write semantics.
+func (pdt PageDirectoryTable) Clone() (PageDirectoryTable, *kernel.Error) {
+	var clone = PageDirectoryTable{pcid: allocPCID()}
+
+	srcTable, err := pageTableAt(pdt.pdtFrame)
+	if err != nil {
+		return clone, err
+	}
+
+	if clone.pdtFrame, err = allocPageTable(); err != nil {
+		return clone, err
+	}
+
+	// allocPageTable has already verified that the frame is directly mapped
+	dstTable, _ := pageTableAt(clone.pdtFrame)
+
+	lastEntry := len(dstTable) - 1
+	for index := len(dstTable) / 2; index < lastEntry; index++ {
+		dstTable[index] = srcTable[index]
+	}
+	dstTable[lastEntry].SetFlags(FlagPresent | FlagRW)
+	dstTable[lastEntry].SetFrame(clone.pdtFrame)
+
+	err = cloneTable(srcTable, dstTable, 0, len(dstTable)/2)
+
+	// The source entries for writable pages have been converted to
+	// read-only; the CPU must not keep using the stale RW TLB entries.
+	if activePDTFn() == pdt.pdtFrame.Address() {
+		flushTLBFn()
+	} else {
+		pdt.invalidateTLB()
+	}
+
+	if err != nil {
+		clone.Destroy()
+		return PageDirectoryTable{}, err
+	}
+
+	return clone, nil
+}
+
+// preallocKernelTables ensures that every top-level entry for the kernel half
+// of the active PDT (except the entry used for the recursive mapping) points
+// to a page table. Since PDT clones share the kernel half by copying the
+// top-level entries, the entries must never change after the first clone is
+// made. The active PDT must be the one set up for the kernel by Init.
+func preallocKernelTables() *kernel.Error {
+	var (
+		err       *kernel.Error
+		lastEntry = uintptr(1<<pageLevelBits[0]) - 1
+		pte       *pageTableEntry
+	)
+
+	for index := (lastEntry + 1) / 2; index < lastEntry; index++ {
+		// Sign-extend the address so that it is in canonical form
+		page := PageFromAddress(^uintptr(0)<<(pageLevelShifts[0]+pageLevelBits[0]-1) | index<<pageLevelShifts[0])
+		pte = (*pageTableEntry)(ptePtrFn(pdtVirtualAddr + index<<mem.PointerShift))
+		if err = ensureNextTable(page, 0, pte, FlagPresent|FlagRW); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Destroy releases the page tables that make up the user half of the address
+// space described by this PDT together with the frames that they map and the
+// frame used by the PDT itself. The page tables for the kernel half of the
+// address space are shared between all PDTs and are left intact. Destroy
+// cannot be used on the currently active PDT. If the user half contains huge
+// page mappings, Destroy returns errNoHugePageSupport without releasing any
+// frames.
+func (pdt PageDirectoryTable) Destroy() *kernel.Error {
+	if activePDTFn() == pdt.pdtFrame.Address() {
+		return errDestroyActivePDT
+	}
+
+	table, err := pageTableAt(pdt.pdtFrame)
+	if err != nil {
+		return err
+	}
+
+	// Validate the tables before releasing anything so that a failure
+	// does not leave the PDT partially destroyed.
+	if err = checkDestroyable(table, 0, len(table)/2); err != nil {
+		return err
+	}
+
+	if err = destroyTable(table, 0, len(table)/2); err != nil {
+		return err
+	}
+
+	// The PDT frame may be reused by a new PDT with the same PCID
+	pdt.invalidateTLB()
+	return freeFrame(pdt.pdtFrame)
+}
+
+// cloneTable copies the first count entries of the src page table at the
+// specified paging level to the dst page table, recursively cloning any
+// lower-level tables they point to.
+func cloneTable(src, dst *pageTable, level uint8, count int) *kernel.Error {
+	for index := 0; index < count; index++ {
+		srcEntry := &src[index]
+		if !srcEntry.HasFlags(FlagPresent) {
+			continue
+		}
+
+		if level == pageLevels-1 {
+			if err := shareFrame(srcEntry); err != nil {
+				return err
+			}
+
+			dst[index] = *srcEntry
+			continue
+		}
+
+		// CoW is not supported for huge pages
+		if srcEntry.HasFlags(FlagHugePage) {
+			return errNoHugePageSupport
+		}
+
+		srcNext, err := pageTableAt(srcEntry.Frame())
+		if err != nil {
+			return err
+		}
+
+		nextFrame, err := allocPageTable()
+		if err != nil {
+			return err
+		}
+
+		dst[index] = *srcEntry
+		dst[index].SetFrame(nextFrame)
+
+		dstNext, _ := pageTableAt(nextFrame)
+		if err = cloneTable(srcNext, dstNext, level+1, len(dstNext)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// shareFrame prepares the frame referenced by a page table entry so it can be
+// mapped by another page table. Writable pages are converted into read-only
+// copy-on-write pages.
+func shareFrame(pte *pageTableEntry) *kernel.Error {
+	frame := pte.Frame()
+	if !isRefCounted(frame) {
+		return nil
+	}
+
+	if frameIncRef != nil {
+		if err := frameIncRef(frame); err != nil {
+			return err
+		}
+	}
+
+	if pte.HasFlags(FlagRW) {
+		pte.ClearFlags(FlagRW)
+		pte.SetFlags(FlagCopyOnWrite)
+	}
+
+	return nil
+}
+
+// checkDestroyable returns an error if the first count entries of the supplied
+// page table at the specified paging level, or any lower-level tables that
+// they point to, cannot be released by destroyTable.
+func checkDestroyable(table *pageTable, level uint8, count int) *kernel.Error {
+	if level == pageLevels-1 {
+		return nil
+	}
+
+	for index := 0; index < count; index++ {
+		pte := &table[index]
+		if !pte.HasFlags(FlagPresent) {
+			continue
+		}
+
+		if pte.HasFlags(FlagHugePage) {
+			return errNoHugePageSupport
+		}
+
+		next, err := pageTableAt(pte.Frame())
+		if err != nil {
+			return err
+		}
+
+		if err = checkDestroyable(next, level+1, len(next)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// destroyTable releases the frames referenced by the first count entries of
+// the supplied page table at the specified paging level. Any lower-level
+// tables are destroyed recursively.
+func destroyTable(table *pageTable, level uint8, count int) *kernel.Error {
+	for index := 0; index < count; index++ {
+		pte := &table[index]
+		if !pte.HasFlags(FlagPresent) {
+			continue
+		}
+
+		frame := pte.Frame()
+		switch {
+		case level == pageLevels-1:
+			if isRefCounted(frame) {
+				if err := freeFrame(frame); err != nil {
+					return err
+				}
+			}
+		case pte.HasFlags(FlagHugePage):
+			return errNoHugePageSupport
+		default:
+			next, err := pageTableAt(frame)
+			if err != nil {
+				return err
+			}
+
+			if err = destroyTable(next, level+1, len(next)); err != nil {
+				return err
+			}
+
+			if err = freeFrame(frame); err != nil {
+				return err
+			}
+		}
+
+		*pte = 0
+	}
+
+	return nil
+}
+
+// isRefCounted returns true if frame is tracked by the registered frame
+// reference counter. If no reference counter has been registered, all frames
+// are assumed to be tracked.
+func isRefCounted(frame pmm.Frame) bool {
+	return frameRefCount == nil || frameRefCount(frame) != 0
+}
+
+// freeFrame drops a reference to frame using the registered frame freer.
+func freeFrame(frame pmm.Frame) *kernel.Error {
+	if frameFreer == nil {
+		return nil
+	}
+
+	return frameFreer(frame)
+}
+
+// allocPageTable allocates and clears a frame for storing a page table.
+func allocPageTable() (pmm.Frame, *kernel.Error) {
+	frame, err := frameAllocator()
+	if err != nil {
+		return pmm.InvalidFrame, err
+	}
+
+	addr, err := physToVirtFn(frame.Address())
+	if err != nil {
+		freeFrame(frame)
+		return pmm.InvalidFrame, err
+	}
+
+	memsetFn(addr, 0, mem.PageSize)
+	return frame, nil
+}
+
+// pageTableAt returns a pointer to the page table stored in the supplied
+// frame. The table is accessed via the direct physical memory map.
+func pageTableAt(frame pmm.Frame) (*pageTable, *kernel.Error) {
+	addr, err := physToVirtFn(frame.Address())
+	if err != nil {
+		return nil, err
+	}
+
+	return (*pageTable)(unsafe.Pointer(addr)), nil
+}
@@ -0,0 +1,344 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"testing"
+	"unsafe"
+)
+
+// cloneTestEnv emulates a small amount of physical memory that can hold
+// page tables. Frame N is backed by tables[N].
+type cloneTestEnv struct {
+	tables      [16]pageTable
+	nextFrame   pmm.Frame
+	freedFrames map[pmm.Frame]int
+	incRefs     map[pmm.Frame]int
+}
+
+func (env *cloneTestEnv) install() {
+	env.freedFrames = make(map[pmm.Frame]int)
+	env.incRefs = make(map[pmm.Frame]int)
+
+	physToVirtFn = func(physAddr uintptr) (uintptr, *kernel.Error) {
+		return uintptr(unsafe.Pointer(&env.tables[physAddr>>12])), nil
+	}
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+		env.nextFrame++
+		return env.nextFrame, nil
+	})
+	SetFrameFreer(func(frame pmm.Frame) *kernel.Error {
+		env.freedFrames[frame]++
+		return nil
+	})
+	SetFrameRefCounter(
+		func(frame pmm.Frame) *kernel.Error {
+			env.incRefs[frame]++
+			return nil
+		},
+		nil,
+		func(frame pmm.Frame) uint16 {
+			// Frame 200 emulates a memory-mapped device
+			if frame == pmm.Frame(200) {
+				return 0
+			}
+			return 1
+		},
+	)
+}
+
+// populate sets up the PDT at frame 0 so that its user half maps three pages
+// using the tables at frames 1-3 and its kernel half contains a single entry.
+func (env *cloneTestEnv) populate() {
+	env.nextFrame = 3
+
+	userFlags := FlagPresent | FlagRW | FlagUserAccessible
+	env.tables[0][0].SetFlags(userFlags)
+	env.tables[0][0].SetFrame(pmm.Frame(1))
+	env.tables[0][300].SetFlags(FlagPresent | FlagRW)
+	env.tables[0][300].SetFrame(pmm.Frame(50))
+	env.tables[0][511].SetFlags(FlagPresent | FlagRW)
+	env.tables[0][511].SetFrame(pmm.Frame(0))
+	env.tables[1][0].SetFlags(userFlags)
+	env.tables[1][0].SetFrame(pmm.Frame(2))
+	env.tables[2][4].SetFlags(userFlags)
+	env.tables[2][4].SetFrame(pmm.Frame(3))
+
+	env.tables[3][0].SetFlags(userFlags)
+	env.tables[3][0].SetFrame(pmm.Frame(100))
+	env.tables[3][1].SetFlags(FlagPresent | FlagUserAccessible)
+	env.tables[3][1].SetFrame(pmm.Frame(101))
+	env.tables[3][2].SetFlags(userFlags)
+	env.tables[3][2].SetFrame(pmm.Frame(200))
+}
+
+func TestPageDirectoryTableClone(t *testing.T) {
+	defer func() {
+		physToVirtFn = PhysToVirt
+		activePDTFn = cpu.ActivePDT
+		flushTLBFn = cpu.FlushTLB
+		frameAllocator = nil
+		frameFreer = nil
+		SetFrameRefCounter(nil, nil, nil)
+	}()
+
+	var (
+		env        cloneTestEnv
+		tlbFlushed bool
+		src        = PageDirectoryTable{pdtFrame: pmm.Frame(0)}
+	)
+
+	env.install()
+	env.populate()
+	activePDTFn = func() uintptr { return src.pdtFrame.Address() }
+	flushTLBFn = func() { tlbFlushed = true }
+
+	clone, err := src.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := pmm.Frame(4); clone.pdtFrame != exp {
+		t.Fatalf("expected clone PDT to be stored at frame %d; got %d", exp, clone.pdtFrame)
+	}
+
+	if !tlbFlushed {
+		t.Error("expected the TLB to be flushed for the active source PDT")
+	}
+
+	dst := &env.tables[clone.pdtFrame]
+	if dst[300] != env.tables[0][300] {
+		t.Error("expected kernel half entries to be shared with the clone")
+	}
+
+	if dst[511].Frame() != clone.pdtFrame || !dst[511].HasFlags(FlagPresent|FlagRW) {
+		t.Error("expected the last clone PDT entry to be recursively mapped")
+	}
+
+	// Walk the cloned user tables
+	dstTable := dst
+	for level, index := 0, []int{0, 0, 4}; level < pageLevels-1; level++ {
+		entry := dstTable[index[level]]
+		if entry.Frame() <= 3 || !entry.HasFlags(FlagPresent|FlagRW|FlagUserAccessible) {
+			t.Fatalf("expected level %d table to be cloned into a new frame; got entry %x", level, entry)
+		}
+		dstTable = &env.tables[entry.Frame()]
+	}
+
+	specs := []struct {
+		index     int
+		expFrame  pmm.Frame
+		expFlags  PageTableEntryFlag
+		expIncRef int
+	}{
+		{0, pmm.Frame(100), FlagPresent | FlagCopyOnWrite | FlagUserAccessible, 1},
+		{1, pmm.Frame(101), FlagPresent | FlagUserAccessible, 1},
+		{2, pmm.Frame(200), FlagPresent | FlagRW | FlagUserAccessible, 0},
+	}
+
+	for _, spec := range specs {
+		for _, entry := range []pageTableEntry{env.tables[3][spec.index], dstTable[spec.index]} {
+			if entry.Frame() != spec.expFrame || entry&^pageTableEntry(ptePhysPageMask) != pageTableEntry(spec.expFlags) {
+				t.Errorf("[entry %d] expected entry to map frame %d with flags %x; got %x", spec.index, spec.expFrame, spec.expFlags, entry)
+			}
+		}
+
+		if got := env.incRefs[spec.expFrame]; got != spec.expIncRef {
+			t.Errorf("[entry %d] expected frame %d reference count to be incremented %d time(s); got %d", spec.index, spec.expFrame, spec.expIncRef, got)
+		}
+	}
+
+	if err = src.Destroy(); err != errDestroyActivePDT {
+		t.Errorf("expected to get errDestroyActivePDT; got %v", err)
+	}
+
+	if err = clone.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, frame := range []pmm.Frame{4, 5, 6, 7, 100, 101} {
+		if got := env.freedFrames[frame]; got != 1 {
+			t.Errorf("expected frame %d to be freed once; got %d", frame, got)
+		}
+	}
+
+	for _, frame := range []pmm.Frame{0, 1, 2, 3, 50, 200} {
+		if got := env.freedFrames[frame]; got != 0 {
+			t.Errorf("expected frame %d not to be freed; freed %d time(s)", frame, got)
+		}
+	}
+}
+
+func TestPageDirectoryTableCloneErrors(t *testing.T) {
+	defer func() {
+		physToVirtFn = PhysToVirt
+		activePDTFn = cpu.ActivePDT
+		flushTLBFn = cpu.FlushTLB
+		frameAllocator = nil
+		frameFreer = nil
+		SetFrameRefCounter(nil, nil, nil)
+	}()
+
+	var (
+		env    cloneTestEnv
+		src    = PageDirectoryTable{pdtFrame: pmm.Frame(0)}
+		expErr = &kernel.Error{Module: "test", Message: "something went wrong"}
+	)
+
+	activePDTFn = func() uintptr { return src.pdtFrame.Address() }
+	flushTLBFn = func() {}
+
+	t.Run("huge pages in user half", func(t *testing.T) {
+		env = cloneTestEnv{}
+		env.install()
+		env.populate()
+		env.tables[2][4].SetFlags(FlagHugePage)
+
+		if _, err := src.Clone(); err != errNoHugePageSupport {
+			t.Fatalf("expected to get errNoHugePageSupport; got %v", err)
+		}
+
+		// The partially cloned tables should be released
+		for _, frame := range []pmm.Frame{4, 5, 6} {
+			if got := env.freedFrames[frame]; got != 1 {
+				t.Errorf("expected frame %d to be freed once; got %d", frame, got)
+			}
+		}
+	})
+
+	t.Run("destroy with huge pages in user half", func(t *testing.T) {
+		defer func() {
+			activePDTFn = func() uintptr { return src.pdtFrame.Address() }
+		}()
+
+		env = cloneTestEnv{}
+		env.install()
+		env.populate()
+		activePDTFn = func() uintptr { return pmm.Frame(1).Address() }
+
+		// Add a page table that precedes the huge page mapping
+		env.tables[2][0].SetFlags(FlagPresent | FlagRW | FlagUserAccessible)
+		env.tables[2][0].SetFrame(pmm.Frame(9))
+		env.tables[9][0].SetFlags(FlagPresent | FlagRW | FlagUserAccessible)
+		env.tables[9][0].SetFrame(pmm.Frame(102))
+		env.tables[2][4].SetFlags(FlagHugePage)
+
+		if err := src.Destroy(); err != errNoHugePageSupport {
+			t.Fatalf("expected to get errNoHugePageSupport; got %v", err)
+		}
+
+		if len(env.freedFrames) != 0 {
+			t.Errorf("expected no frames to be freed; got %v", env.freedFrames)
+		}
+
+		if !env.tables[2][0].HasFlags(FlagPresent) || !env.tables[9][0].HasFlags(FlagPresent) {
+			t.Error("expected the page tables to be left intact")
+		}
+	})
+
+	t.Run("frame allocation fails", func(t *testing.T) {
+		env = cloneTestEnv{}
+		env.install()
+		env.populate()
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			if env.nextFrame == 5 {
+				return pmm.InvalidFrame, expErr
+			}
+			env.nextFrame++
+			return env.nextFrame, nil
+		})
+
+		if _, err := src.Clone(); err != expErr {
+			t.Fatalf("expected to get error %v; got %v", expErr, err)
+		}
+	})
+
+	t.Run("reference count increment fails", func(t *testing.T) {
+		env = cloneTestEnv{}
+		env.install()
+		env.populate()
+		SetFrameRefCounter(func(_ pmm.Frame) *kernel.Error { return expErr }, nil, nil)
+
+		if _, err := src.Clone(); err != expErr {
+			t.Fatalf("expected to get error %v; got %v", expErr, err)
+		}
+	})
+
+	t.Run("frame not directly mapped", func(t *testing.T) {
+		env = cloneTestEnv{}
+		env.install()
+		physToVirtFn = func(_ uintptr) (uintptr, *kernel.Error) { return 0, errNotDirectlyMapped }
+
+		if _, err := src.Clone(); err != errNotDirectlyMapped {
+			t.Errorf("expected to get errNotDirectlyMapped; got %v", err)
+		}
+
+		if err := (PageDirectoryTable{pdtFrame: pmm.Frame(1)}).Destroy(); err != errNotDirectlyMapped {
+			t.Errorf("expected to get errNotDirectlyMapped; got %v", err)
+		}
+	})
+}
+
+func TestPreallocKernelTables(t *testing.T) {
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origNextAddrFn func(uintptr) uintptr) {
+		ptePtrFn = origPtePtr
+		nextAddrFn = origNextAddrFn
+		frameAllocator = nil
+	}(ptePtrFn, nextAddrFn)
+
+	var (
+		pdtTable  pageTable
+		scratch   pageTable
+		nextFrame pmm.Frame
+	)
+
+	ptePtrFn = func(entryAddr uintptr) unsafe.Pointer {
+		return unsafe.Pointer(&pdtTable[(entryAddr-pdtVirtualAddr)>>mem.PointerShift])
+	}
+	nextAddrFn = func(_ uintptr) uintptr { return uintptr(unsafe.Pointer(&scratch[0])) }
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+		nextFrame++
+		return nextFrame, nil
+	})
+
+	pdtTable[300].SetFlags(FlagPresent | FlagRW)
+	pdtTable[300].SetFrame(pmm.Frame(1000))
+	pdtTable[511].SetFlags(FlagPresent | FlagRW)
+	pdtTable[511].SetFrame(pmm.Frame(2000))
+
+	if err := preallocKernelTables(); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := pmm.Frame(254); nextFrame != exp {
+		t.Errorf("expected %d page tables to be allocated; got %d", exp, nextFrame)
+	}
+
+	for index := 0; index < 256; index++ {
+		if pdtTable[index] != 0 {
+			t.Errorf("[entry %d] expected user half entry to be left untouched; got %x", index, pdtTable[index])
+		}
+	}
+
+	for index := 256; index < 511; index++ {
+		if !pdtTable[index].HasFlags(FlagPresent | FlagRW) {
+			t.Errorf("[entry %d] expected kernel half entry to point to a page table; got %x", index, pdtTable[index])
+		}
+	}
+
+	if pdtTable[300].Frame() != pmm.Frame(1000) || pdtTable[511].Frame() != pmm.Frame(2000) {
+		t.Error("expected existing entries to be left untouched")
+	}
+
+	t.Run("allocation error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+		pdtTable = pageTable{}
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) { return pmm.InvalidFrame, expErr })
+
+		if err := preallocKernelTables(); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+	})
+}
@@ -13,11 +13,55 @@ const (
 	// bits 12-51 contain the physical memory address.
 	ptePhysPageMask = uintptr(0x000ffffffffff000)
 
-	// tempMappingAddr is a reserved virtual page address used for
+	// defaultTempMappingAddr is the reserved virtual page address used for
 	// temporary physical page mappings (e.g. when mapping inactive PDT
-	// pages). For amd64 this address uses the following table indices:
-	// 510, 511, 511, 511.
-	tempMappingAddr = uintptr(0Xffffff7ffffff000)
+	// pages) when KASLR is disabled. For amd64 this address uses the
+	// following table indices: 510, 511, 511, 511.
+	defaultTempMappingAddr = uintptr(0Xffffff7ffffff000)
+
+	// kaslrTempMappingStart is the lowest virtual address that can be
+	// selected for temporary mappings when KASLR is enabled. For amd64
+	// this address corresponds to P4 index 510; the temporary mapping
+	// address is randomized within the 512G covered by this entry.
+	kaslrTempMappingStart = uintptr(0xffffff0000000000)
+
+	// kaslrEarlyReserveStart is the lowest virtual address that can be
+	// selected as the end of the EarlyReserveRegion area when KASLR is
+	// enabled. For amd64 this address corresponds to P4 index 448.
+	kaslrEarlyReserveStart = uintptr(0xffffe00000000000)
+
+	// kaslrHeapArenaStart and kaslrHeapArenaEnd define the virtual
+	// address range that can be selected as the end of the Go heap arena
+	// when KASLR is enabled. The range starts 1T above kernelRangesStart
+	// so that the arena reservation always fits below the selected
+	// address and spans 16T.
+	kaslrHeapArenaStart = uintptr(0xffffc10000000000)
+	kaslrHeapArenaEnd   = uintptr(0xffffd10000000000)
+
+	// directMapAddr is the virtual address where the kernel establishes a
+	// linear mapping of the available physical memory. For amd64 this
+	// address corresponds to P4 index 320 which leaves 32T of address
+	// space for the direct map.
+	directMapAddr = uintptr(0xffffa00000000000)
+
+	// kernelRangesStart is the lowest virtual address that can be handed
+	// out by the kernel range allocator. For amd64 this address
+	// corresponds to P4 index 384; the range allocator manages the
+	// address space between this address and the regions reserved via
+	// EarlyReserveRegion.
+	kernelRangesStart = uintptr(0xffffc00000000000)
+
+	// canonicalHoleStart and canonicalHoleEnd define the range of
+	// non-canonical virtual addresses that cannot be mapped. For amd64,
+	// bits 48-63 of a virtual address must be copies of bit 47.
+	canonicalHoleStart = uintptr(0x0000800000000000)
+	canonicalHoleEnd   = uintptr(0xffff800000000000)
+
+	// recursiveMappingAddr is the virtual address where the page tables
+	// of the active PDT become accessible via the recursive mapping in
+	// the last PDT entry. For amd64 this address corresponds to P4 index
+	// 511.
+	recursiveMappingAddr = uintptr(0xffffff8000000000)
 )
 
 var (
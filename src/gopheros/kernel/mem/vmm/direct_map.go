@@ -0,0 +1,135 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/hal/multiboot"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"unsafe"
+)
+
+// maxDirectMapRanges defines the maximum number of disjoint physical address
+// ranges that can be tracked by the direct map.
+const maxDirectMapRanges = 64
+
+// directMapRange describes a physical address range [start, end) that is
+// covered by the direct map.
+type directMapRange struct {
+	start uintptr
+	end   uintptr
+}
+
+var (
+	// directMapRanges tracks the physical address ranges that are covered
+	// by the direct map. A static array is used as the direct map is set
+	// up before the Go allocator is initialized.
+	directMapRanges     [maxDirectMapRanges]directMapRange
+	directMapRangeCount int
+
+	// visitMemRegionsFn is used by tests and is automatically inlined by
+	// the compiler.
+	visitMemRegionsFn = multiboot.VisitMemRegions
+
+	errNotDirectlyMapped      = &kernel.Error{Module: "vmm", Message: "physical address is not covered by the direct map"}
+	errTooManyDirectMapRanges = &kernel.Error{Module: "vmm", Message: "too many disjoint memory regions for the direct map"}
+)
+
+// setupDirectMap establishes a linear mapping of the available physical
+// memory regions reported by the bootloader starting at directMapAddr.
+//
+// Only the memory covered by the available regions gets mapped; holes in the
+// memory map (e.g. the VGA buffer and the BIOS ROM areas) are never mapped so
+// that they do not end up with write-back caching enabled. Each region is
+// mapped using 4K pages up to the first 2M boundary and after the last 2M
+// boundary it contains while the remaining part of the region is mapped using
+// 1G pages where supported by the CPU and 2M pages otherwise.
+func setupDirectMap() *kernel.Error {
+	var (
+		err          *kernel.Error
+		pageMask     = uint64(mem.PageSize - 1)
+		hugePageMask = uint64(HugePageSize2M - 1)
+		gbPageMask   = uint64(HugePageSize1G - 1)
+		useGbPages   = hasGigabytePagesFn()
+	)
+
+	var visitor = func(region *multiboot.MemoryMapEntry) bool {
+		if region.Type != multiboot.MemAvailable {
+			return true
+		}
+
+		// Only map the pages that are fully contained within the
+		// region. The memory map entries are sorted by address so we
+		// can skip any part of the region that has already been mapped.
+		start := (region.PhysAddress + pageMask) &^ pageMask
+		end := (region.PhysAddress + region.Length) &^ pageMask
+		if directMapRangeCount != 0 && start < uint64(directMapRanges[directMapRangeCount-1].end) {
+			start = uint64(directMapRanges[directMapRangeCount-1].end)
+		}
+
+		if start >= end {
+			return true
+		}
+
+		for addr, size := start, mem.PageSize; addr < end; addr += uint64(size) {
+			page, frame := PageFromAddress(directMapAddr+uintptr(addr)), pmm.Frame(addr>>mem.PageShift)
+
+			switch {
+			case useGbPages && addr&gbPageMask == 0 && end-addr >= uint64(HugePageSize1G):
+				size = HugePageSize1G
+				err = mapHugeFn(page, frame, size, FlagPresent|FlagRW|FlagNoExecute)
+			case addr&hugePageMask == 0 && end-addr >= uint64(HugePageSize2M):
+				size = HugePageSize2M
+				err = mapHugeFn(page, frame, size, FlagPresent|FlagRW|FlagNoExecute)
+			default:
+				size = mem.PageSize
+				err = mapFn(page, frame, FlagPresent|FlagRW|FlagNoExecute)
+			}
+
+			if err != nil {
+				return false
+			}
+		}
+
+		err = trackDirectMapRange(uintptr(start), uintptr(end))
+		return err == nil
+	}
+
+	// Use the noescape hack to prevent the compiler from leaking the visitor
+	// function literal to the heap.
+	visitMemRegionsFn(
+		*(*multiboot.MemRegionVisitor)(noEscape(unsafe.Pointer(&visitor))),
+	)
+
+	return err
+}
+
+// trackDirectMapRange records that the physical address range [start, end) is
+// covered by the direct map. Ranges that are adjacent to the last tracked
+// range are merged with it.
+func trackDirectMapRange(start, end uintptr) *kernel.Error {
+	if directMapRangeCount != 0 && directMapRanges[directMapRangeCount-1].end == start {
+		directMapRanges[directMapRangeCount-1].end = end
+		return nil
+	}
+
+	if directMapRangeCount == maxDirectMapRanges {
+		return errTooManyDirectMapRanges
+	}
+
+	directMapRanges[directMapRangeCount] = directMapRange{start: start, end: end}
+	directMapRangeCount++
+	return nil
+}
+
+// PhysToVirt returns the virtual address in the kernel's direct map that
+// corresponds to the supplied physical address. An error is returned if the
+// physical address is not covered by the direct map.
+func PhysToVirt(physAddr uintptr) (uintptr, *kernel.Error) {
+	for index := 0; index < directMapRangeCount; index++ {
+		if physAddr >= directMapRanges[index].start && physAddr < directMapRanges[index].end {
+			return directMapAddr + physAddr, nil
+		}
+	}
+
+	return 0, errNotDirectlyMapped
+}
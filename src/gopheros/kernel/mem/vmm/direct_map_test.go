@@ -0,0 +1,196 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/hal/multiboot"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"testing"
+)
+
+func TestSetupDirectMap(t *testing.T) {
+	defer func() {
+		mapFn = Map
+		mapHugeFn = MapHuge
+		visitMemRegionsFn = multiboot.VisitMemRegions
+		hasGigabytePagesFn = cpu.HasGigabytePages
+		directMapRangeCount = 0
+	}()
+
+	regions := []multiboot.MemoryMapEntry{
+		{PhysAddress: 0, Length: 0x9fc00, Type: multiboot.MemAvailable},
+		{PhysAddress: 0x9fc00, Length: 0x400, Type: multiboot.MemReserved},
+		{PhysAddress: 0xf0000, Length: 0x10000, Type: multiboot.MemReserved},
+		{PhysAddress: 0x100000, Length: uint64(3*mem.Gb) - 0x100000, Type: multiboot.MemAvailable},
+		{PhysAddress: uint64(4 * mem.Gb), Length: uint64(mem.Gb + 1), Type: multiboot.MemAvailable},
+	}
+
+	visitMemRegionsFn = func(visitor multiboot.MemRegionVisitor) {
+		for index := range regions {
+			if !visitor(&regions[index]) {
+				return
+			}
+		}
+	}
+
+	type mapping struct {
+		physAddr uintptr
+		size     mem.Size
+	}
+
+	var mappings []mapping
+	mapHugeFn = func(page Page, frame pmm.Frame, size mem.Size, flags PageTableEntryFlag) *kernel.Error {
+		if exp := directMapAddr + frame.Address(); page.Address() != exp {
+			t.Errorf("expected frame %x to be mapped at %x; got %x", frame, exp, page.Address())
+		}
+
+		if flags != FlagPresent|FlagRW|FlagNoExecute {
+			t.Errorf("unexpected mapping flags %x", flags)
+		}
+
+		mappings = append(mappings, mapping{frame.Address(), size})
+		return nil
+	}
+	mapFn = func(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
+		return mapHugeFn(page, frame, mem.PageSize, flags)
+	}
+
+	countMappings := func() map[mem.Size]int {
+		counts := make(map[mem.Size]int)
+		for _, m := range mappings {
+			counts[m.size]++
+		}
+		return counts
+	}
+
+	// The non-available regions below 1M must never be mapped
+	checkHoles := func(t *testing.T) {
+		for _, m := range mappings {
+			if m.physAddr < 0x100000 && m.physAddr+uintptr(m.size) > 0x9f000 {
+				t.Errorf("mapping at %x (size %x) overlaps a memory map hole", m.physAddr, m.size)
+			}
+		}
+	}
+
+	expRanges := []directMapRange{
+		{0, 0x9f000},
+		{0x100000, uintptr(3 * mem.Gb)},
+		{uintptr(4 * mem.Gb), uintptr(5 * mem.Gb)},
+	}
+
+	checkRanges := func(t *testing.T) {
+		if directMapRangeCount != len(expRanges) {
+			t.Fatalf("expected %d direct map ranges; got %d", len(expRanges), directMapRangeCount)
+		}
+
+		for index, exp := range expRanges {
+			if got := directMapRanges[index]; got != exp {
+				t.Errorf("[range %d] expected %x; got %x", index, exp, got)
+			}
+		}
+	}
+
+	t.Run("with 1G page support", func(t *testing.T) {
+		mappings, directMapRangeCount = nil, 0
+		hasGigabytePagesFn = func() bool { return true }
+
+		if err := setupDirectMap(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The region edges below 2M are mapped with 4K pages; the
+		// region at 4G gets one 1G page while its unaligned tail is
+		// not mapped.
+		counts := countMappings()
+		if counts[mem.PageSize] != 0x9f+0x100 || counts[HugePageSize2M] != 511 || counts[HugePageSize1G] != 3 {
+			t.Errorf("expected 415 4K, 511 2M and 3 1G pages to be mapped; got %v", counts)
+		}
+
+		checkHoles(t)
+		checkRanges(t)
+	})
+
+	t.Run("without 1G page support", func(t *testing.T) {
+		mappings, directMapRangeCount = nil, 0
+		hasGigabytePagesFn = func() bool { return false }
+
+		if err := setupDirectMap(); err != nil {
+			t.Fatal(err)
+		}
+
+		counts := countMappings()
+		if exp := int((3*mem.Gb+mem.Gb)/HugePageSize2M) - 1; counts[mem.PageSize] != 0x9f+0x100 || counts[HugePageSize2M] != exp || counts[HugePageSize1G] != 0 {
+			t.Errorf("expected 415 4K and %d 2M pages to be mapped; got %v", exp, counts)
+		}
+
+		checkHoles(t)
+		checkRanges(t)
+	})
+
+	t.Run("too many ranges", func(t *testing.T) {
+		directMapRangeCount = maxDirectMapRanges
+		directMapRanges[maxDirectMapRanges-1] = directMapRange{}
+
+		if err := setupDirectMap(); err != errTooManyDirectMapRanges {
+			t.Fatalf("expected error %v; got %v", errTooManyDirectMapRanges, err)
+		}
+	})
+
+	t.Run("map error", func(t *testing.T) {
+		directMapRangeCount = 0
+		expErr := &kernel.Error{Module: "test", Message: "map failed"}
+		mapHugeFn = func(_ Page, _ pmm.Frame, _ mem.Size, _ PageTableEntryFlag) *kernel.Error {
+			return expErr
+		}
+
+		if err := setupDirectMap(); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestPhysToVirt(t *testing.T) {
+	defer func() {
+		directMapRangeCount = 0
+	}()
+
+	directMapRangeCount = 0
+	if err := trackDirectMapRange(0, 0x9f000); err != nil {
+		t.Fatal(err)
+	}
+	if err := trackDirectMapRange(0x100000, uintptr(HugePageSize2M)); err != nil {
+		t.Fatal(err)
+	}
+	if err := trackDirectMapRange(uintptr(HugePageSize2M), uintptr(2*HugePageSize2M)); err != nil {
+		t.Fatal(err)
+	}
+
+	if directMapRangeCount != 2 {
+		t.Fatalf("expected adjacent ranges to be merged; got %d ranges", directMapRangeCount)
+	}
+
+	specs := []struct {
+		physAddr uintptr
+		expErr   *kernel.Error
+	}{
+		{0x1234, nil},
+		{0x9f000, errNotDirectlyMapped},
+		{0xb8000, errNotDirectlyMapped},
+		{0x100000, nil},
+		{uintptr(HugePageSize2M) + 0x10, nil},
+		{uintptr(2 * HugePageSize2M), errNotDirectlyMapped},
+	}
+
+	for specIndex, spec := range specs {
+		got, err := PhysToVirt(spec.physAddr)
+		if err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if err == nil && got != directMapAddr+spec.physAddr {
+			t.Errorf("[spec %d] expected to get %x; got %x", specIndex, directMapAddr+spec.physAddr, got)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package vmm
+
+import (
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mem"
+	"io"
+	"unsafe"
+)
+
+// mappingRange describes a contiguous range of virtual addresses that is
+// mapped to a contiguous range of physical addresses using the same flags.
+type mappingRange struct {
+	start, end uintptr
+	physAddr   uintptr
+	flags      PageTableEntryFlag
+}
+
+// mappingVisitor is a function that gets invoked by visitMappings for each
+// coalesced mapping range.
+type mappingVisitor func(*mappingRange)
+
+// DumpMappings writes a description of the mappings for the virtual address
+// range [start, end) in the active PDT to w. Adjacent mappings with the same
+// flags and contiguous physical addresses are coalesced into a single range.
+//
+// Each range is printed on its own line listing its virtual and physical
+// addresses followed by its RW, NX, User and CoW flags. The reported flags
+// reflect the effective page permissions which also depend on the flags of
+// the intermediate page tables.
+func DumpMappings(w io.Writer, start, end uintptr) {
+	var visitor = func(r *mappingRange) {
+		printMappingRange(w, r)
+	}
+
+	// Use the noescape hack to prevent the compiler from leaking the visitor
+	// function literal to the heap.
+	visitMappings(start, end, *(*mappingVisitor)(noEscape(unsafe.Pointer(&visitor))))
+}
+
+// visitMappings invokes visitor for each coalesced range of mappings in the
+// virtual address range [start, end) of the active PDT.
+func visitMappings(start, end uintptr, visitor mappingVisitor) {
+	var cur mappingRange
+
+	for addr := start &^ uintptr(mem.PageSize-1); addr < end; {
+		// Skip over the addresses that cannot be mapped
+		if addr >= canonicalHoleStart && addr < canonicalHoleEnd {
+			addr = canonicalHoleEnd
+			continue
+		}
+
+		size, physAddr, flags, mapped := lookupMapping(addr)
+
+		// The next address may wrap around when we reach the end
+		// of the address space
+		nextAddr := (addr &^ (size - 1)) + size
+		if nextAddr > end || nextAddr < addr {
+			nextAddr = end
+		}
+
+		switch {
+		case !mapped:
+		case cur.end == addr && cur.flags == flags && cur.physAddr+(addr-cur.start) == physAddr:
+			cur.end = nextAddr
+		default:
+			if cur.end != cur.start {
+				visitor(&cur)
+			}
+			cur = mappingRange{start: addr, end: nextAddr, physAddr: physAddr, flags: flags}
+		}
+
+		addr = nextAddr
+	}
+
+	if cur.end != cur.start {
+		visitor(&cur)
+	}
+}
+
+// lookupMapping performs a page table walk for the supplied virtual address
+// and returns the size of the region covered by the last visited page table
+// entry. If the address is mapped, lookupMapping also returns the physical
+// address that it maps to and the effective flags for the mapping.
+func lookupMapping(virtAddr uintptr) (size, physAddr uintptr, flags PageTableEntryFlag, mapped bool) {
+	flags = FlagRW | FlagUserAccessible
+
+	walk(virtAddr, func(pteLevel uint8, pte *pageTableEntry) bool {
+		size = uintptr(1) << pageLevelShifts[pteLevel]
+		if !pte.HasFlags(FlagPresent) {
+			return false
+		}
+
+		// A page is only writable or user-accessible if all page
+		// table levels allow it and non-executable if any of them
+		// disallows instruction fetches.
+		if !pte.HasFlags(FlagRW) {
+			flags &^= FlagRW
+		}
+		if !pte.HasFlags(FlagUserAccessible) {
+			flags &^= FlagUserAccessible
+		}
+		if pte.HasFlags(FlagNoExecute) {
+			flags |= FlagNoExecute
+		}
+
+		// Keep walking until we reach the last page level or an entry
+		// that maps a huge page.
+		if pteLevel < pageLevels-1 && (pteLevel == 0 || !pte.HasFlags(FlagHugePage)) {
+			return true
+		}
+
+		if pte.HasFlags(FlagCopyOnWrite) {
+			flags |= FlagCopyOnWrite
+		}
+
+		physAddr = (uintptr(*pte) & ptePhysPageMask &^ (size - 1)) + (virtAddr & (size - 1))
+		mapped = true
+		return false
+	})
+
+	return size, physAddr, flags, mapped
+}
+
+// printMappingRange writes a description of a mapping range to w.
+func printMappingRange(w io.Writer, r *mappingRange) {
+	var rw, nx, user, cow = "--", "--", "--", "---"
+	if r.flags&FlagRW != 0 {
+		rw = "RW"
+	}
+	if r.flags&FlagNoExecute != 0 {
+		nx = "NX"
+	}
+	if r.flags&FlagUserAccessible != 0 {
+		user = "US"
+	}
+	if r.flags&FlagCopyOnWrite != 0 {
+		cow = "CoW"
+	}
+
+	kfmt.Fprintf(w, "0x%16x - 0x%16x -> 0x%16x %s %s %s %s\n", r.start, r.end, r.physAddr, rw, nx, user, cow)
+}
@@ -0,0 +1,147 @@
+package vmm
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+// fakeMMU emulates the page table lookups performed by walk using the
+// recursive PDT mapping. Page tables are allocated on demand and are keyed by
+// their page level and the table indices of the virtual address that leads
+// to them. Virtual addresses whose table indices are equal to the index of
+// the recursive mapping are not supported.
+type fakeMMU struct {
+	tables map[[pageLevels]uintptr]*pageTable
+}
+
+func newFakeMMU() *fakeMMU {
+	return &fakeMMU{tables: make(map[[pageLevels]uintptr]*pageTable)}
+}
+
+// table returns the page table at the specified level that is used for
+// translating virtAddr.
+func (mmu *fakeMMU) table(level uint8, virtAddr uintptr) *pageTable {
+	var key [pageLevels]uintptr
+	key[0] = uintptr(level)
+	for pathLevel := uint8(0); pathLevel < level; pathLevel++ {
+		key[pathLevel+1] = (virtAddr >> pageLevelShifts[pathLevel]) & ((1 << pageLevelBits[pathLevel]) - 1)
+	}
+
+	table, exists := mmu.tables[key]
+	if !exists {
+		table = new(pageTable)
+		mmu.tables[key] = table
+	}
+
+	return table
+}
+
+// entry returns the page table entry at the specified level that is used for
+// translating virtAddr.
+func (mmu *fakeMMU) entry(level uint8, virtAddr uintptr) *pageTableEntry {
+	index := (virtAddr >> pageLevelShifts[level]) & ((1 << pageLevelBits[level]) - 1)
+	return &mmu.table(level, virtAddr)[index]
+}
+
+// ptePtr decodes a page table entry address generated by walk and returns a
+// pointer to the matching fake page table entry.
+func (mmu *fakeMMU) ptePtr(entryAddr uintptr) unsafe.Pointer {
+	var (
+		indices        [pageLevels]uintptr
+		recursiveIndex = uintptr((1 << pageLevelBits[0]) - 1)
+		recursiveCount uint8
+		virtAddr       uintptr
+	)
+
+	for level := uint8(0); level < pageLevels; level++ {
+		indices[level] = (entryAddr >> pageLevelShifts[level]) & ((1 << pageLevelBits[level]) - 1)
+	}
+
+	for recursiveCount < pageLevels && indices[recursiveCount] == recursiveIndex {
+		recursiveCount++
+	}
+
+	// Rebuild the virtual address using the table indices that follow
+	// the recursive ones and the entry index encoded in the page offset.
+	level := pageLevels - recursiveCount
+	for pathLevel := uint8(0); pathLevel < level; pathLevel++ {
+		virtAddr |= indices[recursiveCount+pathLevel] << pageLevelShifts[pathLevel]
+	}
+	virtAddr |= ((entryAddr & ((1 << pageLevelShifts[pageLevels-1]) - 1)) >> 3) << pageLevelShifts[level]
+
+	return unsafe.Pointer(mmu.entry(level, virtAddr))
+}
+
+// mapPage installs a mapping for virtAddr at the specified level using the
+// supplied leaf entry. Intermediate page table entries are populated using
+// tableFlags.
+func (mmu *fakeMMU) mapPage(virtAddr uintptr, level uint8, leaf pageTableEntry, tableFlags PageTableEntryFlag) {
+	for tableLevel := uint8(0); tableLevel < level; tableLevel++ {
+		*mmu.entry(tableLevel, virtAddr) = pageTableEntry(tableFlags)
+	}
+
+	*mmu.entry(level, virtAddr) = leaf
+}
+
+func TestDumpMappingsAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+	}(ptePtrFn)
+
+	mmu := newFakeMMU()
+	ptePtrFn = mmu.ptePtr
+
+	userTable := FlagPresent | FlagRW | FlagUserAccessible
+	mmu.mapPage(0x400000, 3, pageTableEntry(0x100000|userTable), userTable)
+	mmu.mapPage(0x401000, 3, pageTableEntry(0x101000|userTable), userTable)
+	mmu.mapPage(0x402000, 3, pageTableEntry(0x102000|userTable), userTable)
+	mmu.mapPage(0x403000, 3, pageTableEntry(0x200000|userTable), userTable)
+	mmu.mapPage(0x404000, 3, pageTableEntry(0x201000|FlagPresent|FlagUserAccessible|FlagCopyOnWrite), userTable)
+	mmu.mapPage(0x600000, 2, pageTableEntry(0x800000|userTable|FlagHugePage|FlagNoExecute), userTable)
+
+	// The P3 entry for this mapping does not allow writes
+	mmu.mapPage(0xffff800000000000, 3, pageTableEntry(0x300000|FlagPresent|FlagRW), FlagPresent|FlagRW)
+	mmu.entry(1, 0xffff800000000000).ClearFlags(FlagRW)
+
+	specs := []struct {
+		start, end uintptr
+		exp        string
+	}{
+		{
+			0x400000, 0xffff800000200000,
+			"0x0000000000400000 - 0x0000000000403000 -> 0x0000000000100000 RW -- US ---\n" +
+				"0x0000000000403000 - 0x0000000000404000 -> 0x0000000000200000 RW -- US ---\n" +
+				"0x0000000000404000 - 0x0000000000405000 -> 0x0000000000201000 -- -- US CoW\n" +
+				"0x0000000000600000 - 0x0000000000800000 -> 0x0000000000800000 RW NX US ---\n" +
+				"0xffff800000000000 - 0xffff800000001000 -> 0x0000000000300000 -- -- -- ---\n",
+		},
+		{
+			0x401800, 0x402000,
+			"0x0000000000401000 - 0x0000000000402000 -> 0x0000000000101000 RW -- US ---\n",
+		},
+		{
+			0x700000, 0x701000,
+			"0x0000000000700000 - 0x0000000000701000 -> 0x0000000000900000 RW NX US ---\n",
+		},
+		{
+			0x405000, 0x600000,
+			"",
+		},
+	}
+
+	var buf bytes.Buffer
+	for specIndex, spec := range specs {
+		buf.Reset()
+		DumpMappings(&buf, spec.start, spec.end)
+
+		if got := buf.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected output:\n%s\ngot:\n%s", specIndex, spec.exp, got)
+		}
+	}
+}
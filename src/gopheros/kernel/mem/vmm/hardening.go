@@ -0,0 +1,113 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mem"
+)
+
+var (
+	// smapEnabled is set to true when the CPU supports SMAP and the
+	// protection has been enabled by Init. While SMAP is enabled, the
+	// kernel can only access user-accessible pages after calling
+	// beginUserAccess.
+	smapEnabled bool
+
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	readCR4Fn  = cpu.ReadCR4
+	writeCR4Fn = cpu.WriteCR4
+	hasSMEPFn  = cpu.HasSMEP
+	hasSMAPFn  = cpu.HasSMAP
+	hasUMIPFn  = cpu.HasUMIP
+	stacFn     = cpu.Stac
+	clacFn     = cpu.Clac
+
+	errInvalidUserAddress = &kernel.Error{Module: "vmm", Message: "address range does not belong to user space"}
+)
+
+// enableCPUProtections enables supervisor-mode execution prevention (SMEP),
+// supervisor-mode access prevention (SMAP) and user-mode instruction
+// prevention (UMIP) if they are supported by the CPU.
+func enableCPUProtections() {
+	cr4 := readCR4Fn()
+
+	if hasSMEPFn() {
+		cr4 |= cpu.CR4SMEP
+	}
+
+	if hasUMIPFn() {
+		cr4 |= cpu.CR4UMIP
+	}
+
+	if hasSMAPFn() {
+		cr4 |= cpu.CR4SMAP
+		smapEnabled = true
+	}
+
+	writeCR4Fn(cr4)
+}
+
+// beginUserAccess allows the kernel to access user-accessible pages while
+// SMAP is enabled. Each call to beginUserAccess must be paired with a call to
+// endUserAccess.
+func beginUserAccess() {
+	if smapEnabled {
+		stacFn()
+	}
+}
+
+// endUserAccess revokes the user-accessible page access granted by
+// beginUserAccess.
+func endUserAccess() {
+	if smapEnabled {
+		clacFn()
+	}
+}
+
+// CopyFromUser copies size bytes from the user-space address src to the
+// kernel address dst. An error is returned if the source range does not
+// belong to the user half of the address space.
+//
+// The source range must be mapped by the active PDT or be part of a VMA in
+// the active address space; accesses to unmapped user pages are handled by
+// the page fault handler.
+func CopyFromUser(dst, src uintptr, size mem.Size) *kernel.Error {
+	if err := validateUserRange(src, size); err != nil {
+		return err
+	}
+
+	beginUserAccess()
+	mem.Memcopy(src, dst, size)
+	endUserAccess()
+	return nil
+}
+
+// CopyToUser copies size bytes from the kernel address src to the user-space
+// address dst. An error is returned if the destination range does not belong
+// to the user half of the address space.
+//
+// The destination range must be mapped by the active PDT or be part of a VMA
+// in the active address space; accesses to unmapped user pages are handled
+// by the page fault handler.
+func CopyToUser(dst, src uintptr, size mem.Size) *kernel.Error {
+	if err := validateUserRange(dst, size); err != nil {
+		return err
+	}
+
+	beginUserAccess()
+	mem.Memcopy(src, dst, size)
+	endUserAccess()
+	return nil
+}
+
+// validateUserRange returns errInvalidUserAddress if the [addr, addr+size)
+// range is not fully contained in the user half of the address space.
+func validateUserRange(addr uintptr, size mem.Size) *kernel.Error {
+	end := addr + uintptr(size)
+	if end < addr || end > canonicalHoleStart {
+		return errInvalidUserAddress
+	}
+
+	return nil
+}
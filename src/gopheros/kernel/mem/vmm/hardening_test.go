@@ -0,0 +1,124 @@
+package vmm
+
+import (
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mem"
+	"testing"
+	"unsafe"
+)
+
+func TestEnableCPUProtections(t *testing.T) {
+	defer func() {
+		readCR4Fn = cpu.ReadCR4
+		writeCR4Fn = cpu.WriteCR4
+		hasSMEPFn = cpu.HasSMEP
+		hasSMAPFn = cpu.HasSMAP
+		hasUMIPFn = cpu.HasUMIP
+		smapEnabled = false
+	}()
+
+	specs := []struct {
+		smep, smap, umip bool
+		expCR4           uint64
+	}{
+		{false, false, false, cpu.CR4PGE},
+		{true, false, false, cpu.CR4PGE | cpu.CR4SMEP},
+		{false, true, false, cpu.CR4PGE | cpu.CR4SMAP},
+		{false, false, true, cpu.CR4PGE | cpu.CR4UMIP},
+		{true, true, true, cpu.CR4PGE | cpu.CR4SMEP | cpu.CR4SMAP | cpu.CR4UMIP},
+	}
+
+	var cr4 uint64
+	readCR4Fn = func() uint64 { return cpu.CR4PGE }
+	writeCR4Fn = func(value uint64) { cr4 = value }
+
+	for specIndex, spec := range specs {
+		smapEnabled = false
+		hasSMEPFn = func() bool { return spec.smep }
+		hasSMAPFn = func() bool { return spec.smap }
+		hasUMIPFn = func() bool { return spec.umip }
+
+		enableCPUProtections()
+
+		if cr4 != spec.expCR4 {
+			t.Errorf("[spec %d] expected CR4 to be set to %x; got %x", specIndex, spec.expCR4, cr4)
+		}
+
+		if smapEnabled != spec.smap {
+			t.Errorf("[spec %d] expected smapEnabled to be %t; got %t", specIndex, spec.smap, smapEnabled)
+		}
+	}
+}
+
+func TestCopyUser(t *testing.T) {
+	defer func() {
+		stacFn = cpu.Stac
+		clacFn = cpu.Clac
+		smapEnabled = false
+	}()
+
+	var stacCount, clacCount int
+	stacFn = func() { stacCount++ }
+	clacFn = func() { clacCount++ }
+
+	var (
+		kernelBuf = []byte("kernel")
+		userBuf   = make([]byte, len(kernelBuf))
+		size      = mem.Size(len(kernelBuf))
+	)
+
+	for _, smap := range []bool{false, true} {
+		smapEnabled = smap
+		stacCount, clacCount = 0, 0
+		for i := range userBuf {
+			userBuf[i] = 0
+		}
+
+		if err := CopyToUser(uintptr(unsafe.Pointer(&userBuf[0])), uintptr(unsafe.Pointer(&kernelBuf[0])), size); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(userBuf) != string(kernelBuf) {
+			t.Errorf("expected user buffer to contain %q; got %q", kernelBuf, userBuf)
+		}
+
+		copyBuf := make([]byte, len(userBuf))
+		if err := CopyFromUser(uintptr(unsafe.Pointer(&copyBuf[0])), uintptr(unsafe.Pointer(&userBuf[0])), size); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(copyBuf) != string(kernelBuf) {
+			t.Errorf("expected kernel buffer to contain %q; got %q", kernelBuf, copyBuf)
+		}
+
+		expCount := 0
+		if smap {
+			expCount = 2
+		}
+
+		if stacCount != expCount || clacCount != expCount {
+			t.Errorf("[smap: %t] expected stac and clac to be called %d times; got %d and %d", smap, expCount, stacCount, clacCount)
+		}
+	}
+
+	t.Run("invalid user addresses", func(t *testing.T) {
+		specs := []struct {
+			addr uintptr
+			size mem.Size
+		}{
+			{0xffff800000000000, 1},
+			{canonicalHoleStart - 1, 2},
+			{^uintptr(0), 2},
+		}
+
+		for specIndex, spec := range specs {
+			if err := CopyFromUser(0, spec.addr, spec.size); err != errInvalidUserAddress {
+				t.Errorf("[spec %d] expected CopyFromUser to return errInvalidUserAddress; got %v", specIndex, err)
+			}
+
+			if err := CopyToUser(spec.addr, 0, spec.size); err != errInvalidUserAddress {
+				t.Errorf("[spec %d] expected CopyToUser to return errInvalidUserAddress; got %v", specIndex, err)
+			}
+		}
+	})
+}
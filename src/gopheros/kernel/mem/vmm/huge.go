@@ -0,0 +1,184 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"unsafe"
+)
+
+const (
+	// HugePageSize2M is the size of a huge page mapped by a P2 entry.
+	HugePageSize2M = 2 * mem.Mb
+
+	// HugePageSize1G is the size of a huge page mapped by a P3 entry. Support
+	// for this page size depends on the CPU.
+	HugePageSize1G = 1 * mem.Gb
+)
+
+var (
+	// hasGigabytePagesFn is used by tests to override calls to
+	// cpu.HasGigabytePages and is automatically inlined by the compiler.
+	hasGigabytePagesFn = cpu.HasGigabytePages
+
+	// mapHugeFn is used by tests and is automatically inlined by the compiler.
+	mapHugeFn = MapHuge
+
+	// unmapHugeFn is used by tests and is automatically inlined by the compiler.
+	unmapHugeFn = UnmapHuge
+
+	errInvalidHugePageSize = &kernel.Error{Module: "vmm", Message: "huge page size must be either 2M or 1G"}
+	errMisalignedHugePage  = &kernel.Error{Module: "vmm", Message: "huge page and frame addresses must be aligned to the huge page size"}
+	errHugePageOverlap     = &kernel.Error{Module: "vmm", Message: "huge page overlaps with an existing page table"}
+	errNotHugePage         = &kernel.Error{Module: "vmm", Message: "virtual address is not mapped by a huge page of the requested size"}
+)
+
+// hugePageLevel returns the page level whose entries can map pages of the
+// requested size. If size does not correspond to a supported huge page size,
+// hugePageLevel returns false.
+func hugePageLevel(size mem.Size) (uint8, bool) {
+	// The top-most and bottom-most page levels cannot be used for
+	// mapping huge pages.
+	for level := uint8(1); level < pageLevels-1; level++ {
+		if size == mem.Size(1)<<pageLevelShifts[level] {
+			return level, true
+		}
+	}
+
+	return 0, false
+}
+
+// MapHuge establishes a mapping between a virtual page and a physically
+// contiguous memory region of the requested size using the currently active
+// page directory table. The size argument must be either HugePageSize2M or
+// HugePageSize1G and both the page and frame addresses must be aligned to it.
+// Mapping 1G pages is only possible if it is supported by the CPU.
+//
+// Similar to Map, missing page tables are allocated using the registered
+// physical frame allocator. MapHuge will return an error if the virtual
+// region is already mapped by a page table.
+func MapHuge(page Page, frame pmm.Frame, size mem.Size, flags PageTableEntryFlag) *kernel.Error {
+	hugeLevel, ok := hugePageLevel(size)
+	if !ok {
+		return errInvalidHugePageSize
+	}
+
+	if size == HugePageSize1G && !hasGigabytePagesFn() {
+		return errNoHugePageSupport
+	}
+
+	if (page.Address()|frame.Address())&uintptr(size-1) != 0 {
+		return errMisalignedHugePage
+	}
+
+	if err := checkWX(page, flags); err != nil {
+		return err
+	}
+
+	flags |= globalFlag(page)
+
+	var err *kernel.Error
+
+	walk(page.Address(), func(pteLevel uint8, pte *pageTableEntry) bool {
+		if pteLevel == hugeLevel {
+			if pte.HasFlags(FlagPresent) && !pte.HasFlags(FlagHugePage) {
+				err = errHugePageOverlap
+				return false
+			}
+
+			*pte = 0
+			pte.SetFrame(frame)
+			pte.SetFlags(flags | FlagHugePage)
+			flushTLBEntryFn(page.Address())
+			return false
+		}
+
+		err = ensureNextTable(page, pteLevel, pte, flags)
+		return err == nil
+	})
+
+	return err
+}
+
+// UnmapHuge removes a huge page mapping previously installed via a call to
+// MapHuge. The size argument must match the size of the mapped huge page.
+func UnmapHuge(page Page, size mem.Size) *kernel.Error {
+	hugeLevel, ok := hugePageLevel(size)
+	if !ok {
+		return errInvalidHugePageSize
+	}
+
+	var err *kernel.Error
+
+	walk(page.Address(), func(pteLevel uint8, pte *pageTableEntry) bool {
+		if !pte.HasFlags(FlagPresent) {
+			err = ErrInvalidMapping
+			return false
+		}
+
+		if pteLevel == hugeLevel || pte.HasFlags(FlagHugePage) {
+			if pteLevel != hugeLevel || !pte.HasFlags(FlagHugePage) {
+				err = errNotHugePage
+				return false
+			}
+
+			pte.ClearFlags(FlagPresent)
+			flushTLBEntryFn(page.Address())
+			return false
+		}
+
+		return true
+	})
+
+	return err
+}
+
+// splitHugePage replaces the huge page mapping at the specified page level
+// with a new page table whose entries map the same physical memory region
+// using the page size of the next level. The entries of the new table inherit
+// the flags of the original huge page mapping.
+func splitHugePage(page Page, pteLevel uint8, pte *pageTableEntry) *kernel.Error {
+	// Huge pages are not supported by top-level entries
+	if pteLevel == 0 {
+		return errNoHugePageSupport
+	}
+
+	newTableFrame, err := frameAllocator()
+	if err != nil {
+		return err
+	}
+
+	var (
+		hugePageMask   = (uintptr(1) << pageLevelShifts[pteLevel]) - 1
+		nextFrame      = pmm.Frame((uintptr(*pte) & ptePhysPageMask &^ hugePageMask) >> mem.PageShift)
+		framesPerEntry = pmm.Frame(1) << (pageLevelShifts[pteLevel+1] - mem.PageShift)
+		entryFlags     = PageTableEntryFlag(uintptr(*pte) &^ ptePhysPageMask)
+	)
+
+	// For the last page level, the huge page bit is used as the PAT bit
+	if pteLevel+1 == pageLevels-1 {
+		entryFlags &^= FlagHugePage
+	}
+
+	*pte = 0
+	pte.SetFrame(newTableFrame)
+	pte.SetFlags(FlagPresent | FlagRW | (entryFlags & FlagUserAccessible))
+
+	// The new table can now be accessed via the recursive mapping. Make sure
+	// that any stale TLB entries for its virtual address are flushed before
+	// populating it.
+	nextTableAddr := nextAddrFn(uintptr(unsafe.Pointer(pte)) << pageLevelBits[pteLevel+1])
+	flushTLBEntryFn(nextTableAddr)
+
+	for entryIndex := uintptr(0); entryIndex < 1<<pageLevelBits[pteLevel+1]; entryIndex, nextFrame = entryIndex+1, nextFrame+framesPerEntry {
+		entry := (*pageTableEntry)(unsafe.Pointer(nextTableAddr + (entryIndex << mem.PointerShift)))
+		*entry = 0
+		entry.SetFrame(nextFrame)
+		entry.SetFlags(entryFlags)
+	}
+
+	// Flush the TLB entry for the original huge page
+	flushTLBEntryFn(page.Address())
+	return nil
+}
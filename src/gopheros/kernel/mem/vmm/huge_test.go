@@ -0,0 +1,352 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+func TestHugePageLevel(t *testing.T) {
+	specs := []struct {
+		size     mem.Size
+		expLevel uint8
+		expOK    bool
+	}{
+		{HugePageSize2M, 2, true},
+		{HugePageSize1G, 1, true},
+		{mem.PageSize, 0, false},
+		{512 * mem.Gb, 0, false},
+		{3 * mem.Mb, 0, false},
+	}
+
+	for specIndex, spec := range specs {
+		level, ok := hugePageLevel(spec.size)
+		if level != spec.expLevel || ok != spec.expOK {
+			t.Errorf("[spec %d] expected to get (%d, %t); got (%d, %t)", specIndex, spec.expLevel, spec.expOK, level, ok)
+		}
+	}
+}
+
+func TestMapHugeAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origNextAddrFn func(uintptr) uintptr, origFlushTLBEntryFn func(uintptr)) {
+		ptePtrFn = origPtePtr
+		nextAddrFn = origNextAddrFn
+		flushTLBEntryFn = origFlushTLBEntryFn
+		hasGigabytePagesFn = cpu.HasGigabytePages
+		frameAllocator = nil
+	}(ptePtrFn, nextAddrFn, flushTLBEntryFn)
+
+	var (
+		physPages    [pageLevels][mem.PageSize >> mem.PointerShift]pageTableEntry
+		nextPhysPage int
+		pteCallCount int
+	)
+
+	// allocFn returns pages from index 1; we keep index 0 for the P4 entry
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+		nextPhysPage++
+		pageAddr := unsafe.Pointer(&physPages[nextPhysPage][0])
+		return pmm.Frame(uintptr(pageAddr) >> mem.PageShift), nil
+	})
+
+	ptePtrFn = func(entry uintptr) unsafe.Pointer {
+		pteCallCount++
+		pteIndex := (entry & uintptr(mem.PageSize-1)) >> mem.PointerShift
+		return unsafe.Pointer(&physPages[pteCallCount-1][pteIndex])
+	}
+
+	nextAddrFn = func(entry uintptr) uintptr {
+		return uintptr(unsafe.Pointer(&physPages[nextPhysPage][0]))
+	}
+
+	flushTLBEntryFn = func(uintptr) {}
+
+	reset := func() {
+		physPages = [pageLevels][mem.PageSize >> mem.PointerShift]pageTableEntry{}
+		nextPhysPage, pteCallCount = 0, 0
+	}
+
+	specs := []struct {
+		size         mem.Size
+		virtAddr     uintptr
+		levelIndices []int
+	}{
+		// p4: 0, p3: 1, p2: 3
+		{HugePageSize2M, 1<<30 + 3*uintptr(HugePageSize2M), []int{0, 1, 3}},
+		// p4: 0, p3: 2
+		{HugePageSize1G, 2 << 30, []int{0, 2}},
+	}
+
+	hasGigabytePagesFn = func() bool { return true }
+	frame := pmm.Frame(uintptr(HugePageSize1G) >> mem.PageShift)
+	for specIndex, spec := range specs {
+		reset()
+
+		if err := MapHuge(PageFromAddress(spec.virtAddr), frame, spec.size, FlagPresent|FlagRW); err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		hugeLevel := len(spec.levelIndices) - 1
+		for level, index := range spec.levelIndices {
+			pte := physPages[level][index]
+			if level < hugeLevel {
+				if exp, got := pmm.Frame(uintptr(unsafe.Pointer(&physPages[level+1][0]))>>mem.PageShift), pte.Frame(); got != exp {
+					t.Errorf("[spec %d] [pte at level %d] expected entry frame to be %d; got %d", specIndex, level, exp, got)
+				}
+				continue
+			}
+
+			if !pte.HasFlags(FlagPresent | FlagRW | FlagHugePage) {
+				t.Errorf("[spec %d] expected huge page entry to have FlagPresent, FlagRW and FlagHugePage set", specIndex)
+			}
+
+			if got := pte.Frame(); got != frame {
+				t.Errorf("[spec %d] expected huge page entry frame to be %d; got %d", specIndex, frame, got)
+			}
+		}
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		reset()
+
+		if err := MapHuge(0, 0, 4*mem.Mb, FlagPresent); err != errInvalidHugePageSize {
+			t.Errorf("expected to get errInvalidHugePageSize; got %v", err)
+		}
+
+		if err := MapHuge(PageFromAddress(uintptr(HugePageSize2M)), 1, HugePageSize2M, FlagPresent); err != errMisalignedHugePage {
+			t.Errorf("expected to get errMisalignedHugePage; got %v", err)
+		}
+
+		if err := MapHuge(1, 0, HugePageSize2M, FlagPresent); err != errMisalignedHugePage {
+			t.Errorf("expected to get errMisalignedHugePage; got %v", err)
+		}
+
+		hasGigabytePagesFn = func() bool { return false }
+		if err := MapHuge(0, 0, HugePageSize1G, FlagPresent); err != errNoHugePageSupport {
+			t.Errorf("expected to get errNoHugePageSupport; got %v", err)
+		}
+
+		// The P2 entry already points to a page table
+		reset()
+		for level := 0; level < pageLevels-1; level++ {
+			physPages[level][0].SetFlags(FlagPresent | FlagRW)
+		}
+		if err := MapHuge(0, 0, HugePageSize2M, FlagPresent); err != errHugePageOverlap {
+			t.Errorf("expected to get errHugePageOverlap; got %v", err)
+		}
+
+		reset()
+		expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			return pmm.InvalidFrame, expErr
+		})
+		if err := MapHuge(0, 0, HugePageSize2M, FlagPresent); err != expErr {
+			t.Errorf("expected to get error %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestUnmapHugeAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origFlushTLBEntryFn func(uintptr)) {
+		ptePtrFn = origPtePtr
+		flushTLBEntryFn = origFlushTLBEntryFn
+	}(ptePtrFn, flushTLBEntryFn)
+
+	var (
+		physPages    [pageLevels][mem.PageSize >> mem.PointerShift]pageTableEntry
+		pteCallCount int
+		flushCount   int
+		// p4: 0, p3: 1, p2: 3
+		virtAddr = 1<<30 + 3*uintptr(HugePageSize2M)
+	)
+
+	ptePtrFn = func(entry uintptr) unsafe.Pointer {
+		pteCallCount++
+		pteIndex := (entry & uintptr(mem.PageSize-1)) >> mem.PointerShift
+		return unsafe.Pointer(&physPages[pteCallCount-1][pteIndex])
+	}
+
+	flushTLBEntryFn = func(uintptr) { flushCount++ }
+
+	reset := func() {
+		physPages = [pageLevels][mem.PageSize >> mem.PointerShift]pageTableEntry{}
+		pteCallCount, flushCount = 0, 0
+		physPages[0][0].SetFlags(FlagPresent | FlagRW)
+		physPages[1][1].SetFlags(FlagPresent | FlagRW)
+		physPages[2][3].SetFlags(FlagPresent | FlagRW | FlagHugePage)
+	}
+
+	t.Run("success", func(t *testing.T) {
+		reset()
+
+		if err := UnmapHuge(PageFromAddress(virtAddr), HugePageSize2M); err != nil {
+			t.Fatal(err)
+		}
+
+		if physPages[2][3].HasFlags(FlagPresent) {
+			t.Error("expected FlagPresent to be cleared for the huge page entry")
+		}
+
+		if exp := 1; flushCount != exp {
+			t.Errorf("expected flushTLBEntry to be called %d times; got %d", exp, flushCount)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		reset()
+		if err := UnmapHuge(PageFromAddress(virtAddr), 4*mem.Mb); err != errInvalidHugePageSize {
+			t.Errorf("expected to get errInvalidHugePageSize; got %v", err)
+		}
+
+		// size does not match the size of the mapped huge page
+		reset()
+		if err := UnmapHuge(PageFromAddress(virtAddr), HugePageSize1G); err != errNotHugePage {
+			t.Errorf("expected to get errNotHugePage; got %v", err)
+		}
+
+		// page is mapped via a regular P1 table
+		reset()
+		physPages[2][3].ClearFlags(FlagHugePage)
+		if err := UnmapHuge(PageFromAddress(virtAddr), HugePageSize2M); err != errNotHugePage {
+			t.Errorf("expected to get errNotHugePage; got %v", err)
+		}
+
+		reset()
+		physPages[2][3] = 0
+		if err := UnmapHuge(PageFromAddress(virtAddr), HugePageSize2M); err != ErrInvalidMapping {
+			t.Errorf("expected to get ErrInvalidMapping; got %v", err)
+		}
+	})
+}
+
+func TestSplitHugePageAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origNextAddrFn func(uintptr) uintptr, origFlushTLBEntryFn func(uintptr)) {
+		ptePtrFn = origPtePtr
+		nextAddrFn = origNextAddrFn
+		flushTLBEntryFn = origFlushTLBEntryFn
+		frameAllocator = nil
+	}(ptePtrFn, nextAddrFn, flushTLBEntryFn)
+
+	var (
+		physPages    [pageLevels][mem.PageSize >> mem.PointerShift]pageTableEntry
+		pteCallCount int
+		// p4: 0, p3: 0, p2: 3, p1: 5
+		virtAddr   = 3*uintptr(HugePageSize2M) + 5*uintptr(mem.PageSize)
+		hugeFrame  = pmm.Frame(uintptr(HugePageSize2M) >> mem.PageShift)
+		hugeFlags  = FlagPresent | FlagRW | FlagNoExecute
+		p2Index    = 3
+		p1Index    = 5
+		tableFrame = func(level int) pmm.Frame {
+			return pmm.Frame(uintptr(unsafe.Pointer(&physPages[level][0])) >> mem.PageShift)
+		}
+	)
+
+	reset := func() {
+		physPages = [pageLevels][mem.PageSize >> mem.PointerShift]pageTableEntry{}
+		pteCallCount = 0
+		physPages[0][0].SetFlags(FlagPresent | FlagRW)
+		physPages[0][0].SetFrame(tableFrame(1))
+		physPages[1][0].SetFlags(FlagPresent | FlagRW)
+		physPages[1][0].SetFrame(tableFrame(2))
+		physPages[2][p2Index].SetFlags(hugeFlags | FlagHugePage)
+		physPages[2][p2Index].SetFrame(hugeFrame)
+	}
+
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+		return tableFrame(3), nil
+	})
+
+	ptePtrFn = func(entry uintptr) unsafe.Pointer {
+		pteCallCount++
+		pteIndex := (entry & uintptr(mem.PageSize-1)) >> mem.PointerShift
+		return unsafe.Pointer(&physPages[pteCallCount-1][pteIndex])
+	}
+
+	nextAddrFn = func(entry uintptr) uintptr {
+		return uintptr(unsafe.Pointer(&physPages[3][0]))
+	}
+
+	flushTLBEntryFn = func(uintptr) {}
+
+	checkSplitTable := func(t *testing.T, skipIndex int) {
+		if got := physPages[2][p2Index]; got.HasFlags(FlagHugePage) || got.Frame() != tableFrame(3) {
+			t.Fatal("expected huge page entry to be replaced by a page table")
+		}
+
+		for index, pte := range physPages[3] {
+			if index == skipIndex {
+				continue
+			}
+
+			if !pte.HasFlags(hugeFlags) || pte.HasFlags(FlagHugePage) {
+				t.Errorf("[entry %d] expected entry to inherit the huge page flags", index)
+			}
+
+			if exp, got := hugeFrame+pmm.Frame(index), pte.Frame(); got != exp {
+				t.Errorf("[entry %d] expected entry frame to be %d; got %d", index, exp, got)
+			}
+		}
+	}
+
+	t.Run("map 4K page inside a huge page", func(t *testing.T) {
+		reset()
+
+		if err := Map(PageFromAddress(virtAddr), pmm.Frame(123), FlagPresent); err != nil {
+			t.Fatal(err)
+		}
+
+		checkSplitTable(t, p1Index)
+
+		if got := physPages[3][p1Index]; got.Frame() != pmm.Frame(123) || got.HasFlags(FlagRW) {
+			t.Error("expected remapped entry to point to the new frame")
+		}
+	})
+
+	t.Run("unmap 4K page inside a huge page", func(t *testing.T) {
+		reset()
+
+		if err := Unmap(PageFromAddress(virtAddr)); err != nil {
+			t.Fatal(err)
+		}
+
+		checkSplitTable(t, p1Index)
+
+		if physPages[3][p1Index].HasFlags(FlagPresent) {
+			t.Error("expected unmapped entry not to have FlagPresent set")
+		}
+	})
+
+	t.Run("allocation error", func(t *testing.T) {
+		reset()
+
+		expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			return pmm.InvalidFrame, expErr
+		})
+
+		if err := Unmap(PageFromAddress(virtAddr)); err != expErr {
+			t.Fatalf("expected to get error %v; got %v", expErr, err)
+		}
+
+		if !physPages[2][p2Index].HasFlags(FlagHugePage) {
+			t.Fatal("expected huge page entry to remain intact")
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/entropy"
+	"gopheros/kernel/hal/multiboot"
+	"gopheros/kernel/mem"
+	"unsafe"
+)
+
+const (
+	// kaslrRegionAlign defines the alignment of the randomized region
+	// addresses. Using a 2M alignment allows regions to be mapped using
+	// huge pages.
+	kaslrRegionAlign = uintptr(2 * mem.Mb)
+)
+
+// Layout describes the base addresses of the kernel virtual memory regions
+// whose location is randomized at boot when KASLR is enabled.
+type Layout struct {
+	// TempMappingAddr is the page address used by MapTemporary.
+	TempMappingAddr uintptr
+
+	// EarlyReserveEnd is the address below which EarlyReserveRegion
+	// reserves regions before the vmm package is initialized.
+	EarlyReserveEnd uintptr
+
+	// HeapArenaEnd is the address below which the Go heap arena gets
+	// reserved via ReserveHeapRegion.
+	HeapArenaEnd uintptr
+
+	// Randomized is set to true if the region addresses were randomized.
+	Randomized bool
+}
+
+var (
+	// kernelLayout describes the active kernel virtual memory layout. The
+	// default values correspond to the layout used when KASLR is disabled.
+	kernelLayout = Layout{
+		TempMappingAddr: defaultTempMappingAddr,
+		EarlyReserveEnd: defaultTempMappingAddr,
+		HeapArenaEnd:    defaultTempMappingAddr,
+	}
+
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	randomUint64Fn     = entropy.Uint64
+	visitBootCmdLineFn = multiboot.VisitBootCmdLine
+
+	errLayoutInUse = &kernel.Error{Module: "vmm", Message: "kernel layout cannot be changed after reserving regions via EarlyReserveRegion"}
+)
+
+// GetLayout returns the active kernel virtual memory layout.
+func GetLayout() Layout {
+	return kernelLayout
+}
+
+// InitLayout randomizes the kernel virtual memory layout unless the "nokaslr"
+// argument is present in the kernel command line. InitLayout must be invoked
+// after the multiboot info pointer has been set and before any region gets
+// reserved via EarlyReserveRegion.
+func InitLayout() *kernel.Error {
+	if earlyReserveLastUsed != kernelLayout.EarlyReserveEnd {
+		return errLayoutInUse
+	}
+
+	var (
+		kaslr   = true
+		visitor = func(key, _ string) bool {
+			if key == "nokaslr" {
+				kaslr = false
+				return false
+			}
+
+			return true
+		}
+	)
+
+	// Use the noescape hack to prevent the compiler from leaking the visitor
+	// function literal to the heap.
+	visitBootCmdLineFn(
+		*(*multiboot.BootCmdLineVisitor)(noEscape(unsafe.Pointer(&visitor))),
+	)
+
+	if kaslr {
+		randomizeLayout(kaslrSeed())
+	}
+
+	return nil
+}
+
+// randomizeLayout selects random addresses for the kernel layout regions
+// using the supplied seed.
+func randomizeLayout(seed uint64) {
+	kernelLayout = Layout{
+		TempMappingAddr: randomAddr(&seed, kaslrTempMappingStart, recursiveMappingAddr, uintptr(mem.PageSize)),
+		EarlyReserveEnd: randomAddr(&seed, kaslrEarlyReserveStart, kaslrTempMappingStart, kaslrRegionAlign),
+		HeapArenaEnd:    randomAddr(&seed, kaslrHeapArenaStart, kaslrHeapArenaEnd, kaslrRegionAlign),
+		Randomized:      true,
+	}
+
+	earlyReserveLastUsed = kernelLayout.EarlyReserveEnd
+}
+
+// kaslrSeed returns a seed for randomizing the kernel layout which is
+// obtained from the kernel entropy pool.
+func kaslrSeed() uint64 {
+	return randomUint64Fn()
+}
+
+// randomAddr returns a random address in the range [start, end) which is
+// aligned to align. The state of the pseudo-random number generator is
+// updated in place.
+func randomAddr(state *uint64, start, end, align uintptr) uintptr {
+	return start + uintptr(splitMix64(state)%uint64((end-start)/align))*align
+}
+
+// splitMix64 implements the SplitMix64 pseudo-random number generator which
+// is used for deriving the random values for each layout region from a
+// single seed.
+func splitMix64(state *uint64) uint64 {
+	*state += 0x9e3779b97f4a7c15
+	z := *state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
@@ -0,0 +1,143 @@
+package vmm
+
+import (
+	"gopheros/kernel/entropy"
+	"gopheros/kernel/hal/multiboot"
+	"gopheros/kernel/mem"
+	"testing"
+)
+
+func TestRandomizeLayout(t *testing.T) {
+	defer func(origLayout Layout, origLastUsed uintptr) {
+		kernelLayout = origLayout
+		earlyReserveLastUsed = origLastUsed
+	}(kernelLayout, earlyReserveLastUsed)
+
+	seen := make(map[Layout]bool)
+	for seed := uint64(0); seed < 16; seed++ {
+		randomizeLayout(seed)
+
+		layout := GetLayout()
+		if !layout.Randomized {
+			t.Fatalf("[seed %d] expected layout to be flagged as randomized", seed)
+		}
+
+		if layout.TempMappingAddr < kaslrTempMappingStart || layout.TempMappingAddr >= recursiveMappingAddr || layout.TempMappingAddr&uintptr(mem.PageSize-1) != 0 {
+			t.Errorf("[seed %d] invalid temp mapping address %x", seed, layout.TempMappingAddr)
+		}
+
+		if layout.EarlyReserveEnd < kaslrEarlyReserveStart || layout.EarlyReserveEnd >= kaslrTempMappingStart || layout.EarlyReserveEnd&(kaslrRegionAlign-1) != 0 {
+			t.Errorf("[seed %d] invalid early reserve end address %x", seed, layout.EarlyReserveEnd)
+		}
+
+		if layout.HeapArenaEnd < kaslrHeapArenaStart || layout.HeapArenaEnd >= kaslrHeapArenaEnd || layout.HeapArenaEnd&(kaslrRegionAlign-1) != 0 {
+			t.Errorf("[seed %d] invalid heap arena end address %x", seed, layout.HeapArenaEnd)
+		}
+
+		if earlyReserveLastUsed != layout.EarlyReserveEnd {
+			t.Errorf("[seed %d] expected earlyReserveLastUsed to be set to %x; got %x", seed, layout.EarlyReserveEnd, earlyReserveLastUsed)
+		}
+
+		seen[layout] = true
+	}
+
+	if len(seen) < 16 {
+		t.Errorf("expected each seed to generate a different layout; got %d distinct layouts", len(seen))
+	}
+}
+
+func TestKASLRSeed(t *testing.T) {
+	defer func() {
+		randomUint64Fn = entropy.Uint64
+	}()
+
+	randomUint64Fn = func() uint64 { return 42 }
+	if got := kaslrSeed(); got != 42 {
+		t.Fatalf("expected seed to be obtained from the entropy pool; got %d", got)
+	}
+}
+
+func TestInitLayout(t *testing.T) {
+	defer func(origLayout Layout, origLastUsed uintptr) {
+		kernelLayout = origLayout
+		earlyReserveLastUsed = origLastUsed
+		visitBootCmdLineFn = multiboot.VisitBootCmdLine
+		randomUint64Fn = entropy.Uint64
+	}(kernelLayout, earlyReserveLastUsed)
+
+	randomUint64Fn = func() uint64 { return 42 }
+
+	defaultLayout := kernelLayout
+
+	specs := []struct {
+		cmdLine       [][2]string
+		expRandomized bool
+	}{
+		{nil, true},
+		{[][2]string{{"consoleFont", "terminus"}}, true},
+		{[][2]string{{"consoleFont", "terminus"}, {"nokaslr", "nokaslr"}}, false},
+	}
+
+	for specIndex, spec := range specs {
+		kernelLayout = defaultLayout
+		earlyReserveLastUsed = defaultLayout.EarlyReserveEnd
+		visitBootCmdLineFn = func(visitor multiboot.BootCmdLineVisitor) {
+			for _, kv := range spec.cmdLine {
+				if !visitor(kv[0], kv[1]) {
+					return
+				}
+			}
+		}
+
+		if err := InitLayout(); err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if got := GetLayout().Randomized; got != spec.expRandomized {
+			t.Errorf("[spec %d] expected layout randomization to be %t; got %t", specIndex, spec.expRandomized, got)
+		}
+
+		if !spec.expRandomized && GetLayout() != defaultLayout {
+			t.Errorf("[spec %d] expected default layout to be used", specIndex)
+		}
+	}
+
+	t.Run("early reservations already made", func(t *testing.T) {
+		kernelLayout = defaultLayout
+		earlyReserveLastUsed = defaultLayout.EarlyReserveEnd - uintptr(mem.PageSize)
+
+		if err := InitLayout(); err != errLayoutInUse {
+			t.Fatalf("expected to get errLayoutInUse; got %v", err)
+		}
+	})
+}
+
+func TestReserveHeapRegion(t *testing.T) {
+	defer func(origLayout Layout, origLastUsed uintptr) {
+		kernelLayout = origLayout
+		earlyReserveLastUsed = origLastUsed
+		kernelRangesReady = false
+	}(kernelLayout, earlyReserveLastUsed)
+
+	earlyReserveLastUsed = kernelLayout.EarlyReserveEnd
+	addr, err := ReserveHeapRegion(mem.PageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := kernelLayout.EarlyReserveEnd - uintptr(mem.PageSize); addr != exp {
+		t.Fatalf("expected early heap reservation to start at %x; got %x", exp, addr)
+	}
+
+	kernelLayout.HeapArenaEnd = kernelRangesStart + 64*uintptr(mem.PageSize)
+	handOverEarlyReservations()
+
+	if addr, err = ReserveHeapRegion(4 * mem.PageSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := kernelLayout.HeapArenaEnd - 5*uintptr(mem.PageSize); addr != exp {
+		t.Fatalf("expected heap reservation to start at %x; got %x", exp, addr)
+	}
+}
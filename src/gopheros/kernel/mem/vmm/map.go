@@ -2,7 +2,6 @@ package vmm
 
 import (
 	"gopheros/kernel"
-	"gopheros/kernel/cpu"
 	"gopheros/kernel/mem"
 	"gopheros/kernel/mem/pmm"
 	"unsafe"
@@ -45,9 +44,15 @@ var (
 
 	// flushTLBEntryFn is used by tests to override calls to flushTLBEntry
 	// which will cause a fault if called in user-mode.
-	flushTLBEntryFn = cpu.FlushTLBEntry
+	flushTLBEntryFn = flushTLBEntry
 
-	earlyReserveRegionFn = EarlyReserveRegion
+	// reserveRegionFn is used by tests and is automatically inlined by
+	// the compiler.
+	reserveRegionFn = ReserveRegion
+
+	// releaseRegionFn is used by tests and is automatically inlined by
+	// the compiler.
+	releaseRegionFn = ReleaseRegion
 
 	errNoHugePageSupport           = &kernel.Error{Module: "vmm", Message: "huge pages are not supported"}
 	errAttemptToRWMapReservedFrame = &kernel.Error{Module: "vmm", Message: "reserved blank frame cannot be mapped with a RW flag"}
@@ -56,14 +61,23 @@ var (
 // Map establishes a mapping between a virtual page and a physical memory frame
 // using the currently active page directory table. Calls to Map will use the
 // supplied physical frame allocator to initialize missing page tables at each
-// paging level supported by the MMU.
+// paging level supported by the MMU. If the page is part of a huge page
+// mapping, the huge page is split into smaller pages before the mapping for
+// the page is updated.
 //
 // Attempts to map ReservedZeroedFrame with a RW flag will result in an error.
+// Once W^X enforcement is enabled by Init, attempts to create kernel mappings
+// that are both writable and executable will also result in an error.
 func Map(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
 	if protectReservedZeroedPage && frame == ReservedZeroedFrame && (flags&FlagRW) != 0 {
 		return errAttemptToRWMapReservedFrame
 	}
 
+	if err := checkWX(page, flags); err != nil {
+		return err
+	}
+
+	flags |= globalFlag(page)
 	var err *kernel.Error
 
 	walk(page.Address(), func(pteLevel uint8, pte *pageTableEntry) bool {
@@ -77,34 +91,47 @@ func Map(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
 			return true
 		}
 
-		if pte.HasFlags(FlagHugePage) {
-			err = errNoHugePageSupport
-			return false
-		}
+		err = ensureNextTable(page, pteLevel, pte, flags)
+		return err == nil
+	})
 
-		// Next table does not yet exist; we need to allocate a
-		// physical frame for it map it and clear its contents.
-		if !pte.HasFlags(FlagPresent) {
-			var newTableFrame pmm.Frame
-			newTableFrame, err = frameAllocator()
-			if err != nil {
-				return false
-			}
+	return err
+}
 
-			*pte = 0
-			pte.SetFrame(newTableFrame)
-			pte.SetFlags(FlagPresent | FlagRW)
+// ensureNextTable checks that the page table entry pte for the specified
+// page level points to a valid page table. If the next table does not yet
+// exist, ensureNextTable allocates a physical frame for it, maps it and clears
+// its contents. If pte maps a huge page, it gets split into a page table that
+// maps the same physical memory using pages of the next level's size.
+//
+// The flags argument contains the flags for the page that is being mapped. If
+// the page is user-accessible, the FlagUserAccessible bit is also set for the
+// page table entry as the CPU checks it at every paging level.
+func ensureNextTable(page Page, pteLevel uint8, pte *pageTableEntry, flags PageTableEntryFlag) *kernel.Error {
+	if pte.HasFlags(FlagPresent | FlagHugePage) {
+		return splitHugePage(page, pteLevel, pte)
+	}
 
-			// The next pte entry becomes available but we need to
-			// make sure that the new page is properly cleared
-			nextTableAddr := (uintptr(unsafe.Pointer(pte)) << pageLevelBits[pteLevel+1])
-			mem.Memset(nextAddrFn(nextTableAddr), 0, mem.PageSize)
-		}
+	// Next table already exists
+	if pte.HasFlags(FlagPresent) {
+		pte.SetFlags(flags & FlagUserAccessible)
+		return nil
+	}
 
-		return true
-	})
+	newTableFrame, err := frameAllocator()
+	if err != nil {
+		return err
+	}
 
-	return err
+	*pte = 0
+	pte.SetFrame(newTableFrame)
+	pte.SetFlags(FlagPresent | FlagRW | (flags & FlagUserAccessible))
+
+	// The next pte entry becomes available but we need to
+	// make sure that the new page is properly cleared
+	nextTableAddr := (uintptr(unsafe.Pointer(pte)) << pageLevelBits[pteLevel+1])
+	mem.Memset(nextAddrFn(nextTableAddr), 0, mem.PageSize)
+	return nil
 }
 
 // MapRegion establishes a mapping to the physical memory region which starts
@@ -112,22 +139,92 @@ func Map(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
 // always rounded up to the nearest page boundary. MapRegion reserves the next
 // available region in the active virtual address space, establishes the
 // mapping and returns back the Page that corresponds to the region start.
+//
+// Regions that are at least HugePageSize2M bytes long are mapped using 2M
+// pages wherever the alignment of the physical region permits it.
+//
+// Regions established by MapRegion can be removed via a call to UnmapRegion.
 func MapRegion(frame pmm.Frame, size mem.Size, flags PageTableEntryFlag) (Page, *kernel.Error) {
-	// Reserve next free block in the address space
+	// Reserve next free block in the address space. For large regions we
+	// reserve a 2M-aligned block with some extra space so that the region
+	// start has the same offset (modulo HugePageSize2M) as the physical
+	// address allowing us to map the bulk of the region using huge pages.
 	size = (size + (mem.PageSize - 1)) & ^(mem.PageSize - 1)
-	startPage, err := earlyReserveRegionFn(size)
+	regionOffset, align := regionAlignment(frame.Address(), size)
+
+	regionStart, err := reserveRegionFn(size+mem.Size(regionOffset), align)
 	if err != nil {
 		return 0, err
 	}
+	regionStart += regionOffset
+
+	var (
+		pageCount     = size >> mem.PageShift
+		hugePageCount = HugePageSize2M >> mem.PageShift
+	)
+	for page := PageFromAddress(regionStart); pageCount > 0; {
+		if pageCount >= hugePageCount && page.Address()&uintptr(HugePageSize2M-1) == 0 {
+			if err := mapHugeFn(page, frame, HugePageSize2M, flags); err != nil {
+				return 0, err
+			}
+
+			pageCount, page, frame = pageCount-hugePageCount, page+Page(hugePageCount), frame+pmm.Frame(hugePageCount)
+			continue
+		}
 
-	pageCount := size >> mem.PageShift
-	for page := PageFromAddress(startPage); pageCount > 0; pageCount, page, frame = pageCount-1, page+1, frame+1 {
 		if err := mapFn(page, frame, flags); err != nil {
 			return 0, err
 		}
+
+		pageCount, page, frame = pageCount-1, page+1, frame+1
+	}
+
+	return PageFromAddress(regionStart), nil
+}
+
+// UnmapRegion removes the mappings for a region previously established via a
+// call to MapRegion and releases the reserved virtual address space. The size
+// argument must match the one passed to MapRegion.
+func UnmapRegion(page Page, size mem.Size) *kernel.Error {
+	size = (size + (mem.PageSize - 1)) & ^(mem.PageSize - 1)
+	regionOffset, _ := regionAlignment(page.Address(), size)
+
+	var (
+		pageCount     = size >> mem.PageShift
+		hugePageCount = HugePageSize2M >> mem.PageShift
+	)
+	for curPage := page; pageCount > 0; {
+		if pageCount >= hugePageCount && curPage.Address()&uintptr(HugePageSize2M-1) == 0 {
+			if err := unmapHugeFn(curPage, HugePageSize2M); err != nil {
+				return err
+			}
+
+			pageCount, curPage = pageCount-hugePageCount, curPage+Page(hugePageCount)
+			continue
+		}
+
+		if err := unmapFn(curPage); err != nil {
+			return err
+		}
+
+		pageCount, curPage = pageCount-1, curPage+1
 	}
 
-	return PageFromAddress(startPage), nil
+	return releaseRegionFn(page.Address()-regionOffset, size+mem.Size(regionOffset))
+}
+
+// regionAlignment returns the alignment that should be used when reserving
+// virtual address space for mapping a region of the specified size that
+// starts at addr. Regions large enough to be mapped using huge pages are
+// aligned to HugePageSize2M and need to be offset from the start of the
+// reserved region so that their start address has the same offset within a
+// huge page as addr.
+func regionAlignment(addr uintptr, size mem.Size) (uintptr, uintptr) {
+	if size < HugePageSize2M {
+		return 0, uintptr(mem.PageSize)
+	}
+
+	return addr & uintptr(HugePageSize2M-1), uintptr(HugePageSize2M)
 }
 
 // IdentityMapRegion establishes an identity mapping to the physical memory
@@ -149,7 +246,7 @@ func IdentityMapRegion(startFrame pmm.Frame, size mem.Size, flags PageTableEntry
 }
 
 // MapTemporary establishes a temporary RW mapping of a physical memory frame
-// to a fixed virtual address overwriting any previous mapping. The temporary
+// to a reserved virtual address overwriting any previous mapping. The temporary
 // mapping mechanism is primarily used by the kernel to access and initialize
 // inactive page tables.
 //
@@ -159,14 +256,18 @@ func MapTemporary(frame pmm.Frame) (Page, *kernel.Error) {
 		return 0, errAttemptToRWMapReservedFrame
 	}
 
-	if err := Map(PageFromAddress(tempMappingAddr), frame, FlagPresent|FlagRW); err != nil {
+	if err := Map(PageFromAddress(kernelLayout.TempMappingAddr), frame, FlagPresent|FlagRW|FlagNoExecute); err != nil {
 		return 0, err
 	}
 
-	return PageFromAddress(tempMappingAddr), nil
+	return PageFromAddress(kernelLayout.TempMappingAddr), nil
 }
 
-// Unmap removes a mapping previously installed via a call to Map or MapTemporary.
+// Unmap removes a mapping previously installed via a call to Map or
+// MapTemporary. The physical frame backing the page is not released; callers
+// that own the frame should use UnmapAndFree instead. If the page is part of
+// a huge page mapping, the huge page is split so that only the mapping for
+// the requested page is removed.
 func Unmap(page Page) *kernel.Error {
 	var err *kernel.Error
 
@@ -186,12 +287,99 @@ func Unmap(page Page) *kernel.Error {
 		}
 
 		if pte.HasFlags(FlagHugePage) {
+			err = splitHugePage(page, pteLevel, pte)
+			return err == nil
+		}
+
+		return true
+	})
+
+	return err
+}
+
+// UnmapAndFree removes a mapping previously installed via a call to Map and
+// releases the physical frame backing the page using the function registered
+// via SetFrameFreer. ReservedZeroedFrame is never released.
+//
+// Any intermediate page tables that become empty as a result of the unmap
+// operation are also released. As the top-level page table entries may be
+// shared between multiple page directory tables, the tables referenced by
+// them are never released.
+func UnmapAndFree(page Page) *kernel.Error {
+	var (
+		err     *kernel.Error
+		entries [pageLevels]*pageTableEntry
+	)
+
+	walk(page.Address(), func(pteLevel uint8, pte *pageTableEntry) bool {
+		if !pte.HasFlags(FlagPresent) {
+			err = ErrInvalidMapping
+			return false
+		}
+
+		if pteLevel < pageLevels-1 && pte.HasFlags(FlagHugePage) {
 			err = errNoHugePageSupport
 			return false
 		}
 
+		entries[pteLevel] = pte
 		return true
 	})
 
-	return err
+	if err != nil {
+		return err
+	}
+
+	frame := entries[pageLevels-1].Frame()
+	*entries[pageLevels-1] = 0
+	flushTLBEntryFn(page.Address())
+
+	if frameFreer == nil {
+		return nil
+	}
+
+	if !protectReservedZeroedPage || frame != ReservedZeroedFrame {
+		if err = frameFreer(frame); err != nil {
+			return err
+		}
+	}
+
+	// Release any page tables that no longer contain present entries
+	// stopping at the tables referenced by the top-level entries.
+	for level := uint8(pageLevels - 1); level > 1; level-- {
+		if !isTableEmpty(page.Address(), level, entries[level]) {
+			break
+		}
+
+		tableFrame := entries[level-1].Frame()
+		*entries[level-1] = 0
+		flushTLBEntryFn(page.Address())
+
+		// The released table is also reachable via the recursive
+		// mapping so its translation must be flushed as well before
+		// the frame gets reused.
+		flushTLBEntryFn(uintptr(unsafe.Pointer(entries[level])) &^ uintptr(mem.PageSize-1))
+
+		if err = frameFreer(tableFrame); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isTableEmpty returns true if no entry in the page table that contains pte
+// has the FlagPresent bit set. The virtual address and page level that
+// correspond to pte are used to locate the start of the table.
+func isTableEmpty(virtAddr uintptr, level uint8, pte *pageTableEntry) bool {
+	entryIndex := (virtAddr >> pageLevelShifts[level]) & ((1 << pageLevelBits[level]) - 1)
+	table := (*[mem.PageSize >> mem.PointerShift]pageTableEntry)(unsafe.Pointer(uintptr(unsafe.Pointer(pte)) - entryIndex<<mem.PointerShift))
+
+	for entryIndex = 0; entryIndex < 1<<pageLevelBits[level]; entryIndex++ {
+		if table[entryIndex].HasFlags(FlagPresent) {
+			return false
+		}
+	}
+
+	return true
 }
@@ -69,8 +69,8 @@ func TestMapTemporaryAmd64(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if got := page.Address(); got != tempMappingAddr {
-		t.Fatalf("expected temp mapping virtual address to be %x; got %x", tempMappingAddr, got)
+	if got := page.Address(); got != kernelLayout.TempMappingAddr {
+		t.Fatalf("expected temp mapping virtual address to be %x; got %x", kernelLayout.TempMappingAddr, got)
 	}
 
 	for level, physPage := range physPages {
@@ -100,7 +100,7 @@ func TestMapTemporaryAmd64(t *testing.T) {
 func TestMapRegion(t *testing.T) {
 	defer func() {
 		mapFn = Map
-		earlyReserveRegionFn = EarlyReserveRegion
+		reserveRegionFn = ReserveRegion
 	}()
 
 	t.Run("success", func(t *testing.T) {
@@ -110,9 +110,9 @@ func TestMapRegion(t *testing.T) {
 			return nil
 		}
 
-		earlyReserveRegionCallCount := 0
-		earlyReserveRegionFn = func(_ mem.Size) (uintptr, *kernel.Error) {
-			earlyReserveRegionCallCount++
+		reserveRegionCallCount := 0
+		reserveRegionFn = func(_ mem.Size, _ uintptr) (uintptr, *kernel.Error) {
+			reserveRegionCallCount++
 			return 0xf00, nil
 		}
 
@@ -124,15 +124,15 @@ func TestMapRegion(t *testing.T) {
 			t.Errorf("expected Map to be called %d time(s); got %d", exp, mapCallCount)
 		}
 
-		if exp := 1; earlyReserveRegionCallCount != exp {
-			t.Errorf("expected EarlyReserveRegion to be called %d time(s); got %d", exp, earlyReserveRegionCallCount)
+		if exp := 1; reserveRegionCallCount != exp {
+			t.Errorf("expected ReserveRegion to be called %d time(s); got %d", exp, reserveRegionCallCount)
 		}
 	})
 
-	t.Run("EarlyReserveRegion fails", func(t *testing.T) {
+	t.Run("ReserveRegion fails", func(t *testing.T) {
 		expErr := &kernel.Error{Module: "test", Message: "out of address space"}
 
-		earlyReserveRegionFn = func(_ mem.Size) (uintptr, *kernel.Error) {
+		reserveRegionFn = func(_ mem.Size, _ uintptr) (uintptr, *kernel.Error) {
 			return 0, expErr
 		}
 
@@ -144,9 +144,9 @@ func TestMapRegion(t *testing.T) {
 	t.Run("Map fails", func(t *testing.T) {
 		expErr := &kernel.Error{Module: "test", Message: "map failed"}
 
-		earlyReserveRegionCallCount := 0
-		earlyReserveRegionFn = func(_ mem.Size) (uintptr, *kernel.Error) {
-			earlyReserveRegionCallCount++
+		reserveRegionCallCount := 0
+		reserveRegionFn = func(_ mem.Size, _ uintptr) (uintptr, *kernel.Error) {
+			reserveRegionCallCount++
 			return 0xf00, nil
 		}
 
@@ -158,8 +158,190 @@ func TestMapRegion(t *testing.T) {
 			t.Fatalf("expected error: %v; got %v", expErr, err)
 		}
 
-		if exp := 1; earlyReserveRegionCallCount != exp {
-			t.Errorf("expected EarlyReserveRegion to be called %d time(s); got %d", exp, earlyReserveRegionCallCount)
+		if exp := 1; reserveRegionCallCount != exp {
+			t.Errorf("expected ReserveRegion to be called %d time(s); got %d", exp, reserveRegionCallCount)
+		}
+	})
+}
+
+func TestMapRegionWithHugePages(t *testing.T) {
+	defer func() {
+		mapFn = Map
+		mapHugeFn = MapHuge
+		reserveRegionFn = ReserveRegion
+	}()
+
+	var (
+		mappedPages []Page
+		hugePages   []Page
+		regionStart = uintptr(0xffff800000000000)
+		frame       = pmm.Frame(0x1000 + 1)
+	)
+
+	mapFn = func(page Page, _ pmm.Frame, _ PageTableEntryFlag) *kernel.Error {
+		mappedPages = append(mappedPages, page)
+		return nil
+	}
+
+	mapHugeFn = func(page Page, f pmm.Frame, size mem.Size, _ PageTableEntryFlag) *kernel.Error {
+		if size != HugePageSize2M {
+			t.Errorf("expected huge page size to be 2M; got %d", size)
+		}
+
+		// The page and frame should have the same 2M alignment
+		if (page.Address()|f.Address())&uintptr(HugePageSize2M-1) != 0 {
+			t.Errorf("expected page %x and frame %x to be aligned to a 2M boundary", page, f)
+		}
+		hugePages = append(hugePages, page)
+		return nil
+	}
+
+	var reservedSize mem.Size
+	reserveRegionFn = func(size mem.Size, align uintptr) (uintptr, *kernel.Error) {
+		if align != uintptr(HugePageSize2M) {
+			t.Errorf("expected region to be aligned to a 2M boundary; got alignment %x", align)
+		}
+
+		reservedSize = size
+		return regionStart, nil
+	}
+
+	// Map 4M + 8K
+	page, err := MapRegion(frame, 2*HugePageSize2M+2*mem.PageSize, FlagPresent|FlagRW)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := 2*HugePageSize2M + 2*mem.PageSize + mem.PageSize; reservedSize != exp {
+		t.Errorf("expected to reserve %d bytes; got %d", exp, reservedSize)
+	}
+
+	// The returned page should have the same offset (modulo 2M) as the frame
+	if exp, got := frame.Address()&uintptr(HugePageSize2M-1), page.Address()&uintptr(HugePageSize2M-1); got != exp {
+		t.Errorf("expected region start offset to be %x; got %x", exp, got)
+	}
+
+	if page.Address() < regionStart || page.Address()+uintptr(2*HugePageSize2M+2*mem.PageSize) > regionStart+uintptr(reservedSize) {
+		t.Error("expected mapped region to fit inside the reserved region")
+	}
+
+	// The first 511 and the last 3 pages should be mapped using regular pages
+	if exp, got := 1, len(hugePages); got != exp {
+		t.Errorf("expected %d huge page(s) to be mapped; got %d", exp, got)
+	}
+
+	if exp, got := 511+3, len(mappedPages); got != exp {
+		t.Errorf("expected %d regular page(s) to be mapped; got %d", exp, got)
+	}
+
+	t.Run("MapHuge fails", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "map failed"}
+		mapHugeFn = func(_ Page, _ pmm.Frame, _ mem.Size, _ PageTableEntryFlag) *kernel.Error {
+			return expErr
+		}
+
+		if _, err := MapRegion(pmm.Frame(0), HugePageSize2M, FlagPresent|FlagRW); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestUnmapRegion(t *testing.T) {
+	defer func() {
+		unmapFn = Unmap
+		unmapHugeFn = UnmapHuge
+		releaseRegionFn = ReleaseRegion
+	}()
+
+	var (
+		unmappedPages []Page
+		hugePages     []Page
+		releasedAddr  uintptr
+		releasedSize  mem.Size
+	)
+
+	unmapFn = func(page Page) *kernel.Error {
+		unmappedPages = append(unmappedPages, page)
+		return nil
+	}
+
+	unmapHugeFn = func(page Page, size mem.Size) *kernel.Error {
+		if size != HugePageSize2M {
+			t.Errorf("expected huge page size to be 2M; got %d", size)
+		}
+		hugePages = append(hugePages, page)
+		return nil
+	}
+
+	releaseRegionFn = func(addr uintptr, size mem.Size) *kernel.Error {
+		releasedAddr, releasedSize = addr, size
+		return nil
+	}
+
+	reset := func() {
+		unmappedPages, hugePages = nil, nil
+		releasedAddr, releasedSize = 0, 0
+	}
+
+	specs := []struct {
+		addr            uintptr
+		size            mem.Size
+		expPages        int
+		expHugePages    int
+		expReleasedAddr uintptr
+		expReleasedSize mem.Size
+	}{
+		{0xffffc00000001000, 4097, 2, 0, 0xffffc00000001000, 2 * mem.PageSize},
+		// Region layout matches the one generated by MapRegion for 4M + 8K
+		// starting one page into a 2M-aligned reservation
+		{
+			0xffffc00000201000, 2*HugePageSize2M + 2*mem.PageSize,
+			511 + 3, 1,
+			0xffffc00000200000, 2*HugePageSize2M + 3*mem.PageSize,
+		},
+	}
+
+	for specIndex, spec := range specs {
+		reset()
+
+		if err := UnmapRegion(PageFromAddress(spec.addr), spec.size); err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if got := len(unmappedPages); got != spec.expPages {
+			t.Errorf("[spec %d] expected %d regular page(s) to be unmapped; got %d", specIndex, spec.expPages, got)
+		}
+
+		if got := len(hugePages); got != spec.expHugePages {
+			t.Errorf("[spec %d] expected %d huge page(s) to be unmapped; got %d", specIndex, spec.expHugePages, got)
+		}
+
+		if releasedAddr != spec.expReleasedAddr || releasedSize != spec.expReleasedSize {
+			t.Errorf("[spec %d] expected to release region (%x, %d); got (%x, %d)", specIndex, spec.expReleasedAddr, spec.expReleasedSize, releasedAddr, releasedSize)
+		}
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "unmap failed"}
+
+		reset()
+		unmapFn = func(_ Page) *kernel.Error { return expErr }
+		if err := UnmapRegion(PageFromAddress(0xffffc00000001000), mem.PageSize); err != expErr {
+			t.Errorf("expected error: %v; got %v", expErr, err)
+		}
+
+		reset()
+		unmapHugeFn = func(_ Page, _ mem.Size) *kernel.Error { return expErr }
+		if err := UnmapRegion(PageFromAddress(0xffffc00000200000), HugePageSize2M); err != expErr {
+			t.Errorf("expected error: %v; got %v", expErr, err)
+		}
+
+		reset()
+		unmapFn = func(_ Page) *kernel.Error { return nil }
+		releaseRegionFn = func(_ uintptr, _ mem.Size) *kernel.Error { return expErr }
+		if err := UnmapRegion(PageFromAddress(0xffffc00000001000), mem.PageSize); err != expErr {
+			t.Errorf("expected error: %v; got %v", expErr, err)
 		}
 	})
 }
@@ -369,3 +551,226 @@ func TestUnmapErrorsAmd64(t *testing.T) {
 		}
 	})
 }
+
+func TestUnmapAndFreeAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origFlushTLBEntryFn func(uintptr)) {
+		ptePtrFn = origPtePtr
+		flushTLBEntryFn = origFlushTLBEntryFn
+		frameFreer = nil
+		protectReservedZeroedPage = false
+	}(ptePtrFn, flushTLBEntryFn)
+
+	var (
+		physPages [pageLevels][mem.PageSize >> mem.PointerShift]pageTableEntry
+		frame     = pmm.Frame(123)
+		freed     []pmm.Frame
+	)
+
+	tableFrame := func(level int) pmm.Frame {
+		return pmm.Frame(uintptr(unsafe.Pointer(&physPages[level][0])) >> mem.PageShift)
+	}
+
+	// Emulate a page mapped to virtAddr 0 across all page levels
+	resetTables := func() {
+		physPages = [pageLevels][mem.PageSize >> mem.PointerShift]pageTableEntry{}
+		for level := 0; level < pageLevels; level++ {
+			physPages[level][0].SetFlags(FlagPresent | FlagRW)
+			if level < pageLevels-1 {
+				physPages[level][0].SetFrame(tableFrame(level + 1))
+			} else {
+				physPages[level][0].SetFrame(frame)
+			}
+		}
+		freed = freed[:0]
+	}
+
+	pteCallCount := 0
+	ptePtrFn = func(entry uintptr) unsafe.Pointer {
+		pteCallCount++
+		return unsafe.Pointer(&physPages[pteCallCount-1][0])
+	}
+
+	flushTLBEntryFn = func(uintptr) {}
+
+	SetFrameFreer(func(f pmm.Frame) *kernel.Error {
+		freed = append(freed, f)
+		return nil
+	})
+
+	t.Run("page tables still in use", func(t *testing.T) {
+		resetTables()
+		pteCallCount = 0
+		physPages[pageLevels-1][1].SetFlags(FlagPresent)
+
+		if err := UnmapAndFree(PageFromAddress(0)); err != nil {
+			t.Fatal(err)
+		}
+
+		if physPages[pageLevels-1][0] != 0 {
+			t.Error("expected last level entry to be cleared")
+		}
+
+		if len(freed) != 1 || freed[0] != frame {
+			t.Fatalf("expected only frame %d to be freed; got %v", frame, freed)
+		}
+
+		for level := 0; level < pageLevels-1; level++ {
+			if !physPages[level][0].HasFlags(FlagPresent) {
+				t.Errorf("[pte at level %d] expected entry to retain FlagPresent", level)
+			}
+		}
+	})
+
+	t.Run("release empty page tables", func(t *testing.T) {
+		defer func() { flushTLBEntryFn = func(uintptr) {} }()
+
+		var flushed []uintptr
+		flushTLBEntryFn = func(addr uintptr) { flushed = append(flushed, addr) }
+
+		resetTables()
+		pteCallCount = 0
+
+		if err := UnmapAndFree(PageFromAddress(0)); err != nil {
+			t.Fatal(err)
+		}
+
+		// The recursive mapping of each released table must be flushed
+		for _, level := range []int{3, 2} {
+			tableAddr := uintptr(unsafe.Pointer(&physPages[level][0])) &^ uintptr(mem.PageSize-1)
+
+			var found bool
+			for _, addr := range flushed {
+				if addr == tableAddr {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				t.Errorf("expected TLB entry for the level %d table at 0x%x to be flushed; flushed: %x", level, tableAddr, flushed)
+			}
+		}
+
+		// The P1 and P2 tables should be released but the P3 table
+		// should be retained as it is referenced by a P4 entry.
+		expFreed := []pmm.Frame{frame, tableFrame(3), tableFrame(2)}
+		if len(freed) != len(expFreed) {
+			t.Fatalf("expected %d frames to be freed; got %v", len(expFreed), freed)
+		}
+
+		for index, exp := range expFreed {
+			if freed[index] != exp {
+				t.Errorf("expected freed frame %d to be %d; got %d", index, exp, freed[index])
+			}
+		}
+
+		if !physPages[0][0].HasFlags(FlagPresent) {
+			t.Error("expected P4 entry to retain FlagPresent")
+		}
+
+		for level := 1; level < pageLevels; level++ {
+			if physPages[level][0] != 0 {
+				t.Errorf("[pte at level %d] expected entry to be cleared", level)
+			}
+		}
+	})
+
+	t.Run("do not free ReservedZeroedFrame", func(t *testing.T) {
+		defer func(origFrame pmm.Frame) {
+			ReservedZeroedFrame = origFrame
+			protectReservedZeroedPage = false
+		}(ReservedZeroedFrame)
+
+		resetTables()
+		pteCallCount = 0
+		physPages[pageLevels-1][1].SetFlags(FlagPresent)
+		ReservedZeroedFrame = frame
+		protectReservedZeroedPage = true
+
+		if err := UnmapAndFree(PageFromAddress(0)); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(freed) != 0 {
+			t.Fatalf("expected no frames to be freed; got %v", freed)
+		}
+	})
+
+	t.Run("no frame freer registered", func(t *testing.T) {
+		defer SetFrameFreer(frameFreer)
+		SetFrameFreer(nil)
+
+		resetTables()
+		pteCallCount = 0
+
+		if err := UnmapAndFree(PageFromAddress(0)); err != nil {
+			t.Fatal(err)
+		}
+
+		if physPages[pageLevels-1][0] != 0 {
+			t.Error("expected last level entry to be cleared")
+		}
+
+		if !physPages[pageLevels-2][0].HasFlags(FlagPresent) {
+			t.Error("expected P2 entry to retain FlagPresent")
+		}
+	})
+}
+
+func TestUnmapAndFreeErrorsAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origFlushTLBEntryFn func(uintptr)) {
+		ptePtrFn = origPtePtr
+		flushTLBEntryFn = origFlushTLBEntryFn
+		frameFreer = nil
+	}(ptePtrFn, flushTLBEntryFn)
+
+	var physPages [pageLevels][mem.PageSize >> mem.PointerShift]pageTableEntry
+
+	ptePtrFn = func(entry uintptr) unsafe.Pointer {
+		// The last 12 bits encode the page table offset in bytes
+		// which we need to convert to a uint64 entry
+		pteIndex := (entry & uintptr(mem.PageSize-1)) >> mem.PointerShift
+		return unsafe.Pointer(&physPages[0][pteIndex])
+	}
+	flushTLBEntryFn = func(uintptr) {}
+
+	t.Run("encounter huge page", func(t *testing.T) {
+		physPages[0][0].SetFlags(FlagPresent | FlagHugePage)
+
+		if err := UnmapAndFree(PageFromAddress(0)); err != errNoHugePageSupport {
+			t.Fatalf("expected to get errNoHugePageSupport; got %v", err)
+		}
+	})
+
+	t.Run("virtual address not mapped", func(t *testing.T) {
+		physPages[0][0].ClearFlags(FlagPresent)
+
+		if err := UnmapAndFree(PageFromAddress(0)); err != ErrInvalidMapping {
+			t.Fatalf("expected to get ErrInvalidMapping; got %v", err)
+		}
+	})
+
+	t.Run("frame freer returns an error", func(t *testing.T) {
+		// Make all page levels point back to physPages[0] with a
+		// mapping for virtual address 0.
+		physPages[0][0] = 0
+		physPages[0][0].SetFlags(FlagPresent | FlagRW)
+
+		expErr := &kernel.Error{Module: "test", Message: "free failed"}
+		SetFrameFreer(func(_ pmm.Frame) *kernel.Error {
+			return expErr
+		})
+
+		if err := UnmapAndFree(PageFromAddress(0)); err != expErr {
+			t.Fatalf("expected to get error %v; got %v", expErr, err)
+		}
+	})
+}
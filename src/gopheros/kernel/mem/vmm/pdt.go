@@ -30,6 +30,10 @@ var (
 // PageDirectoryTable describes the top-most table in a multi-level paging scheme.
 type PageDirectoryTable struct {
 	pdtFrame pmm.Frame
+
+	// pcid holds the process-context identifier used for tagging the TLB
+	// entries of this PDT when PCIDs are enabled.
+	pcid uint16
 }
 
 // Init sets up the page table directory starting at the supplied physical
@@ -39,8 +43,11 @@ type PageDirectoryTable struct {
 // Init can:
 //  - call mem.Memset to clear the frame contents
 //  - setup a recursive mapping for the last table entry to the page itself.
+//
+// New page table directories are also assigned a PCID.
 func (pdt *PageDirectoryTable) Init(pdtFrame pmm.Frame) *kernel.Error {
 	pdt.pdtFrame = pdtFrame
+	pdt.pcid = 0
 
 	// Check active PDT physical address. If it matches the input pdt then
 	// nothing more needs to be done
@@ -49,6 +56,8 @@ func (pdt *PageDirectoryTable) Init(pdtFrame pmm.Frame) *kernel.Error {
 		return nil
 	}
 
+	pdt.pcid = allocPCID()
+
 	// Create a temporary mapping for the pdt frame so we can work on it
 	pdtPage, err := mapTemporaryFn(pdtFrame)
 	if err != nil {
@@ -87,6 +96,7 @@ func (pdt PageDirectoryTable) Map(page Page, frame pmm.Frame, flags PageTableEnt
 		lastPdtEntry = (*pageTableEntry)(unsafe.Pointer(lastPdtEntryAddr))
 		lastPdtEntry.SetFrame(pdt.pdtFrame)
 		flushTLBEntryFn(lastPdtEntryAddr)
+		pdt.invalidateTLB()
 	}
 
 	err := mapFn(page, frame, flags)
@@ -117,6 +127,7 @@ func (pdt PageDirectoryTable) Unmap(page Page) *kernel.Error {
 		lastPdtEntry = (*pageTableEntry)(unsafe.Pointer(lastPdtEntryAddr))
 		lastPdtEntry.SetFrame(pdt.pdtFrame)
 		flushTLBEntryFn(lastPdtEntryAddr)
+		pdt.invalidateTLB()
 	}
 
 	err := unmapFn(page)
@@ -129,7 +140,62 @@ func (pdt PageDirectoryTable) Unmap(page Page) *kernel.Error {
 	return err
 }
 
-// Activate enables this page directory table and flushes the TLB
+// Activate enables this page directory table and flushes the TLB. If PCIDs
+// are enabled, the TLB entries tagged with the PCID of this PDT are preserved
+// unless the PDT has been modified while inactive, its PCID was last used by
+// a different PDT or a kernel mapping has been modified since the PCID was
+// last flushed.
 func (pdt PageDirectoryTable) Activate() {
-	switchPDTFn(pdt.pdtFrame.Address())
+	if !pcidEnabled {
+		switchPDTFn(pdt.pdtFrame.Address())
+		return
+	}
+
+	cr3 := pdt.pdtFrame.Address() | uintptr(pdt.pcid)
+	if owner := &pcidOwners[pdt.pcid]; owner.valid && owner.pdtFrame == pdt.pdtFrame && owner.kernelTLBGen == kernelTLBGen {
+		cr3 |= cpu.CR3NoFlush
+	} else {
+		owner.pdtFrame, owner.valid, owner.kernelTLBGen = pdt.pdtFrame, true, kernelTLBGen
+	}
+
+	switchPDTFn(cr3)
+}
+
+// invalidateTLB ensures that any TLB entries tagged with the PCID of this PDT
+// are flushed the next time the PDT gets activated. It must be invoked
+// whenever an inactive PDT is modified.
+func (pdt PageDirectoryTable) invalidateTLB() {
+	if owner := &pcidOwners[pdt.pcid]; owner.pdtFrame == pdt.pdtFrame {
+		owner.valid = false
+	}
+}
+
+// withTables invokes fn while the entries of this PDT can be accessed using
+// the recursive virtual address scheme. If this table is not active, it gets
+// temporarily mapped to the last entry of the active PDT for the duration of
+// the call. This allows fn to use functions like Map and Unmap to operate on
+// inactive PDTs.
+func (pdt PageDirectoryTable) withTables(fn func() *kernel.Error) *kernel.Error {
+	var (
+		activePdtFrame   = pmm.Frame(activePDTFn() >> mem.PageShift)
+		lastPdtEntryAddr uintptr
+		lastPdtEntry     *pageTableEntry
+	)
+
+	if activePdtFrame != pdt.pdtFrame {
+		lastPdtEntryAddr = activePdtFrame.Address() + (((1 << pageLevelBits[0]) - 1) << mem.PointerShift)
+		lastPdtEntry = (*pageTableEntry)(unsafe.Pointer(lastPdtEntryAddr))
+		lastPdtEntry.SetFrame(pdt.pdtFrame)
+		flushTLBEntryFn(lastPdtEntryAddr)
+		pdt.invalidateTLB()
+	}
+
+	err := fn()
+
+	if activePdtFrame != pdt.pdtFrame {
+		lastPdtEntry.SetFrame(activePdtFrame)
+		flushTLBEntryFn(lastPdtEntryAddr)
+	}
+
+	return err
 }
@@ -2,6 +2,7 @@ package vmm
 
 import (
 	"gopheros/kernel"
+	"gopheros/kernel/cpu"
 	"gopheros/kernel/mem"
 	"gopheros/kernel/mem/pmm"
 	"runtime"
@@ -304,6 +305,67 @@ func TestPageDirectoryTableUnmapAmd64(t *testing.T) {
 	})
 }
 
+func TestPageDirectoryTableWithTablesAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origFlushTLBEntry func(uintptr), origActivePDT func() uintptr) {
+		flushTLBEntryFn = origFlushTLBEntry
+		activePDTFn = origActivePDT
+	}(flushTLBEntryFn, activePDTFn)
+
+	var (
+		pdtFrame       = pmm.Frame(123)
+		pdt            = PageDirectoryTable{pdtFrame: pdtFrame}
+		activePhysPage [mem.PageSize >> mem.PointerShift]pageTableEntry
+		activePdtFrame = pmm.Frame(uintptr(unsafe.Pointer(&activePhysPage[0])) >> mem.PageShift)
+		expErr         = &kernel.Error{Module: "test", Message: "fn failed"}
+		flushCallCount int
+	)
+
+	activePhysPage[len(activePhysPage)-1].SetFlags(FlagPresent | FlagRW)
+	activePhysPage[len(activePhysPage)-1].SetFrame(activePdtFrame)
+	flushTLBEntryFn = func(_ uintptr) { flushCallCount++ }
+
+	t.Run("already mapped PDT", func(t *testing.T) {
+		flushCallCount = 0
+		activePDTFn = func() uintptr { return pdtFrame.Address() }
+
+		if err := pdt.withTables(func() *kernel.Error { return expErr }); err != expErr {
+			t.Fatalf("expected to get error %v; got %v", expErr, err)
+		}
+
+		if exp := 0; flushCallCount != exp {
+			t.Fatalf("expected flushTLBEntry to be called %d times; called %d", exp, flushCallCount)
+		}
+	})
+
+	t.Run("not mapped PDT", func(t *testing.T) {
+		flushCallCount = 0
+		activePDTFn = func() uintptr { return activePdtFrame.Address() }
+
+		err := pdt.withTables(func() *kernel.Error {
+			if got := activePhysPage[len(activePhysPage)-1].Frame(); got != pdtFrame {
+				t.Errorf("expected last PDT entry of active PDT to be re-mapped to frame %x; got %x", pdtFrame, got)
+			}
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := activePhysPage[len(activePhysPage)-1].Frame(); got != activePdtFrame {
+			t.Errorf("expected last PDT entry of active PDT to be mapped back to frame %x; got %x", activePdtFrame, got)
+		}
+
+		if exp := 2; flushCallCount != exp {
+			t.Fatalf("expected flushTLBEntry to be called %d times; called %d", exp, flushCallCount)
+		}
+	})
+}
+
 func TestPageDirectoryTableActivateAmd64(t *testing.T) {
 	if runtime.GOARCH != "amd64" {
 		t.Skip("test requires amd64 runtime; skipping")
@@ -327,4 +389,70 @@ func TestPageDirectoryTableActivateAmd64(t *testing.T) {
 	if exp := 1; switchPDTCallCount != exp {
 		t.Fatalf("expected switchPDT to be called %d times; called %d", exp, switchPDTCallCount)
 	}
+
+	t.Run("with PCID", func(t *testing.T) {
+		defer func() {
+			pcidEnabled = false
+			pcidOwners[pdt.pcid] = pcidOwner{}
+		}()
+
+		var cr3 uintptr
+		switchPDTFn = func(val uintptr) { cr3 = val }
+		pcidEnabled = true
+		pdt.pcid = 5
+
+		specs := []struct {
+			invalidate bool
+			expCR3     uintptr
+		}{
+			// first activation flushes the entries tagged with the PCID
+			{false, pdtFrame.Address() | 5},
+			{false, pdtFrame.Address() | 5 | cpu.CR3NoFlush},
+			{true, pdtFrame.Address() | 5},
+			{false, pdtFrame.Address() | 5 | cpu.CR3NoFlush},
+		}
+
+		for specIndex, spec := range specs {
+			if spec.invalidate {
+				pdt.invalidateTLB()
+			}
+
+			pdt.Activate()
+			if cr3 != spec.expCR3 {
+				t.Errorf("[spec %d] expected CR3 to be set to %x; got %x", specIndex, spec.expCR3, cr3)
+			}
+		}
+
+		// Activating a different PDT with the same PCID should flush
+		// the TLB entries of the previous owner
+		other := PageDirectoryTable{pdtFrame: pmm.Frame(456), pcid: pdt.pcid}
+		other.Activate()
+		if exp := other.pdtFrame.Address() | 5; cr3 != exp {
+			t.Errorf("expected CR3 to be set to %x; got %x", exp, cr3)
+		}
+
+		pdt.Activate()
+		if exp := pdtFrame.Address() | 5; cr3 != exp {
+			t.Errorf("expected CR3 to be set to %x; got %x", exp, cr3)
+		}
+
+		// Modifying a kernel mapping only flushes the TLB entries for
+		// the current PCID so the entries tagged with the PCID of this
+		// PDT must be flushed when it gets activated
+		pdt.Activate()
+		if exp := pdtFrame.Address() | 5 | cpu.CR3NoFlush; cr3 != exp {
+			t.Errorf("expected CR3 to be set to %x; got %x", exp, cr3)
+		}
+
+		invalidateKernelTLB()
+		for specIndex, exp := range []uintptr{
+			pdtFrame.Address() | 5,
+			pdtFrame.Address() | 5 | cpu.CR3NoFlush,
+		} {
+			pdt.Activate()
+			if cr3 != exp {
+				t.Errorf("[kernel mapping change, activation %d] expected CR3 to be set to %x; got %x", specIndex, exp, cr3)
+			}
+		}
+	})
 }
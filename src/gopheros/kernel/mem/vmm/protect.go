@@ -0,0 +1,82 @@
+package vmm
+
+import "gopheros/kernel"
+
+var (
+	errInvalidProtectFlags = &kernel.Error{Module: "vmm", Message: "page protection changes cannot modify the present and huge page flags"}
+)
+
+// Protect updates the flags of count consecutive pages starting at the
+// supplied page without remapping them. Protect sets the flags in setFlags
+// and then clears the flags in clearFlags for each page table entry and
+// flushes the TLB entries for the updated pages. If a page is part of a huge
+// page mapping, the huge page is split so that only the requested pages are
+// affected. Pages that are marked as copy-on-write or map the reserved zeroed
+// frame are never made writable; they remain read-only and copy-on-write.
+//
+// Protect returns ErrInvalidMapping if it encounters a page that is not
+// mapped and errWXViolation if the update would make a kernel page both
+// writable and executable while W^X enforcement is enabled. In both cases,
+// the pages preceding the failing page will already have been updated.
+func Protect(page Page, count int, setFlags, clearFlags PageTableEntryFlag) *kernel.Error {
+	if (setFlags|clearFlags)&(FlagPresent|FlagHugePage) != 0 {
+		return errInvalidProtectFlags
+	}
+
+	var (
+		err       *kernel.Error
+		curPage   = page
+		remaining = count
+	)
+
+	for ; remaining > 0 && err == nil; curPage, remaining = curPage+1, remaining-1 {
+		err = protectPage(curPage, setFlags, clearFlags)
+	}
+
+	flushTLBRange(page, count-remaining)
+	return err
+}
+
+// protectPage updates the flags of the page table entry for a single page.
+func protectPage(page Page, setFlags, clearFlags PageTableEntryFlag) *kernel.Error {
+	var err *kernel.Error
+
+	walk(page.Address(), func(pteLevel uint8, pte *pageTableEntry) bool {
+		if !pte.HasFlags(FlagPresent) {
+			err = ErrInvalidMapping
+			return false
+		}
+
+		if pteLevel == pageLevels-1 {
+			// Pages that map the reserved zeroed frame or a frame
+			// shared with a cloned address space must remain
+			// read-only so that writes trigger a copy.
+			if pte.HasFlags(FlagCopyOnWrite) || (protectReservedZeroedPage && pte.Frame() == ReservedZeroedFrame) {
+				setFlags = (setFlags &^ FlagRW) | FlagCopyOnWrite
+				clearFlags &^= FlagCopyOnWrite
+			}
+
+			newFlags := (PageTableEntryFlag(*pte) | setFlags) &^ clearFlags
+			if err = checkWX(page, newFlags); err != nil {
+				return false
+			}
+
+			pte.SetFlags(setFlags)
+			pte.ClearFlags(clearFlags)
+			return true
+		}
+
+		if pte.HasFlags(FlagHugePage) {
+			if err = splitHugePage(page, pteLevel, pte); err != nil {
+				return false
+			}
+		}
+
+		// User-mode code can only access the page if all intermediate
+		// tables are also flagged as user-accessible.
+		pte.SetFlags(setFlags & FlagUserAccessible)
+		return true
+	})
+
+	return err
+}
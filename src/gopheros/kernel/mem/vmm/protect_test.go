@@ -0,0 +1,147 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem/pmm"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+func TestProtectAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origNextAddrFn func(uintptr) uintptr, origFlushTLBEntryFn func(uintptr)) {
+		ptePtrFn = origPtePtr
+		nextAddrFn = origNextAddrFn
+		flushTLBEntryFn = origFlushTLBEntryFn
+		frameAllocator = nil
+	}(ptePtrFn, nextAddrFn, flushTLBEntryFn)
+
+	var (
+		mmu           = newFakeMMU()
+		flushedPages  []Page
+		kernelTable   = FlagPresent | FlagRW
+		kernelRWFlags = FlagPresent | FlagRW | FlagNoExecute
+	)
+
+	ptePtrFn = mmu.ptePtr
+	flushTLBEntryFn = func(addr uintptr) {
+		flushedPages = append(flushedPages, PageFromAddress(addr))
+	}
+
+	mmu.mapPage(0x400000, 3, pageTableEntry(0x100000|kernelRWFlags), kernelTable)
+	mmu.mapPage(0x401000, 3, pageTableEntry(0x101000|kernelRWFlags), kernelTable)
+
+	if err := Protect(PageFromAddress(0x400000), 2, FlagUserAccessible, FlagRW|FlagNoExecute); err != nil {
+		t.Fatal(err)
+	}
+
+	for index, addr := range []uintptr{0x400000, 0x401000} {
+		exp := pageTableEntry(0x100000+uintptr(index)<<12) | pageTableEntry(FlagPresent|FlagUserAccessible)
+		if got := *mmu.entry(3, addr); got != exp {
+			t.Errorf("expected entry for page %x to be %x; got %x", addr, exp, got)
+		}
+
+		if flushedPages[index] != PageFromAddress(addr) {
+			t.Errorf("expected TLB entry for page %x to be flushed", addr)
+		}
+	}
+
+	for level := uint8(0); level < pageLevels-1; level++ {
+		if !mmu.entry(level, 0x400000).HasFlags(FlagUserAccessible) {
+			t.Errorf("expected level %d table entry to be flagged as user-accessible", level)
+		}
+	}
+
+	t.Run("huge page", func(t *testing.T) {
+		var (
+			hugeAddr  = uintptr(0x600000)
+			nextTable = mmu.table(3, hugeAddr)
+		)
+
+		mmu.mapPage(hugeAddr, 2, pageTableEntry(0x800000|kernelRWFlags|FlagHugePage), kernelTable)
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			return pmm.Frame(0x42), nil
+		})
+		nextAddrFn = func(_ uintptr) uintptr {
+			return uintptr(unsafe.Pointer(nextTable))
+		}
+
+		if err := Protect(PageFromAddress(hugeAddr+0x1000), 1, 0, FlagRW); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := *mmu.entry(2, hugeAddr); got.HasFlags(FlagHugePage) || got.Frame() != pmm.Frame(0x42) {
+			t.Errorf("expected huge page to be split; got entry %x", got)
+		}
+
+		if exp, got := pageTableEntry(0x801000|FlagPresent|FlagNoExecute), nextTable[1]; got != exp {
+			t.Errorf("expected protected page entry to be %x; got %x", exp, got)
+		}
+
+		if exp, got := pageTableEntry(0x802000|kernelRWFlags), nextTable[2]; got != exp {
+			t.Errorf("expected remaining page entries to keep their flags; got %x", got)
+		}
+	})
+
+	t.Run("copy-on-write page", func(t *testing.T) {
+		cowAddr := uintptr(0x410000)
+		mmu.mapPage(cowAddr, 3, pageTableEntry(0x110000|FlagPresent|FlagCopyOnWrite), kernelTable)
+
+		if err := Protect(PageFromAddress(cowAddr), 1, FlagRW, FlagCopyOnWrite); err != nil {
+			t.Fatal(err)
+		}
+
+		if exp, got := pageTableEntry(0x110000|FlagPresent|FlagCopyOnWrite), *mmu.entry(3, cowAddr); got != exp {
+			t.Errorf("expected copy-on-write page entry to be %x; got %x", exp, got)
+		}
+	})
+
+	t.Run("reserved zeroed frame", func(t *testing.T) {
+		defer func(origFrame pmm.Frame) {
+			ReservedZeroedFrame = origFrame
+			protectReservedZeroedPage = false
+		}(ReservedZeroedFrame)
+
+		ReservedZeroedFrame = pmm.Frame(0x111)
+		protectReservedZeroedPage = true
+
+		zeroAddr := uintptr(0x411000)
+		mmu.mapPage(zeroAddr, 3, pageTableEntry(0x111000|FlagPresent|FlagNoExecute), kernelTable)
+
+		if err := Protect(PageFromAddress(zeroAddr), 1, FlagRW|FlagUserAccessible, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if exp, got := pageTableEntry(0x111000|FlagPresent|FlagNoExecute|FlagUserAccessible|FlagCopyOnWrite), *mmu.entry(3, zeroAddr); got != exp {
+			t.Errorf("expected zeroed frame page entry to be %x; got %x", exp, got)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, flag := range []PageTableEntryFlag{FlagPresent, FlagHugePage} {
+			if err := Protect(PageFromAddress(0x400000), 1, flag, 0); err != errInvalidProtectFlags {
+				t.Errorf("expected to get errInvalidProtectFlags; got %v", err)
+			}
+
+			if err := Protect(PageFromAddress(0x400000), 1, 0, flag); err != errInvalidProtectFlags {
+				t.Errorf("expected to get errInvalidProtectFlags; got %v", err)
+			}
+		}
+
+		// The first two pages should be updated before reaching the
+		// unmapped page
+		if err := Protect(PageFromAddress(0x400000), 3, FlagRW, 0); err != ErrInvalidMapping {
+			t.Errorf("expected to get ErrInvalidMapping; got %v", err)
+		}
+
+		for _, addr := range []uintptr{0x400000, 0x401000} {
+			if !mmu.entry(3, addr).HasFlags(FlagRW) {
+				t.Errorf("expected entry for page %x to be updated", addr)
+			}
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+)
+
+const (
+	// maxFreeRanges defines the maximum number of disjoint free ranges
+	// that can be tracked by a RangeAllocator. As guard gaps are kept in
+	// the free list, each live reservation may contribute a free range.
+	maxFreeRanges = 512
+)
+
+var (
+	errRangeAllocNoSpace        = &kernel.Error{Module: "range_alloc", Message: "no free virtual address range large enough to satisfy reservation request"}
+	errRangeAllocInvalidAlign   = &kernel.Error{Module: "range_alloc", Message: "alignment must be a power of 2 multiple of the page size"}
+	errRangeAllocInvalidRelease = &kernel.Error{Module: "range_alloc", Message: "released range is outside the managed range or overlaps with a free range"}
+	errRangeAllocMisaligned     = &kernel.Error{Module: "range_alloc", Message: "released range must be page-aligned"}
+	errRangeAllocTooFragmented  = &kernel.Error{Module: "range_alloc", Message: "too many free ranges"}
+)
+
+// addrRange describes the virtual address range [start, end).
+type addrRange struct {
+	start, end uintptr
+}
+
+// RangeAllocator manages the reservation of page-aligned ranges within a
+// virtual address space region. As the allocator may be used before the Go
+// runtime is initialized, the free ranges are tracked using a fixed-size
+// array that is kept sorted by address.
+//
+// The allocator can optionally maintain a guard gap between reserved ranges.
+// Guard gaps are never handed out to callers so any access that overflows a
+// reserved range will trigger a page fault instead of silently corrupting a
+// neighboring range.
+type RangeAllocator struct {
+	// guardSize specifies the size of the unused gap that is kept on
+	// each side of a reserved range.
+	guardSize uintptr
+
+	// managed specifies the address range handled by the allocator.
+	managed addrRange
+
+	freeRanges [maxFreeRanges]addrRange
+	freeCount  int
+}
+
+// Init sets up the allocator to manage the virtual address range
+// [start, end) and configures the size of the guard gap that is kept around
+// each reserved range. All arguments are rounded to a page boundary.
+func (alloc *RangeAllocator) Init(start, end uintptr, guardSize mem.Size) {
+	pageSizeMinus1 := uintptr(mem.PageSize - 1)
+
+	alloc.guardSize = (uintptr(guardSize) + pageSizeMinus1) &^ pageSizeMinus1
+	alloc.managed = addrRange{
+		start: (start + pageSizeMinus1) &^ pageSizeMinus1,
+		end:   end &^ pageSizeMinus1,
+	}
+	alloc.freeRanges[0] = alloc.managed
+	alloc.freeCount = 1
+}
+
+// Reserve reserves a contiguous virtual address range of the requested size
+// whose start address is aligned to align. The size is rounded up to the
+// nearest page boundary and align must be a power of 2 multiple of the page
+// size. Reserve serves requests using the highest available free range.
+func (alloc *RangeAllocator) Reserve(size mem.Size, align uintptr) (uintptr, *kernel.Error) {
+	return alloc.ReserveBelow(^uintptr(0), size, align)
+}
+
+// ReserveBelow behaves like Reserve but only considers the part of the free
+// ranges that lies below the supplied limit address.
+func (alloc *RangeAllocator) ReserveBelow(limit uintptr, size mem.Size, align uintptr) (uintptr, *kernel.Error) {
+	if align < uintptr(mem.PageSize) || align&(align-1) != 0 {
+		return 0, errRangeAllocInvalidAlign
+	}
+
+	reqSize := (uintptr(size) + uintptr(mem.PageSize-1)) &^ uintptr(mem.PageSize-1)
+	for rangeIndex := alloc.freeCount - 1; rangeIndex >= 0; rangeIndex-- {
+		r := alloc.freeRanges[rangeIndex]
+		if r.end > limit {
+			r.end = limit &^ uintptr(mem.PageSize-1)
+		}
+
+		if r.end < r.start || r.end-r.start < reqSize+2*alloc.guardSize {
+			continue
+		}
+
+		start := (r.end - alloc.guardSize - reqSize) &^ (align - 1)
+		if start < r.start+alloc.guardSize {
+			continue
+		}
+
+		if err := alloc.carve(rangeIndex, start, start+reqSize); err != nil {
+			return 0, err
+		}
+
+		return start, nil
+	}
+
+	return 0, errRangeAllocNoSpace
+}
+
+// Release returns a range previously obtained via a call to Reserve back to
+// the allocator. The size is rounded up to the nearest page boundary.
+// Adjacent free ranges are automatically merged. Ranges that are not part of
+// the address range managed by the allocator are rejected.
+func (alloc *RangeAllocator) Release(addr uintptr, size mem.Size) *kernel.Error {
+	if addr&uintptr(mem.PageSize-1) != 0 {
+		return errRangeAllocMisaligned
+	}
+
+	end := addr + (uintptr(size)+uintptr(mem.PageSize-1))&^uintptr(mem.PageSize-1)
+	if end <= addr || addr < alloc.managed.start || end > alloc.managed.end {
+		return errRangeAllocInvalidRelease
+	}
+
+	// Find the first free range that starts after the released range
+	nextIndex := 0
+	for ; nextIndex < alloc.freeCount && alloc.freeRanges[nextIndex].start < end; nextIndex++ {
+	}
+
+	var (
+		mergePrev = nextIndex > 0 && alloc.freeRanges[nextIndex-1].end == addr
+		mergeNext = nextIndex < alloc.freeCount && alloc.freeRanges[nextIndex].start == end
+	)
+
+	// The released range must not overlap with the free range before it
+	if nextIndex > 0 && alloc.freeRanges[nextIndex-1].end > addr {
+		return errRangeAllocInvalidRelease
+	}
+
+	switch {
+	case mergePrev && mergeNext:
+		alloc.freeRanges[nextIndex-1].end = alloc.freeRanges[nextIndex].end
+		alloc.remove(nextIndex)
+	case mergePrev:
+		alloc.freeRanges[nextIndex-1].end = end
+	case mergeNext:
+		alloc.freeRanges[nextIndex].start = addr
+	default:
+		return alloc.insert(nextIndex, addrRange{addr, end})
+	}
+
+	return nil
+}
+
+// carve removes [start, end) from the free range at the specified index.
+func (alloc *RangeAllocator) carve(rangeIndex int, start, end uintptr) *kernel.Error {
+	r := alloc.freeRanges[rangeIndex]
+
+	switch {
+	case r.start == start && r.end == end:
+		alloc.remove(rangeIndex)
+	case r.start == start:
+		alloc.freeRanges[rangeIndex].start = end
+	case r.end == end:
+		alloc.freeRanges[rangeIndex].end = start
+	default:
+		// Splitting the range in two requires an extra slot
+		if err := alloc.insert(rangeIndex+1, addrRange{end, r.end}); err != nil {
+			return err
+		}
+		alloc.freeRanges[rangeIndex].end = start
+	}
+
+	return nil
+}
+
+// insert adds a free range at the specified index shifting any ranges after
+// it to the right.
+func (alloc *RangeAllocator) insert(index int, r addrRange) *kernel.Error {
+	if alloc.freeCount == maxFreeRanges {
+		return errRangeAllocTooFragmented
+	}
+
+	copy(alloc.freeRanges[index+1:alloc.freeCount+1], alloc.freeRanges[index:alloc.freeCount])
+	alloc.freeRanges[index] = r
+	alloc.freeCount++
+	return nil
+}
+
+// remove deletes the free range at the specified index shifting any ranges
+// after it to the left.
+func (alloc *RangeAllocator) remove(index int) {
+	copy(alloc.freeRanges[index:alloc.freeCount-1], alloc.freeRanges[index+1:alloc.freeCount])
+	alloc.freeCount--
+}
@@ -0,0 +1,206 @@
+package vmm
+
+import (
+	"gopheros/kernel/mem"
+	"testing"
+)
+
+func TestRangeAllocatorReserve(t *testing.T) {
+	var (
+		alloc    RangeAllocator
+		pageSize = uintptr(mem.PageSize)
+		start    = uintptr(0x100000)
+		end      = start + 64*pageSize
+	)
+
+	alloc.Init(start+1, end+1, mem.PageSize-1)
+
+	if alloc.guardSize != pageSize {
+		t.Fatalf("expected guard size to be rounded up to %d; got %d", pageSize, alloc.guardSize)
+	}
+
+	if exp := (addrRange{start + pageSize, end}); alloc.freeCount != 1 || alloc.freeRanges[0] != exp {
+		t.Fatalf("expected allocator to manage range %+v; got %+v", exp, alloc.freeRanges[0])
+	}
+
+	// Reservations are served from the end of the range while keeping a
+	// guard gap between them.
+	addr1, err := alloc.Reserve(42, pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := end - 2*pageSize; addr1 != exp {
+		t.Fatalf("expected reservation to start at %x; got %x", exp, addr1)
+	}
+
+	addr2, err := alloc.Reserve(2*mem.PageSize, pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := addr1 - 3*pageSize; addr2 != exp {
+		t.Fatalf("expected reservation to start at %x; got %x", exp, addr2)
+	}
+
+	addr3, err := alloc.Reserve(mem.PageSize, 16*pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr3&(16*pageSize-1) != 0 || addr3+2*pageSize > addr2 {
+		t.Fatalf("expected aligned reservation with a guard gap below %x; got %x", addr2, addr3)
+	}
+
+	// The guard gaps above each reservation remain in the free list
+	if exp := 4; alloc.freeCount != exp {
+		t.Fatalf("expected %d free ranges; got %d", exp, alloc.freeCount)
+	}
+
+	t.Run("release and merge", func(t *testing.T) {
+		for _, spec := range []struct {
+			addr uintptr
+			size mem.Size
+		}{
+			{addr2, 2 * mem.PageSize},
+			{addr1, 42},
+			{addr3, mem.PageSize},
+		} {
+			if err := alloc.Release(spec.addr, spec.size); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if exp := (addrRange{start + pageSize, end}); alloc.freeCount != 1 || alloc.freeRanges[0] != exp {
+			t.Fatalf("expected free ranges to be merged into %+v; got %d ranges", exp, alloc.freeCount)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		if _, err := alloc.Reserve(mem.PageSize, 0); err != errRangeAllocInvalidAlign {
+			t.Errorf("expected to get errRangeAllocInvalidAlign; got %v", err)
+		}
+
+		if _, err := alloc.Reserve(mem.PageSize, 3*pageSize); err != errRangeAllocInvalidAlign {
+			t.Errorf("expected to get errRangeAllocInvalidAlign; got %v", err)
+		}
+
+		if _, err := alloc.Reserve(63*mem.PageSize, pageSize); err != errRangeAllocNoSpace {
+			t.Errorf("expected to get errRangeAllocNoSpace; got %v", err)
+		}
+
+		// Alignment pushes the range start past the free range start
+		if _, err := alloc.Reserve(mem.PageSize, 1<<30); err != errRangeAllocNoSpace {
+			t.Errorf("expected to get errRangeAllocNoSpace; got %v", err)
+		}
+
+		if err := alloc.Release(end-pageSize+1, mem.PageSize); err != errRangeAllocMisaligned {
+			t.Errorf("expected to get errRangeAllocMisaligned; got %v", err)
+		}
+
+		if err := alloc.Release(end-pageSize, mem.PageSize); err != errRangeAllocInvalidRelease {
+			t.Errorf("expected to get errRangeAllocInvalidRelease; got %v", err)
+		}
+
+		// Ranges outside the managed range must be rejected
+		for _, spec := range []struct {
+			addr uintptr
+			size mem.Size
+		}{
+			{start - pageSize, mem.PageSize},
+			{start - pageSize, 2 * mem.PageSize},
+			{end, mem.PageSize},
+			{end - pageSize, 2 * mem.PageSize},
+			{start + pageSize, 0},
+		} {
+			if err := alloc.Release(spec.addr, spec.size); err != errRangeAllocInvalidRelease {
+				t.Errorf("expected releasing [%x, +%d) to fail with errRangeAllocInvalidRelease; got %v", spec.addr, spec.size, err)
+			}
+		}
+	})
+}
+
+func TestRangeAllocatorFragmentation(t *testing.T) {
+	var (
+		alloc    RangeAllocator
+		pageSize = uintptr(mem.PageSize)
+		start    = uintptr(0x100000)
+	)
+
+	alloc.Init(start, start+uintptr(2*maxFreeRanges+2)*pageSize, 0)
+
+	// Reserve all pages and then release every second page
+	for i := 0; i < 2*maxFreeRanges+2; i++ {
+		if _, err := alloc.Reserve(mem.PageSize, pageSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if alloc.freeCount != 0 {
+		t.Fatalf("expected no free ranges; got %d", alloc.freeCount)
+	}
+
+	for i := 0; i < maxFreeRanges; i++ {
+		if err := alloc.Release(start+uintptr(2*i)*pageSize, mem.PageSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := alloc.Release(start+uintptr(2*maxFreeRanges)*pageSize, mem.PageSize); err != errRangeAllocTooFragmented {
+		t.Fatalf("expected to get errRangeAllocTooFragmented; got %v", err)
+	}
+
+	// Splitting a free range also requires an extra slot
+	alloc.Init(start, start+16*pageSize, 0)
+	alloc.freeCount = maxFreeRanges
+	for i := 1; i < maxFreeRanges; i++ {
+		alloc.freeRanges[i] = addrRange{start + uintptr(16+2*i)*pageSize, start + uintptr(17+2*i)*pageSize}
+	}
+
+	if _, err := alloc.Reserve(2*mem.PageSize, 8*pageSize); err != errRangeAllocTooFragmented {
+		t.Fatalf("expected to get errRangeAllocTooFragmented; got %v", err)
+	}
+}
+
+func TestRangeAllocatorReserveBelow(t *testing.T) {
+	var (
+		alloc    RangeAllocator
+		pageSize = uintptr(mem.PageSize)
+		start    = uintptr(0x100000)
+		end      = start + 64*pageSize
+		limit    = start + 32*pageSize + 1
+	)
+
+	alloc.Init(start, end, mem.PageSize)
+
+	addr, err := alloc.ReserveBelow(limit, mem.PageSize, pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The limit is rounded down to a page boundary and a guard gap is kept
+	// below it.
+	if exp := start + 30*pageSize; addr != exp {
+		t.Fatalf("expected reservation to start at %x; got %x", exp, addr)
+	}
+
+	// The free space above the limit remains available
+	if exp := 2; alloc.freeCount != exp || alloc.freeRanges[1].end != end {
+		t.Fatalf("expected free range above the limit to be preserved; got %+v", alloc.freeRanges[:alloc.freeCount])
+	}
+
+	specs := []struct {
+		limit uintptr
+		size  mem.Size
+	}{
+		{start, mem.PageSize},
+		{start + 2*pageSize, mem.PageSize},
+		{start + 32*pageSize, 64 * mem.PageSize},
+	}
+
+	for specIndex, spec := range specs {
+		if _, err := alloc.ReserveBelow(spec.limit, spec.size, pageSize); err != errRangeAllocNoSpace {
+			t.Errorf("[spec %d] expected to get errRangeAllocNoSpace; got %v", specIndex, err)
+		}
+	}
+}
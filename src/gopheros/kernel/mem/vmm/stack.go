@@ -0,0 +1,199 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mem"
+)
+
+const (
+	// KernelStackSize is the default size of stacks allocated via
+	// AllocKernelStack.
+	KernelStackSize = 16 * mem.Kb
+
+	// maxKernelStacks defines the maximum number of kernel stacks that
+	// can be tracked at any point in time.
+	maxKernelStacks = 64
+)
+
+var (
+	// kernelStacks tracks all kernel stacks with a guard page so that the
+	// fault handlers can detect stack overflows. A slot whose stack has
+	// a zero size is considered to be free.
+	kernelStacks [maxKernelStacks]KernelStack
+
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	loadTSSFn             = cpu.LoadTSS
+	setTSSStackFn         = cpu.SetInterruptStack
+	setInterruptStackFn   = irq.SetInterruptStack
+	setDoubleFaultStackFn = irq.SetDoubleFaultStack
+	allocKernelStackFn    = AllocKernelStack
+
+	errTooManyStacks       = &kernel.Error{Module: "vmm", Message: "maximum number of kernel stacks reached"}
+	errInvalidKernelStack  = &kernel.Error{Module: "vmm", Message: "invalid kernel stack"}
+	errKernelStackOverflow = &kernel.Error{Module: "vmm", Message: "kernel stack overflow"}
+)
+
+// KernelStack describes a kernel stack with an unmapped guard page below its
+// lowest address. Any attempt to grow the stack past its bottom address
+// triggers a fault that is reported as a kernel stack overflow.
+type KernelStack struct {
+	region Region
+	name   string
+}
+
+// Name returns the name of the task that owns the stack.
+func (s *KernelStack) Name() string {
+	return s.name
+}
+
+// Bottom returns the lowest usable address of the stack.
+func (s *KernelStack) Bottom() uintptr {
+	return s.region.Address()
+}
+
+// Top returns the address just past the end of the stack. As the stack grows
+// downwards, this is the initial value for the stack pointer.
+func (s *KernelStack) Top() uintptr {
+	return s.region.Address() + uintptr(s.region.Size())
+}
+
+// guardPageContains returns true if addr is located inside the stack's guard
+// page.
+func (s *KernelStack) guardPageContains(addr uintptr) bool {
+	bottom := s.Bottom()
+	return s.region.Size() != 0 && addr >= bottom-uintptr(mem.PageSize) && addr < bottom
+}
+
+// AllocKernelStack allocates a kernel stack of the requested size and places
+// an unmapped guard page below it. The name argument identifies the task that
+// owns the stack and is included in stack overflow reports.
+func AllocKernelStack(name string, size mem.Size) (*KernelStack, *kernel.Error) {
+	slot := freeKernelStackSlot()
+	if slot == nil {
+		return nil, errTooManyStacks
+	}
+
+	region, err := Alloc(size, AllocGuardLow)
+	if err != nil {
+		return nil, err
+	}
+
+	slot.region, slot.name = region, name
+	return slot, nil
+}
+
+// FreeKernelStack releases a stack previously allocated via AllocKernelStack.
+func FreeKernelStack(stack *KernelStack) *kernel.Error {
+	if stack == nil || stack.region.Size() == 0 {
+		return errInvalidKernelStack
+	}
+
+	if err := Free(stack.region); err != nil {
+		return err
+	}
+
+	*stack = KernelStack{}
+	return nil
+}
+
+// ProtectBootStack converts the lowest page of the stack set up by the rt0
+// code into a guard page so that overflows of the boot stack are detected
+// instead of silently corrupting the memory below it. The stack occupies the
+// [bottom, top) range which must be page-aligned.
+func ProtectBootStack(bottom, top uintptr) *kernel.Error {
+	if bottom&uintptr(mem.PageSize-1) != 0 || top <= bottom+uintptr(mem.PageSize) {
+		return errInvalidKernelStack
+	}
+
+	slot := freeKernelStackSlot()
+	if slot == nil {
+		return errTooManyStacks
+	}
+
+	if err := unmapFn(PageFromAddress(bottom)); err != nil {
+		return err
+	}
+
+	guardSize := uintptr(mem.PageSize)
+	slot.region = Region{start: bottom + guardSize, size: mem.Size(top - bottom - guardSize), flags: AllocGuardLow}
+	slot.name = "boot"
+	return nil
+}
+
+// freeKernelStackSlot returns a pointer to an unused kernelStacks entry or
+// nil if all entries are in use.
+func freeKernelStackSlot() *KernelStack {
+	for index := 0; index < maxKernelStacks; index++ {
+		if kernelStacks[index].region.Size() == 0 {
+			return &kernelStacks[index]
+		}
+	}
+
+	return nil
+}
+
+// stackForGuardAddress returns the kernel stack whose guard page contains
+// addr or nil if addr does not belong to a guard page.
+func stackForGuardAddress(addr uintptr) *KernelStack {
+	for index := 0; index < maxKernelStacks; index++ {
+		if kernelStacks[index].guardPageContains(addr) {
+			return &kernelStacks[index]
+		}
+	}
+
+	return nil
+}
+
+// setupDoubleFaultHandler allocates a dedicated stack for the double-fault
+// handler and installs it in the TSS. When a kernel stack overflows, the CPU
+// fails to push the page fault exception frame to the overflowing stack and
+// raises a double fault instead; running the handler on a separate stack
+// allows the overflow to be reported instead of triple-faulting the CPU.
+func setupDoubleFaultHandler() *kernel.Error {
+	stack, err := allocKernelStackFn("double-fault", KernelStackSize)
+	if err != nil {
+		return err
+	}
+
+	setTSSStackFn(cpu.DoubleFaultIST, stack.Top())
+	loadTSSFn()
+
+	// The handler runs on the IST stack so the g that the rt0 code installs
+	// while it runs must use the IST stack bounds for its stack checks.
+	setDoubleFaultStackFn(stack.Bottom(), stack.Top())
+
+	handleExceptionWithCodeFn(irq.DoubleFault, doubleFaultHandler)
+	setInterruptStackFn(irq.DoubleFault, cpu.DoubleFaultIST)
+	return nil
+}
+
+func doubleFaultHandler(errorCode uint64, frame *irq.Frame, regs *irq.Regs) {
+	// A double fault caused by a stack overflow is triggered while the
+	// CPU tries to deliver a page fault for an access to the guard page.
+	// Depending on the access that overflowed the stack, either the
+	// faulting address or the stack pointer will point to the guard page.
+	if stack := stackForGuardAddress(uintptr(readCR2Fn())); stack != nil {
+		kernelStackOverflow(stack, frame, regs)
+	} else if stack = stackForGuardAddress(uintptr(frame.RSP)); stack != nil {
+		kernelStackOverflow(stack, frame, regs)
+	}
+
+	irq.PrintException(irq.DoubleFault, errorCode, frame, regs)
+
+	panic(errUnrecoverableFault)
+}
+
+func kernelStackOverflow(stack *KernelStack, frame *irq.Frame, regs *irq.Regs) {
+	kfmt.Printf("\nKernel stack overflow in task: %s\n", stack.Name())
+	kfmt.Printf("RSP = 0x%16x RIP = 0x%16x\n", frame.RSP, frame.RIP)
+	kfmt.Printf("Stack: 0x%16x - 0x%16x\n", stack.Bottom(), stack.Top())
+	kfmt.Printf("\nRegisters:\n")
+	regs.Print()
+	frame.Print()
+
+	panic(errKernelStackOverflow)
+}
@@ -0,0 +1,312 @@
+package vmm
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestAllocKernelStack(t *testing.T) {
+	defer func() {
+		mapFn = Map
+		unmapAndFreeFn = UnmapAndFree
+		memsetFn = mem.Memset
+		reserveRegionFn = ReserveRegion
+		releaseRegionFn = ReleaseRegion
+		frameAllocator = nil
+		kernelStacks = [maxKernelStacks]KernelStack{}
+	}()
+
+	var (
+		reservedAddr = uintptr(0xffffc00000100000)
+		mapCount     int
+		unmapCount   int
+	)
+
+	reserveRegionFn = func(_ mem.Size, _ uintptr) (uintptr, *kernel.Error) { return reservedAddr, nil }
+	releaseRegionFn = func(_ uintptr, _ mem.Size) *kernel.Error { return nil }
+	mapFn = func(_ Page, _ pmm.Frame, _ PageTableEntryFlag) *kernel.Error {
+		mapCount++
+		return nil
+	}
+	unmapAndFreeFn = func(_ Page) *kernel.Error {
+		unmapCount++
+		return nil
+	}
+	memsetFn = func(_ uintptr, _ byte, _ mem.Size) {}
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) { return pmm.Frame(1), nil })
+
+	stack, err := AllocKernelStack("test", KernelStackSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := "test"; stack.Name() != exp {
+		t.Errorf("expected stack name to be %q; got %q", exp, stack.Name())
+	}
+
+	if exp := reservedAddr + uintptr(mem.PageSize); stack.Bottom() != exp {
+		t.Errorf("expected stack bottom to be %x; got %x", exp, stack.Bottom())
+	}
+
+	if exp := stack.Bottom() + uintptr(KernelStackSize); stack.Top() != exp {
+		t.Errorf("expected stack top to be %x; got %x", exp, stack.Top())
+	}
+
+	if exp := int(KernelStackSize >> mem.PageShift); mapCount != exp {
+		t.Errorf("expected %d page(s) to be mapped; got %d", exp, mapCount)
+	}
+
+	if got := stackForGuardAddress(reservedAddr + 8); got != stack {
+		t.Error("expected guard page address to be associated with the allocated stack")
+	}
+
+	if got := stackForGuardAddress(stack.Bottom()); got != nil {
+		t.Error("expected stack bottom not to be treated as part of the guard page")
+	}
+
+	if err = FreeKernelStack(stack); err != nil {
+		t.Fatal(err)
+	}
+
+	if mapCount != unmapCount {
+		t.Errorf("expected %d page(s) to be unmapped; got %d", mapCount, unmapCount)
+	}
+
+	if got := stackForGuardAddress(reservedAddr + 8); got != nil {
+		t.Error("expected freed stack guard page to be untracked")
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		if err := FreeKernelStack(nil); err != errInvalidKernelStack {
+			t.Errorf("expected to get errInvalidKernelStack; got %v", err)
+		}
+
+		if err := FreeKernelStack(&KernelStack{}); err != errInvalidKernelStack {
+			t.Errorf("expected to get errInvalidKernelStack; got %v", err)
+		}
+
+		expErr := &kernel.Error{Module: "test", Message: "out of address space"}
+		reserveRegionFn = func(_ mem.Size, _ uintptr) (uintptr, *kernel.Error) { return 0, expErr }
+		if _, err := AllocKernelStack("test", KernelStackSize); err != expErr {
+			t.Errorf("expected to get error %v; got %v", expErr, err)
+		}
+
+		for index := 0; index < maxKernelStacks; index++ {
+			kernelStacks[index].region.size = mem.PageSize
+		}
+		if _, err := AllocKernelStack("test", KernelStackSize); err != errTooManyStacks {
+			t.Errorf("expected to get errTooManyStacks; got %v", err)
+		}
+	})
+}
+
+func TestProtectBootStack(t *testing.T) {
+	defer func() {
+		unmapFn = Unmap
+		kernelStacks = [maxKernelStacks]KernelStack{}
+	}()
+
+	var (
+		bottom        = uintptr(0xffff800000200000)
+		top           = bottom + uintptr(4*mem.PageSize)
+		unmappedPages []Page
+	)
+
+	unmapFn = func(page Page) *kernel.Error {
+		unmappedPages = append(unmappedPages, page)
+		return nil
+	}
+
+	if err := ProtectBootStack(bottom, top); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(unmappedPages) != 1 || unmappedPages[0] != PageFromAddress(bottom) {
+		t.Errorf("expected the lowest stack page to be unmapped; got %v", unmappedPages)
+	}
+
+	stack := stackForGuardAddress(bottom)
+	if stack == nil {
+		t.Fatal("expected the lowest stack page to be tracked as a guard page")
+	}
+
+	if exp := "boot"; stack.Name() != exp {
+		t.Errorf("expected stack name to be %q; got %q", exp, stack.Name())
+	}
+
+	if exp := bottom + uintptr(mem.PageSize); stack.Bottom() != exp || stack.Top() != top {
+		t.Errorf("expected stack range to be [%x, %x); got [%x, %x)", exp, top, stack.Bottom(), stack.Top())
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		if err := ProtectBootStack(bottom+1, top); err != errInvalidKernelStack {
+			t.Errorf("expected to get errInvalidKernelStack; got %v", err)
+		}
+
+		if err := ProtectBootStack(bottom, bottom+uintptr(mem.PageSize)); err != errInvalidKernelStack {
+			t.Errorf("expected to get errInvalidKernelStack; got %v", err)
+		}
+
+		expErr := &kernel.Error{Module: "test", Message: "unmap failed"}
+		unmapFn = func(_ Page) *kernel.Error { return expErr }
+		if err := ProtectBootStack(bottom, top); err != expErr {
+			t.Errorf("expected to get error %v; got %v", expErr, err)
+		}
+
+		for index := 0; index < maxKernelStacks; index++ {
+			kernelStacks[index].region.size = mem.PageSize
+		}
+		if err := ProtectBootStack(bottom, top); err != errTooManyStacks {
+			t.Errorf("expected to get errTooManyStacks; got %v", err)
+		}
+	})
+}
+
+func TestSetupDoubleFaultHandler(t *testing.T) {
+	defer func() {
+		allocKernelStackFn = AllocKernelStack
+		setTSSStackFn = cpu.SetInterruptStack
+		loadTSSFn = cpu.LoadTSS
+		setInterruptStackFn = irq.SetInterruptStack
+		setDoubleFaultStackFn = irq.SetDoubleFaultStack
+		handleExceptionWithCodeFn = irq.HandleExceptionWithCode
+	}()
+
+	var (
+		gStackLo     uintptr
+		gStackHi     uintptr
+		stack        = KernelStack{region: Region{start: 0xffffc00000101000, size: KernelStackSize}}
+		tssIndex     uint8
+		tssStackTop  uintptr
+		tssLoaded    bool
+		handledNum   irq.ExceptionNum
+		idtException irq.ExceptionNum
+		idtIST       uint8
+	)
+
+	allocKernelStackFn = func(_ string, _ mem.Size) (*KernelStack, *kernel.Error) { return &stack, nil }
+	setTSSStackFn = func(index uint8, stackTop uintptr) { tssIndex, tssStackTop = index, stackTop }
+	loadTSSFn = func() { tssLoaded = true }
+	handleExceptionWithCodeFn = func(num irq.ExceptionNum, _ irq.ExceptionHandlerWithCode) { handledNum = num }
+	setInterruptStackFn = func(num irq.ExceptionNum, ist uint8) { idtException, idtIST = num, ist }
+	setDoubleFaultStackFn = func(bottom, top uintptr) { gStackLo, gStackHi = bottom, top }
+
+	if err := setupDoubleFaultHandler(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The handler starts running at the IST stack top and may use the whole
+	// stack; both must be within the stack bounds of the handler's g.
+	if tssStackTop <= gStackLo || tssStackTop > gStackHi || stack.Bottom() < gStackLo {
+		t.Errorf("expected IST stack [%x, %x) to lie within the double-fault g stack bounds [%x, %x)", stack.Bottom(), tssStackTop, gStackLo, gStackHi)
+	}
+
+	if tssIndex != cpu.DoubleFaultIST || tssStackTop != stack.Top() {
+		t.Errorf("expected IST entry %d to point to %x; got entry %d pointing to %x", cpu.DoubleFaultIST, stack.Top(), tssIndex, tssStackTop)
+	}
+
+	if !tssLoaded {
+		t.Error("expected TSS to be loaded")
+	}
+
+	if handledNum != irq.DoubleFault || idtException != irq.DoubleFault || idtIST != cpu.DoubleFaultIST {
+		t.Error("expected double-fault handler to be installed using the double-fault IST entry")
+	}
+
+	t.Run("stack allocation fails", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+		allocKernelStackFn = func(_ string, _ mem.Size) (*KernelStack, *kernel.Error) { return nil, expErr }
+
+		if err := setupDoubleFaultHandler(); err != expErr {
+			t.Fatalf("expected to get error %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestStackOverflowDetection(t *testing.T) {
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+		readCR2Fn = cpu.ReadCR2
+		kfmt.SetOutputSink(nil)
+		kernelStacks = [maxKernelStacks]KernelStack{}
+	}(ptePtrFn)
+
+	var (
+		buf       bytes.Buffer
+		regs      irq.Regs
+		pageEntry pageTableEntry
+		guardAddr = uintptr(0xffffc00000100000)
+		faultAddr uintptr
+	)
+
+	kernelStacks[1] = KernelStack{
+		region: Region{start: guardAddr + uintptr(mem.PageSize), size: KernelStackSize, flags: AllocGuardLow},
+		name:   "worker",
+	}
+
+	ptePtrFn = func(_ uintptr) unsafe.Pointer { return unsafe.Pointer(&pageEntry) }
+	readCR2Fn = func() uint64 { return uint64(faultAddr) }
+
+	specs := []struct {
+		descr     string
+		handler   func(*irq.Frame)
+		faultAddr uintptr
+		rsp       uintptr
+		expErr    *kernel.Error
+	}{
+		{
+			"page fault inside guard page",
+			func(frame *irq.Frame) { pageFaultHandler(2, frame, &regs) },
+			guardAddr + 8, guardAddr + uintptr(mem.PageSize) + 16,
+			errKernelStackOverflow,
+		},
+		{
+			"double fault with CR2 inside guard page",
+			func(frame *irq.Frame) { doubleFaultHandler(0, frame, &regs) },
+			guardAddr + 8, guardAddr + 16,
+			errKernelStackOverflow,
+		},
+		{
+			"double fault with RSP inside guard page",
+			func(frame *irq.Frame) { doubleFaultHandler(0, frame, &regs) },
+			0xbadf00d000, guardAddr + 16,
+			errKernelStackOverflow,
+		},
+		{
+			"unrelated double fault",
+			func(frame *irq.Frame) { doubleFaultHandler(0, frame, &regs) },
+			0xbadf00d000, 0xbadf00d000,
+			errUnrecoverableFault,
+		},
+	}
+
+	kfmt.SetOutputSink(&buf)
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			buf.Reset()
+			faultAddr = spec.faultAddr
+			frame := irq.Frame{RIP: 0xc0ffee, RSP: uint64(spec.rsp)}
+
+			defer func() {
+				if err := recover(); err != spec.expErr {
+					t.Errorf("expected a panic with %v; got %v", spec.expErr, err)
+				}
+
+				expMsg := "Kernel stack overflow in task: worker"
+				if got := buf.String(); strings.Contains(got, expMsg) != (spec.expErr == errKernelStackOverflow) {
+					t.Errorf("unexpected handler output:\n%s", got)
+				}
+			}()
+
+			spec.handler(&frame)
+		})
+	}
+}
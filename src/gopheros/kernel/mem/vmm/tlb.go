@@ -0,0 +1,145 @@
+package vmm
+
+import (
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mem/pmm"
+)
+
+const (
+	// maxPCIDs defines the number of process-context identifiers that are
+	// assigned to page directory tables. PCID 0 is used by the PDT set up
+	// by the rt0 code so PDTs are assigned PCIDs in the range
+	// [1, maxPCIDs).
+	maxPCIDs = 64
+
+	// flushTLBRangeThreshold defines the maximum number of pages that
+	// flushTLBRange will flush individually. Larger ranges trigger a full
+	// TLB flush which is cheaper than invalidating each page.
+	flushTLBRangeThreshold = 32
+)
+
+// pcidOwner tracks the PDT whose TLB entries may be tagged with a PCID.
+type pcidOwner struct {
+	pdtFrame pmm.Frame
+	valid    bool
+
+	// kernelTLBGen holds the value of kernelTLBGen when the PCID was
+	// last flushed.
+	kernelTLBGen uint64
+}
+
+var (
+	// pcidEnabled is set to true if the CPU supports PCIDs and the
+	// feature has been enabled by Init.
+	pcidEnabled bool
+
+	// globalPagesEnabled is set to true if the CPU supports global pages
+	// and the feature has been enabled by Init. While enabled, kernel
+	// mappings are flagged as global so their TLB entries survive PDT
+	// switches.
+	globalPagesEnabled bool
+
+	// nextPCID holds the last PCID assigned by allocPCID.
+	nextPCID uint16
+
+	// pcidOwners tracks the PDT that was last activated with each PCID.
+	// Activating a PDT preserves the TLB entries tagged with its PCID
+	// only if it is still the valid owner of the PCID.
+	pcidOwners [maxPCIDs]pcidOwner
+
+	// kernelTLBGen is incremented whenever a kernel mapping is modified.
+	// Flushing the TLB entry for a page only affects the entries tagged
+	// with the current PCID so the entries tagged with any other PCID may
+	// still refer to the old kernel mapping. Activating a PDT preserves
+	// its TLB entries only if no kernel mappings have been modified since
+	// its PCID was last flushed.
+	kernelTLBGen uint64
+
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	hasPGEFn         = cpu.HasPGE
+	hasPCIDFn        = cpu.HasPCID
+	flushTLBFn       = cpu.FlushTLB
+	flushGlobalTLBFn = cpu.FlushTLBGlobal
+	invlpgFn         = cpu.FlushTLBEntry
+)
+
+// enableTLBFeatures enables support for global pages and PCIDs if they are
+// supported by the CPU. It must be called while the lower 12 bits of the
+// CR3 register are cleared.
+func enableTLBFeatures() {
+	cr4 := readCR4Fn()
+
+	if hasPGEFn() {
+		cr4 |= cpu.CR4PGE
+		globalPagesEnabled = true
+	}
+
+	if hasPCIDFn() {
+		cr4 |= cpu.CR4PCIDE
+		pcidEnabled = true
+	}
+
+	writeCR4Fn(cr4)
+}
+
+// allocPCID returns the next PCID that can be assigned to a PDT. Once all
+// PCIDs have been assigned, allocPCID wraps around and starts reusing them.
+// Reusing a PCID is safe as the TLB entries for a PCID are flushed whenever
+// it gets activated by a different PDT.
+func allocPCID() uint16 {
+	nextPCID = nextPCID%(maxPCIDs-1) + 1
+	return nextPCID
+}
+
+// globalFlag returns FlagGlobal if global pages are enabled and page belongs
+// to the kernel half of the address space.
+func globalFlag(page Page) PageTableEntryFlag {
+	if globalPagesEnabled && isKernelAddress(page.Address()) {
+		return FlagGlobal
+	}
+
+	return 0
+}
+
+// flushTLBEntry flushes the TLB entry for the page that contains virtAddr. If
+// virtAddr belongs to the kernel half of the address space, the TLB entries
+// tagged with the PCIDs of all other PDTs are also invalidated.
+func flushTLBEntry(virtAddr uintptr) {
+	invlpgFn(virtAddr)
+
+	if isKernelAddress(virtAddr) {
+		invalidateKernelTLB()
+	}
+}
+
+// invalidateKernelTLB ensures that the TLB entries tagged with any PCID are
+// flushed the next time the PDT that owns the PCID gets activated. It must be
+// invoked whenever a kernel mapping is modified.
+func invalidateKernelTLB() {
+	kernelTLBGen++
+}
+
+// flushTLBRange flushes the TLB entries for count consecutive pages starting
+// at page. If count exceeds flushTLBRangeThreshold, the entire TLB is flushed
+// instead.
+func flushTLBRange(page Page, count int) {
+	if isKernelAddress(page.Address()) {
+		invalidateKernelTLB()
+	}
+
+	if count <= flushTLBRangeThreshold {
+		for ; count > 0; count, page = count-1, page+1 {
+			flushTLBEntryFn(page.Address())
+		}
+		return
+	}
+
+	// The TLB entries for global pages survive CR3 reloads
+	if globalPagesEnabled && isKernelAddress(page.Address()) {
+		flushGlobalTLBFn()
+		return
+	}
+
+	flushTLBFn()
+}
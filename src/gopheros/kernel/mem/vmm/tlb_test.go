@@ -0,0 +1,180 @@
+package vmm
+
+import (
+	"gopheros/kernel/cpu"
+	"testing"
+)
+
+func TestEnableTLBFeatures(t *testing.T) {
+	defer func() {
+		readCR4Fn = cpu.ReadCR4
+		writeCR4Fn = cpu.WriteCR4
+		hasPGEFn = cpu.HasPGE
+		hasPCIDFn = cpu.HasPCID
+		globalPagesEnabled = false
+		pcidEnabled = false
+	}()
+
+	specs := []struct {
+		hasPGE, hasPCID bool
+		expCR4          uint64
+	}{
+		{false, false, 0},
+		{true, false, cpu.CR4PGE},
+		{false, true, cpu.CR4PCIDE},
+		{true, true, cpu.CR4PGE | cpu.CR4PCIDE},
+	}
+
+	for specIndex, spec := range specs {
+		var cr4 uint64
+		globalPagesEnabled, pcidEnabled = false, false
+		readCR4Fn = func() uint64 { return 0 }
+		writeCR4Fn = func(val uint64) { cr4 = val }
+		hasPGEFn = func() bool { return spec.hasPGE }
+		hasPCIDFn = func() bool { return spec.hasPCID }
+
+		enableTLBFeatures()
+
+		if cr4 != spec.expCR4 {
+			t.Errorf("[spec %d] expected CR4 to be set to %x; got %x", specIndex, spec.expCR4, cr4)
+		}
+
+		if globalPagesEnabled != spec.hasPGE {
+			t.Errorf("[spec %d] expected globalPagesEnabled to be %t", specIndex, spec.hasPGE)
+		}
+
+		if pcidEnabled != spec.hasPCID {
+			t.Errorf("[spec %d] expected pcidEnabled to be %t", specIndex, spec.hasPCID)
+		}
+	}
+}
+
+func TestAllocPCID(t *testing.T) {
+	defer func() {
+		nextPCID = 0
+	}()
+
+	nextPCID = 0
+	for exp := uint16(1); exp < maxPCIDs; exp++ {
+		if got := allocPCID(); got != exp {
+			t.Fatalf("expected to get PCID %d; got %d", exp, got)
+		}
+	}
+
+	// PCID 0 is reserved for the PDT set up by the rt0 code
+	if got := allocPCID(); got != 1 {
+		t.Fatalf("expected PCID allocation to wrap around to PCID 1; got %d", got)
+	}
+}
+
+func TestGlobalFlag(t *testing.T) {
+	defer func() {
+		globalPagesEnabled = false
+	}()
+
+	specs := []struct {
+		enabled bool
+		addr    uintptr
+		exp     PageTableEntryFlag
+	}{
+		{false, 0xffff800000000000, 0},
+		{true, 0x400000, 0},
+		{true, 0xffff800000000000, FlagGlobal},
+	}
+
+	for specIndex, spec := range specs {
+		globalPagesEnabled = spec.enabled
+		if got := globalFlag(PageFromAddress(spec.addr)); got != spec.exp {
+			t.Errorf("[spec %d] expected to get flag %x; got %x", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestFlushTLBRange(t *testing.T) {
+	defer func(origFlushTLBEntryFn func(uintptr)) {
+		flushTLBEntryFn = origFlushTLBEntryFn
+		flushTLBFn = cpu.FlushTLB
+		flushGlobalTLBFn = cpu.FlushTLBGlobal
+		globalPagesEnabled = false
+	}(flushTLBEntryFn)
+
+	var (
+		entryFlushes, fullFlushes, globalFlushes int
+	)
+
+	flushTLBEntryFn = func(_ uintptr) { entryFlushes++ }
+	flushTLBFn = func() { fullFlushes++ }
+	flushGlobalTLBFn = func() { globalFlushes++ }
+
+	specs := []struct {
+		globalPages      bool
+		addr             uintptr
+		count            int
+		expEntryFlushes  int
+		expFullFlushes   int
+		expGlobalFlushes int
+	}{
+		{false, 0x400000, 0, 0, 0, 0},
+		{false, 0x400000, flushTLBRangeThreshold, flushTLBRangeThreshold, 0, 0},
+		{false, 0x400000, flushTLBRangeThreshold + 1, 0, 1, 0},
+		{true, 0x400000, flushTLBRangeThreshold + 1, 0, 1, 0},
+		{false, 0xffff800000000000, flushTLBRangeThreshold + 1, 0, 1, 0},
+		{true, 0xffff800000000000, flushTLBRangeThreshold + 1, 0, 0, 1},
+	}
+
+	for specIndex, spec := range specs {
+		entryFlushes, fullFlushes, globalFlushes = 0, 0, 0
+		globalPagesEnabled = spec.globalPages
+		origGen := kernelTLBGen
+
+		flushTLBRange(PageFromAddress(spec.addr), spec.count)
+
+		// Flushing kernel pages must also invalidate the TLB entries
+		// tagged with the PCIDs of inactive PDTs
+		if exp := isKernelAddress(spec.addr); (kernelTLBGen != origGen) != exp {
+			t.Errorf("[spec %d] expected kernel TLB invalidation to be %t", specIndex, exp)
+		}
+
+		if entryFlushes != spec.expEntryFlushes || fullFlushes != spec.expFullFlushes || globalFlushes != spec.expGlobalFlushes {
+			t.Errorf(
+				"[spec %d] expected entry/full/global flushes to be %d/%d/%d; got %d/%d/%d",
+				specIndex,
+				spec.expEntryFlushes, spec.expFullFlushes, spec.expGlobalFlushes,
+				entryFlushes, fullFlushes, globalFlushes,
+			)
+		}
+	}
+}
+
+func TestFlushTLBEntry(t *testing.T) {
+	defer func() {
+		invlpgFn = cpu.FlushTLBEntry
+	}()
+
+	var flushed []uintptr
+	invlpgFn = func(addr uintptr) { flushed = append(flushed, addr) }
+
+	specs := []struct {
+		addr          uintptr
+		expInvalidate bool
+	}{
+		{0x400000, false},
+		{0xffff800000000000, true},
+		{pdtVirtualAddr, true},
+	}
+
+	for specIndex, spec := range specs {
+		flushed = flushed[:0]
+		origGen := kernelTLBGen
+
+		flushTLBEntry(spec.addr)
+
+		if len(flushed) != 1 || flushed[0] != spec.addr {
+			t.Errorf("[spec %d] expected TLB entry for %x to be flushed; got %x", specIndex, spec.addr, flushed)
+		}
+
+		if invalidated := kernelTLBGen != origGen; invalidated != spec.expInvalidate {
+			t.Errorf("[spec %d] expected kernel TLB invalidation to be %t; got %t", specIndex, spec.expInvalidate, invalidated)
+		}
+	}
+}
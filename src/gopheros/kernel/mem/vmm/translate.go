@@ -4,16 +4,37 @@ import "gopheros/kernel"
 
 // Translate returns the physical address that corresponds to the supplied
 // virtual address or ErrInvalidMapping if the virtual address does not
-// correspond to a mapped physical address.
+// correspond to a mapped physical address. Translate supports virtual
+// addresses that are mapped using huge pages.
 func Translate(virtAddr uintptr) (uintptr, *kernel.Error) {
-	pte, err := pteForAddress(virtAddr)
+	var (
+		physAddr uintptr
+		err      *kernel.Error
+	)
+
+	walk(virtAddr, func(pteLevel uint8, pte *pageTableEntry) bool {
+		if !pte.HasFlags(FlagPresent) {
+			err = ErrInvalidMapping
+			return false
+		}
+
+		// Keep walking until we reach the last page level or an entry
+		// that maps a huge page.
+		if pteLevel < pageLevels-1 && (pteLevel == 0 || !pte.HasFlags(FlagHugePage)) {
+			return true
+		}
+
+		// Calculate the physical address by taking the physical frame
+		// address and appending the offset from the virtual address
+		offsetMask := (uintptr(1) << pageLevelShifts[pteLevel]) - 1
+		physAddr = (uintptr(*pte) & ptePhysPageMask &^ offsetMask) + (virtAddr & offsetMask)
+		return false
+	})
+
 	if err != nil {
 		return 0, err
 	}
 
-	// Calculate the physical address by taking the physical frame address and
-	// appending the offset from the virtual address
-	physAddr := pte.Frame().Address() + PageOffset(virtAddr)
 	return physAddr, nil
 }
 
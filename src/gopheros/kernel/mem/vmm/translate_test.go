@@ -1,6 +1,7 @@
 package vmm
 
 import (
+	"gopheros/kernel/mem"
 	"gopheros/kernel/mem/pmm"
 	"runtime"
 	"testing"
@@ -61,3 +62,55 @@ func TestTranslateAmd64(t *testing.T) {
 		}
 	}
 }
+
+func TestTranslateHugePageAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+	}(ptePtrFn)
+
+	specs := []struct {
+		hugeLevel int
+		pageSize  mem.Size
+	}{
+		{2, HugePageSize2M},
+		{1, HugePageSize1G},
+	}
+
+	for specIndex, spec := range specs {
+		var (
+			// the virtual address just contains the page offset
+			virtAddr     = uintptr(spec.pageSize) - 1234
+			hugeFrame    = pmm.Frame(uintptr(8*spec.pageSize) >> mem.PageShift)
+			expPhysAddr  = hugeFrame.Address() + virtAddr
+			pteCallCount int
+		)
+
+		ptePtrFn = func(entry uintptr) unsafe.Pointer {
+			var pte pageTableEntry
+			pte.SetFlags(FlagPresent)
+			if pteCallCount == spec.hugeLevel {
+				pte.SetFlags(FlagHugePage)
+				pte.SetFrame(hugeFrame)
+			} else if pteCallCount > spec.hugeLevel {
+				t.Fatalf("[spec %d] unexpected walk past the huge page entry", specIndex)
+			}
+			pteCallCount++
+
+			return unsafe.Pointer(&pte)
+		}
+
+		physAddr, err := Translate(virtAddr)
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error %v", specIndex, err)
+			continue
+		}
+
+		if physAddr != expPhysAddr {
+			t.Errorf("[spec %d] expected phys addr to be 0x%x; got 0x%x", specIndex, expPhysAddr, physAddr)
+		}
+	}
+}
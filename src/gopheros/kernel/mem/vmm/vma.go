@@ -0,0 +1,499 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+)
+
+// VMAFlag describes the access permissions for the pages of a virtual memory
+// area.
+type VMAFlag uint8
+
+const (
+	// VMARead allows the pages of the area to be read.
+	VMARead VMAFlag = 1 << iota
+
+	// VMAWrite allows the pages of the area to be written to.
+	VMAWrite
+
+	// VMAExec allows code to be executed from the pages of the area.
+	VMAExec
+
+	// VMAUser allows user-mode code to access the pages of the area.
+	VMAUser
+)
+
+// VMAKind describes how the pages of a virtual memory area are backed.
+type VMAKind uint8
+
+const (
+	// VMAAnonymous areas are backed by zero-filled frames that are
+	// allocated the first time each page is written to.
+	VMAAnonymous VMAKind = iota
+
+	// VMAPhysical areas map a fixed physical memory region (e.g. device
+	// memory). The frames backing the area are never released.
+	VMAPhysical
+
+	// VMAFile areas are backed by private copies of the contents of a
+	// file that are loaded the first time each page is accessed.
+	VMAFile
+)
+
+// String implements fmt.Stringer for VMAKind.
+func (k VMAKind) String() string {
+	switch k {
+	case VMAAnonymous:
+		return "anonymous"
+	case VMAPhysical:
+		return "physical"
+	case VMAFile:
+		return "file"
+	default:
+		return "unknown"
+	}
+}
+
+// FileBacking is implemented by objects that can provide the contents of
+// file-backed virtual memory areas.
+type FileBacking interface {
+	// ReadPage fills the page at dstAddr with mem.PageSize bytes of data
+	// starting at the specified file offset. Any bytes past the end of
+	// the file must be cleared.
+	ReadPage(offset uintptr, dstAddr uintptr) *kernel.Error
+}
+
+const (
+	// maxVMAs defines the maximum number of virtual memory areas that can
+	// be tracked by an AddressSpace.
+	maxVMAs = 64
+
+	// The following bits of the page fault error code are used for
+	// resolving faults in VMAs and for reporting unrecoverable faults.
+	pfErrPresent     = 1 << 0
+	pfErrWrite       = 1 << 1
+	pfErrUser        = 1 << 2
+	pfErrReserved    = 1 << 3
+	pfErrFetch       = 1 << 4
+	pfErrProtKey     = 1 << 5
+	pfErrShadowStack = 1 << 6
+)
+
+var (
+	// activeAddressSpace points to the address space that was activated
+	// via the last call to AddressSpace.Activate. Page faults for
+	// addresses in its VMAs are resolved using the VMA information.
+	activeAddressSpace *AddressSpace
+
+	errVMAInvalidRange    = &kernel.Error{Module: "vmm", Message: "virtual memory area range must be page-aligned and non-empty"}
+	errVMAOverlap         = &kernel.Error{Module: "vmm", Message: "virtual memory area overlaps with an existing area"}
+	errVMANotMapped       = &kernel.Error{Module: "vmm", Message: "range is not fully covered by virtual memory areas"}
+	errTooManyVMAs        = &kernel.Error{Module: "vmm", Message: "maximum number of virtual memory areas reached"}
+	errVMAAccessViolation = &kernel.Error{Module: "vmm", Message: "access violates virtual memory area permissions"}
+)
+
+// VMA describes a contiguous, page-aligned range of virtual addresses that
+// share the same permissions and backing.
+type VMA struct {
+	start, end uintptr
+	flags      VMAFlag
+	kind       VMAKind
+
+	// offset holds the physical address of the first page for VMAPhysical
+	// areas or the file offset of the first page for VMAFile areas.
+	offset uintptr
+	file   FileBacking
+}
+
+// Start returns the address of the first byte in the area.
+func (v *VMA) Start() uintptr { return v.start }
+
+// End returns the address just past the last byte in the area.
+func (v *VMA) End() uintptr { return v.end }
+
+// Flags returns the access permissions for the area.
+func (v *VMA) Flags() VMAFlag { return v.flags }
+
+// Kind returns the backing kind for the area.
+func (v *VMA) Kind() VMAKind { return v.kind }
+
+// pageFlags returns the page table entry flags for mapping the area pages.
+func (v *VMA) pageFlags() PageTableEntryFlag {
+	flags := FlagPresent
+	if v.flags&VMAWrite != 0 {
+		flags |= FlagRW
+	}
+	if v.flags&VMAExec == 0 {
+		flags |= FlagNoExecute
+	}
+	if v.flags&VMAUser != 0 {
+		flags |= FlagUserAccessible
+	}
+
+	return flags
+}
+
+// backingOffset returns the offset into the area backing that corresponds to
+// the specified address.
+func (v *VMA) backingOffset(addr uintptr) uintptr {
+	return v.offset + (addr - v.start)
+}
+
+// AddressSpace combines a page directory table with the ordered list of
+// virtual memory areas (VMAs) that describe which address ranges are mapped,
+// with what permissions and how their contents are backed.
+//
+// Mapping a range via one of the Map methods only records a VMA; the pages of
+// the area are populated on demand by the page fault handler when the address
+// space is active.
+type AddressSpace struct {
+	pdt PageDirectoryTable
+
+	vmas     [maxVMAs]VMA
+	vmaCount int
+}
+
+// Init associates the address space with a page directory table and clears
+// its VMA list.
+func (as *AddressSpace) Init(pdt PageDirectoryTable) {
+	as.pdt = pdt
+	as.vmaCount = 0
+}
+
+// PDT returns the page directory table for the address space.
+func (as *AddressSpace) PDT() PageDirectoryTable {
+	return as.pdt
+}
+
+// Activate switches to the address space page directory table and enables
+// VMA-driven page fault resolution for it.
+func (as *AddressSpace) Activate() {
+	as.pdt.Activate()
+	activeAddressSpace = as
+}
+
+// VMACount returns the number of VMAs in the address space.
+func (as *AddressSpace) VMACount() int {
+	return as.vmaCount
+}
+
+// VMA returns the VMA at the specified index. VMAs are ordered by their start
+// address.
+func (as *AddressSpace) VMA(index int) VMA {
+	return as.vmas[index]
+}
+
+// FindVMA returns the VMA that contains addr.
+func (as *AddressSpace) FindVMA(addr uintptr) (VMA, bool) {
+	if vma := as.vmaFor(addr); vma != nil {
+		return *vma, true
+	}
+
+	return VMA{}, false
+}
+
+// MapAnonymous adds a VMA for the [start, start+size) range that is backed by
+// zero-filled frames.
+func (as *AddressSpace) MapAnonymous(start uintptr, size mem.Size, flags VMAFlag) *kernel.Error {
+	return as.insertVMA(VMA{start: start, end: start + uintptr(size), flags: flags, kind: VMAAnonymous})
+}
+
+// MapPhysical adds a VMA for the [start, start+size) range that maps the
+// contiguous physical memory region starting at frame.
+func (as *AddressSpace) MapPhysical(start uintptr, frame pmm.Frame, size mem.Size, flags VMAFlag) *kernel.Error {
+	return as.insertVMA(VMA{start: start, end: start + uintptr(size), flags: flags, kind: VMAPhysical, offset: frame.Address()})
+}
+
+// MapFile adds a VMA for the [start, start+size) range that is backed by a
+// private copy of the file contents starting at the page-aligned offset.
+func (as *AddressSpace) MapFile(start uintptr, size mem.Size, file FileBacking, offset uintptr, flags VMAFlag) *kernel.Error {
+	if offset&uintptr(mem.PageSize-1) != 0 {
+		return errVMAInvalidRange
+	}
+
+	return as.insertVMA(VMA{start: start, end: start + uintptr(size), flags: flags, kind: VMAFile, offset: offset, file: file})
+}
+
+// Unmap removes the [start, start+size) range from the address space. VMAs
+// that partially overlap with the range are split. Any pages that have been
+// populated in the range are unmapped and, unless they belong to a
+// VMAPhysical area, their frames are released.
+func (as *AddressSpace) Unmap(start uintptr, size mem.Size) *kernel.Error {
+	end := start + uintptr(size)
+	if err := as.splitRange(start, end); err != nil {
+		return err
+	}
+
+	first, last := as.vmaIndexRange(start, end)
+	err := as.pdt.withTables(func() *kernel.Error {
+		for index := first; index < last; index++ {
+			vma := &as.vmas[index]
+			for page := PageFromAddress(vma.start); page < PageFromAddress(vma.end); page++ {
+				if err := unmapVMAPage(vma, page); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	copy(as.vmas[first:], as.vmas[last:as.vmaCount])
+	as.vmaCount -= last - first
+	return nil
+}
+
+// Protect updates the access permissions for the [start, start+size) range
+// which must be fully covered by VMAs. VMAs that partially overlap with the
+// range are split. The page table entries of any pages that have been
+// populated in the range are updated to reflect the new permissions.
+func (as *AddressSpace) Protect(start uintptr, size mem.Size, flags VMAFlag) *kernel.Error {
+	end := start + uintptr(size)
+	if err := validateVMARange(start, end); err != nil {
+		return err
+	}
+
+	// Ensure that there are no holes in the range
+	for addr := start; addr < end; {
+		vma := as.vmaFor(addr)
+		if vma == nil {
+			return errVMANotMapped
+		}
+		addr = vma.end
+	}
+
+	if err := as.splitRange(start, end); err != nil {
+		return err
+	}
+
+	first, last := as.vmaIndexRange(start, end)
+	return as.pdt.withTables(func() *kernel.Error {
+		for index := first; index < last; index++ {
+			vma := &as.vmas[index]
+			vma.flags = flags
+			for page := PageFromAddress(vma.start); page < PageFromAddress(vma.end); page++ {
+				updatePageFlags(page, vma.pageFlags())
+			}
+		}
+		return nil
+	})
+}
+
+// handleFault attempts to resolve a page fault at faultAddress using the VMA
+// information for the address space. It returns false if the fault should be
+// handled by the default page fault handling logic; this is the case for
+// addresses outside any VMA and for faults on present pages (e.g.
+// copy-on-write faults) that are permitted by the VMA flags.
+func (as *AddressSpace) handleFault(faultAddress uintptr, errorCode uint64) (bool, *kernel.Error) {
+	vma := as.vmaFor(faultAddress)
+	if vma == nil {
+		return false, nil
+	}
+
+	if (errorCode&pfErrWrite != 0 && vma.flags&VMAWrite == 0) ||
+		(errorCode&pfErrFetch != 0 && vma.flags&VMAExec == 0) ||
+		(errorCode&pfErrUser != 0 && vma.flags&VMAUser == 0) {
+		return true, errVMAAccessViolation
+	}
+
+	if errorCode&pfErrPresent != 0 {
+		return false, nil
+	}
+
+	return true, populateVMAPage(vma, PageFromAddress(faultAddress), errorCode&pfErrWrite != 0)
+}
+
+// insertVMA adds vma to the ordered VMA list.
+func (as *AddressSpace) insertVMA(vma VMA) *kernel.Error {
+	if err := validateVMARange(vma.start, vma.end); err != nil {
+		return err
+	}
+
+	index := 0
+	for ; index < as.vmaCount && as.vmas[index].start < vma.end; index++ {
+		if as.vmas[index].end > vma.start {
+			return errVMAOverlap
+		}
+	}
+
+	return as.insertVMAAt(index, vma)
+}
+
+// insertVMAAt inserts vma at the specified index of the VMA list.
+func (as *AddressSpace) insertVMAAt(index int, vma VMA) *kernel.Error {
+	if as.vmaCount == maxVMAs {
+		return errTooManyVMAs
+	}
+
+	copy(as.vmas[index+1:as.vmaCount+1], as.vmas[index:as.vmaCount])
+	as.vmas[index] = vma
+	as.vmaCount++
+	return nil
+}
+
+// vmaFor returns the VMA that contains addr or nil if no VMA contains it.
+func (as *AddressSpace) vmaFor(addr uintptr) *VMA {
+	for index := 0; index < as.vmaCount; index++ {
+		if addr >= as.vmas[index].start && addr < as.vmas[index].end {
+			return &as.vmas[index]
+		}
+	}
+
+	return nil
+}
+
+// vmaIndexRange returns the [first, last) range of indices for the VMAs that
+// are fully contained in the [start, end) range.
+func (as *AddressSpace) vmaIndexRange(start, end uintptr) (int, int) {
+	first := 0
+	for ; first < as.vmaCount && as.vmas[first].start < start; first++ {
+	}
+
+	last := first
+	for ; last < as.vmaCount && as.vmas[last].end <= end; last++ {
+	}
+
+	return first, last
+}
+
+// splitRange validates the [start, end) range and splits any VMAs that cross
+// its boundaries so that each VMA is either fully inside or fully outside
+// the range.
+func (as *AddressSpace) splitRange(start, end uintptr) *kernel.Error {
+	if err := validateVMARange(start, end); err != nil {
+		return err
+	}
+
+	if err := as.splitAt(start); err != nil {
+		return err
+	}
+
+	return as.splitAt(end)
+}
+
+// splitAt splits the VMA that contains addr (if any) into two VMAs so that
+// addr becomes the start address of the second VMA.
+func (as *AddressSpace) splitAt(addr uintptr) *kernel.Error {
+	for index := 0; index < as.vmaCount; index++ {
+		vma := as.vmas[index]
+		if addr <= vma.start || addr >= vma.end {
+			continue
+		}
+
+		upper := vma
+		upper.start = addr
+		if vma.kind != VMAAnonymous {
+			upper.offset = vma.backingOffset(addr)
+		}
+		if err := as.insertVMAAt(index+1, upper); err != nil {
+			return err
+		}
+
+		as.vmas[index].end = addr
+		return nil
+	}
+
+	return nil
+}
+
+// validateVMARange checks that [start, end) is a non-empty page-aligned range.
+func validateVMARange(start, end uintptr) *kernel.Error {
+	if end <= start || (start|end)&uintptr(mem.PageSize-1) != 0 {
+		return errVMAInvalidRange
+	}
+
+	return nil
+}
+
+// populateVMAPage establishes a mapping for a page of the VMA in response to
+// a page fault. The VMA address space must be active.
+func populateVMAPage(vma *VMA, page Page, isWrite bool) *kernel.Error {
+	flags := vma.pageFlags()
+
+	switch vma.kind {
+	case VMAPhysical:
+		return mapFn(page, pmm.Frame(vma.backingOffset(page.Address())>>mem.PageShift), flags)
+	case VMAAnonymous:
+		// Read accesses are served by the shared zeroed frame; a copy
+		// is made the first time the page is written to. The CoW flag
+		// is set even for read-only VMAs so that the shared frame never
+		// becomes writable if the VMA permissions are changed later on.
+		if !isWrite {
+			return mapFn(page, ReservedZeroedFrame, (flags&^FlagRW)|FlagCopyOnWrite)
+		}
+	}
+
+	frame, err := frameAllocator()
+	if err != nil {
+		return err
+	}
+
+	// Prepare the frame contents via a temporary mapping before making it
+	// visible at the faulting address.
+	tmpPage, err := mapTemporaryFn(frame)
+	if err == nil {
+		if vma.kind == VMAFile {
+			err = vma.file.ReadPage(vma.backingOffset(page.Address()), tmpPage.Address())
+		} else {
+			memsetFn(tmpPage.Address(), 0, mem.PageSize)
+		}
+		_ = unmapFn(tmpPage)
+	}
+
+	if err == nil {
+		err = mapFn(page, frame, flags)
+	}
+
+	if err != nil && frameFreer != nil {
+		_ = frameFreer(frame)
+	}
+
+	return err
+}
+
+// unmapVMAPage removes the mapping for a page of the VMA if the page has been
+// populated.
+func unmapVMAPage(vma *VMA, page Page) *kernel.Error {
+	var err *kernel.Error
+	if vma.kind == VMAPhysical {
+		err = unmapFn(page)
+	} else {
+		err = unmapAndFreeFn(page)
+	}
+
+	// Pages that were never accessed have no mapping
+	if err == ErrInvalidMapping {
+		return nil
+	}
+
+	return err
+}
+
+// updatePageFlags replaces the flags of a present page with the supplied
+// flags. Copy-on-write pages and pages backed by ReservedZeroedFrame remain
+// read-only until they are written to.
+func updatePageFlags(page Page, flags PageTableEntryFlag) {
+	walk(page.Address(), func(pteLevel uint8, pte *pageTableEntry) bool {
+		if !pte.HasFlags(FlagPresent) {
+			return false
+		}
+
+		if pteLevel == pageLevels-1 {
+			if pte.HasFlags(FlagCopyOnWrite) || (protectReservedZeroedPage && pte.Frame() == ReservedZeroedFrame) {
+				flags = (flags &^ FlagRW) | FlagCopyOnWrite
+			}
+
+			frame := pte.Frame()
+			*pte = 0
+			pte.SetFrame(frame)
+			pte.SetFlags(flags)
+			flushTLBEntryFn(page.Address())
+		}
+
+		return true
+	})
+}
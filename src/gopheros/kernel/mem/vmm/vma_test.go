@@ -0,0 +1,564 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"testing"
+	"unsafe"
+)
+
+type testFileBacking struct {
+	offsets []uintptr
+	err     *kernel.Error
+}
+
+func (f *testFileBacking) ReadPage(offset uintptr, _ uintptr) *kernel.Error {
+	f.offsets = append(f.offsets, offset)
+	return f.err
+}
+
+// newTestAddressSpace returns an address space whose PDT is reported as the
+// active one so that no temporary PDT mappings need to be established.
+func newTestAddressSpace() *AddressSpace {
+	var as AddressSpace
+	as.Init(PageDirectoryTable{pdtFrame: pmm.Frame(123)})
+	activePDTFn = func() uintptr { return pmm.Frame(123).Address() }
+	return &as
+}
+
+func TestVMAKindString(t *testing.T) {
+	specs := []struct {
+		kind VMAKind
+		exp  string
+	}{
+		{VMAAnonymous, "anonymous"},
+		{VMAPhysical, "physical"},
+		{VMAFile, "file"},
+		{VMAKind(42), "unknown"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.kind.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestVMAPageFlags(t *testing.T) {
+	specs := []struct {
+		flags VMAFlag
+		exp   PageTableEntryFlag
+	}{
+		{VMARead, FlagPresent | FlagNoExecute},
+		{VMARead | VMAWrite, FlagPresent | FlagRW | FlagNoExecute},
+		{VMARead | VMAExec, FlagPresent},
+		{VMARead | VMAWrite | VMAUser, FlagPresent | FlagRW | FlagNoExecute | FlagUserAccessible},
+	}
+
+	for specIndex, spec := range specs {
+		vma := VMA{flags: spec.flags}
+		if got := vma.pageFlags(); got != spec.exp {
+			t.Errorf("[spec %d] expected page flags %x; got %x", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestAddressSpaceMap(t *testing.T) {
+	defer func() {
+		activePDTFn = cpu.ActivePDT
+	}()
+
+	as := newTestAddressSpace()
+	file := &testFileBacking{}
+
+	if err := as.MapAnonymous(0x10000, 4*mem.PageSize, VMARead|VMAWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := as.MapPhysical(0x1000, pmm.Frame(0xb8), mem.PageSize, VMARead|VMAWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := as.MapFile(0x4000, 2*mem.PageSize, file, 0x2000, VMARead|VMAExec); err != nil {
+		t.Fatal(err)
+	}
+
+	expVMAs := []VMA{
+		{start: 0x1000, end: 0x2000, flags: VMARead | VMAWrite, kind: VMAPhysical, offset: 0xb8000},
+		{start: 0x4000, end: 0x6000, flags: VMARead | VMAExec, kind: VMAFile, offset: 0x2000, file: file},
+		{start: 0x10000, end: 0x14000, flags: VMARead | VMAWrite, kind: VMAAnonymous},
+	}
+
+	if got := as.VMACount(); got != len(expVMAs) {
+		t.Fatalf("expected address space to contain %d VMAs; got %d", len(expVMAs), got)
+	}
+
+	for index, exp := range expVMAs {
+		if got := as.VMA(index); got != exp {
+			t.Errorf("expected VMA %d to be %+v; got %+v", index, exp, got)
+		}
+	}
+
+	if vma, found := as.FindVMA(0x5fff); !found || vma.Start() != 0x4000 || vma.End() != 0x6000 || vma.Kind() != VMAFile || vma.Flags() != VMARead|VMAExec {
+		t.Errorf("expected to find the file VMA; got %+v, %t", vma, found)
+	}
+
+	if _, found := as.FindVMA(0x6000); found {
+		t.Error("expected no VMA to contain address 0x6000")
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		specs := []struct {
+			start  uintptr
+			size   mem.Size
+			expErr *kernel.Error
+		}{
+			{0x20000, 0, errVMAInvalidRange},
+			{0x20001, mem.PageSize, errVMAInvalidRange},
+			{0x20000, 1, errVMAInvalidRange},
+			{0x5000, 2 * mem.PageSize, errVMAOverlap},
+			{0xf000, 2 * mem.PageSize, errVMAOverlap},
+			{0x11000, mem.PageSize, errVMAOverlap},
+		}
+
+		for specIndex, spec := range specs {
+			if err := as.MapAnonymous(spec.start, spec.size, VMARead); err != spec.expErr {
+				t.Errorf("[spec %d] expected to get error %v; got %v", specIndex, spec.expErr, err)
+			}
+		}
+
+		if err := as.MapFile(0x20000, mem.PageSize, file, 1, VMARead); err != errVMAInvalidRange {
+			t.Errorf("expected to get errVMAInvalidRange; got %v", err)
+		}
+
+		full := newTestAddressSpace()
+		for index := 0; index < maxVMAs; index++ {
+			if err := full.MapAnonymous(uintptr(index+1)<<mem.PageShift, mem.PageSize, VMARead); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := full.MapAnonymous(0x100000, mem.PageSize, VMARead); err != errTooManyVMAs {
+			t.Errorf("expected to get errTooManyVMAs; got %v", err)
+		}
+	})
+}
+
+func TestAddressSpaceUnmap(t *testing.T) {
+	defer func() {
+		activePDTFn = cpu.ActivePDT
+		unmapFn = Unmap
+		unmapAndFreeFn = UnmapAndFree
+	}()
+
+	var (
+		unmappedPages []Page
+		freedPages    []Page
+	)
+
+	unmapFn = func(page Page) *kernel.Error {
+		unmappedPages = append(unmappedPages, page)
+		return nil
+	}
+
+	unmapAndFreeFn = func(page Page) *kernel.Error {
+		freedPages = append(freedPages, page)
+
+		// Simulate a page that was never accessed
+		if page == PageFromAddress(0x12000) {
+			return ErrInvalidMapping
+		}
+		return nil
+	}
+
+	as := newTestAddressSpace()
+	if err := as.MapAnonymous(0x10000, 4*mem.PageSize, VMARead|VMAWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := as.MapPhysical(0x20000, pmm.Frame(0xb8), 2*mem.PageSize, VMARead|VMAWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	// Punch a hole in the anonymous VMA
+	if err := as.Unmap(0x11000, 2*mem.PageSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := []Page{PageFromAddress(0x11000), PageFromAddress(0x12000)}; len(freedPages) != len(exp) || freedPages[0] != exp[0] || freedPages[1] != exp[1] {
+		t.Errorf("expected pages %v to be unmapped and freed; got %v", exp, freedPages)
+	}
+
+	// Remove the second part of the anonymous VMA and half of the
+	// physical VMA; physical frames must not be freed
+	freedPages = nil
+	if err := as.Unmap(0x13000, 0xe000); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := 1; len(freedPages) != exp {
+		t.Errorf("expected %d page(s) to be unmapped and freed; got %d", exp, len(freedPages))
+	}
+
+	if exp := []Page{PageFromAddress(0x20000)}; len(unmappedPages) != len(exp) || unmappedPages[0] != exp[0] {
+		t.Errorf("expected pages %v to be unmapped; got %v", exp, unmappedPages)
+	}
+
+	expVMAs := []VMA{
+		{start: 0x10000, end: 0x11000, flags: VMARead | VMAWrite, kind: VMAAnonymous},
+		{start: 0x21000, end: 0x22000, flags: VMARead | VMAWrite, kind: VMAPhysical, offset: 0xb9000},
+	}
+
+	if got := as.VMACount(); got != len(expVMAs) {
+		t.Fatalf("expected address space to contain %d VMAs; got %d", len(expVMAs), got)
+	}
+
+	for index, exp := range expVMAs {
+		if got := as.VMA(index); got != exp {
+			t.Errorf("expected VMA %d to be %+v; got %+v", index, exp, got)
+		}
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		if err := as.Unmap(0x10001, mem.PageSize); err != errVMAInvalidRange {
+			t.Errorf("expected to get errVMAInvalidRange; got %v", err)
+		}
+
+		expErr := &kernel.Error{Module: "test", Message: "unmap failed"}
+		unmapAndFreeFn = func(_ Page) *kernel.Error { return expErr }
+		if err := as.Unmap(0x10000, mem.PageSize); err != expErr {
+			t.Errorf("expected to get error %v; got %v", expErr, err)
+		}
+
+		// Splitting a VMA requires an extra slot
+		full := newTestAddressSpace()
+		for index := 0; index < maxVMAs; index++ {
+			if err := full.MapAnonymous(uintptr(2*index+1)<<mem.PageShift, 2*mem.PageSize, VMARead); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := full.Unmap(2<<mem.PageShift, mem.PageSize); err != errTooManyVMAs {
+			t.Errorf("expected to get errTooManyVMAs; got %v", err)
+		}
+	})
+}
+
+func TestAddressSpaceProtect(t *testing.T) {
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+		activePDTFn = cpu.ActivePDT
+		flushTLBEntryFn = flushTLBEntry
+	}(ptePtrFn)
+
+	var pageEntry pageTableEntry
+
+	ptePtrFn = func(_ uintptr) unsafe.Pointer { return unsafe.Pointer(&pageEntry) }
+	flushTLBEntryFn = func(_ uintptr) {}
+
+	as := newTestAddressSpace()
+	if err := as.MapAnonymous(0x10000, 4*mem.PageSize, VMARead|VMAWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := as.MapAnonymous(0x14000, mem.PageSize, VMARead|VMAWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	pageEntry.SetFrame(pmm.Frame(42))
+	pageEntry.SetFlags(FlagPresent | FlagRW | FlagNoExecute)
+
+	if err := as.Protect(0x13000, 2*mem.PageSize, VMARead); err != nil {
+		t.Fatal(err)
+	}
+
+	expVMAs := []VMA{
+		{start: 0x10000, end: 0x13000, flags: VMARead | VMAWrite, kind: VMAAnonymous},
+		{start: 0x13000, end: 0x14000, flags: VMARead, kind: VMAAnonymous},
+		{start: 0x14000, end: 0x15000, flags: VMARead, kind: VMAAnonymous},
+	}
+
+	if got := as.VMACount(); got != len(expVMAs) {
+		t.Fatalf("expected address space to contain %d VMAs; got %d", len(expVMAs), got)
+	}
+
+	for index, exp := range expVMAs {
+		if got := as.VMA(index); got != exp {
+			t.Errorf("expected VMA %d to be %+v; got %+v", index, exp, got)
+		}
+	}
+
+	if pageEntry.HasFlags(FlagRW) || !pageEntry.HasFlags(FlagPresent|FlagNoExecute) || pageEntry.Frame() != pmm.Frame(42) {
+		t.Errorf("expected page entry to be updated to a read-only mapping of frame 42; got %x", pageEntry)
+	}
+
+	// Copy-on-write pages should remain read-only
+	pageEntry = 0
+	pageEntry.SetFrame(pmm.Frame(42))
+	pageEntry.SetFlags(FlagPresent | FlagCopyOnWrite)
+	if err := as.Protect(0x13000, mem.PageSize, VMARead|VMAWrite|VMAExec); err != nil {
+		t.Fatal(err)
+	}
+
+	if pageEntry.HasFlags(FlagRW) || !pageEntry.HasFlags(FlagPresent|FlagCopyOnWrite) {
+		t.Errorf("expected page entry to remain a copy-on-write mapping; got %x", pageEntry)
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		if err := as.Protect(0x10000, 0, VMARead); err != errVMAInvalidRange {
+			t.Errorf("expected to get errVMAInvalidRange; got %v", err)
+		}
+
+		if err := as.Protect(0x14000, 2*mem.PageSize, VMARead); err != errVMANotMapped {
+			t.Errorf("expected to get errVMANotMapped; got %v", err)
+		}
+	})
+}
+
+func TestAddressSpaceProtectZeroedPage(t *testing.T) {
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origFrame pmm.Frame) {
+		ptePtrFn = origPtePtr
+		activePDTFn = cpu.ActivePDT
+		flushTLBEntryFn = flushTLBEntry
+		mapFn = Map
+		ReservedZeroedFrame = origFrame
+		protectReservedZeroedPage = false
+	}(ptePtrFn, ReservedZeroedFrame)
+
+	var pageEntry pageTableEntry
+
+	ptePtrFn = func(_ uintptr) unsafe.Pointer { return unsafe.Pointer(&pageEntry) }
+	flushTLBEntryFn = func(_ uintptr) {}
+	mapFn = func(_ Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
+		pageEntry = 0
+		pageEntry.SetFrame(frame)
+		pageEntry.SetFlags(flags)
+		return nil
+	}
+	ReservedZeroedFrame = pmm.Frame(0x1234)
+	protectReservedZeroedPage = true
+
+	as := newTestAddressSpace()
+	if err := as.MapAnonymous(0x10000, mem.PageSize, VMARead); err != nil {
+		t.Fatal(err)
+	}
+
+	specs := []struct {
+		descr    string
+		pteFlags PageTableEntryFlag
+	}{
+		{"populated by a read fault", 0},
+		{"zeroed frame mapped without the CoW flag", FlagPresent | FlagNoExecute},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			if err := as.Protect(0x10000, mem.PageSize, VMARead); err != nil {
+				t.Fatal(err)
+			}
+
+			if spec.pteFlags == 0 {
+				if handled, err := as.handleFault(0x10000, 0); !handled || err != nil {
+					t.Fatalf("expected read fault to be handled; got (%t, %v)", handled, err)
+				}
+			} else {
+				pageEntry = 0
+				pageEntry.SetFrame(ReservedZeroedFrame)
+				pageEntry.SetFlags(spec.pteFlags)
+			}
+
+			if err := as.Protect(0x10000, mem.PageSize, VMARead|VMAWrite); err != nil {
+				t.Fatal(err)
+			}
+
+			if pageEntry.Frame() != ReservedZeroedFrame || pageEntry.HasFlags(FlagRW) || !pageEntry.HasFlags(FlagPresent|FlagCopyOnWrite) {
+				t.Errorf("expected page entry to remain a read-only CoW mapping of the zeroed frame; got %x", pageEntry)
+			}
+		})
+	}
+}
+
+func TestAddressSpaceHandleFault(t *testing.T) {
+	defer func() {
+		activePDTFn = cpu.ActivePDT
+		mapFn = Map
+		unmapFn = Unmap
+		mapTemporaryFn = MapTemporary
+		memsetFn = mem.Memset
+		frameAllocator = nil
+		frameFreer = nil
+	}()
+
+	var (
+		mappedPage   Page
+		mappedFrame  pmm.Frame
+		mappedFlags  PageTableEntryFlag
+		clearedPages int
+		freedFrames  int
+		file         = &testFileBacking{}
+		allocFrame   = pmm.Frame(0x42)
+		expErr       = &kernel.Error{Module: "test", Message: "something went wrong"}
+	)
+
+	mapFn = func(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
+		mappedPage, mappedFrame, mappedFlags = page, frame, flags
+		return nil
+	}
+	unmapFn = func(_ Page) *kernel.Error { return nil }
+	mapTemporaryFn = func(f pmm.Frame) (Page, *kernel.Error) { return Page(f), nil }
+	memsetFn = func(_ uintptr, _ byte, _ mem.Size) { clearedPages++ }
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) { return allocFrame, nil })
+	SetFrameFreer(func(_ pmm.Frame) *kernel.Error {
+		freedFrames++
+		return nil
+	})
+
+	as := newTestAddressSpace()
+	if err := as.MapAnonymous(0x10000, mem.PageSize, VMARead|VMAWrite|VMAUser); err != nil {
+		t.Fatal(err)
+	}
+	if err := as.MapPhysical(0x20000, pmm.Frame(0xb8), 2*mem.PageSize, VMARead|VMAWrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := as.MapFile(0x30000, 2*mem.PageSize, file, 0x4000, VMARead|VMAExec); err != nil {
+		t.Fatal(err)
+	}
+
+	specs := []struct {
+		descr      string
+		addr       uintptr
+		errorCode  uint64
+		expHandled bool
+		expErr     *kernel.Error
+		expFrame   pmm.Frame
+		expFlags   PageTableEntryFlag
+		expCleared int
+	}{
+		{"outside VMAs", 0x50000, 0, false, nil, 0, 0, 0},
+		{"write to read-only VMA", 0x30000, pfErrWrite, true, errVMAAccessViolation, 0, 0, 0},
+		{"fetch from non-exec VMA", 0x10000, pfErrFetch, true, errVMAAccessViolation, 0, 0, 0},
+		{"user access to kernel VMA", 0x20000, pfErrUser, true, errVMAAccessViolation, 0, 0, 0},
+		{"write to present page", 0x10000, pfErrPresent | pfErrWrite, false, nil, 0, 0, 0},
+		{
+			"read from anonymous VMA", 0x10008, 0, true, nil,
+			ReservedZeroedFrame, FlagPresent | FlagCopyOnWrite | FlagNoExecute | FlagUserAccessible, 0,
+		},
+		{
+			"write to anonymous VMA", 0x10008, pfErrWrite | pfErrUser, true, nil,
+			allocFrame, FlagPresent | FlagRW | FlagNoExecute | FlagUserAccessible, 1,
+		},
+		{
+			"access to physical VMA", 0x21008, pfErrWrite, true, nil,
+			pmm.Frame(0xb9), FlagPresent | FlagRW | FlagNoExecute, 0,
+		},
+		{
+			"access to file VMA", 0x31000, pfErrFetch, true, nil,
+			allocFrame, FlagPresent, 0,
+		},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			mappedPage, mappedFrame, mappedFlags, clearedPages = 0, 0, 0, 0
+
+			handled, err := as.handleFault(spec.addr, spec.errorCode)
+			if handled != spec.expHandled || err != spec.expErr {
+				t.Fatalf("expected to get (%t, %v); got (%t, %v)", spec.expHandled, spec.expErr, handled, err)
+			}
+
+			if !handled || err != nil {
+				return
+			}
+
+			if exp := PageFromAddress(spec.addr); mappedPage != exp {
+				t.Errorf("expected page %x to be mapped; got %x", exp, mappedPage)
+			}
+
+			if mappedFrame != spec.expFrame || mappedFlags != spec.expFlags {
+				t.Errorf("expected page to be mapped to frame %x with flags %x; got frame %x with flags %x", spec.expFrame, spec.expFlags, mappedFrame, mappedFlags)
+			}
+
+			if clearedPages != spec.expCleared {
+				t.Errorf("expected %d page(s) to be cleared; got %d", spec.expCleared, clearedPages)
+			}
+		})
+	}
+
+	if exp := uintptr(0x5000); len(file.offsets) != 1 || file.offsets[0] != exp {
+		t.Errorf("expected file contents to be read from offset %x; got %v", exp, file.offsets)
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) { return pmm.InvalidFrame, expErr })
+		if _, err := as.handleFault(0x10000, pfErrWrite); err != expErr {
+			t.Errorf("expected to get error %v; got %v", expErr, err)
+		}
+
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) { return allocFrame, nil })
+		file.err = expErr
+		freedFrames = 0
+		if _, err := as.handleFault(0x30000, 0); err != expErr {
+			t.Errorf("expected to get error %v; got %v", expErr, err)
+		}
+
+		if exp := 1; freedFrames != exp {
+			t.Errorf("expected %d frame(s) to be freed; got %d", exp, freedFrames)
+		}
+
+		file.err = nil
+		mapTemporaryFn = func(f pmm.Frame) (Page, *kernel.Error) { return 0, expErr }
+		if _, err := as.handleFault(0x10000, pfErrWrite); err != expErr {
+			t.Errorf("expected to get error %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestPageFaultHandlerWithAddressSpace(t *testing.T) {
+	defer func() {
+		activePDTFn = cpu.ActivePDT
+		switchPDTFn = cpu.SwitchPDT
+		readCR2Fn = cpu.ReadCR2
+		mapFn = Map
+		activeAddressSpace = nil
+	}()
+
+	var (
+		regs      irq.Regs
+		frame     irq.Frame
+		mapCalled bool
+	)
+
+	switchPDTFn = func(_ uintptr) {}
+	mapFn = func(_ Page, _ pmm.Frame, _ PageTableEntryFlag) *kernel.Error {
+		mapCalled = true
+		return nil
+	}
+
+	as := newTestAddressSpace()
+	if err := as.MapPhysical(0x20000, pmm.Frame(0xb8), mem.PageSize, VMARead); err != nil {
+		t.Fatal(err)
+	}
+	as.Activate()
+
+	if activeAddressSpace != as {
+		t.Fatal("expected Activate to update the active address space")
+	}
+
+	readCR2Fn = func() uint64 { return 0x20008 }
+	pageFaultHandler(0, &frame, &regs)
+
+	if !mapCalled {
+		t.Fatal("expected fault to be resolved by mapping the faulting page")
+	}
+
+	defer func() {
+		if err := recover(); err != errVMAAccessViolation {
+			t.Errorf("expected a panic with errVMAAccessViolation; got %v", err)
+		}
+	}()
+
+	pageFaultHandler(pfErrWrite, &frame, &regs)
+}
@@ -6,6 +6,7 @@ import (
 	"gopheros/kernel/hal/multiboot"
 	"gopheros/kernel/irq"
 	"gopheros/kernel/kfmt"
+	"gopheros/kernel/ksym"
 	"gopheros/kernel/mem"
 	"gopheros/kernel/mem/pmm"
 	"unsafe"
@@ -16,9 +17,20 @@ var (
 	// SetFrameAllocator.
 	frameAllocator FrameAllocatorFn
 
+	// frameFreer points to a function registered using SetFrameFreer
+	// that can release physical frames back to the frame allocator.
+	frameFreer FrameFreeFn
+
+	// The following functions are registered using SetFrameRefCounter and
+	// allow the vmm code to share frames between multiple mappings.
+	frameIncRef   FrameRefFn
+	framePin      FrameRefFn
+	frameRefCount FrameRefCountFn
+
 	// the following functions are mocked by tests and are automatically
 	// inlined by the compiler.
 	handleExceptionWithCodeFn = irq.HandleExceptionWithCode
+	lookupSymbolFn            = ksym.Lookup
 	readCR2Fn                 = cpu.ReadCR2
 	translateFn               = Translate
 	visitElfSectionsFn        = multiboot.VisitElfSections
@@ -29,12 +41,47 @@ var (
 // FrameAllocatorFn is a function that can allocate physical frames.
 type FrameAllocatorFn func() (pmm.Frame, *kernel.Error)
 
+// FrameFreeFn is a function that can release physical frames previously
+// allocated by a FrameAllocatorFn.
+type FrameFreeFn func(pmm.Frame) *kernel.Error
+
+// FrameRefFn is a function that updates the reference count of a physical
+// frame.
+type FrameRefFn func(pmm.Frame) *kernel.Error
+
+// FrameRefCountFn is a function that returns the reference count of a
+// physical frame.
+type FrameRefCountFn func(pmm.Frame) uint16
+
 // SetFrameAllocator registers a frame allocator function that will be used by
 // the vmm code when new physical frames need to be allocated.
 func SetFrameAllocator(allocFn FrameAllocatorFn) {
 	frameAllocator = allocFn
 }
 
+// SetFrameFreer registers a function that will be used by the vmm code for
+// releasing physical frames that are no longer in use (e.g. when unmapping
+// pages via UnmapAndFree). Until a free function is registered, the vmm code
+// will not release any frames.
+func SetFrameFreer(freeFn FrameFreeFn) {
+	frameFreer = freeFn
+}
+
+// SetFrameRefCounter registers the functions that will be used by the vmm
+// code for tracking the number of references to physical frames. The
+// incRefFn function adds a reference to a frame, pinFn marks a frame as
+// permanently in use and refCountFn returns the number of references to a
+// frame. References are dropped via the function registered with
+// SetFrameFreer.
+//
+// Until a reference counter is registered, the vmm code assumes that every
+// frame may be shared by multiple mappings.
+func SetFrameRefCounter(incRefFn, pinFn FrameRefFn, refCountFn FrameRefCountFn) {
+	frameIncRef = incRefFn
+	framePin = pinFn
+	frameRefCount = refCountFn
+}
+
 func pageFaultHandler(errorCode uint64, frame *irq.Frame, regs *irq.Regs) {
 	var (
 		faultAddress = uintptr(readCR2Fn())
@@ -42,8 +89,24 @@ func pageFaultHandler(errorCode uint64, frame *irq.Frame, regs *irq.Regs) {
 		pageEntry    *pageTableEntry
 	)
 
+	// Faults inside the VMAs of the active address space are resolved
+	// using the VMA information.
+	if activeAddressSpace != nil {
+		if handled, err := activeAddressSpace.handleFault(faultAddress, errorCode); handled {
+			if err != nil {
+				nonRecoverablePageFault(faultAddress, errorCode, frame, regs, err)
+			}
+			return
+		}
+	}
+
 	// Lookup entry for the page where the fault occurred
 	walk(faultPage.Address(), func(pteLevel uint8, pte *pageTableEntry) bool {
+		// CoW is not supported for huge pages
+		if pteLevel < pageLevels-1 && pte.HasFlags(FlagPresent|FlagHugePage) {
+			return false
+		}
+
 		nextIsPresent := pte.HasFlags(FlagPresent)
 
 		if pteLevel == pageLevels-1 && nextIsPresent {
@@ -57,18 +120,32 @@ func pageFaultHandler(errorCode uint64, frame *irq.Frame, regs *irq.Regs) {
 	// CoW is supported for RO pages with the CoW flag set
 	if pageEntry != nil && !pageEntry.HasFlags(FlagRW) && pageEntry.HasFlags(FlagCopyOnWrite) {
 		var (
-			copy    pmm.Frame
-			tmpPage Page
-			err     *kernel.Error
+			copy      pmm.Frame
+			tmpPage   Page
+			err       *kernel.Error
+			origFrame = pageEntry.Frame()
 		)
 
+		// If this is the only mapping that references the frame we
+		// can skip the copy and just make the page writable.
+		if frameRefCount != nil && frameRefCount(origFrame) == 1 {
+			pageEntry.ClearFlags(FlagCopyOnWrite)
+			pageEntry.SetFlags(FlagPresent | FlagRW)
+			flushTLBEntryFn(faultPage.Address())
+			return
+		}
+
 		if copy, err = frameAllocator(); err != nil {
 			nonRecoverablePageFault(faultAddress, errorCode, frame, regs, err)
 		} else if tmpPage, err = mapTemporaryFn(copy); err != nil {
 			nonRecoverablePageFault(faultAddress, errorCode, frame, regs, err)
 		} else {
-			// Copy page contents, mark as RW and remove CoW flag
+			// Copy page contents, mark as RW and remove CoW flag. The
+			// page may be user-accessible so SMAP needs to be
+			// temporarily disabled.
+			beginUserAccess()
 			mem.Memcopy(faultPage.Address(), tmpPage.Address(), mem.PageSize)
+			endUserAccess()
 			unmapFn(tmpPage)
 
 			// Update mapping to point to the new frame, flag it as RW and
@@ -78,33 +155,38 @@ func pageFaultHandler(errorCode uint64, frame *irq.Frame, regs *irq.Regs) {
 			pageEntry.SetFrame(copy)
 			flushTLBEntryFn(faultPage.Address())
 
+			// Drop the reference to the shared frame; if this was
+			// the last reference the frame will be released.
+			if frameFreer != nil {
+				if err = frameFreer(origFrame); err != nil {
+					nonRecoverablePageFault(faultAddress, errorCode, frame, regs, err)
+				}
+			}
+
 			// Fault recovered; retry the instruction that caused the fault
 			return
 		}
 	}
 
+	// Accesses to a stack guard page indicate that a kernel stack has
+	// overflowed
+	if stack := stackForGuardAddress(faultAddress); stack != nil {
+		kernelStackOverflow(stack, frame, regs)
+	}
+
 	nonRecoverablePageFault(faultAddress, errorCode, frame, regs, errUnrecoverableFault)
 }
 
 func nonRecoverablePageFault(faultAddress uintptr, errorCode uint64, frame *irq.Frame, regs *irq.Regs, err *kernel.Error) {
 	kfmt.Printf("\nPage fault while accessing address: 0x%16x\nReason: ", faultAddress)
-	switch {
-	case errorCode == 0:
-		kfmt.Printf("read from non-present page")
-	case errorCode == 1:
-		kfmt.Printf("page protection violation (read)")
-	case errorCode == 2:
-		kfmt.Printf("write to non-present page")
-	case errorCode == 3:
-		kfmt.Printf("page protection violation (write)")
-	case errorCode == 4:
-		kfmt.Printf("page-fault in user-mode")
-	case errorCode == 8:
-		kfmt.Printf("page table has reserved bit set")
-	case errorCode == 16:
-		kfmt.Printf("instruction fetch")
-	default:
-		kfmt.Printf("unknown")
+	printPageFaultReason(errorCode)
+
+	kfmt.Printf("\nError code: 0x%x", errorCode)
+	printPageFaultErrorBits(errorCode)
+
+	kfmt.Printf("\nFaulting instruction: 0x%16x", frame.RIP)
+	if name, offset, ok := lookupSymbolFn(uintptr(frame.RIP)); ok {
+		kfmt.Printf(" (%s+0x%x)", name, offset)
 	}
 
 	kfmt.Printf("\n\nRegisters:\n")
@@ -115,11 +197,76 @@ func nonRecoverablePageFault(faultAddress uintptr, errorCode uint64, frame *irq.
 	panic(err)
 }
 
-func generalProtectionFaultHandler(_ uint64, frame *irq.Frame, regs *irq.Regs) {
-	kfmt.Printf("\nGeneral protection fault while accessing address: 0x%x\n", readCR2Fn())
-	kfmt.Printf("Registers:\n")
-	regs.Print()
-	frame.Print()
+// printPageFaultReason outputs a description of the access that triggered a
+// page fault based on the bits of the page fault error code.
+func printPageFaultReason(errorCode uint64) {
+	var mode, access, cause = "kernel-mode", "read", "non-present page"
+
+	if errorCode&pfErrUser != 0 {
+		mode = "user-mode"
+	}
+
+	switch {
+	case errorCode&pfErrFetch != 0:
+		access = "instruction fetch"
+	case errorCode&pfErrWrite != 0:
+		access = "write"
+	}
+
+	if errorCode&pfErrPresent != 0 {
+		cause = "page protection violation"
+	}
+
+	kfmt.Printf("%s (%s %s)", cause, mode, access)
+
+	if errorCode&pfErrReserved != 0 {
+		kfmt.Printf("; page table has reserved bit set")
+	}
+
+	if errorCode&pfErrProtKey != 0 {
+		kfmt.Printf("; protection key violation")
+	}
+
+	if errorCode&pfErrShadowStack != 0 {
+		kfmt.Printf("; shadow stack access")
+	}
+}
+
+// printPageFaultErrorBits outputs the names of the bits that are set in the
+// page fault error code.
+func printPageFaultErrorBits(errorCode uint64) {
+	var (
+		bits = [...]struct {
+			mask uint64
+			name string
+		}{
+			{pfErrPresent, "P"},
+			{pfErrWrite, "W"},
+			{pfErrUser, "U"},
+			{pfErrReserved, "RSVD"},
+			{pfErrFetch, "I"},
+			{pfErrProtKey, "PK"},
+			{pfErrShadowStack, "SS"},
+		}
+		sep = " ["
+	)
+
+	for _, bit := range bits {
+		if errorCode&bit.mask == 0 {
+			continue
+		}
+
+		kfmt.Printf("%s%s", sep, bit.name)
+		sep = " "
+	}
+
+	if sep != " [" {
+		kfmt.Printf("]")
+	}
+}
+
+func generalProtectionFaultHandler(errorCode uint64, frame *irq.Frame, regs *irq.Regs) {
+	irq.PrintException(irq.GPFException, errorCode, frame, regs)
 
 	// TODO: Revisit this when user-mode tasks are implemented
 	panic(errUnrecoverableFault)
@@ -141,25 +288,53 @@ func reserveZeroedFrame() *kernel.Error {
 	mem.Memset(tempPage.Address(), 0, mem.PageSize)
 	unmapFn(tempPage)
 
+	// ReservedZeroedFrame is shared by all lazy allocations and must never
+	// be released.
+	if framePin != nil {
+		if err = framePin(ReservedZeroedFrame); err != nil {
+			return err
+		}
+	}
+
 	// From this point on, ReservedZeroedFrame cannot be mapped with a RW flag
 	protectReservedZeroedPage = true
 	return nil
 }
 
-// Init initializes the vmm system, creates a granular PDT for the kernel and
-// installs paging-related exception handlers.
+// Init initializes the vmm system, creates a granular PDT for the kernel,
+// enables the CPU memory protection features and installs paging-related
+// exception handlers.
 func Init(kernelPageOffset uintptr) *kernel.Error {
+	// Global pages and PCIDs must be enabled before switching to the new
+	// kernel PDT
+	enableTLBFeatures()
+
 	if err := setupPDTForKernel(kernelPageOffset); err != nil {
 		return err
 	}
 
+	// Page tables for the kernel half of the address space must be set up
+	// before any PDT gets cloned so that they are shared by all PDTs
+	if err := preallocKernelTables(); err != nil {
+		return err
+	}
+
+	// From this point on, kernel mappings cannot be both writable and
+	// executable
+	enforceWX = true
+	enableCPUProtections()
+
+	if err := setupDirectMap(); err != nil {
+		return err
+	}
+
 	if err := reserveZeroedFrame(); err != nil {
 		return err
 	}
 
 	handleExceptionWithCodeFn(irq.PageFaultException, pageFaultHandler)
 	handleExceptionWithCodeFn(irq.GPFException, generalProtectionFaultHandler)
-	return nil
+	return setupDoubleFaultHandler()
 }
 
 // setupPDTForKernel queries the multiboot package for the ELF sections that
@@ -182,7 +357,7 @@ func setupPDTForKernel(kernelPageOffset uintptr) *kernel.Error {
 	// Query the ELF sections of the kernel image and establish mappings
 	// for each one using the appropriate flags
 	pageSizeMinus1 := uint64(mem.PageSize - 1)
-	var visitor = func(_ string, secFlags multiboot.ElfSectionFlag, secAddress uintptr, secSize uint64) {
+	var visitor = func(secName string, secFlags multiboot.ElfSectionFlag, secAddress uintptr, secSize uint64) {
 		// Bail out if we have encountered an error; also ignore sections
 		// not using the kernel's VMA
 		if err != nil || secAddress < kernelPageOffset {
@@ -195,8 +370,13 @@ func setupPDTForKernel(kernelPageOffset uintptr) *kernel.Error {
 			flags |= FlagNoExecute
 		}
 
+		// Writable sections that only need to be modified while the
+		// kernel boots are made read-only by Seal
 		if (secFlags & multiboot.ElfSectionWritable) != 0 {
 			flags |= FlagRW
+			if err = trackSealedSection(secName, secAddress, secSize); err != nil {
+				return
+			}
 		}
 
 		// We assume that all sections are page-aligned by the linker script
@@ -223,7 +403,7 @@ func setupPDTForKernel(kernelPageOffset uintptr) *kernel.Error {
 
 	// Ensure that any pages mapped by the memory allocator using
 	// EarlyReserveRegion are copied to the new page directory.
-	for rsvAddr := earlyReserveLastUsed; rsvAddr < tempMappingAddr; rsvAddr += uintptr(mem.PageSize) {
+	for rsvAddr := earlyReserveLastUsed; rsvAddr < kernelLayout.EarlyReserveEnd; rsvAddr += uintptr(mem.PageSize) {
 		page := PageFromAddress(rsvAddr)
 
 		frameAddr, err := translateFn(rsvAddr)
@@ -231,7 +411,7 @@ func setupPDTForKernel(kernelPageOffset uintptr) *kernel.Error {
 			return err
 		}
 
-		if err = pdt.Map(page, pmm.Frame(frameAddr>>mem.PageShift), FlagPresent|FlagRW); err != nil {
+		if err = pdt.Map(page, pmm.Frame(frameAddr>>mem.PageShift), FlagPresent|FlagRW|FlagNoExecute); err != nil {
 			return err
 		}
 	}
@@ -240,6 +420,10 @@ func setupPDTForKernel(kernelPageOffset uintptr) *kernel.Error {
 	// physical memory addresses where the kernel is loaded becomes invalid.
 	pdt.Activate()
 
+	// From now on, virtual address space reservations are handled by the
+	// kernel range allocator.
+	handOverEarlyReservations()
+
 	return nil
 }
 
@@ -8,6 +8,7 @@ import (
 	"gopheros/kernel/hal/multiboot"
 	"gopheros/kernel/irq"
 	"gopheros/kernel/kfmt"
+	"gopheros/kernel/ksym"
 	"gopheros/kernel/mem"
 	"gopheros/kernel/mem/pmm"
 	"strings"
@@ -31,7 +32,7 @@ func TestRecoverablePageFault(t *testing.T) {
 		frameAllocator = nil
 		mapTemporaryFn = MapTemporary
 		unmapFn = Unmap
-		flushTLBEntryFn = cpu.FlushTLBEntry
+		flushTLBEntryFn = flushTLBEntry
 	}(ptePtrFn)
 
 	specs := []struct {
@@ -99,55 +100,177 @@ func TestRecoverablePageFault(t *testing.T) {
 
 }
 
+func TestRecoverablePageFaultRefCounting(t *testing.T) {
+	var (
+		frame      irq.Frame
+		regs       irq.Regs
+		pageEntry  pageTableEntry
+		origPage   = make([]byte, mem.PageSize)
+		clonedPage = make([]byte, mem.PageSize)
+		origFrame  = pmm.Frame(uintptr(unsafe.Pointer(&origPage[0])) >> mem.PageShift)
+	)
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+		readCR2Fn = cpu.ReadCR2
+		frameAllocator = nil
+		frameFreer = nil
+		mapTemporaryFn = MapTemporary
+		unmapFn = Unmap
+		flushTLBEntryFn = flushTLBEntry
+		SetFrameRefCounter(nil, nil, nil)
+	}(ptePtrFn)
+
+	ptePtrFn = func(entry uintptr) unsafe.Pointer { return unsafe.Pointer(&pageEntry) }
+	readCR2Fn = func() uint64 { return uint64(uintptr(unsafe.Pointer(&origPage[0]))) }
+	unmapFn = func(_ Page) *kernel.Error { return nil }
+	mapTemporaryFn = func(f pmm.Frame) (Page, *kernel.Error) { return Page(f), nil }
+	flushTLBEntryFn = func(_ uintptr) {}
+
+	var droppedRefs []pmm.Frame
+	SetFrameFreer(func(f pmm.Frame) *kernel.Error {
+		droppedRefs = append(droppedRefs, f)
+		return nil
+	})
+
+	t.Run("sole owner", func(t *testing.T) {
+		droppedRefs = droppedRefs[:0]
+		SetFrameRefCounter(nil, nil, func(_ pmm.Frame) uint16 { return 1 })
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			t.Fatal("unexpected call to frame allocator")
+			return pmm.InvalidFrame, nil
+		})
+
+		pageEntry = 0
+		pageEntry.SetFlags(FlagPresent | FlagCopyOnWrite)
+		pageEntry.SetFrame(origFrame)
+
+		pageFaultHandler(2, &frame, &regs)
+
+		if !pageEntry.HasFlags(FlagPresent|FlagRW) || pageEntry.HasFlags(FlagCopyOnWrite) {
+			t.Error("expected page entry to be marked as RW and have the CoW flag cleared")
+		}
+
+		if got := pageEntry.Frame(); got != origFrame {
+			t.Errorf("expected page entry to still point to frame %d; got %d", origFrame, got)
+		}
+
+		if len(droppedRefs) != 0 {
+			t.Errorf("expected no references to be dropped; got %v", droppedRefs)
+		}
+	})
+
+	t.Run("shared frame", func(t *testing.T) {
+		droppedRefs = droppedRefs[:0]
+		SetFrameRefCounter(nil, nil, func(_ pmm.Frame) uint16 { return 2 })
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			addr := uintptr(unsafe.Pointer(&clonedPage[0]))
+			return pmm.Frame(addr >> mem.PageShift), nil
+		})
+
+		pageEntry = 0
+		pageEntry.SetFlags(FlagPresent | FlagCopyOnWrite)
+		pageEntry.SetFrame(origFrame)
+
+		pageFaultHandler(2, &frame, &regs)
+
+		if exp, got := pmm.Frame(uintptr(unsafe.Pointer(&clonedPage[0]))>>mem.PageShift), pageEntry.Frame(); got != exp {
+			t.Errorf("expected page entry to point to the copied frame %d; got %d", exp, got)
+		}
+
+		if len(droppedRefs) != 1 || droppedRefs[0] != origFrame {
+			t.Errorf("expected reference to frame %d to be dropped; got %v", origFrame, droppedRefs)
+		}
+	})
+	t.Run("dropping reference fails", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "double free"}
+		SetFrameRefCounter(nil, nil, func(_ pmm.Frame) uint16 { return 2 })
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			addr := uintptr(unsafe.Pointer(&clonedPage[0]))
+			return pmm.Frame(addr >> mem.PageShift), nil
+		})
+		SetFrameFreer(func(_ pmm.Frame) *kernel.Error { return expErr })
+
+		pageEntry = 0
+		pageEntry.SetFlags(FlagPresent | FlagCopyOnWrite)
+		pageEntry.SetFrame(origFrame)
+
+		defer func() {
+			if err := recover(); err != expErr {
+				t.Errorf("expected a panic with error %v; got %v", expErr, err)
+			}
+		}()
+
+		pageFaultHandler(2, &frame, &regs)
+	})
+}
+
 func TestNonRecoverablePageFault(t *testing.T) {
 	defer func() {
 		kfmt.SetOutputSink(nil)
+		lookupSymbolFn = ksym.Lookup
 	}()
 
 	specs := []struct {
 		errCode   uint64
 		expReason string
+		expBits   string
 	}{
 		{
 			0,
-			"read from non-present page",
+			"non-present page (kernel-mode read)",
+			"Error code: 0x0\n",
 		},
 		{
 			1,
-			"page protection violation (read)",
+			"page protection violation (kernel-mode read)",
+			"Error code: 0x1 [P]\n",
 		},
 		{
 			2,
-			"write to non-present page",
+			"non-present page (kernel-mode write)",
+			"Error code: 0x2 [W]\n",
 		},
 		{
 			3,
-			"page protection violation (write)",
+			"page protection violation (kernel-mode write)",
+			"Error code: 0x3 [P W]\n",
 		},
 		{
-			4,
-			"page-fault in user-mode",
+			7,
+			"page protection violation (user-mode write)",
+			"Error code: 0x7 [P W U]\n",
 		},
 		{
-			8,
-			"page table has reserved bit set",
+			9,
+			"page protection violation (kernel-mode read); page table has reserved bit set",
+			"Error code: 0x9 [P RSVD]\n",
 		},
 		{
-			16,
-			"instruction fetch",
+			0x11,
+			"page protection violation (kernel-mode instruction fetch)",
+			"Error code: 0x11 [P I]\n",
 		},
 		{
-			0xf00,
-			"unknown",
+			0x63,
+			"page protection violation (kernel-mode write); protection key violation; shadow stack access",
+			"Error code: 0x63 [P W PK SS]\n",
 		},
 	}
 
 	var (
 		regs  irq.Regs
-		frame irq.Frame
+		frame = irq.Frame{RIP: 0xffff800000101234}
 		buf   bytes.Buffer
 	)
 
+	lookupSymbolFn = func(addr uintptr) (string, uintptr, bool) {
+		if addr != uintptr(frame.RIP) {
+			t.Errorf("expected symbol lookup for address 0x%x; got 0x%x", frame.RIP, addr)
+		}
+		return "main.main", 0x34, true
+	}
+
 	kfmt.SetOutputSink(&buf)
 	for specIndex, spec := range specs {
 		t.Run(fmt.Sprint(specIndex), func(t *testing.T) {
@@ -156,14 +279,31 @@ func TestNonRecoverablePageFault(t *testing.T) {
 				if err := recover(); err != errUnrecoverableFault {
 					t.Errorf("expected a panic with errUnrecoverableFault; got %v", err)
 				}
+
+				got := buf.String()
+				for _, exp := range []string{"Reason: " + spec.expReason + "\n", spec.expBits, "(main.main+0x34)"} {
+					if !strings.Contains(got, exp) {
+						t.Errorf("expected output to contain %q; got:\n%q", exp, got)
+					}
+				}
 			}()
 
 			nonRecoverablePageFault(0xbadf00d000, spec.errCode, &frame, &regs, errUnrecoverableFault)
-			if got := buf.String(); !strings.Contains(got, spec.expReason) {
-				t.Errorf("expected reason %q; got output:\n%q", spec.expReason, got)
-			}
 		})
 	}
+
+	t.Run("unknown symbol", func(t *testing.T) {
+		buf.Reset()
+		lookupSymbolFn = func(_ uintptr) (string, uintptr, bool) { return "", 0, false }
+		defer func() {
+			_ = recover()
+			if exp, got := "Faulting instruction: 0xffff800000101234\n", buf.String(); !strings.Contains(got, exp) {
+				t.Errorf("expected output to contain %q; got:\n%q", exp, got)
+			}
+		}()
+
+		nonRecoverablePageFault(0xbadf00d000, 0, &frame, &regs, errUnrecoverableFault)
+	})
 }
 
 func TestGPFHandler(t *testing.T) {
@@ -190,7 +330,8 @@ func TestGPFHandler(t *testing.T) {
 }
 
 func TestInit(t *testing.T) {
-	defer func() {
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
 		frameAllocator = nil
 		activePDTFn = cpu.ActivePDT
 		switchPDTFn = cpu.SwitchPDT
@@ -198,7 +339,43 @@ func TestInit(t *testing.T) {
 		mapTemporaryFn = MapTemporary
 		unmapFn = Unmap
 		handleExceptionWithCodeFn = irq.HandleExceptionWithCode
-	}()
+		SetFrameRefCounter(nil, nil, nil)
+		kernelRangesReady = false
+		allocKernelStackFn = AllocKernelStack
+		setTSSStackFn = cpu.SetInterruptStack
+		loadTSSFn = cpu.LoadTSS
+		setInterruptStackFn = irq.SetInterruptStack
+		enforceWX = false
+		readCR4Fn = cpu.ReadCR4
+		writeCR4Fn = cpu.WriteCR4
+		hasSMEPFn = cpu.HasSMEP
+		hasSMAPFn = cpu.HasSMAP
+		hasUMIPFn = cpu.HasUMIP
+		hasPGEFn = cpu.HasPGE
+		hasPCIDFn = cpu.HasPCID
+		smapEnabled = false
+		globalPagesEnabled = false
+		pcidEnabled = false
+	}(ptePtrFn)
+
+	// Emulate a PDT whose kernel half entries are already populated
+	var kernelPDTEntry pageTableEntry
+	kernelPDTEntry.SetFlags(FlagPresent | FlagRW)
+	ptePtrFn = func(_ uintptr) unsafe.Pointer { return unsafe.Pointer(&kernelPDTEntry) }
+
+	readCR4Fn = func() uint64 { return 0 }
+	writeCR4Fn = func(_ uint64) {}
+	hasSMEPFn = func() bool { return false }
+	hasSMAPFn = func() bool { return false }
+	hasUMIPFn = func() bool { return false }
+	hasPGEFn = func() bool { return false }
+	hasPCIDFn = func() bool { return false }
+
+	var dfStack KernelStack
+	allocKernelStackFn = func(_ string, _ mem.Size) (*KernelStack, *kernel.Error) { return &dfStack, nil }
+	setTSSStackFn = func(_ uint8, _ uintptr) {}
+	loadTSSFn = func() {}
+	setInterruptStackFn = func(_ irq.ExceptionNum, _ uint8) {}
 
 	// reserve space for an allocated page
 	reservedPage := make([]byte, mem.PageSize)
@@ -227,6 +404,10 @@ func TestInit(t *testing.T) {
 			t.Fatal(err)
 		}
 
+		if !enforceWX {
+			t.Error("expected W^X enforcement to be enabled")
+		}
+
 		// reserved page should be zeroed
 		for i := 0; i < len(reservedPage); i++ {
 			if reservedPage[i] != 0 {
@@ -297,6 +478,37 @@ func TestInit(t *testing.T) {
 			t.Fatalf("expected error: %v; got %v", expErr, err)
 		}
 	})
+
+	t.Run("pin blank page", func(t *testing.T) {
+		defer SetFrameRefCounter(nil, nil, nil)
+
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			addr := uintptr(unsafe.Pointer(&reservedPage[0]))
+			return pmm.Frame(addr >> mem.PageShift), nil
+		})
+		mapTemporaryFn = func(f pmm.Frame) (Page, *kernel.Error) { return Page(f), nil }
+
+		var pinned []pmm.Frame
+		SetFrameRefCounter(nil, func(f pmm.Frame) *kernel.Error {
+			pinned = append(pinned, f)
+			return nil
+		}, nil)
+
+		if err := Init(0); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(pinned) != 1 || pinned[0] != ReservedZeroedFrame {
+			t.Fatalf("expected ReservedZeroedFrame to be pinned; pinned frames: %v", pinned)
+		}
+
+		expErr := &kernel.Error{Module: "test", Message: "pin failed"}
+		SetFrameRefCounter(nil, func(_ pmm.Frame) *kernel.Error { return expErr }, nil)
+
+		if err := Init(0); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
 }
 
 func TestSetupPDTForKernel(t *testing.T) {
@@ -308,7 +520,8 @@ func TestSetupPDTForKernel(t *testing.T) {
 		mapFn = Map
 		mapTemporaryFn = MapTemporary
 		unmapFn = Unmap
-		earlyReserveLastUsed = tempMappingAddr
+		earlyReserveLastUsed = kernelLayout.EarlyReserveEnd
+		sealedSectionCount = 0
 	}()
 
 	// reserve space for an allocated page
@@ -334,6 +547,7 @@ func TestSetupPDTForKernel(t *testing.T) {
 			v(".text", multiboot.ElfSectionExecutable, 0xbadc0ffee, uint64(mem.PageSize>>1))
 			v(".data", multiboot.ElfSectionWritable, 0xbadc0ffee, uint64(mem.PageSize))
 			v(".rodata", 0, 0xbadc0ffee, uint64(mem.PageSize<<1))
+			v(".goredirectstbl", multiboot.ElfSectionWritable, 0xbadc0ffee, uint64(mem.PageSize))
 		}
 		mapCount := 0
 		mapFn = func(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
@@ -344,7 +558,7 @@ func TestSetupPDTForKernel(t *testing.T) {
 			switch mapCount {
 			case 0:
 				expFlags = FlagPresent
-			case 1:
+			case 1, 4:
 				expFlags = FlagPresent | FlagNoExecute | FlagRW
 			case 2, 3:
 				expFlags = FlagPresent | FlagNoExecute
@@ -361,9 +575,14 @@ func TestSetupPDTForKernel(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if exp := 4; mapCount != exp {
+		if exp := 5; mapCount != exp {
 			t.Errorf("expected Map to be called %d times; got %d", exp, mapCount)
 		}
+
+		// Only the writable redirect table section should be sealed
+		if exp := (sealedSection{start: 0xbadc0ffee, end: 0xbadc0ffee + uintptr(mem.PageSize)}); sealedSectionCount != 1 || sealedSections[0] != exp {
+			t.Errorf("expected the redirect table section to be tracked for sealing; got %v", sealedSections[:sealedSectionCount])
+		}
 	})
 
 	t.Run("map of kernel sections fials", func(t *testing.T) {
@@ -393,7 +612,7 @@ func TestSetupPDTForKernel(t *testing.T) {
 	})
 
 	t.Run("copy allocator reservations to PDT", func(t *testing.T) {
-		earlyReserveLastUsed = tempMappingAddr - uintptr(mem.PageSize)
+		earlyReserveLastUsed = kernelLayout.EarlyReserveEnd - uintptr(mem.PageSize)
 		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
 			addr := uintptr(unsafe.Pointer(&reservedPage[0]))
 			return pmm.Frame(addr >> mem.PageShift), nil
@@ -414,8 +633,8 @@ func TestSetupPDTForKernel(t *testing.T) {
 				t.Errorf("expected Map to be called with frame %d; got %d", exp, frame)
 			}
 
-			if flags&(FlagPresent|FlagRW) != (FlagPresent | FlagRW) {
-				t.Error("expected Map to be called FlagPresent | FlagRW")
+			if flags&(FlagPresent|FlagRW|FlagNoExecute) != (FlagPresent | FlagRW | FlagNoExecute) {
+				t.Error("expected Map to be called FlagPresent | FlagRW | FlagNoExecute")
 			}
 			return nil
 		}
@@ -443,7 +662,7 @@ func TestSetupPDTForKernel(t *testing.T) {
 	t.Run("translation fails for page in reserved address space", func(t *testing.T) {
 		expErr := &kernel.Error{Module: "test", Message: "translate failed"}
 
-		earlyReserveLastUsed = tempMappingAddr - uintptr(mem.PageSize)
+		earlyReserveLastUsed = kernelLayout.EarlyReserveEnd - uintptr(mem.PageSize)
 		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
 			addr := uintptr(unsafe.Pointer(&reservedPage[0]))
 			return pmm.Frame(addr >> mem.PageShift), nil
@@ -463,7 +682,7 @@ func TestSetupPDTForKernel(t *testing.T) {
 	t.Run("map fails for page in reserved address space", func(t *testing.T) {
 		expErr := &kernel.Error{Module: "test", Message: "map failed"}
 
-		earlyReserveLastUsed = tempMappingAddr - uintptr(mem.PageSize)
+		earlyReserveLastUsed = kernelLayout.EarlyReserveEnd - uintptr(mem.PageSize)
 		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
 			addr := uintptr(unsafe.Pointer(&reservedPage[0]))
 			return pmm.Frame(addr >> mem.PageShift), nil
@@ -0,0 +1,155 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mem"
+	"unsafe"
+)
+
+const (
+	// maxSealedSections defines the maximum number of kernel image
+	// sections that can be made read-only by Seal.
+	maxSealedSections = 8
+)
+
+// sealedSection describes the virtual address range of a kernel image section
+// that gets made read-only by Seal.
+type sealedSection struct {
+	start, end uintptr
+}
+
+var (
+	// enforceWX is set to true to prevent the creation of kernel mappings
+	// that are both writable and executable.
+	enforceWX bool
+
+	// sealedSectionNames lists the kernel image sections that must not be
+	// modified once the kernel has booted. It includes sections that the
+	// linker may flag as writable even though they contain read-only data
+	// as well as sections that are only written to by the rt0 code (e.g.
+	// the redirect table used for installing the Go runtime hooks).
+	sealedSectionNames = [...]string{
+		".rodata",
+		".typelink",
+		".itablink",
+		".gosymtab",
+		".gopclntab",
+		".goredirectstbl",
+	}
+
+	// sealedSections tracks the address ranges of the writable kernel
+	// image sections whose name is included in sealedSectionNames.
+	sealedSections     [maxSealedSections]sealedSection
+	sealedSectionCount int
+
+	// kernelSealed is set to true once Seal has been invoked.
+	kernelSealed bool
+
+	// protectFn is used by tests and is automatically inlined by the compiler.
+	protectFn = Protect
+
+	errWXViolation   = &kernel.Error{Module: "vmm", Message: "kernel mappings cannot be both writable and executable"}
+	errKernelSealed  = &kernel.Error{Module: "vmm", Message: "kernel image sections have already been sealed"}
+	errTooManySealed = &kernel.Error{Module: "vmm", Message: "maximum number of sealed kernel sections reached"}
+)
+
+// isKernelAddress returns true if virtAddr belongs to the kernel half of the
+// virtual address space.
+func isKernelAddress(virtAddr uintptr) bool {
+	return virtAddr >= canonicalHoleEnd
+}
+
+// checkWX returns errWXViolation if W^X enforcement is enabled and mapping
+// page with the supplied flags would result in a writable and executable
+// kernel mapping.
+func checkWX(page Page, flags PageTableEntryFlag) *kernel.Error {
+	if enforceWX && flags&(FlagRW|FlagNoExecute) == FlagRW && isKernelAddress(page.Address()) {
+		return errWXViolation
+	}
+
+	return nil
+}
+
+// trackSealedSection records the address range of a writable kernel image
+// section if its name is included in sealedSectionNames.
+func trackSealedSection(name string, address uintptr, size uint64) *kernel.Error {
+	for _, sealedName := range sealedSectionNames {
+		if name != sealedName {
+			continue
+		}
+
+		if sealedSectionCount == maxSealedSections {
+			return errTooManySealed
+		}
+
+		sealedSections[sealedSectionCount] = sealedSection{start: address, end: address + uintptr(size)}
+		sealedSectionCount++
+		break
+	}
+
+	return nil
+}
+
+// Seal makes the kernel image sections that are only written to while the
+// kernel boots read-only and then audits the kernel mappings reporting any
+// mappings that are both writable and executable. Seal should be invoked
+// once the kernel has been initialized and can only be called once.
+//
+// As sections are not required to be page-aligned, only the pages that are
+// fully covered by a section are made read-only.
+func Seal() *kernel.Error {
+	if kernelSealed {
+		return errKernelSealed
+	}
+
+	pageSizeMinus1 := uintptr(mem.PageSize - 1)
+	for index := 0; index < sealedSectionCount; index++ {
+		var (
+			start = (sealedSections[index].start + pageSizeMinus1) &^ pageSizeMinus1
+			end   = sealedSections[index].end &^ pageSizeMinus1
+		)
+
+		if end <= start {
+			continue
+		}
+
+		if err := protectFn(PageFromAddress(start), int((end-start)>>mem.PageShift), 0, FlagRW); err != nil {
+			return err
+		}
+	}
+
+	kernelSealed = true
+	auditKernelMappings()
+	return nil
+}
+
+// auditKernelMappings scans the kernel half of the active PDT and reports
+// any mappings that are both writable and executable. It returns the number
+// of violating mapping ranges.
+func auditKernelMappings() int {
+	var (
+		violations int
+		visitor    = func(r *mappingRange) {
+			if r.flags&(FlagRW|FlagNoExecute) != FlagRW {
+				return
+			}
+
+			if violations == 0 {
+				kfmt.Printf("[vmm] W^X audit: found writable and executable kernel mappings:\n")
+			}
+
+			violations++
+			printMappingRange(kfmt.GetOutputSink(), r)
+		}
+	)
+
+	// The page tables accessible via the recursive mapping are excluded
+	// from the audit.
+	visitMappings(
+		canonicalHoleEnd, recursiveMappingAddr,
+		*(*mappingVisitor)(noEscape(unsafe.Pointer(&visitor))),
+	)
+
+	return violations
+}
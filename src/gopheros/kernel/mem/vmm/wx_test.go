@@ -0,0 +1,219 @@
+package vmm
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"runtime"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestWXEnforcement(t *testing.T) {
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origFlushTLBEntryFn func(uintptr)) {
+		ptePtrFn = origPtePtr
+		flushTLBEntryFn = origFlushTLBEntryFn
+		enforceWX = false
+	}(ptePtrFn, flushTLBEntryFn)
+
+	var (
+		kernelPage = PageFromAddress(0xffff800000200000)
+		userPage   = PageFromAddress(0x400000)
+	)
+
+	specs := []struct {
+		enforce bool
+		page    Page
+		flags   PageTableEntryFlag
+		expErr  *kernel.Error
+	}{
+		{false, kernelPage, FlagPresent | FlagRW, nil},
+		{true, kernelPage, FlagPresent | FlagRW, errWXViolation},
+		{true, kernelPage, FlagPresent | FlagRW | FlagNoExecute, nil},
+		{true, kernelPage, FlagPresent, nil},
+		{true, userPage, FlagPresent | FlagRW | FlagUserAccessible, nil},
+	}
+
+	for specIndex, spec := range specs {
+		enforceWX = spec.enforce
+		if err := checkWX(spec.page, spec.flags); err != spec.expErr {
+			t.Errorf("[spec %d] expected to get error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	enforceWX = true
+	if err := Map(kernelPage, pmm.Frame(1), FlagPresent|FlagRW); err != errWXViolation {
+		t.Errorf("expected Map to return errWXViolation; got %v", err)
+	}
+
+	if err := MapHuge(PageFromAddress(0xffff800000200000), pmm.Frame(0x200), HugePageSize2M, FlagPresent|FlagRW); err != errWXViolation {
+		t.Errorf("expected MapHuge to return errWXViolation; got %v", err)
+	}
+
+	if runtime.GOARCH != "amd64" {
+		return
+	}
+
+	mmu := newFakeMMU()
+	ptePtrFn = mmu.ptePtr
+	flushTLBEntryFn = func(_ uintptr) {}
+	mmu.mapPage(kernelPage.Address(), 3, pageTableEntry(0x100000|FlagPresent|FlagRW|FlagNoExecute), FlagPresent|FlagRW)
+
+	if err := Protect(kernelPage, 1, 0, FlagNoExecute); err != errWXViolation {
+		t.Errorf("expected Protect to return errWXViolation; got %v", err)
+	}
+
+	if !mmu.entry(3, kernelPage.Address()).HasFlags(FlagNoExecute) {
+		t.Error("expected page entry to remain unchanged")
+	}
+
+	if err := Protect(kernelPage, 1, 0, FlagRW|FlagNoExecute); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestTrackSealedSection(t *testing.T) {
+	defer func() {
+		sealedSectionCount = 0
+	}()
+
+	if err := trackSealedSection(".data", 0x1000, 0x1000); err != nil || sealedSectionCount != 0 {
+		t.Fatalf("expected .data section to be ignored; got error %v and %d tracked section(s)", err, sealedSectionCount)
+	}
+
+	for index := 0; index < maxSealedSections; index++ {
+		if err := trackSealedSection(".rodata", uintptr(index)<<mem.PageShift, uint64(mem.PageSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := trackSealedSection(".rodata", 0, uint64(mem.PageSize)); err != errTooManySealed {
+		t.Errorf("expected to get errTooManySealed; got %v", err)
+	}
+}
+
+func TestSeal(t *testing.T) {
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+		protectFn = Protect
+		sealedSectionCount = 0
+		kernelSealed = false
+		kfmt.SetOutputSink(nil)
+	}(ptePtrFn)
+
+	type protectCall struct {
+		page       Page
+		count      int
+		setFlags   PageTableEntryFlag
+		clearFlags PageTableEntryFlag
+	}
+
+	var (
+		buf   bytes.Buffer
+		calls []protectCall
+		mmu   = newFakeMMU()
+	)
+
+	// Audit the empty PDT provided by the fake MMU unless a test installs
+	// mappings
+	ptePtrFn = mmu.ptePtr
+	kfmt.SetOutputSink(&buf)
+	buf.Reset()
+	protectFn = func(page Page, count int, setFlags, clearFlags PageTableEntryFlag) *kernel.Error {
+		calls = append(calls, protectCall{page, count, setFlags, clearFlags})
+		return nil
+	}
+
+	trackSealedSection(".goredirectstbl", 0xffff800000400000, uint64(2*mem.PageSize))
+	trackSealedSection(".rodata", 0xffff800000200800, uint64(3*mem.PageSize))
+	trackSealedSection(".gosymtab", 0xffff800000300800, 0x100)
+
+	if err := Seal(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only pages that are fully covered by the sections should be
+	// protected
+	expCalls := []protectCall{
+		{PageFromAddress(0xffff800000400000), 2, 0, FlagRW},
+		{PageFromAddress(0xffff800000201000), 2, 0, FlagRW},
+	}
+
+	if len(calls) != len(expCalls) {
+		t.Fatalf("expected Protect to be called %d times; got %d", len(expCalls), len(calls))
+	}
+
+	for index, exp := range expCalls {
+		if calls[index] != exp {
+			t.Errorf("expected Protect call %d to be %+v; got %+v", index, exp, calls[index])
+		}
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("expected audit to report no violations; got:\n%s", buf.String())
+	}
+
+	if err := Seal(); err != errKernelSealed {
+		t.Errorf("expected to get errKernelSealed; got %v", err)
+	}
+
+	t.Run("protect fails", func(t *testing.T) {
+		kernelSealed = false
+		expErr := &kernel.Error{Module: "test", Message: "protect failed"}
+		protectFn = func(_ Page, _ int, _, _ PageTableEntryFlag) *kernel.Error { return expErr }
+
+		if err := Seal(); err != expErr {
+			t.Errorf("expected to get error %v; got %v", expErr, err)
+		}
+
+		if kernelSealed {
+			t.Error("expected kernel not to be flagged as sealed")
+		}
+	})
+}
+
+func TestAuditKernelMappingsAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+		kfmt.SetOutputSink(nil)
+	}(ptePtrFn)
+
+	var (
+		buf        bytes.Buffer
+		mmu        = newFakeMMU()
+		tableFlags = FlagPresent | FlagRW
+	)
+
+	ptePtrFn = mmu.ptePtr
+	kfmt.SetOutputSink(&buf)
+	buf.Reset()
+
+	mmu.mapPage(0xffff800000100000, 3, pageTableEntry(0x100000|FlagPresent), tableFlags)
+	mmu.mapPage(0xffff800000101000, 3, pageTableEntry(0x101000|FlagPresent|FlagRW|FlagNoExecute), tableFlags)
+	mmu.mapPage(0xffff800000102000, 3, pageTableEntry(0x102000|FlagPresent|FlagRW), tableFlags)
+	mmu.mapPage(0xffff800000103000, 3, pageTableEntry(0x103000|FlagPresent|FlagRW), tableFlags)
+	mmu.mapPage(0xffffc00000000000, 2, pageTableEntry(0x200000|FlagPresent|FlagRW|FlagHugePage), tableFlags)
+
+	// User mappings are not audited
+	mmu.mapPage(0x400000, 3, pageTableEntry(0x300000|FlagPresent|FlagRW|FlagUserAccessible), tableFlags|FlagUserAccessible)
+
+	if exp, got := 2, auditKernelMappings(); got != exp {
+		t.Errorf("expected audit to report %d violation(s); got %d", exp, got)
+	}
+
+	for _, exp := range []string{
+		"0xffff800000102000 - 0xffff800000104000 -> 0x0000000000102000 RW -- -- ---",
+		"0xffffc00000000000 - 0xffffc00000200000 -> 0x0000000000200000 RW -- -- ---",
+	} {
+		if got := buf.String(); !strings.Contains(got, exp) {
+			t.Errorf("expected audit output to contain %q; got:\n%s", exp, got)
+		}
+	}
+}
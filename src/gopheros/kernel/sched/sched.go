@@ -0,0 +1,274 @@
+// Package sched implements a cooperative scheduler for kernel threads. Kernel
+// threads provide the execution contexts for the Ms (OS threads) used by the
+// Go runtime scheduler while the Wait and Wake functions provide the futex
+// semantics that the runtime relies on for parking and waking up Ms.
+package sched
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"unsafe"
+)
+
+const (
+	// maxThreads defines the maximum number of kernel threads that can
+	// exist at any given time, including the boot thread.
+	maxThreads = 32
+
+	// initialStackWords defines the number of words that Spawn pushes
+	// to the stack of a new thread.
+	initialStackWords = 3
+)
+
+// threadState describes the state of a kernel thread.
+type threadState uint8
+
+const (
+	threadFree threadState = iota
+	threadRunnable
+	threadRunning
+	threadBlocked
+)
+
+// context holds the saved execution state of a suspended kernel thread. The
+// field order must be kept in sync with the offsets used by switchContext.
+type context struct {
+	// sp points to the stack of the suspended thread.
+	sp uintptr
+
+	// g contains the TLS g pointer of the suspended thread.
+	g uintptr
+}
+
+// thread describes a kernel thread.
+type thread struct {
+	ctx   context
+	state threadState
+
+	// waitAddr points to the address that a blocked thread waits on.
+	waitAddr *uint32
+
+	// deadline specifies the clock value after which a blocked thread
+	// becomes runnable again even if it has not been woken up. A zero
+	// value indicates that the thread waits indefinitely.
+	deadline int64
+}
+
+var (
+	// threads contains the kernel thread list. The thread at index 0 is
+	// the boot thread.
+	threads [maxThreads]thread
+
+	// curThread is the index of the thread that is currently running.
+	curThread int
+
+	// clockFn returns a monotonic clock value in nanoseconds. It is nil
+	// until a clock source is registered via SetClock.
+	clockFn func() int64
+
+	// switchContextFn is used by tests and is automatically inlined by the compiler.
+	switchContextFn = switchContext
+
+	errNoFreeThreads = &kernel.Error{Module: "sched", Message: "maximum number of kernel threads reached"}
+)
+
+// Init registers the thread that is currently running as the boot thread.
+func Init() {
+	threads[0].state = threadRunning
+	curThread = 0
+}
+
+// SetClock registers a function that returns a monotonic clock value in
+// nanoseconds. The clock is used for enforcing the timeouts passed to Wait
+// and Sleep. Until a clock is registered, timed waits are treated as
+// spurious wake-ups and Sleep just yields the CPU.
+func SetClock(fn func() int64) {
+	clockFn = fn
+}
+
+// Spawn creates a kernel thread that starts executing the code at entryPC
+// using the stack whose top is located at stackTop. The TLS g pointer is set
+// to g before the thread starts. Once the code at entryPC returns, the thread
+// exits. The new thread runs the next time the running thread yields the CPU.
+func Spawn(entryPC uintptr, stackTop unsafe.Pointer, g uintptr) *kernel.Error {
+	for index := 1; index < maxThreads; index++ {
+		t := &threads[index]
+		if t.state != threadFree {
+			continue
+		}
+
+		// Set up the stack so that switchContext pops a zero frame
+		// pointer and returns to entryPC which in turn returns to
+		// threadExit.
+		stack := (*[initialStackWords]uintptr)(unsafe.Pointer(uintptr(stackTop) - initialStackWords*unsafe.Sizeof(entryPC)))
+		stack[0] = 0
+		stack[1] = entryPC
+		stack[2] = threadExitPC()
+
+		t.ctx = context{sp: uintptr(unsafe.Pointer(&stack[0])), g: g}
+		t.waitAddr = nil
+		t.deadline = 0
+		t.state = threadRunnable
+		return nil
+	}
+
+	return errNoFreeThreads
+}
+
+// Yield switches to the next runnable kernel thread, if any.
+//
+//go:nosplit
+func Yield() {
+	threads[curThread].state = threadRunnable
+	if !reschedule() {
+		threads[curThread].state = threadRunning
+	}
+}
+
+// Wait blocks the running thread until another thread invokes Wake with the
+// same address or until timeout nanoseconds elapse. A negative timeout value
+// disables the timeout. Wait returns immediately if the value stored at addr
+// does not match val.
+//
+// Like the futex system call, Wait is allowed to return spuriously; this
+// happens when no other thread can run while the running thread is blocked.
+// Callers must always recheck the condition they are waiting for.
+//
+//go:nosplit
+func Wait(addr *uint32, val uint32, timeout int64) {
+	if *addr != val {
+		return
+	}
+
+	t := &threads[curThread]
+	t.waitAddr = addr
+	t.deadline = deadlineAfter(timeout)
+	t.state = threadBlocked
+
+	if !reschedule() {
+		t.waitAddr = nil
+		t.state = threadRunning
+	}
+}
+
+// Wake unblocks up to count threads that wait on addr and returns the number
+// of threads that were woken up.
+//
+//go:nosplit
+func Wake(addr *uint32, count uint32) uint32 {
+	var woken uint32
+	for index := 0; index < maxThreads && woken < count; index++ {
+		t := &threads[index]
+		if t.state != threadBlocked || t.waitAddr != addr {
+			continue
+		}
+
+		t.waitAddr = nil
+		t.state = threadRunnable
+		woken++
+	}
+
+	return woken
+}
+
+// Sleep suspends the running thread for at least ns nanoseconds. Other
+// runnable threads get to run while the thread sleeps.
+//
+//go:nosplit
+func Sleep(ns int64) {
+	if clockFn == nil {
+		Yield()
+		return
+	}
+
+	for deadline := clockFn() + ns; clockFn() < deadline; {
+		t := &threads[curThread]
+		t.waitAddr = nil
+		t.deadline = deadline
+		t.state = threadBlocked
+
+		if !reschedule() {
+			t.state = threadRunning
+		}
+	}
+}
+
+// deadlineAfter returns the clock value after timeout nanoseconds or 0 if the
+// timeout is negative or no clock has been registered.
+//
+//go:nosplit
+func deadlineAfter(timeout int64) int64 {
+	if timeout < 0 || clockFn == nil {
+		return 0
+	}
+
+	return clockFn() + timeout
+}
+
+// reschedule switches to the next runnable kernel thread. The caller must
+// update the state of the running thread before invoking reschedule. It
+// returns false if no other thread can run; otherwise it returns true once
+// the running thread is scheduled again.
+//
+//go:nosplit
+func reschedule() bool {
+	next := pickNext()
+	if next < 0 {
+		return false
+	}
+
+	prev := curThread
+	curThread = next
+	threads[next].state = threadRunning
+	switchContextFn(&threads[prev].ctx, &threads[next].ctx)
+	return true
+}
+
+// pickNext returns the index of the next thread to run using a round-robin
+// policy or -1 if no other thread can run. Blocked threads whose deadline has
+// expired are treated as runnable.
+//
+//go:nosplit
+func pickNext() int {
+	var now int64
+	if clockFn != nil {
+		now = clockFn()
+	}
+
+	for offset := 1; offset < maxThreads; offset++ {
+		index := (curThread + offset) % maxThreads
+		t := &threads[index]
+
+		switch {
+		case t.state == threadRunnable:
+			return index
+		case t.state == threadBlocked && t.deadline != 0 && now >= t.deadline:
+			t.waitAddr = nil
+			return index
+		}
+	}
+
+	return -1
+}
+
+// threadExit is invoked when the entry function of a thread returns. It
+// releases the thread slot and switches to the next runnable thread. If no
+// other thread can run, the CPU is halted.
+//
+//go:nosplit
+func threadExit() {
+	threads[curThread].state = threadFree
+	if !reschedule() {
+		cpu.Halt()
+	}
+}
+
+// threadExitPC returns the address of threadExit.
+func threadExitPC() uintptr {
+	fn := threadExit
+	return **(**uintptr)(unsafe.Pointer(&fn))
+}
+
+// switchContext saves the execution state of the running thread to from and
+// resumes the thread whose state is stored in to.
+func switchContext(from, to *context)
@@ -0,0 +1,18 @@
+#include "textflag.h"
+
+TEXT ·switchContext(SB),NOSPLIT,$0-16
+	MOVQ from+0(FP), AX
+	MOVQ to+8(FP), BX
+
+	// save the TLS g pointer and frame pointer of the running thread
+	MOVQ (TLS), CX
+	MOVQ CX, 8(AX)
+	PUSHQ BP
+	MOVQ SP, 0(AX)
+
+	// switch to the stack of the resumed thread and restore its state
+	MOVQ 0(BX), SP
+	POPQ BP
+	MOVQ 8(BX), CX
+	MOVQ CX, (TLS)
+	RET
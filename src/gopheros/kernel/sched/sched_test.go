@@ -0,0 +1,235 @@
+package sched
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// resetThreads restores the scheduler state and registers a mock context
+// switch function that records the index of each thread that gets resumed.
+func resetThreads(switches *[]int) {
+	threads = [maxThreads]thread{}
+	clockFn = nil
+	Init()
+
+	switchContextFn = func(_, to *context) {
+		for index := range threads {
+			if &threads[index].ctx == to {
+				*switches = append(*switches, index)
+				return
+			}
+		}
+	}
+}
+
+func TestSpawn(t *testing.T) {
+	defer func() {
+		switchContextFn = switchContext
+	}()
+
+	var (
+		switches []int
+		stack    [16]uintptr
+		stackTop = unsafe.Pointer(uintptr(unsafe.Pointer(&stack[0])) + unsafe.Sizeof(stack))
+	)
+	resetThreads(&switches)
+
+	if err := Spawn(0xc0ffee, stackTop, 0xbadf00d); err != nil {
+		t.Fatal(err)
+	}
+
+	thr := threads[1]
+	if thr.state != threadRunnable {
+		t.Fatalf("expected spawned thread to be runnable; got state %d", thr.state)
+	}
+
+	if exp := uintptr(unsafe.Pointer(&stack[13])); thr.ctx.sp != exp {
+		t.Errorf("expected thread sp to be %x; got %x", exp, thr.ctx.sp)
+	}
+
+	if exp := uintptr(0xbadf00d); thr.ctx.g != exp {
+		t.Errorf("expected thread g to be %x; got %x", exp, thr.ctx.g)
+	}
+
+	if stack[13] != 0 || stack[14] != 0xc0ffee || stack[15] != threadExitPC() {
+		t.Errorf("unexpected initial stack contents: %x", stack[13:])
+	}
+
+	t.Run("no free threads", func(t *testing.T) {
+		for index := 2; index < maxThreads; index++ {
+			if err := Spawn(0xc0ffee, stackTop, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := Spawn(0xc0ffee, stackTop, 0); err != errNoFreeThreads {
+			t.Fatalf("expected to get errNoFreeThreads; got %v", err)
+		}
+	})
+}
+
+func TestYield(t *testing.T) {
+	defer func() {
+		switchContextFn = switchContext
+	}()
+
+	var switches []int
+	resetThreads(&switches)
+
+	// Nothing else to run
+	Yield()
+	if len(switches) != 0 || threads[0].state != threadRunning {
+		t.Fatalf("expected Yield to return without switching; got switches %v", switches)
+	}
+
+	threads[2].state = threadRunnable
+	threads[5].state = threadRunnable
+
+	Yield()
+	Yield()
+	Yield()
+
+	if exp := []int{2, 5, 0}; !equalInts(switches, exp) {
+		t.Fatalf("expected round-robin switches %v; got %v", exp, switches)
+	}
+
+	if curThread != 0 || threads[0].state != threadRunning || threads[5].state != threadRunnable {
+		t.Fatal("expected thread 0 to be running and thread 5 to be runnable")
+	}
+}
+
+func TestWaitWake(t *testing.T) {
+	defer func() {
+		switchContextFn = switchContext
+	}()
+
+	var (
+		switches []int
+		addr     uint32
+	)
+	resetThreads(&switches)
+
+	t.Run("value mismatch", func(t *testing.T) {
+		Wait(&addr, 1, -1)
+		if threads[0].state != threadRunning || len(switches) != 0 {
+			t.Fatal("expected Wait to return immediately")
+		}
+	})
+
+	t.Run("spurious wakeup", func(t *testing.T) {
+		Wait(&addr, 0, -1)
+		if threads[0].state != threadRunning || threads[0].waitAddr != nil || len(switches) != 0 {
+			t.Fatal("expected Wait to return when no other thread can run")
+		}
+	})
+
+	t.Run("block and wake", func(t *testing.T) {
+		threads[3].state = threadRunnable
+
+		Wait(&addr, 0, -1)
+		if exp := []int{3}; !equalInts(switches, exp) {
+			t.Fatalf("expected switches %v; got %v", exp, switches)
+		}
+
+		if threads[0].state != threadBlocked || threads[0].waitAddr != &addr {
+			t.Fatal("expected thread 0 to be blocked on addr")
+		}
+
+		var other uint32
+		if got := Wake(&other, 1); got != 0 {
+			t.Fatalf("expected Wake on a different address to wake 0 threads; got %d", got)
+		}
+
+		if got := Wake(&addr, 10); got != 1 {
+			t.Fatalf("expected Wake to wake 1 thread; got %d", got)
+		}
+
+		if threads[0].state != threadRunnable || threads[0].waitAddr != nil {
+			t.Fatal("expected thread 0 to be runnable")
+		}
+	})
+}
+
+func TestTimeouts(t *testing.T) {
+	defer func() {
+		switchContextFn = switchContext
+		clockFn = nil
+	}()
+
+	var (
+		switches []int
+		addr     uint32
+		now      int64
+	)
+	resetThreads(&switches)
+
+	SetClock(func() int64 { return now })
+	threads[1].state = threadRunnable
+
+	Wait(&addr, 0, 100)
+	if threads[0].deadline != 100 {
+		t.Fatalf("expected thread deadline to be 100; got %d", threads[0].deadline)
+	}
+
+	// Thread 1 now yields; thread 0 is still blocked
+	Yield()
+	if exp := []int{1}; !equalInts(switches, exp) {
+		t.Fatalf("expected switches %v; got %v", exp, switches)
+	}
+
+	// Once the deadline expires, thread 0 can run again
+	now = 100
+	Yield()
+	if exp := []int{1, 0}; !equalInts(switches, exp) {
+		t.Fatalf("expected switches %v; got %v", exp, switches)
+	}
+
+	if threads[0].state != threadRunning || threads[0].waitAddr != nil {
+		t.Fatal("expected thread 0 to be running after its deadline expired")
+	}
+
+	t.Run("sleep", func(t *testing.T) {
+		switches = switches[:0]
+		threads[1].state = threadRunnable
+
+		// Advance the clock each time another thread gets scheduled
+		switchContextFn = func(_, to *context) {
+			now += 50
+			if to == &threads[1].ctx {
+				curThread = 0
+				threads[0].state = threadRunning
+				threads[1].state = threadRunnable
+			}
+			switches = append(switches, len(switches))
+		}
+
+		start := now
+		Sleep(120)
+		if now-start < 120 {
+			t.Fatalf("expected Sleep to wait for at least 120ns; waited %d", now-start)
+		}
+	})
+
+	t.Run("sleep without clock", func(t *testing.T) {
+		switches = switches[:0]
+		clockFn = nil
+		Sleep(120)
+		if len(switches) != 1 {
+			t.Fatalf("expected Sleep to yield once; got %d switches", len(switches))
+		}
+	})
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for index := range a {
+		if a[index] != b[index] {
+			return false
+		}
+	}
+
+	return true
+}